@@ -0,0 +1,43 @@
+package main
+
+import "github.com/lightningnetwork/lnd/lnrpc"
+
+// Msat is an amount in millisatoshi. The amounts in sats are converted to it
+// before any fee math so that small amounts aren't distorted by rounding,
+// they're converted back to sats only for display and channel balances.
+type Msat int64
+
+func satToMsat(sat int64) Msat {
+	return Msat(sat * 1000)
+}
+
+// sats rounds the amount down to whole sats.
+func (m Msat) sats() int64 {
+	return int64(m) / 1000
+}
+
+// satsCeil rounds the amount up to whole sats.
+func (m Msat) satsCeil() int64 {
+	return (int64(m) + 999) / 1000
+}
+
+// feePPM returns the fee rate in ppm of the amount rounded to the nearest
+// integer.
+func feePPM(amt Msat, fee Msat) int64 {
+	if amt <= 0 {
+		return 0
+	}
+	return (int64(fee)*1e6 + int64(amt)/2) / int64(amt)
+}
+
+// ppmFee returns the fee at the ppm rate rounded down so that it never
+// exceeds the limit.
+func ppmFee(amt Msat, ppm int64) Msat {
+	return Msat(int64(amt) * ppm / 1e6)
+}
+
+// policyFee returns the fee charged by the channel policy to forward the
+// amount.
+func policyFee(policy *lnrpc.RoutingPolicy, amt Msat) Msat {
+	return Msat(policy.FeeBaseMsat) + ppmFee(amt, policy.FeeRateMilliMsat)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestSatConversions(t *testing.T) {
+	for sat := int64(1); sat <= 1000; sat++ {
+		m := satToMsat(sat)
+		if m.sats() != sat || m.satsCeil() != sat {
+			t.Fatalf("%d sat: got %d and %d back", sat, m.sats(), m.satsCeil())
+		}
+		if (m+1).sats() != sat || (m+1).satsCeil() != sat+1 || (m-1).sats() != sat-1 {
+			t.Fatalf("%d sat: wrong rounding of %d msat", sat, m+1)
+		}
+	}
+}
+
+// TestSmallAmountFees checks the fee math at the amounts where the fees are
+// below one sat so rounding to sats would distort the rates.
+func TestSmallAmountFees(t *testing.T) {
+	policy := &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 100}
+	for sat := int64(1); sat <= 1000; sat++ {
+		amt := satToMsat(sat)
+		if fee, expected := ppmFee(amt, 100), Msat(sat/10); fee != expected {
+			t.Fatalf("%d sat at 100 ppm: got %d msat, expected %d", sat, fee, expected)
+		}
+		if fee, expected := policyFee(policy, amt), Msat(1000+sat/10); fee != expected {
+			t.Fatalf("%d sat policy fee: got %d msat, expected %d", sat, fee, expected)
+		}
+		// 1 msat is 1000 ppm of 1 sat, the rate is rounded to the nearest ppm
+		if ppm, expected := feePPM(amt, 1), (1000+sat/2)/sat; ppm != expected {
+			t.Fatalf("1 msat fee of %d sat: got %d ppm, expected %d", sat, ppm, expected)
+		}
+	}
+	for _, tc := range []struct {
+		amt Msat
+		fee Msat
+		ppm int64
+	}{
+		{satToMsat(1), 1, 1000},
+		{satToMsat(3), 1, 333},
+		{satToMsat(3), 2, 667},
+		{satToMsat(1000), 999, 999},
+		{satToMsat(1000), 1, 1},
+		{satToMsat(1000), 0, 0},
+		{0, 1, 0},
+	} {
+		if ppm := feePPM(tc.amt, tc.fee); ppm != tc.ppm {
+			t.Errorf("%d msat fee of %d msat: got %d ppm, expected %d", tc.fee, tc.amt, ppm, tc.ppm)
+		}
+	}
+}
+
+// TestSmallAmountEconFee checks that the econ ratio fee of the small amounts
+// includes the full base fee and the sub-sat proportional fee.
+func TestSmallAmountEconFee(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	r, _ := newRouteTest(nil)
+	params.FeeLimitPPM, params.FeeLimitIsCap, params.LostProfit, params.EconRatioMaxPPM = 0, false, false, 0
+	r.lnClient.(*fakeLightning).edges[2].Node2Policy = &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 500}
+	for _, tc := range []struct {
+		sat   int64
+		ratio float64
+		fee   Msat
+	}{
+		{1, 1, 1000},
+		{3, 1, 1001},
+		{999, 1, 1499},
+		{1000, 1, 1500},
+		{1, 0.5, 500},
+		{1000, 0.5, 750},
+	} {
+		params.EconRatio = tc.ratio
+		fee, _, _, err := r.calcFeeMsat(context.Background(), 1, 2, satToMsat(tc.sat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fee != tc.fee {
+			t.Errorf("%d sat at econ ratio %g: got %d msat, expected %d", tc.sat, tc.ratio, fee, tc.fee)
+		}
+	}
+}
+
+// TestMppShardsWholeSats checks that the parts add up to the amount and are
+// whole sats.
+func TestMppShardsWholeSats(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MppParts, params.ShardSize = 3, 0
+	for sat := int64(1); sat <= 1000; sat++ {
+		shards := mppShards(satToMsat(sat))
+		if sat < 3 {
+			if shards != nil {
+				t.Fatalf("%d sat shouldn't be split", sat)
+			}
+			continue
+		}
+		total := Msat(0)
+		for _, s := range shards {
+			if s%1000 != 0 || s == 0 {
+				t.Fatalf("%d sat: part %d msat isn't whole sats", sat, s)
+			}
+			total += s
+		}
+		if total != satToMsat(sat) {
+			t.Fatalf("%d sat: parts add up to %d msat", sat, total)
+		}
+	}
+}
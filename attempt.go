@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// rebalanceAttempt is the state of a single attempt passed between the stages
+// of tryRebalance: selectPair → buildRoutes → filterRoute → execute →
+// classifyResult.
+type rebalanceAttempt struct {
+	from        uint64
+	to          uint64
+	amount      Msat
+	routeAmount Msat
+	fee         Msat
+	routes      []*lnrpc.Route
+	exploring   bool
+}
+
+// now returns the current time from the injected clock if it's set.
+func (r *regolancer) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+func tryRebalance(ctx context.Context, r *regolancer) (err error,
+	repeat bool) {
+	attemptCtx, attemptCancel := context.WithTimeout(ctx, time.Minute*time.Duration(params.TimeoutAttempt))
+
+	defer attemptCancel()
+
+	a := &rebalanceAttempt{}
+	r.setPhase(phaseSelecting, nil)
+	err = r.selectPair(attemptCtx, a)
+	if err != nil {
+		return err, false
+	}
+	r.reserveChannels(a.from, a.to)
+	// filterRoute can move the reservation to another source
+	defer func() { r.releaseChannels(a.from, a.to) }()
+	if shards := mppShards(a.amount); shards != nil {
+		r.attemptInfo = &attemptInfo{start: r.now()}
+		r.setPhase(phasePaying, a)
+		err = r.executeMPP(attemptCtx, a, shards)
+		switch {
+		case err == nil:
+			return nil, false
+		case err == ErrDryRun:
+			r.addFailedRoute(a.from, a.to, failDryRun, 0)
+		case r.feeBudgetErr != nil:
+			return r.feeBudgetErr, false
+		default:
+			log.Printf("Rebalance failed with %s", errColor(err))
+		}
+		return nil, true
+	}
+	err, repeat = r.buildRoutes(attemptCtx, a)
+	if err != nil {
+		return err, repeat
+	}
+	r.attemptInfo = &attemptInfo{start: r.now()}
+	for _, route := range a.routes {
+		route, ok, stop := r.filterRoute(attemptCtx, a, route)
+		if stop {
+			break
+		}
+		if !ok {
+			continue
+		}
+		err = r.execute(attemptCtx, a, route)
+		if err == ErrDryRun {
+			// move on to the next pair to see what else would be tried
+			r.addFailedRoute(a.from, a.to, failDryRun, 0)
+			return nil, true
+		}
+		done := r.classifyResult(ctx, attemptCtx, a, route, err)
+		if r.feeBudgetErr != nil {
+			return r.feeBudgetErr, false
+		}
+		if done {
+			return nil, false
+		}
+	}
+	attemptCancel()
+	if attemptCtx.Err() == context.DeadlineExceeded {
+		log.Print(errColor("Attempt timed out"))
+	}
+
+	return nil, true
+}
+
+func (r *regolancer) selectPair(ctx context.Context, a *rebalanceAttempt) (err error) {
+	a.from, a.to, a.amount, err = r.pickChannelPair(satToMsat(r.amount), satToMsat(params.MinAmount), params.RelAmountFrom,
+		params.RelAmountTo)
+	if err == ErrPairsBusy {
+		return err
+	}
+	if err != nil {
+		log.Printf(errColor("Error during picking channel: %s"), err)
+		return err
+	}
+	a.exploring = r.exploring()
+	if a.exploring && a.amount > satToMsat(params.MinAmount) {
+		a.amount = satToMsat(params.MinAmount)
+	}
+	a.routeAmount = a.amount
+	return nil
+}
+
+// buildRoutes queries the routes for the selected pair, the pair is put in the
+// failure cache if there are none. The repeat result is false if the session
+// should stop.
+func (r *regolancer) buildRoutes(ctx context.Context, a *rebalanceAttempt) (err error, repeat bool) {
+	r.setPhase(phaseRouting, a)
+	routeCtx, routeCtxCancel := context.WithTimeout(ctx, r.routeTimeout())
+	defer routeCtxCancel()
+	if params.MinRouteChoices <= 1 && !a.exploring {
+		if route, fee, ok := r.memoizedRoute(routeCtx, a); ok {
+			a.routes, a.fee = []*lnrpc.Route{route}, fee
+			return nil, true
+		}
+	}
+	r.startSpeculativeHalf(routeCtx, a)
+	defer r.stopSpeculative()
+	a.routes, a.fee, err = r.getRouteChoices(routeCtx, a.from, a.to, a.amount)
+	if err != nil && r.speculative != nil && routeCtx.Err() == nil {
+		a.routes, a.fee, err = r.speculativeRoutes(routeCtx, a, err)
+	}
+	if err != nil {
+		if routeCtx.Err() == context.DeadlineExceeded {
+			log.Printf("%s %s", errColor("Timed out looking for a route"), r.pairLabel(ctx, a.from, a.to))
+			r.saveNoRoute(ctx, a, "timeout")
+			return err, false
+		}
+		if _, ok := err.(ErrNotEnoughRoutes); ok {
+			log.Printf("%s %s", r.pairLabel(ctx, a.from, a.to), infoColor(err))
+			r.addFailedRouteTTL(a.from, a.to, routeChoicesFailureTTL, failNotEnoughRoutes, 0)
+			r.saveNoRoute(ctx, a, failNotEnoughRoutes)
+			return err, true
+		}
+		if _, ok := err.(ErrRouteTooLong); ok {
+			// the pair isn't cached, a shorter route may appear later
+			log.Printf("%s %s", r.pairLabel(ctx, a.from, a.to), infoColor(err))
+			r.longRouteSkips++
+			r.saveNoRoute(ctx, a, "route_too_long")
+			return err, true
+		}
+		r.addFailedRoute(a.from, a.to, failNoRoute, 0)
+		r.saveNoRoute(ctx, a, failNoRoute)
+		return err, true
+	}
+	if a.exploring {
+		r.exploreRoutes(routeCtx, a)
+	}
+	r.recordPairRoute(a.from, a.to, a.routes[0])
+	return nil, true
+}
+
+// filterRoute prepares the route to be paid, ok is false if the route should
+// be skipped and stop is true if no more routes should be tried in this
+// attempt.
+func (r *regolancer) filterRoute(ctx context.Context, a *rebalanceAttempt, route *lnrpc.Route) (result *lnrpc.Route,
+	ok bool, stop bool) {
+	// the route might start with another source if --accept-any-source is set,
+	// it's reserved instead of the picked one unless another worker uses it
+	if from := route.Hops[0].ChanId; from != a.from {
+		if r.channelBusy(from) {
+			log.Printf("The route starts with channel %d used by another worker, skipping it", from)
+			return nil, false, false
+		}
+		r.releaseChannels(a.from)
+		r.reserveChannels(from)
+		a.from = from
+	}
+	// all routes are built for the same amount but it could've changed while trying the previous route
+	a.amount = a.routeAmount
+	if r.failedHTLCs.wait(r.now()) > 0 {
+		// let the main loop wait for the failed HTLCs window
+		return nil, false, true
+	}
+	if a.exploring {
+		if err := r.fitExploreBudget(route); err != nil {
+			log.Print(errColor(err))
+			return nil, false, false
+		}
+	}
+	result, amount, err := r.fitSourceFloor(ctx, route, a.amount)
+	if err != nil {
+		log.Print(errColor(err))
+		return nil, false, false
+	}
+	a.amount = amount
+	return result, true, false
+}
+
+func (r *regolancer) execute(ctx context.Context, a *rebalanceAttempt, route *lnrpc.Route) error {
+	r.attemptInfo.number = r.nextAttempt()
+	r.attemptInfo.routesTried++
+	r.attemptInfo.feeLimit = a.fee
+	r.setPhase(phasePaying, a)
+	attempt := "Attempt"
+	if params.DryRun {
+		attempt = infoColor("Simulated attempt")
+	}
+	log.Printf("%s %s %s, amount: %s (max fee: %s sat | %s ppm%s%s%s)", attempt,
+		hiWhiteColorF("#%d", r.currentAttempt()), r.pairLabel(ctx, a.from, a.to), hiWhiteColor(a.amount.sats()),
+		formatFee(a.fee), formatFeePPM(a.amount, a.fee), r.feeScale, r.feeBound, r.feeMultiplier)
+	emitEvent(logEvent{Event: "attempt_started", Attempt: r.currentAttempt(), FromChan: a.from, ToChan: a.to,
+		Amount: a.amount.sats(), MaxFeeMsat: int64(a.fee), FeePPM: feePPM(a.amount, a.fee)})
+	r.addRouteCacheTally(r.printRoute(ctx, route))
+	if params.DryRun {
+		log.Print(infoColor("Dry run, not paying"))
+		return ErrDryRun
+	}
+	return r.payWithTimeout(ctx, a.amount, satToMsat(params.MinAmount), route, params.ProbeSteps)
+}
+
+// classifyResult handles the payment result: rapid rebalancing follows a
+// success and a probed amount is retried on ErrRetry. It returns true if the
+// attempt succeeded so no more routes should be tried. The probed payment and
+// rapid rebalancing aren't limited by the attempt timeout.
+func (r *regolancer) classifyResult(ctx context.Context, attemptCtx context.Context, a *rebalanceAttempt,
+	route *lnrpc.Route, err error) bool {
+	if err == nil {
+		if params.AllowRapidRebalance {
+			r.rapidRebalance(ctx, a, route)
+		}
+		return true
+	}
+	retryErr, ok := err.(ErrRetry)
+	if !ok {
+		return false
+	}
+	a.amount = retryErr.amount
+	r.attemptInfo.number = r.nextAttempt()
+	r.setPhase(phaseProbing, a)
+	log.Printf("Attempt %s, trying to rebalance again with %s", hiWhiteColorF("#%d", r.currentAttempt()),
+		hiWhiteColor(a.amount.sats()))
+	probedRoute, err := r.rebuildRoute(attemptCtx, route, a.amount)
+	if err != nil {
+		log.Printf("Error rebuilding the route for probed payment: %s", errColor(err))
+		return false
+	}
+	err = r.payWithTimeout(ctx, a.amount, 0, probedRoute, 0)
+	if err != nil {
+		r.invalidateInvoice(a.amount)
+		log.Printf("Probed rebalance failed with error: %s", errColor(err))
+		return false
+	}
+	if params.AllowRapidRebalance && params.MinAmount > 0 {
+		r.rapidRebalance(ctx, a, probedRoute)
+	}
+	return true
+}
+
+func (r *regolancer) rapidRebalance(ctx context.Context, a *rebalanceAttempt, route *lnrpc.Route) {
+	_, err := tryRapidRebalance(ctx, r, a.from, a.to, route, a.amount)
+	if err != nil {
+		log.Printf("Rapid rebalance failed with %s", err)
+	} else {
+		log.Printf("Finished rapid rebalancing")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// pipelineNet is the network behind the fake lnd: a single payment can carry
+// up to liquidity sats and all payments together up to budget sats. The
+// payments with unknown hashes are probes, they fail at our node if the
+// amount could pass.
+type pipelineNet struct {
+	ln        *fakeLightning
+	liquidity int64
+	budget    int64
+	payments  int
+	probes    int
+}
+
+func (n *pipelineNet) known(hash []byte) bool {
+	for i := int64(1); i <= n.ln.invoices; i++ {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(i))
+		if h := sha256.Sum256(b[:]); string(h[:]) == string(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *pipelineNet) send(ctx context.Context, hash []byte, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+	amount := route.Hops[len(route.Hops)-1].AmtToForwardMsat / 1000
+	known := n.known(hash)
+	if known {
+		n.payments++
+	} else {
+		n.probes++
+	}
+	switch {
+	case amount > n.liquidity || amount > n.budget:
+		return failedHTLC(uint32(len(route.Hops) - 2)), nil
+	case !known:
+		return &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_FAILED, Failure: &lnrpc.Failure{
+			Code: lnrpc.Failure_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS, FailureSourceIndex: uint32(len(route.Hops))}}, nil
+	}
+	n.budget -= amount
+	for _, c := range n.ln.channels {
+		switch c.ChanId {
+		case route.Hops[0].ChanId:
+			c.LocalBalance -= Msat(route.TotalAmtMsat).satsCeil()
+			c.RemoteBalance += Msat(route.TotalAmtMsat).satsCeil()
+		case route.Hops[len(route.Hops)-1].ChanId:
+			c.LocalBalance += amount
+			c.RemoteBalance -= amount
+		}
+	}
+	return &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_SUCCEEDED, Route: route}, nil
+}
+
+func pipelineRoute(from uint64, amtMsat int64) *lnrpc.Route {
+	return testRoute(from, 2, amtMsat, amtMsat/10000, testPK(1), testPeerPK)
+}
+
+// pipelineTest returns the session set up like main does with the source
+// channel 1 and the target channel 2.
+func pipelineTest(t *testing.T, liquidity, budget int64) (*regolancer, *pipelineNet) {
+	params.FromPerc, params.ToPerc, params.ProbeSteps, params.TimeoutAttempt = 50, 50, 0, 5
+	params.TimeoutInfo, params.FailedRouteTTL, params.FailureCacheSize = 5, 5, 1000
+	params.MinAmount, params.AllowRapidRebalance, params.InFlightAction = 0, false, "track"
+	r, ln := newRouteTest(func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+		return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{pipelineRoute(req.OutgoingChanId, req.AmtMsat)}}, nil
+	})
+	ln.edges[1] = &lnrpc.ChannelEdge{ChannelId: 1, Node1Pub: testMyPK, Node2Pub: testPK(1),
+		Node1Policy: &lnrpc.RoutingPolicy{}, Node2Policy: &lnrpc.RoutingPolicy{}}
+	ln.channels = []*lnrpc.Channel{
+		{ChanId: 1, RemotePubkey: testPK(1), Active: true, Capacity: 3000000, LocalBalance: 2500000,
+			RemoteBalance: 500000},
+		{ChanId: 2, RemotePubkey: testPeerPK, Active: true, Capacity: 3000000, LocalBalance: 0,
+			RemoteBalance: 3000000},
+	}
+	net := &pipelineNet{ln: ln, liquidity: liquidity, budget: budget}
+	r.sender = &fakeSender{sendHash: net.send}
+	r.routerClient = &fakeRouter{build: func(req *routerrpc.BuildRouteRequest) (*lnrpc.Route, error) {
+		return pipelineRoute(req.OutgoingChanId, req.AmtMsat), nil
+	}}
+	r.channelPairs = map[string][2]*lnrpc.Channel{}
+	r.failureCache = map[string]failedRoute{}
+	r.softFailures = map[string]softFailure{}
+	r.failedPayments = map[string]*lnrpc.Route{}
+	r.capStats = map[uint64]*capStat{}
+	r.sourceUsage = map[uint64]Msat{}
+	r.noPolicyLogged = map[uint64]struct{}{}
+	r.invoiceCache = map[invoiceKey]cachedInvoice{}
+	r.invoiceSkewChecked = true
+	params.Amount = 500000
+	r.amount = params.Amount
+	resp, err := ln.ListChannels(context.Background(), &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.channels = resp.Channels
+	if err := r.getChannelCandidates(params.FromPerc, params.ToPerc, params.Amount); err != nil {
+		t.Fatal(err)
+	}
+	return r, net
+}
+
+func TestAttemptPipeline(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	for _, tc := range []struct {
+		name      string
+		liquidity int64
+		budget    int64
+		setup     func(r *regolancer)
+		err       bool
+		repeat    bool
+		successes int
+		payments  int
+		probes    int
+		received  int64
+	}{
+		{name: "success", liquidity: 1000000, budget: 1000000, successes: 1, payments: 1, received: 500000},
+		{name: "failed", liquidity: 100000, budget: 1000000, repeat: true, payments: 1},
+		// 250000 sats pass and 375000 fail, the probe runs out of steps
+		// without a usable amount
+		{name: "probed", liquidity: 300000, budget: 1000000, setup: func(r *regolancer) { params.ProbeSteps = 2 },
+			repeat: true, payments: 1, probes: 2},
+		// the route is reused in rapid mode until the source drops to 50%
+		{name: "rapid", liquidity: 1000000, budget: 2000000, setup: func(r *regolancer) {
+			params.AllowRapidRebalance = true
+		}, successes: 2, payments: 2, received: 1000000},
+		// the failed HTLCs window is full at the injected time
+		{name: "failed HTLCs limit", liquidity: 1000000, budget: 1000000, setup: func(r *regolancer) {
+			now := time.Unix(1700000000, 0)
+			r.clock = func() time.Time { return now }
+			r.failedHTLCs = failedHTLCLimiter{limit: 1, failures: []time.Time{now.Add(-time.Minute)}}
+		}, repeat: true},
+		{name: "dry run", liquidity: 1000000, budget: 1000000, setup: func(r *regolancer) { params.DryRun = true },
+			repeat: true},
+	} {
+		r, net := pipelineTest(t, tc.liquidity, tc.budget)
+		params.DryRun = false
+		if tc.setup != nil {
+			tc.setup(r)
+		}
+		err, repeat := tryRebalance(context.Background(), r)
+		if (err != nil) != tc.err || repeat != tc.repeat {
+			t.Errorf("%s: unexpected result %v, repeat %t", tc.name, err, repeat)
+		}
+		if r.successes != tc.successes || net.payments != tc.payments || net.probes != tc.probes {
+			t.Errorf("%s: expected %d successes, %d payments and %d probes, got %d, %d and %d", tc.name,
+				tc.successes, tc.payments, tc.probes, r.successes, net.payments, net.probes)
+		}
+		if received := r.findChannel(2).LocalBalance; received != tc.received {
+			t.Errorf("%s: expected the target to receive %d sats, got %d", tc.name, tc.received, received)
+		}
+	}
+}
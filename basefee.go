@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+type ErrBaseFeeRoute struct {
+	maxMsat int64
+}
+
+func (e ErrBaseFeeRoute) Error() string {
+	if e.maxMsat == 0 {
+		return "only found routes with a base fee, skipping under --require-zero-base-fee"
+	}
+	return fmt.Sprintf("only found routes with a base fee over %d msat, skipping under --max-hop-base-fee-msat",
+		e.maxMsat)
+}
+
+// baseFeeHop is a node charging too much base fee, the fee is -1 if its
+// policy is unknown.
+type baseFeeHop struct {
+	pubKey string
+	fee    int64
+}
+
+// maxHopBaseFee returns the max base fee allowed by --require-zero-base-fee
+// and --max-hop-base-fee-msat, ok is false if there's no limit.
+func maxHopBaseFee() (maxMsat int64, ok bool) {
+	switch {
+	case params.RequireZeroBaseFee:
+		return 0, true
+	case params.MaxHopBaseFee > 0:
+		return params.MaxHopBaseFee, true
+	}
+	return 0, false
+}
+
+type baseFeeStats struct {
+	filtered  int
+	preferred int
+}
+
+// hopPolicy returns the policy of the node forwarding the route hop, it's the
+// node of the previous hop.
+func (r *regolancer) hopPolicy(ctx context.Context, route *lnrpc.Route, i int) (*lnrpc.RoutingPolicy, error) {
+	edge, err := r.getChanInfo(ctx, route.Hops[i].ChanId)
+	if err != nil {
+		return nil, err
+	}
+	if edge.Node1Pub == route.Hops[i-1].PubKey {
+		return edge.Node1Policy, nil
+	}
+	return edge.Node2Policy, nil
+}
+
+// baseFeePairs returns the route nodes that charge more than maxMsat base fee
+// (or have no known policy) and their node pairs that can be ignored. The
+// last hop is charged by our target peer so its pair is never returned.
+func (r *regolancer) baseFeePairs(ctx context.Context, route *lnrpc.Route, maxMsat int64) (pairs []*lnrpc.NodePair,
+	offenders []baseFeeHop, err error) {
+	for i := 1; i < len(route.Hops); i++ {
+		policy, err := r.hopPolicy(ctx, route, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		if policy != nil && policy.FeeBaseMsat <= maxMsat {
+			continue
+		}
+		hop := baseFeeHop{pubKey: route.Hops[i-1].PubKey, fee: -1}
+		if policy != nil {
+			hop.fee = policy.FeeBaseMsat
+		}
+		offenders = append(offenders, hop)
+		if i == len(route.Hops)-1 {
+			continue
+		}
+		pairFrom, err := hex.DecodeString(route.Hops[i-1].PubKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		pairTo, err := hex.DecodeString(route.Hops[i].PubKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		pairs = append(pairs, &lnrpc.NodePair{From: pairFrom, To: pairTo})
+	}
+	return
+}
+
+// logBaseFeeHops prints the nodes that made the route rejected so that they
+// can be excluded permanently.
+func (r *regolancer) logBaseFeeHops(ctx context.Context, offenders []baseFeeHop, maxMsat int64) {
+	for _, hop := range offenders {
+		alias := hop.pubKey
+		if nodeInfo, err := r.getNodeInfo(ctx, hop.pubKey); err == nil {
+			alias = nodeInfo.Node.Alias
+		}
+		fee := "unknown"
+		if hop.fee >= 0 {
+			fee = fmt.Sprintf("%d msat", hop.fee)
+		}
+		log.Print(infoColorF("Route goes through %s (%s) charging %s base fee, more than %d msat", alias, hop.pubKey,
+			fee, maxMsat))
+	}
+}
+
+// zeroBaseFeeRoutes marks the routes without base fees if
+// --prefer-zero-base-fee is set so that they're sorted before the cheaper
+// routes with base fees.
+func (r *regolancer) zeroBaseFeeRoutes(ctx context.Context, routes []*lnrpc.Route) (map[*lnrpc.Route]bool, error) {
+	if !params.PreferZeroBaseFee {
+		return nil, nil
+	}
+	result := map[*lnrpc.Route]bool{}
+	var cheapest, cheapestZero *lnrpc.Route
+	for _, route := range routes {
+		_, offenders, err := r.baseFeePairs(ctx, route, 0)
+		if err != nil {
+			return nil, err
+		}
+		result[route] = len(offenders) == 0
+		if cheapest == nil || route.TotalFeesMsat < cheapest.TotalFeesMsat {
+			cheapest = route
+		}
+		if len(offenders) == 0 && (cheapestZero == nil || route.TotalFeesMsat < cheapestZero.TotalFeesMsat) {
+			cheapestZero = route
+		}
+	}
+	if cheapestZero != nil && !result[cheapest] {
+		log.Printf("Preferring a zero base fee route with %s sat fee over %s sat",
+			formatFee(Msat(cheapestZero.TotalFeesMsat)), formatFee(Msat(cheapest.TotalFeesMsat)))
+		r.baseFeeStats.preferred++
+	}
+	return result, nil
+}
+
+func (r *regolancer) printBaseFeeStats() {
+	s := r.baseFeeStats
+	if s.filtered == 0 && s.preferred == 0 {
+		return
+	}
+	log.Printf("Zero base fee: %s routes with a base fee skipped, %s times a zero base fee route preferred",
+		hiWhiteColor(s.filtered), hiWhiteColor(s.preferred))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// baseFeeTest returns the session with two routes from the source peer
+// testPK(1) to the target peer: through testPK(2) charging 1000 msat base fee
+// and through testPK(3) without base fees, the first one is cheaper.
+func baseFeeTest(routes func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error)) (*regolancer,
+	*fakeLightning, *lnrpc.Route, *lnrpc.Route) {
+	r, ln := newRouteTest(routes)
+	edge := func(id uint64, node1, node2 string, baseMsat int64) *lnrpc.ChannelEdge {
+		return &lnrpc.ChannelEdge{ChannelId: id, Node1Pub: node1, Node2Pub: node2,
+			Node1Policy: &lnrpc.RoutingPolicy{FeeBaseMsat: baseMsat, FeeRateMilliMsat: 100},
+			Node2Policy: &lnrpc.RoutingPolicy{}}
+	}
+	ln.edges[1001] = edge(1001, testPK(1), testPK(2), 1000)
+	ln.edges[1002] = edge(1002, testPK(2), testPeerPK, 0)
+	ln.edges[2001] = edge(2001, testPK(1), testPK(3), 0)
+	ln.edges[2002] = edge(2002, testPK(3), testPeerPK, 0)
+	base := testRoute(1, 2, 1000000, 100, testPK(1), testPK(2), testPeerPK)
+	zero := testRoute(1, 2, 1000000, 200, testPK(1), testPK(3), testPeerPK)
+	zero.Hops[1].ChanId, zero.Hops[2].ChanId = 2001, 2002
+	return r, ln, base, zero
+}
+
+func TestBaseFeePairs(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	r, ln, base, zero := baseFeeTest(nil)
+	ctx := context.Background()
+	pairs, offenders, err := r.baseFeePairs(ctx, base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offenders) != 1 || offenders[0].pubKey != testPK(1) || offenders[0].fee != 1000 {
+		t.Errorf("expected %s charging 1000 msat, got %v", testPK(1), offenders)
+	}
+	if len(pairs) != 1 || !ignoresPair(&lnrpc.QueryRoutesRequest{IgnoredPairs: pairs}, testPK(1), testPK(2)) {
+		t.Errorf("expected the pair from %s to %s, got %v", testPK(1), testPK(2), pairs)
+	}
+	if _, offenders, _ = r.baseFeePairs(ctx, base, 1000); len(offenders) != 0 {
+		t.Errorf("1000 msat base fee is allowed, got %v", offenders)
+	}
+	if _, offenders, _ = r.baseFeePairs(ctx, zero, 0); len(offenders) != 0 {
+		t.Errorf("the zero base fee route has no offenders, got %v", offenders)
+	}
+	// the base fee of the target peer can't be avoided by ignoring a pair
+	// and the unknown policy is treated as a base fee
+	r.chanCache = map[uint64]*lnrpc.ChannelEdge{}
+	ln.edges[2].Node1Policy = &lnrpc.RoutingPolicy{FeeBaseMsat: 500}
+	ln.edges[2001].Node1Policy = nil
+	pairs, offenders, err = r.baseFeePairs(ctx, zero, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offenders) != 2 || offenders[0].fee != -1 || offenders[1].pubKey != testPeerPK ||
+		offenders[1].fee != 500 {
+		t.Errorf("expected the unknown policy and the target peer, got %v", offenders)
+	}
+	if len(pairs) != 1 {
+		t.Errorf("only the pair with the unknown policy can be ignored, got %v", pairs)
+	}
+}
+
+func TestRequireZeroBaseFee(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	var base, zero *lnrpc.Route
+	r, ln, base, zero := baseFeeTest(func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+		if ignoresPair(req, testPK(1), testPK(2)) {
+			return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{zero}}, nil
+		}
+		return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{base}}, nil
+	})
+	params.RequireZeroBaseFee = true
+	routes, _, err := r.getRoutes(context.Background(), 1, 2, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0] != zero || ln.queries != 2 {
+		t.Errorf("expected the zero base fee route after a requery, got %d routes in %d queries", len(routes),
+			ln.queries)
+	}
+	if r.baseFeeStats.filtered != 1 {
+		t.Errorf("expected 1 filtered route, got %d", r.baseFeeStats.filtered)
+	}
+	// --max-hop-base-fee-msat allows the base fee up to the limit
+	params.RequireZeroBaseFee, params.MaxHopBaseFee = false, 1000
+	ln.queries = 0
+	routes, _, err = r.getRoutes(context.Background(), 1, 2, 1000000)
+	if err != nil || len(routes) != 1 || routes[0] != base || ln.queries != 1 {
+		t.Errorf("the base fee route is within the limit, got %v, %v in %d queries", routes, err, ln.queries)
+	}
+}
+
+func TestPreferZeroBaseFee(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	var base, zero *lnrpc.Route
+	r, _, base, zero := baseFeeTest(func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+		if ignoresPair(req, testPK(1), testPK(2)) {
+			return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{zero}}, nil
+		}
+		return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{base}}, nil
+	})
+	params.MinRouteChoices = 2
+	routes, _, err := r.getRouteChoices(context.Background(), 1, 2, 1000000)
+	if err != nil || len(routes) != 2 || routes[0] != base {
+		t.Fatalf("the cheapest route should be first, got %v, %v", routes, err)
+	}
+	params.PreferZeroBaseFee = true
+	routes, _, err = r.getRouteChoices(context.Background(), 1, 2, 1000000)
+	if err != nil || len(routes) != 2 || routes[0] != zero || routes[1] != base {
+		t.Fatalf("the zero base fee route should be first, got %v, %v", routes, err)
+	}
+	if r.baseFeeStats.preferred != 1 || r.baseFeeStats.filtered != 0 {
+		t.Errorf("expected 1 preferred and 0 filtered routes, got %+v", r.baseFeeStats)
+	}
+}
@@ -1,16 +1,106 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gofrs/flock"
+	"github.com/lightningnetwork/lnd/lnrpc"
 )
 
+type nodeCacheStats struct {
+	hits        int
+	unknownHits int
+	misses      int
+	routeHits   int
+	routeMisses int
+	coldRoutes  int
+}
+
+// routeCacheTally is the number of route nodes that were in the node cache
+// and missing from it when the route was printed.
+type routeCacheTally struct {
+	hits   int
+	misses int
+}
+
+func (r *regolancer) nodeCached(pk string) bool {
+	n, ok := r.nodeCache[pk]
+	return ok && n.NodeInfo != nil
+}
+
+// addRouteCacheTally adds the route tally to the session stats and the
+// attempt in progress, it's only counted with --node-cache-info.
+func (r *regolancer) addRouteCacheTally(t routeCacheTally) {
+	if !params.NodeCacheInfo {
+		return
+	}
+	r.nodeCacheStats.routeHits += t.hits
+	r.nodeCacheStats.routeMisses += t.misses
+	if t.misses > 0 {
+		r.nodeCacheStats.coldRoutes++
+	}
+	if r.attemptInfo != nil {
+		r.attemptInfo.cacheTallied = true
+		r.attemptInfo.cacheMisses += t.misses
+	}
+}
+
+// cachedChanInfo is the channel with its policies saved to the companion file
+// of the node cache, the timestamp is when it was queried.
+type cachedChanInfo struct {
+	*lnrpc.ChannelEdge
+	Timestamp time.Time
+}
+
+func chanCacheFilename(nodeCacheFilename string) string {
+	return nodeCacheFilename + ".chans"
+}
+
+// compressCache reports if the cache file should be saved with gzip.
+func compressCache(filename string) bool {
+	return params.NodeCacheCompress || strings.HasSuffix(filename, ".gz")
+}
+
+type cacheFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (c cacheFile) Close() error {
+	return c.f.Close()
+}
+
+// openCacheFile opens the cache file for decoding. The gzip compressed files
+// are detected by their header so the uncompressed files saved before are
+// loaded as well and converted on the next save.
+func openCacheFile(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	header, _ := br.Peek(2)
+	if len(header) < 2 || header[0] != 0x1f || header[1] != 0x8b {
+		return cacheFile{Reader: br, f: f}, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cacheFile{Reader: zr, f: f}, nil
+}
+
 func lock() *flock.Flock {
 	return flock.New(filepath.Join(os.TempDir(), "regolancer.lock"))
 }
@@ -33,7 +123,8 @@ func (r *regolancer) loadNodeCache(filename string, exp int, doLock bool) error
 		l.RLock()
 		defer l.Unlock()
 	}
-	f, err := os.Open(filename)
+	start := time.Now()
+	f, err := openCacheFile(filename)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return fmt.Errorf("error opening node cache file: %s", err)
@@ -45,25 +136,80 @@ func (r *regolancer) loadNodeCache(filename string, exp int, doLock bool) error
 	if err != nil {
 		return err
 	}
+	if doLock {
+		log.Printf("Loaded %s cached nodes in %s", hiWhiteColor(len(r.nodeCache)),
+			hiWhiteColor(time.Since(start).Round(time.Millisecond)))
+	}
 	for k, v := range r.nodeCache {
 		since := time.Since(v.Timestamp)
-		if since > time.Minute*time.Duration(exp) {
+		if since > time.Minute*time.Duration(exp) ||
+			v.NodeInfo == nil && since > nodeUnknownLifetime {
 			delete(r.nodeCache, k)
+			continue
+		}
+		// the cache could be saved by a run without --low-memory
+		if params.LowMemory && v.NodeInfo != nil {
+			v.NodeInfo = compactNodeInfo(v.NodeInfo)
+			r.nodeCache[k] = v
 		}
 	}
+	if r.chanCache == nil {
+		return nil
+	}
+	chans, err := readChanCache(chanCacheFilename(filename), exp)
+	if err != nil {
+		logErrorF("Error loading channel cache: %s", err)
+		return nil
+	}
+	for k, v := range chans {
+		r.chanCache[k] = v.ChannelEdge
+		r.chanCacheTimes[k] = v.Timestamp
+		r.touchChanCache(k)
+	}
 	return nil
 }
 
-func (r *regolancer) saveNodeCache(filename string, exp int) error {
-	if filename == "" {
-		return nil
+// readChanCache reads the channels cached less than exp minutes ago as the
+// fee policies change over time.
+func readChanCache(filename string, exp int) (result map[uint64]cachedChanInfo, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			result, err = nil, fmt.Errorf("channel cache format might be outdated: %s", p)
+		}
+	}()
+	result = map[uint64]cachedChanInfo{}
+	f, err := openCacheFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, fmt.Errorf("error opening channel cache file: %s", err)
 	}
-	log.Printf("Saving node cache to %s", filename)
+	defer f.Close()
+	if err = gob.NewDecoder(f).Decode(&result); err != nil {
+		return nil, err
+	}
+	for k, v := range result {
+		if v.ChannelEdge == nil || time.Since(v.Timestamp) > time.Minute*time.Duration(exp) {
+			delete(result, k)
+		}
+	}
+	return result, nil
+}
 
-	l := lock()
-	l.Lock()
-	defer l.Unlock()
+// chanCacheSnapshot copies the cached channels with the time they were
+// queried.
+func (r *regolancer) chanCacheSnapshot() map[uint64]cachedChanInfo {
+	result := make(map[uint64]cachedChanInfo, len(r.chanCache))
+	for k, v := range r.chanCache {
+		result[k] = cachedChanInfo{ChannelEdge: v, Timestamp: r.chanCacheTimes[k]}
+	}
+	return result
+}
 
+// mergeNodeCache adds the entries from the cache file that are newer than the
+// ones in the map, the file should be locked.
+func mergeNodeCache(cache map[string]cachedNodeInfo, filename string, exp int) {
 	old := regolancer{nodeCache: map[string]cachedNodeInfo{}}
 	err := old.loadNodeCache(filename, exp, false)
 
@@ -71,17 +217,152 @@ func (r *regolancer) saveNodeCache(filename string, exp int) error {
 		logErrorF("Error merging cache, saving anew: %s", err)
 	}
 	for k, v := range old.nodeCache {
-		if n, ok := r.nodeCache[k]; !ok ||
+		if n, ok := cache[k]; !ok ||
 			n.Timestamp.Before(v.Timestamp) {
-			r.nodeCache[k] = v
+			cache[k] = v
 		}
 	}
+}
+
+// writeNodeCache merges the node and channel caches with the files saved by
+// other instances and atomically replaces them.
+func writeNodeCache(filename string, exp int, cache map[string]cachedNodeInfo,
+	chans map[uint64]cachedChanInfo) error {
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
 
-	f, err := os.Create(filename)
+	mergeNodeCache(cache, filename, exp)
+	if err := writeGob(filename, cache, compressCache(filename)); err != nil {
+		return fmt.Errorf("error saving node cache file: %s", err)
+	}
+	old, err := readChanCache(chanCacheFilename(filename), exp)
 	if err != nil {
-		return fmt.Errorf("error creating node cache file: %s", err)
+		logErrorF("Error merging channel cache, saving anew: %s", err)
 	}
-	defer f.Close()
-	err = gob.NewEncoder(f).Encode(r.nodeCache)
-	return err
+	for k, v := range old {
+		if c, ok := chans[k]; !ok || c.Timestamp.Before(v.Timestamp) {
+			chans[k] = v
+		}
+	}
+	if err := writeGob(chanCacheFilename(filename), chans, compressCache(filename)); err != nil {
+		return fmt.Errorf("error saving channel cache file: %s", err)
+	}
+	return nil
+}
+
+// writeGob atomically replaces the file with the encoded value.
+func writeGob(filename string, value any, compress bool) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	var w io.Writer = bw
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(bw)
+		w = zw
+	}
+	err = gob.NewEncoder(w).Encode(value)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (r *regolancer) saveNodeCache(filename string, exp int) error {
+	if filename == "" {
+		return nil
+	}
+	r.waitNodeCacheSave()
+	log.Printf("Saving node cache to %s", filename)
+	return writeNodeCache(filename, exp, r.nodeCache, r.chanCacheSnapshot())
+}
+
+// periodicSaveNodeCache saves a snapshot of the node cache in background every
+// --node-cache-save-minutes so that a crash doesn't lose it. The snapshot is
+// taken by the caller's goroutine so the cache itself is never accessed
+// concurrently.
+func (r *regolancer) periodicSaveNodeCache() {
+	if params.NodeCacheFilename == "" || params.NodeCacheSaveMins <= 0 ||
+		time.Since(r.nodeCacheSaved) < time.Minute*time.Duration(params.NodeCacheSaveMins) {
+		return
+	}
+	if r.nodeCacheSaving != nil {
+		select {
+		case <-r.nodeCacheSaving:
+		default:
+			// the previous save is still running
+			return
+		}
+	}
+	r.nodeCacheSaved = time.Now()
+	snapshot := make(map[string]cachedNodeInfo, len(r.nodeCache))
+	for k, v := range r.nodeCache {
+		snapshot[k] = v
+	}
+	chans := r.chanCacheSnapshot()
+	done := make(chan struct{})
+	r.nodeCacheSaving = done
+	go func() {
+		defer close(done)
+		start := time.Now()
+		err := writeNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime, snapshot, chans)
+		if err != nil {
+			logErrorF("Error saving node cache: %s", err)
+			return
+		}
+		log.Printf("Saved %s cached nodes to %s in %s", hiWhiteColor(len(snapshot)), params.NodeCacheFilename,
+			hiWhiteColor(time.Since(start).Round(time.Millisecond)))
+	}()
+}
+
+func (r *regolancer) waitNodeCacheSave() {
+	if r.nodeCacheSaving != nil {
+		<-r.nodeCacheSaving
+	}
+}
+
+// warmNodeCache fills the node cache from the whole graph, only the compact
+// node records are kept. The nodes already cached are not replaced.
+func (r *regolancer) warmNodeCache(ctx context.Context) error {
+	start := time.Now()
+	graph, err := r.lnClient.DescribeGraph(ctx, &lnrpc.ChannelGraphRequest{})
+	if err != nil {
+		return err
+	}
+	nodes := map[string]*lnrpc.NodeInfo{}
+	for _, n := range graph.Nodes {
+		if _, ok := r.nodeCache[n.PubKey]; ok {
+			continue
+		}
+		nodes[n.PubKey] = compactNodeInfo(&lnrpc.NodeInfo{Node: n})
+	}
+	for _, e := range graph.Edges {
+		for _, pk := range []string{e.Node1Pub, e.Node2Pub} {
+			if n, ok := nodes[pk]; ok {
+				n.NumChannels++
+				n.TotalCapacity += e.Capacity
+			}
+		}
+	}
+	now := time.Now()
+	for pk, n := range nodes {
+		r.nodeCache[pk] = cachedNodeInfo{NodeInfo: n, Timestamp: now}
+	}
+	log.Printf("Warmed up the node cache with %s nodes in %s", hiWhiteColor(len(nodes)),
+		hiWhiteColor(time.Since(start).Round(time.Millisecond)))
+	return nil
 }
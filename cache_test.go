@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestPeriodicSaveNodeCache(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	// the cache files are locked in the temp dir
+	t.Setenv("TMPDIR", t.TempDir())
+	params.NodeCacheFilename = filepath.Join(t.TempDir(), "cache.dat")
+	params.NodeCacheLifetime, params.NodeCacheSaveMins = 1440, 30
+	now := time.Now()
+	node := func(alias string) cachedNodeInfo {
+		return cachedNodeInfo{NodeInfo: &lnrpc.NodeInfo{Node: &lnrpc.LightningNode{Alias: alias}}, Timestamp: now}
+	}
+	r := &regolancer{nodeCache: map[string]cachedNodeInfo{}, chanCache: map[uint64]*lnrpc.ChannelEdge{},
+		chanCacheTimes: map[uint64]time.Time{}}
+	for i := 0; i < 100; i++ {
+		r.nodeCache[testPK(i)] = node("before")
+		r.chanCache[uint64(i)] = &lnrpc.ChannelEdge{ChannelId: uint64(i)}
+		r.chanCacheTimes[uint64(i)] = now
+	}
+	r.nodeCacheSaved = now
+	r.periodicSaveNodeCache()
+	if r.nodeCacheSaving != nil {
+		t.Fatal("the cache shouldn't be saved before the interval passes")
+	}
+
+	// the save is held by the file lock while the cache is changed
+	l := lock()
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	r.nodeCacheSaved = now.Add(-time.Hour)
+	r.periodicSaveNodeCache()
+	saving := r.nodeCacheSaving
+	if saving == nil {
+		t.Fatal("the cache should be saved after the interval")
+	}
+	mutate := func(from, to int) {
+		for i := from; i < to; i++ {
+			r.nodeCache[testPK(i)] = node("after")
+			delete(r.nodeCache, testPK(i-100))
+			r.chanCache[uint64(i)] = &lnrpc.ChannelEdge{ChannelId: uint64(i)}
+			r.chanCacheTimes[uint64(i)] = now
+			delete(r.chanCache, uint64(i-100))
+		}
+	}
+	mutate(100, 150)
+	// the previous save is still running so another one is skipped
+	r.nodeCacheSaved = now.Add(-time.Hour)
+	r.periodicSaveNodeCache()
+	if r.nodeCacheSaving != saving {
+		t.Error("a save was started while the previous one is running")
+	}
+	l.Unlock()
+	mutate(150, 200)
+	r.waitNodeCacheSave()
+
+	saved := regolancer{nodeCache: map[string]cachedNodeInfo{}, chanCache: map[uint64]*lnrpc.ChannelEdge{},
+		chanCacheTimes: map[uint64]time.Time{}}
+	if err := saved.loadNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.nodeCache) != 100 || len(saved.chanCache) != 100 {
+		t.Fatalf("expected the snapshot of 100 nodes and channels, got %d and %d", len(saved.nodeCache),
+			len(saved.chanCache))
+	}
+	for i := 0; i < 100; i++ {
+		if n, ok := saved.nodeCache[testPK(i)]; !ok || n.Node.Alias != "before" {
+			t.Errorf("expected node %d from the snapshot, got %v", i, n.NodeInfo)
+		}
+	}
+
+	// the save on exit merges the current cache with the file
+	if err := r.saveNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime); err != nil {
+		t.Fatal(err)
+	}
+	saved.nodeCache = map[string]cachedNodeInfo{}
+	if err := saved.loadNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.nodeCache) != 200 || saved.nodeCache[testPK(199)].Node.Alias != "after" {
+		t.Errorf("expected the merged cache of 200 nodes, got %d", len(saved.nodeCache))
+	}
+}
+
+// printCachedRoute prints the route in the JSON format and returns the
+// route_found event.
+func printCachedRoute(t *testing.T, r *regolancer, route *lnrpc.Route) (routeCacheTally, map[string]any) {
+	buf := &bytes.Buffer{}
+	jsonLogger.out = buf
+	tally := r.printRoute(context.Background(), route)
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		e := map[string]any{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e["event"] == "route_found" {
+			return tally, e
+		}
+	}
+	t.Fatal("no route_found event")
+	return tally, nil
+}
+
+func TestRouteCacheTally(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	defer func(out io.Writer) { jsonLogger.out = out }(jsonLogger.out)
+	params.LogFormat = logFormatJSON
+	params.NodeCacheInfo = true
+	r := &regolancer{
+		lnClient: &fakeLightning{},
+		nodeCache: map[string]cachedNodeInfo{
+			testPK(1): {NodeInfo: &lnrpc.NodeInfo{Node: &lnrpc.LightningNode{Alias: "one"}}},
+			// the unknown node is a miss too
+			testPeerPK: {Timestamp: time.Now()},
+		},
+		statFilename: filepath.Join(t.TempDir(), "stat.csv"),
+		sourceUsage:  map[uint64]Msat{},
+		attemptInfo:  &attemptInfo{number: 1, start: time.Now()},
+	}
+	route := testRoute(1, 2, 100000, 10, testPK(1), testPeerPK)
+	tally, e := printCachedRoute(t, r, route)
+	if tally.hits != 1 || tally.misses != 2 {
+		t.Errorf("expected 1 hit and 2 misses, got %+v", tally)
+	}
+	if e["node_cache_hits"] != 1.0 || e["node_cache_misses"] != 2.0 {
+		t.Errorf("expected the tally in the event, got %v", e)
+	}
+	r.addRouteCacheTally(tally)
+	// the second route of the same attempt is fully cached
+	r.nodeCache[testPeerPK] = r.nodeCache[testPK(1)]
+	r.nodeCache[testMyPK] = r.nodeCache[testPK(1)]
+	tally, _ = printCachedRoute(t, r, route)
+	if tally.hits != 3 || tally.misses != 0 {
+		t.Errorf("expected 3 hits, got %+v", tally)
+	}
+	r.addRouteCacheTally(tally)
+	if s := r.nodeCacheStats; s.routeHits != 4 || s.routeMisses != 2 || s.coldRoutes != 1 {
+		t.Errorf("unexpected session stats %+v", s)
+	}
+	r.saveStat(route)
+
+	// without --node-cache-info nothing is counted
+	params.NodeCacheInfo = false
+	r.attemptInfo = &attemptInfo{number: 2, start: time.Now()}
+	tally, e = printCachedRoute(t, r, route)
+	if _, ok := e["node_cache_hits"]; ok {
+		t.Errorf("the tally should be left out of the event, got %v", e)
+	}
+	r.addRouteCacheTally(tally)
+	r.saveStat(route)
+	rows := readStatColumns(t, r.statFilename)
+	if len(rows) != 2 || rows[0]["node_cache_misses"] != "2" || rows[1]["node_cache_misses"] != "" {
+		t.Errorf("expected 2 misses in the first row and none in the second, got %v", rows)
+	}
+}
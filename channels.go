@@ -1,13 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"math"
-	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -20,10 +20,31 @@ func formatChannelPair(a, b uint64) string {
 	return fmt.Sprintf("%d-%d", a, b)
 }
 
+// channelLabel formats our channel as "[scid alias]" with the peer alias.
+func (r *regolancer) channelLabel(ctx context.Context, chanId uint64) string {
+	label := hiWhiteColor(formatScid(chanId))
+	if c := r.findChannel(chanId); c != nil {
+		if nodeInfo, err := r.getNodeInfo(ctx, c.RemotePubkey); err == nil && nodeInfo.Node != nil {
+			label += " " + cyanColor(sanitizeAlias(nodeInfo.Node.Alias))
+		}
+	}
+	return "[" + label + "]"
+}
+
+func (r *regolancer) pairLabel(ctx context.Context, from, to uint64) string {
+	return r.channelLabel(ctx, from) + " → " + r.channelLabel(ctx, to)
+}
+
+// publicOnly reports if our private channels should be left out, they're only
+// listed if they can be used as sources or targets.
+func publicOnly() bool {
+	return !params.PrivateSources && !params.PrivateTargets
+}
+
 func (r *regolancer) getChannels(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(params.TimeoutRoute))
+	ctx, cancel := context.WithTimeout(ctx, r.routeTimeout())
 	defer cancel()
-	channels, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: true})
+	channels, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: publicOnly()})
 	if err != nil {
 		return err
 	}
@@ -39,19 +60,133 @@ func makeChanSet(chanIds []uint64) (result map[uint64]struct{}) {
 	return
 }
 
-func parseNodeChannelIDs(ids []string) (chans map[uint64]struct{}, nodes [][]byte, err error) {
-	chanIdStr := []string{}
-	nodePKStr := []string{}
+// getLocallyDisabled finds our channels that we disabled on our side so they
+// can't be used for rebalancing.
+func (r *regolancer) getLocallyDisabled(ctx context.Context) error {
+	r.locallyDisabled = map[uint64]struct{}{}
+	for _, c := range r.channels {
+		edge, err := r.getChanInfo(ctx, c.ChanId)
+		if err != nil {
+			return err
+		}
+		policy := edge.Node1Policy
+		if edge.Node2Pub == r.myPK {
+			policy = edge.Node2Policy
+		}
+		if policy != nil && policy.Disabled {
+			r.locallyDisabled[c.ChanId] = struct{}{}
+		}
+	}
+	r.addExclusions(r.locallyDisabled, nil, "channel policy")
+	for chanId := range r.fromChannelId {
+		if _, ok := r.locallyDisabled[chanId]; ok {
+			log.Print(infoColorF("Source channel %d is disabled on our side and will be skipped", chanId))
+		}
+	}
+	for chanId := range r.toChannelId {
+		if _, ok := r.locallyDisabled[chanId]; ok {
+			log.Print(infoColorF("Target channel %d is disabled on our side and will be skipped", chanId))
+		}
+	}
+	return nil
+}
+
+// parseNodePairs parses directed "fromPK,toPK" node pairs.
+func parseNodePairs(pairs []string) (result []*lnrpc.NodePair, err error) {
+	for _, p := range pairs {
+		pks := strings.Split(p, ",")
+		if len(pks) != 2 {
+			return nil, fmt.Errorf("invalid node pair %s, expected two node ids separated by comma", p)
+		}
+		pair := [2][]byte{}
+		for i, pk := range pks {
+			pair[i], err = parseNodeID(pk)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if bytes.Equal(pair[0], pair[1]) {
+			return nil, fmt.Errorf("invalid node pair %s, node ids should be different", p)
+		}
+		result = append(result, &lnrpc.NodePair{From: pair[0], To: pair[1]})
+	}
+	return
+}
+
+// parseAllKeyword returns an empty list if it only contains the "all" keyword
+// which means any channel can be used.
+func parseAllKeyword(ids []string) ([]string, error) {
 	for _, id := range ids {
-		if len(id) == 66 {
-			nodePKStr = append(nodePKStr, id)
-		} else {
-			chanIdStr = append(chanIdStr, id)
+		if strings.ToLower(id) == "all" {
+			if len(ids) > 1 {
+				return nil, fmt.Errorf("\"all\" can't be combined with other channels or nodes")
+			}
+			return nil, nil
+		}
+	}
+	return ids, nil
+}
+
+// looksLikeChanID reports if the id only consists of digits and "x"
+// separators so it should be a channel id (decimal or short channel id) and
+// not a node id.
+func looksLikeChanID(id string) bool {
+	for _, c := range strings.ToLower(id) {
+		if (c < '0' || c > '9') && c != 'x' {
+			return false
 		}
 	}
-	chans = makeChanSet(convertChanStringToInt(chanIdStr))
-	for _, pk := range nodePKStr {
-		nodePK, err := hex.DecodeString(pk)
+	return id != ""
+}
+
+func parseChanID(id string) (uint64, error) {
+	chanId, err := strconv.ParseInt(id, 10, 64)
+	if err == nil {
+		return uint64(chanId), nil
+	}
+	if strings.Count(strings.ToLower(id), "x") != 2 {
+		return 0, fmt.Errorf("invalid channel id %s, expected a number or a short channel id like 123x456x7", id)
+	}
+	chanId, err = parseScid(id)
+	if err != nil {
+		return 0, fmt.Errorf("invalid channel id %s: %s", id, err)
+	}
+	return uint64(chanId), nil
+}
+
+// parseNodeID accepts node ids in any case and in the pubkey@host:port URI
+// form, the address part is ignored.
+func parseNodeID(id string) ([]byte, error) {
+	pk := strings.ToLower(strings.TrimSpace(id))
+	if at := strings.Index(pk, "@"); at >= 0 {
+		pk = pk[:at]
+	}
+	if len(pk) != 66 {
+		return nil, fmt.Errorf("invalid node id %s, expected 66 hex characters, got %d", id, len(pk))
+	}
+	result, err := hex.DecodeString(pk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id %s, not a hex string: %s", id, err)
+	}
+	if result[0] != 2 && result[0] != 3 {
+		return nil, fmt.Errorf("invalid node id %s, expected it to start with 02 or 03", id)
+	}
+	return result, nil
+}
+
+func parseNodeChannelIDs(ids []string) (chans map[uint64]struct{}, nodes [][]byte, err error) {
+	chans = map[uint64]struct{}{}
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if len(id) != 66 && looksLikeChanID(id) {
+			chanId, err := parseChanID(id)
+			if err != nil {
+				return nil, nil, err
+			}
+			chans[chanId] = struct{}{}
+			continue
+		}
+		nodePK, err := parseNodeID(id)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -60,13 +195,37 @@ func parseNodeChannelIDs(ids []string) (chans map[uint64]struct{}, nodes [][]byt
 	return
 }
 
+// getChannelCandidates selects source and target channels. Excluded channels
+// are never used. If no targets are specified with --to (or it's set to
+// "all") every channel with local balance below toPerc percent of its capacity
+// is a target. If targets are specified only they are considered and they are
+// checked against --pto-strict if it's set or toPerc otherwise. Sources are
+// selected the same way using --from, --pfrom-strict, fromPerc and the remote
+// balance.
 func (r *regolancer) getChannelCandidates(fromPerc, toPerc, amount int64) error {
-
+	if len(r.fromChannelId) > 0 && params.FromPercStrict > 0 {
+		fromPerc = params.FromPercStrict
+	}
+	if len(r.toChannelId) > 0 && params.ToPercStrict > 0 {
+		toPerc = params.ToPercStrict
+	}
+	r.fromPerc, r.toPerc = fromPerc, toPerc
 	for _, c := range r.channels {
 		if _, ok := r.excludeBoth[c.ChanId]; ok {
 			continue
 		}
-		if _, ok := r.excludeIn[c.ChanId]; !ok {
+		if _, ok := r.locallyDisabled[c.ChanId]; ok {
+			continue
+		}
+		if _, ok := r.pendingUpdates[c.ChanId]; ok {
+			continue
+		}
+		_, addrExcludedTo := r.addrExcludedTo[c.ChanId]
+		_, demandExcludedTo := r.demandExcludedTo[c.ChanId]
+		_, addrExcludedFrom := r.addrExcludedFrom[c.ChanId]
+		privateExcludedTo := c.Private && !params.PrivateTargets
+		privateExcludedFrom := c.Private && !params.PrivateSources
+		if _, ok := r.excludeIn[c.ChanId]; !ok && !addrExcludedTo && !demandExcludedTo && !privateExcludedTo {
 			if _, ok := r.toChannelId[c.ChanId]; ok || len(r.toChannelId) == 0 {
 				if c.LocalBalance < c.Capacity*toPerc/100 {
 					r.toChannels = append(r.toChannels, c)
@@ -74,9 +233,13 @@ func (r *regolancer) getChannelCandidates(fromPerc, toPerc, amount int64) error
 			}
 
 		}
-		if _, ok := r.excludeOut[c.ChanId]; !ok {
+		if _, ok := r.excludeOut[c.ChanId]; !ok && !addrExcludedFrom && !privateExcludedFrom {
 			if _, ok := r.fromChannelId[c.ChanId]; ok || len(r.fromChannelId) == 0 {
-				if c.RemoteBalance < c.Capacity*fromPerc/100 {
+				if rule, ok := r.sourceRules[c.ChanId]; ok {
+					if rule.triggered(c.LocalBalance, c.Capacity) {
+						r.fromChannels = append(r.fromChannels, c)
+					}
+				} else if c.RemoteBalance < c.Capacity*fromPerc/100 {
 					r.fromChannels = append(r.fromChannels, c)
 				}
 			}
@@ -104,8 +267,77 @@ func min(args ...int64) (result int64) {
 	return
 }
 
-func (r *regolancer) pickChannelPair(amount, minAmount int64,
-	relFromAmount, relToAmount float64) (from uint64, to uint64, maxAmount int64, err error) {
+// headroom returns how much the channel can send (the remote balance grows)
+// or receive (the local balance grows) before crossing the percentage of its
+// capacity.
+func headroom(c *lnrpc.Channel, perc int64, incoming bool) int64 {
+	balance := c.RemoteBalance
+	if incoming {
+		balance = c.LocalBalance
+	}
+	return c.Capacity*perc/100 - balance
+}
+
+// spendable returns how much the channel can send, the local balance above our
+// channel reserve.
+func spendable(c *lnrpc.Channel) int64 {
+	balance := c.LocalBalance
+	if c.LocalConstraints != nil {
+		balance -= int64(c.LocalConstraints.ChanReserveSat)
+	}
+	if balance < 0 {
+		return 0
+	}
+	return balance
+}
+
+// receivable returns how much the channel can receive, the remote balance
+// above the peer's channel reserve.
+func receivable(c *lnrpc.Channel) int64 {
+	balance := c.RemoteBalance
+	if c.RemoteConstraints != nil {
+		balance -= int64(c.RemoteConstraints.ChanReserveSat)
+	}
+	if balance < 0 {
+		return 0
+	}
+	return balance
+}
+
+// fitAmount reduces the amount (the total amount with --distribute) to what
+// the source candidates can send and the target candidates can receive in
+// total. With --strict such amount is an error.
+func (r *regolancer) fitAmount(amount int64) (int64, error) {
+	if amount == 0 || len(r.fromChannels) == 0 || len(r.toChannels) == 0 {
+		return amount, nil
+	}
+	var out, in int64
+	for _, c := range r.fromChannels {
+		out += spendable(c)
+	}
+	for _, c := range r.toChannels {
+		in += receivable(c)
+	}
+	feasible := min(amount, out, in)
+	if feasible == amount {
+		return amount, nil
+	}
+	log.Printf("Amount %s is more than the candidates can move: sources can send %s, targets can receive %s",
+		formatAmt(amount), formatAmt(out), formatAmt(in))
+	if params.Strict {
+		return 0, fmt.Errorf("not enough liquidity for amount %d (--strict is set)", amount)
+	}
+	if feasible == 0 || feasible < params.MinAmount {
+		return 0, fmt.Errorf("not enough liquidity for the min amount %d", params.MinAmount)
+	}
+	log.Printf("%s %s", infoColor("Reducing the amount to"), formatAmt(feasible))
+	return feasible, nil
+}
+
+// pickChannelPair picks a random channel pair and the amount to rebalance, the
+// channel balances and limits are in sats so the amount is whole sats too.
+func (r *regolancer) pickChannelPair(amount, minAmount Msat,
+	relFromAmount, relToAmount float64) (from uint64, to uint64, maxAmount Msat, err error) {
 	if len(r.channelPairs) == 0 {
 		if !r.routeFound || len(r.failureCache) == 0 {
 			return 0, 0, 0, errors.New("no routes")
@@ -113,7 +345,7 @@ func (r *regolancer) pickChannelPair(amount, minAmount int64,
 		log.Print(errColor("No channel pairs left, expiring all failed routes"))
 		// expire all failed routes
 		for k, v := range r.failureCache {
-			r.channelPairs[k] = v.channelPair
+			r.restorePair(k, v.channelPair)
 			delete(r.failureCache, k)
 		}
 
@@ -122,67 +354,321 @@ func (r *regolancer) pickChannelPair(amount, minAmount int64,
 	}
 	var fromChan, toChan *lnrpc.Channel
 
-	idx := rand.Int31n(int32(len(r.channelPairs)))
-
-	var pair [2]*lnrpc.Channel
-	for _, pair = range r.channelPairs {
-		if idx == 0 {
-			break
-		}
-		idx--
+	pairs := r.sourceBalancedPairs()
+	if len(pairs) == 0 {
+		return 0, 0, 0, ErrPairsBusy
 	}
+	pair := r.pickWeightedPair(pairs)
 	fromChan = pair[0]
 	toChan = pair[1]
 	maxFrom := fromChan.LocalBalance
 	if relFromAmount > 0 {
 		maxFrom = min(maxFrom, int64(float64(fromChan.Capacity)*relFromAmount)-fromChan.RemoteBalance)
 	}
+	if rule, ok := r.sourceRules[fromChan.ChanId]; ok {
+		maxFrom = min(maxFrom, rule.maxAmount(fromChan.LocalBalance, fromChan.Capacity))
+	}
 	maxTo := toChan.RemoteBalance
 	if relToAmount > 0 {
 		maxTo = min(maxTo, int64(float64(toChan.Capacity)*relToAmount)-toChan.LocalBalance)
 	}
+	var maxSats int64
 	if amount == 0 {
-		maxAmount = min(maxFrom, maxTo)
+		maxSats = min(maxFrom, maxTo)
 	} else {
-		maxAmount = min(maxFrom, maxTo, amount)
+		maxSats = min(maxFrom, maxTo, amount.sats())
+	}
+	maxSats = r.goalAmount(toChan.ChanId, maxSats)
+	maxSats, err = r.dailyCapAmount(toChan.ChanId, maxSats)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if maxSats == 0 {
+		r.addFailedRoute(fromChan.ChanId, toChan.ChanId, failNoAmount, 0)
+		return r.pickChannelPair(amount, minAmount, relFromAmount, relToAmount)
+	}
+	for _, c := range []struct {
+		channel  *lnrpc.Channel
+		incoming bool
+		name     string
+	}{{fromChan, false, "source"}, {toChan, true, "target"}} {
+		limit := pendingLimit(c.channel, c.incoming)
+		if limit == 0 || maxSats <= limit {
+			continue
+		}
+		if satToMsat(limit) < minAmount {
+			log.Printf("Max pending amount %s of %s channel %s is below the min amount, skipping it",
+				hiWhiteColor(limit), c.name, hiWhiteColor(c.channel.ChanId))
+			r.addFailedRoute(fromChan.ChanId, toChan.ChanId, failPendingLimit, c.channel.ChanId)
+			return r.pickChannelPair(amount, minAmount, relFromAmount, relToAmount)
+		}
+		log.Printf("Amount %s capped to %s by the max pending amount of %s channel %s", hiWhiteColor(maxSats),
+			hiWhiteColor(limit), c.name, hiWhiteColor(c.channel.ChanId))
+		maxSats = limit
+	}
+	if params.StrictHeadroom {
+		for _, c := range []struct {
+			channel  *lnrpc.Channel
+			perc     int64
+			incoming bool
+			name     string
+		}{{fromChan, r.fromPerc, false, "source"}, {toChan, r.toPerc, true, "target"}} {
+			if maxSats <= headroom(c.channel, c.perc, c.incoming) {
+				continue
+			}
+			log.Printf("Amount %s would move %s channel %s past %s%%, skipping it", hiWhiteColor(maxSats),
+				c.name, hiWhiteColor(c.channel.ChanId), hiWhiteColor(c.perc))
+			r.addFailedRoute(fromChan.ChanId, toChan.ChanId, failHeadroom, c.channel.ChanId)
+			return r.pickChannelPair(amount, minAmount, relFromAmount, relToAmount)
+		}
 	}
-	if maxAmount < minAmount {
-		r.addFailedRoute(fromChan.ChanId, toChan.ChanId)
+	if satToMsat(maxSats) < minAmount {
+		r.addFailedRoute(fromChan.ChanId, toChan.ChanId, failBelowMinAmount, 0)
 		return r.pickChannelPair(amount, minAmount, relFromAmount, relToAmount)
 	}
+	r.expireFailedRoutes()
+	r.expireSoftFailures()
+	return fromChan.ChanId, toChan.ChanId, satToMsat(maxSats), nil
+}
+
+// privateTargetHints returns the route hint with the peer policy of our
+// private target channel as it's not announced to the graph. The result is nil
+// for the public channels.
+func (r *regolancer) privateTargetHints(ctx context.Context, to uint64) []*lnrpc.RouteHint {
+	c := r.findChannel(to)
+	if c == nil || !c.Private {
+		return nil
+	}
+	edge, err := r.getChanInfo(ctx, to)
+	if err != nil {
+		logErrorF("Error getting private target channel %d info: %s", to, err)
+		return nil
+	}
+	policy := edge.Node1Policy
+	if edge.Node2Pub == c.RemotePubkey {
+		policy = edge.Node2Policy
+	}
+	if policy == nil {
+		return nil
+	}
+	return []*lnrpc.RouteHint{{HopHints: []*lnrpc.HopHint{{
+		NodeId:                    c.RemotePubkey,
+		ChanId:                    to,
+		FeeBaseMsat:               uint32(policy.FeeBaseMsat),
+		FeeProportionalMillionths: uint32(policy.FeeRateMilliMsat),
+		CltvExpiryDelta:           policy.TimeLockDelta,
+	}}}}
+}
+
+func (r *regolancer) findChannel(chanId uint64) *lnrpc.Channel {
+	for _, c := range r.channels {
+		if c.ChanId == chanId {
+			return c
+		}
+	}
+	return nil
+}
+
+// adjustBalances updates the cached balances of the source and target channels
+// after a successful payment, the source channel also pays the fees.
+func (r *regolancer) adjustBalances(route *lnrpc.Route) {
+	if len(route.Hops) == 0 {
+		return
+	}
+	if from := r.findChannel(route.Hops[0].ChanId); from != nil {
+		// round against us on both sides so that the cached balances never
+		// overstate what can be sent
+		paid := Msat(route.TotalAmtMsat).satsCeil()
+		from.LocalBalance -= paid
+		from.RemoteBalance += paid
+	}
+	if to := r.findChannel(route.Hops[len(route.Hops)-1].ChanId); to != nil {
+		amount := Msat(route.TotalAmtMsat - route.TotalFeesMsat).sats()
+		to.LocalBalance += amount
+		to.RemoteBalance -= amount
+	}
+}
+
+// fitSourceFloor makes sure that the source channel remote balance doesn't
+// exceed --rel-amount-from after paying the amount and the route fee. If it
+// would, the amount is decreased by the difference and the route is rebuilt.
+func (r *regolancer) fitSourceFloor(ctx context.Context, route *lnrpc.Route, amount Msat) (*lnrpc.Route, Msat, error) {
+	if params.RelAmountFrom == 0 || len(route.Hops) == 0 {
+		return route, amount, nil
+	}
+	from := r.findChannel(route.Hops[0].ChanId)
+	if from == nil {
+		return route, amount, nil
+	}
+	// the balances are in sats, the fee is rounded up so that the amount stays
+	// in whole sats
+	room := satToMsat(int64(float64(from.Capacity)*params.RelAmountFrom) - from.RemoteBalance)
+	fee := satToMsat(Msat(route.TotalFeesMsat).satsCeil())
+	if amount+fee <= room {
+		return route, amount, nil
+	}
+	newAmount := room - fee
+	if newAmount <= 0 || newAmount < satToMsat(params.MinAmount) {
+		return nil, 0, fmt.Errorf("source channel %d can't fit %d sats with %d sats fee", from.ChanId, amount.sats(),
+			fee.sats())
+	}
+	log.Printf("Decreasing amount to %s to account for the %s sat fee paid from the source channel",
+		hiWhiteColor(newAmount.sats()), formatFee(Msat(route.TotalFeesMsat)))
+	route, err := r.rebuildRoute(ctx, route, newAmount)
+	if err != nil {
+		return nil, 0, err
+	}
+	return route, newAmount, nil
+}
+
+// pendingLimit returns the max amount in sats that can be pending in the
+// channel in the specified direction according to the channel constraints
+// negotiated on opening. The HTLCs offered by the peer are limited by our
+// constraints and the HTLCs we offer are limited by the peer's ones.
+func pendingLimit(c *lnrpc.Channel, incoming bool) int64 {
+	constraints := c.RemoteConstraints
+	if incoming {
+		constraints = c.LocalConstraints
+	}
+	if constraints == nil {
+		return 0
+	}
+	return Msat(constraints.MaxPendingAmtMsat).sats()
+}
+
+// sourceBalancedPairs returns the channel pairs except the ones with sources
+// that already contributed more than --max-source-usage-perc of the total
+// amount in this session. If all sources are over the limit, all pairs are
+// returned. The pairs with the channels used by other workers are skipped.
+func (r *regolancer) sourceBalancedPairs() [][2]*lnrpc.Channel {
+	all := [][2]*lnrpc.Channel{}
+	balanced := [][2]*lnrpc.Channel{}
+	for _, pair := range r.channelPairs {
+		if r.channelBusy(pair[0].ChanId) || r.channelBusy(pair[1].ChanId) {
+			continue
+		}
+		all = append(all, pair)
+		if params.MaxSourceUsagePerc == 0 || r.totalAmountMsat == 0 ||
+			int64(r.sourceUsage[pair[0].ChanId]*100/r.totalAmountMsat) <= params.MaxSourceUsagePerc {
+			balanced = append(balanced, pair)
+		}
+	}
+	if len(balanced) == 0 {
+		return all
+	}
+	return balanced
+}
+
+// restorePair returns the pair from the failure cache to the candidates.
+func (r *regolancer) restorePair(k string, pair [2]*lnrpc.Channel) {
+	if pair[0] == nil || pair[1] == nil {
+		return
+	}
+	r.channelPairs[k] = pair
+}
+
+// expireFailedRoutes returns the expired failed routes back to the channel
+// pairs.
+func (r *regolancer) expireFailedRoutes() {
 	for k, v := range r.failureCache {
-		if v.expiration.Before(time.Now()) {
-			r.channelPairs[k] = v.channelPair
+		if v.expiration.Before(r.now()) {
+			r.restorePair(k, v.channelPair)
 			delete(r.failureCache, k)
+			r.failureCacheStats.expired++
 		}
 	}
-	return fromChan.ChanId, toChan.ChanId, maxAmount, nil
 }
 
-func (r *regolancer) addFailedRoute(from, to uint64) {
-	t := time.Now().Add(time.Minute * 5)
+const (
+	failNoRoute         = "no_route"
+	failNotEnoughRoutes = "not_enough_routes"
+	failNoAmount        = "no_amount"
+	failBelowMinAmount  = "below_min_amount"
+	failPendingLimit    = "pending_limit"
+	failHeadroom        = "headroom"
+	failDryRun          = "dry_run"
+	failHubCooling      = "hub_cooling"
+)
+
+// failReason tells why the channel pair was put in the failure cache, chanId
+// is the channel that caused the failure if it's known.
+type failReason struct {
+	code   string
+	chanId uint64
+	time   time.Time
+}
+
+func (f failReason) String() string {
+	if f.chanId == 0 {
+		return f.code
+	}
+	return fmt.Sprintf("%s at %s", f.code, formatScid(f.chanId))
+}
+
+func (r *regolancer) addFailedRoute(from, to uint64, code string, chanId uint64) {
+	r.addFailedRouteTTL(from, to, time.Minute*time.Duration(params.FailedRouteTTL), code, chanId)
+}
+
+func (r *regolancer) addFailedRouteTTL(from, to uint64, ttl time.Duration, code string, chanId uint64) {
+	if params.SoftFailureDecay && softFailureCode(code) && r.addSoftFailure(from, to, code, chanId) {
+		return
+	}
+	now := r.now()
+	t := now.Add(ttl)
 	k := formatChannelPair(from, to)
-	r.failureCache[k] = failedRoute{channelPair: r.channelPairs[k], expiration: &t}
-	delete(r.channelPairs, k)
+	reason := failReason{code: code, chanId: chanId, time: now}
+	pair, ok := r.channelPairs[k]
+	if prev, cached := r.failureCache[k]; !ok && cached {
+		// the pair is already in the failure cache (cooled or failed by
+		// another worker), keep it there until the later expiration
+		pair, ok = prev.channelPair, true
+		if prev.expiration.After(t) {
+			t = *prev.expiration
+		}
+	}
+	if ok {
+		r.failureCache[k] = failedRoute{channelPair: pair, expiration: &t, reason: reason}
+		delete(r.channelPairs, k)
+	}
+	if r.failureCacheStats.reasons == nil {
+		r.failureCacheStats.reasons = map[string]int{}
+	}
+	r.failureCacheStats.reasons[code]++
+	r.tallyRouteFailure(from, to, code)
+	log.Print(faintWhiteColor(fmt.Sprintf("Skipping %s → %s: %s, expires in %s", formatScid(from), formatScid(to),
+		reason, ttl.Round(time.Second))))
+	if len(r.failureCache) <= params.FailureCacheSize {
+		return
+	}
+	// evict the route that expires first
+	oldest := ""
+	for k, v := range r.failureCache {
+		if oldest == "" || v.expiration.Before(*r.failureCache[oldest].expiration) {
+			oldest = k
+		}
+	}
+	r.restorePair(oldest, r.failureCache[oldest].channelPair)
+	delete(r.failureCache, oldest)
+	r.failureCacheStats.evicted++
 }
 
-func parseScid(chanId string) int64 {
+func parseScid(chanId string) (int64, error) {
 
 	elements := strings.Split(strings.ToLower(chanId), "x")
 
 	blockHeight, err := strconv.ParseInt(elements[0], 10, 24)
 	if err != nil {
-		log.Fatalf("error: not able to parse Blockheight of ShortChannelID %s, %s ", chanId, err)
+		return 0, fmt.Errorf("not able to parse Blockheight of ShortChannelID %s, %s", chanId, err)
 	}
 	txIndex, err := strconv.ParseInt(elements[1], 10, 24)
 	if err != nil {
-		log.Fatalf("error: not able to parse TxIndex of ShortChannelID %s, %s ", chanId, err)
+		return 0, fmt.Errorf("not able to parse TxIndex of ShortChannelID %s, %s", chanId, err)
 
 	}
 	txPosition, err := strconv.ParseInt(elements[2], 10, 32)
 
 	if err != nil {
-		log.Fatalf("error: not able to parse txPosition of ShortChannelID %s, %s ", chanId, err)
+		return 0, fmt.Errorf("not able to parse txPosition of ShortChannelID %s, %s", chanId, err)
 
 	}
 
@@ -191,6 +677,23 @@ func parseScid(chanId string) int64 {
 	scId.TxIndex = uint32(txIndex)
 	scId.TxPosition = uint16(txPosition)
 
-	return int64(scId.ToUint64())
+	return int64(scId.ToUint64()), nil
 
 }
+
+// printCandidates lists the selected source and target channels for
+// --list-candidates.
+func (r *regolancer) printCandidates(ctx context.Context) {
+	for _, side := range []struct {
+		name     string
+		channels []*lnrpc.Channel
+	}{{"Source", r.fromChannels}, {"Target", r.toChannels}} {
+		log.Printf("%s candidates: %s", side.name, hiWhiteColor(len(side.channels)))
+		for _, c := range side.channels {
+			log.Printf("  %s %s local %s, remote %s (%s local)", liquidityBar(c), r.channelLabel(ctx, c.ChanId),
+				formatAmt(c.LocalBalance), formatAmt(c.RemoteBalance),
+				hiWhiteColorF("%.1f%%", float64(c.LocalBalance)*100/float64(c.Capacity)))
+		}
+	}
+	log.Printf("Channel pairs: %s", hiWhiteColor(len(r.channelPairs)))
+}
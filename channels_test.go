@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+func TestParseAllKeyword(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ids      []string
+		expected []string
+		err      bool
+	}{
+		{"empty", nil, nil, false},
+		{"ids", []string{"1", "2"}, []string{"1", "2"}, false},
+		{"all", []string{"all"}, nil, false},
+		{"all uppercase", []string{"ALL"}, nil, false},
+		{"all with ids", []string{"1", "all"}, nil, true},
+	} {
+		result, err := parseAllKeyword(tc.ids)
+		if (err != nil) != tc.err || !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("%s: expected %v, error %t, got %v, %v", tc.name, tc.expected, tc.err, result, err)
+		}
+	}
+}
+
+// TestChannelCandidates checks which channels are selected for the source and
+// target lists and percentages. The channels have 90%, 60%, 30% and 10% of
+// local balance.
+func TestChannelCandidates(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	channels := []*lnrpc.Channel{}
+	for i, local := range []int64{900000, 600000, 300000, 100000} {
+		channels = append(channels, &lnrpc.Channel{ChanId: uint64(i + 1), RemotePubkey: testPK(i + 1),
+			Capacity: 1000000, LocalBalance: local, RemoteBalance: 1000000 - local})
+	}
+	for _, tc := range []struct {
+		name        string
+		from        []string
+		to          []string
+		pfrom       int64
+		pto         int64
+		pfromStrict int64
+		ptoStrict   int64
+		err         bool
+		sources     []uint64
+		targets     []uint64
+	}{
+		{name: "empty lists", sources: []uint64{1, 2}, targets: []uint64{3, 4}},
+		{name: "all", from: []string{"all"}, to: []string{"ALL"}, sources: []uint64{1, 2}, targets: []uint64{3, 4}},
+		{name: "all with percentages", from: []string{"all"}, to: []string{"all"}, pfrom: 20, pto: 20,
+			sources: []uint64{1}, targets: []uint64{4}},
+		{name: "all with ids", from: []string{"all", "1"}, err: true},
+		{name: "all with target ids", to: []string{"3", "all"}, err: true},
+		// the listed channels are still checked against pfrom and pto
+		{name: "ids", from: []string{"2", "3"}, to: []string{"3"}, sources: []uint64{2}, targets: []uint64{3}},
+		{name: "ids with percentages", from: []string{"2", "3"}, to: []string{"2", "3"}, pfrom: 80, pto: 70,
+			sources: []uint64{2, 3}, targets: []uint64{2, 3}},
+		{name: "strict with ids", from: []string{"2", "3"}, to: []string{"2", "3"}, pfromStrict: 80,
+			ptoStrict: 70, sources: []uint64{2, 3}, targets: []uint64{2, 3}},
+		// pfrom and pto still apply to the other direction
+		{name: "strict sources only", from: []string{"3"}, pfromStrict: 80, sources: []uint64{3},
+			targets: []uint64{3, 4}},
+		{name: "strict targets only", to: []string{"2"}, ptoStrict: 70, sources: []uint64{1, 2},
+			targets: []uint64{2}},
+		{name: "strict without sources", pfromStrict: 80, err: true},
+		{name: "strict without targets", ptoStrict: 70, err: true},
+		{name: "strict with all", from: []string{"all"}, pfromStrict: 80, err: true},
+	} {
+		params = configParams{From: tc.from, To: tc.to, FromPerc: tc.pfrom, ToPerc: tc.pto,
+			FromPercStrict: tc.pfromStrict, ToPercStrict: tc.ptoStrict, Amount: 100000}
+		err := preflightChecks(&params)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected preflight result %v", tc.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		r := &regolancer{channels: channels, channelPairs: map[string][2]*lnrpc.Channel{}}
+		if len(params.From) > 0 {
+			r.fromChannelId, _, _ = parseNodeChannelIDs(params.From)
+		}
+		if len(params.To) > 0 {
+			r.toChannelId, _, _ = parseNodeChannelIDs(params.To)
+		}
+		if err := r.getChannelCandidates(params.FromPerc, params.ToPerc, params.Amount); err != nil {
+			t.Fatal(err)
+		}
+		ids := func(chans []*lnrpc.Channel) []uint64 {
+			result := []uint64{}
+			for _, c := range chans {
+				result = append(result, c.ChanId)
+			}
+			return result
+		}
+		if sources := ids(r.fromChannels); !reflect.DeepEqual(sources, tc.sources) {
+			t.Errorf("%s: expected the sources %v, got %v", tc.name, tc.sources, sources)
+		}
+		if targets := ids(r.toChannels); !reflect.DeepEqual(targets, tc.targets) {
+			t.Errorf("%s: expected the targets %v, got %v", tc.name, tc.targets, targets)
+		}
+	}
+}
+
+// failureCacheTest creates the pairs 1 → 101, 2 → 102 and so on.
+func failureCacheTest(now *time.Time, pairs uint64) *regolancer {
+	r := &regolancer{
+		channelPairs: map[string][2]*lnrpc.Channel{},
+		failureCache: map[string]failedRoute{},
+		clock:        func() time.Time { return *now },
+	}
+	for i := uint64(1); i <= pairs; i++ {
+		from := &lnrpc.Channel{ChanId: i, LocalBalance: 1000000, RemoteBalance: 1000000, Capacity: 2000000}
+		to := &lnrpc.Channel{ChanId: i + 100, LocalBalance: 1000000, RemoteBalance: 1000000, Capacity: 2000000}
+		r.channelPairs[formatChannelPair(from.ChanId, to.ChanId)] = [2]*lnrpc.Channel{from, to}
+	}
+	return r
+}
+
+func TestFailureCacheExpiry(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FailedRouteTTL, params.FailureCacheSize, params.SoftFailureDecay = 5, 1000, false
+	now := time.Unix(1700000000, 0)
+	r := failureCacheTest(&now, 3)
+	r.addFailedRoute(1, 101, failNoRoute, 0)
+	r.addFailedRouteTTL(2, 102, time.Minute*10, failNoAmount, 0)
+	// the pair failed again with a shorter expiration keeps the longer one
+	r.addFailedRouteTTL(2, 102, time.Minute, failNoRoute, 0)
+	if len(r.failureCache) != 2 || len(r.channelPairs) != 1 {
+		t.Fatalf("expected 2 failed pairs and 1 candidate, got %d and %d", len(r.failureCache), len(r.channelPairs))
+	}
+	if exp := r.failureCache[formatChannelPair(2, 102)].expiration; !exp.Equal(now.Add(time.Minute * 10)) {
+		t.Errorf("the later expiration should be kept, got %s", exp)
+	}
+	// the failed pairs are skipped until they expire
+	for i := 0; i < 20; i++ {
+		if from, _, _, err := r.pickChannelPair(satToMsat(1000), 0, 0, 0); err != nil || from != 3 {
+			t.Fatalf("expected the pair 3, got %d, %v", from, err)
+		}
+	}
+	now = now.Add(time.Minute*5 + time.Second)
+	r.pickChannelPair(satToMsat(1000), 0, 0, 0)
+	if _, ok := r.channelPairs[formatChannelPair(1, 101)]; !ok || len(r.failureCache) != 1 ||
+		r.failureCacheStats.expired != 1 {
+		t.Errorf("the pair 1 should expire, failure cache %v, stats %+v", r.failureCache, r.failureCacheStats)
+	}
+	now = now.Add(time.Minute * 5)
+	r.expireFailedRoutes()
+	if len(r.channelPairs) != 3 || len(r.failureCache) != 0 || r.failureCacheStats.expired != 2 {
+		t.Errorf("all pairs should be back, failure cache %v, stats %+v", r.failureCache, r.failureCacheStats)
+	}
+	if r.failureCacheStats.reasons[failNoRoute] != 2 || r.failureCacheStats.reasons[failNoAmount] != 1 {
+		t.Errorf("unexpected failure reasons %v", r.failureCacheStats.reasons)
+	}
+}
+
+func TestFailureCacheEviction(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FailedRouteTTL, params.FailureCacheSize, params.SoftFailureDecay = 5, 2, false
+	now := time.Unix(1700000000, 0)
+	r := failureCacheTest(&now, 4)
+	r.addFailedRouteTTL(1, 101, time.Minute*3, failNoRoute, 0)
+	r.addFailedRouteTTL(2, 102, time.Minute, failNoRoute, 0)
+	r.addFailedRouteTTL(3, 103, time.Minute*2, failNoRoute, 0)
+	// the pair expiring first is evicted and can be picked again
+	if _, ok := r.failureCache[formatChannelPair(2, 102)]; ok || len(r.failureCache) != 2 ||
+		r.failureCacheStats.evicted != 1 {
+		t.Errorf("the pair 2 should be evicted, failure cache %v, stats %+v", r.failureCache, r.failureCacheStats)
+	}
+	if _, ok := r.channelPairs[formatChannelPair(2, 102)]; !ok || len(r.channelPairs) != 2 {
+		t.Errorf("the evicted pair should be a candidate again, got %v", r.channelPairs)
+	}
+}
+
+func TestFailureCacheExhausted(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FailedRouteTTL, params.FailureCacheSize, params.SoftFailureDecay = 5, 1000, false
+	now := time.Unix(1700000000, 0)
+	r := failureCacheTest(&now, 2)
+	r.addFailedRoute(1, 101, failNoRoute, 0)
+	r.addFailedRoute(2, 102, failNoRoute, 0)
+	if _, _, _, err := r.pickChannelPair(satToMsat(1000), 0, 0, 0); err == nil {
+		t.Error("no routes were found, the session should stop")
+	}
+	// all failed pairs are tried again if any route was found
+	r.routeFound = true
+	if _, _, _, err := r.pickChannelPair(satToMsat(1000), 0, 0, 0); err != nil || len(r.failureCache) != 0 ||
+		len(r.channelPairs) != 2 || r.routeFound {
+		t.Errorf("all pairs should be restored, got %v, failure cache %v", err, r.failureCache)
+	}
+}
+
+func TestAdjustBalances(t *testing.T) {
+	from := &lnrpc.Channel{ChanId: 1, Capacity: 1000000, LocalBalance: 600000, RemoteBalance: 400000}
+	to := &lnrpc.Channel{ChanId: 2, Capacity: 1000000, LocalBalance: 100000, RemoteBalance: 900000}
+	r := &regolancer{channels: []*lnrpc.Channel{from, to}}
+	r.adjustBalances(testRoute(1, 2, 1000000, 500, testPK(1), testPeerPK))
+	// the source pays the fee rounded up, the target gets the amount rounded
+	// down
+	if from.LocalBalance != 598999 || from.RemoteBalance != 401001 {
+		t.Errorf("unexpected source balances %d/%d", from.LocalBalance, from.RemoteBalance)
+	}
+	if to.LocalBalance != 101000 || to.RemoteBalance != 899000 {
+		t.Errorf("unexpected target balances %d/%d", to.LocalBalance, to.RemoteBalance)
+	}
+}
+
+// TestFitSourceFloor checks that the last chunk leaves the source channel at
+// --rel-amount-from after the fee is paid.
+func TestFitSourceFloor(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.RelAmountFrom, params.MinAmount = 0.5, 0
+	const feeMsat = 2000001
+	built := []int64{}
+	r := &regolancer{myPK: testMyPK, routerClient: &fakeRouter{
+		build: func(req *routerrpc.BuildRouteRequest) (*lnrpc.Route, error) {
+			built = append(built, req.AmtMsat)
+			return testRoute(req.OutgoingChanId, 2, req.AmtMsat, feeMsat, testPK(1), testPeerPK), nil
+		}}}
+	newSource := func() *lnrpc.Channel {
+		return &lnrpc.Channel{ChanId: 1, Capacity: 1000000, LocalBalance: 600000, RemoteBalance: 400000}
+	}
+	r.channels = []*lnrpc.Channel{newSource()}
+	// the amount and the fee fit
+	route := testRoute(1, 2, 90000000, feeMsat, testPK(1), testPeerPK)
+	if result, amount, err := r.fitSourceFloor(context.Background(), route, satToMsat(90000)); err != nil ||
+		result != route || amount != satToMsat(90000) || len(built) != 0 {
+		t.Errorf("the route should be kept, got %d msat, error %v", amount, err)
+	}
+	// the fee would push the source below the floor
+	route = testRoute(1, 2, 99000000, feeMsat, testPK(1), testPeerPK)
+	result, amount, err := r.fitSourceFloor(context.Background(), route, satToMsat(99000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount != satToMsat(97999) || len(built) != 1 || built[0] != int64(amount) ||
+		result.TotalAmtMsat-result.TotalFeesMsat != int64(amount) {
+		t.Fatalf("the amount should be decreased to 97999 sats, got %d msat, built %v", amount, built)
+	}
+	r.adjustBalances(result)
+	if source := r.channels[0]; source.RemoteBalance > 500000 || source.LocalBalance < 500000 {
+		t.Errorf("the source channel should stay at the floor, got %d/%d", source.LocalBalance, source.RemoteBalance)
+	}
+	// the decreased amount is below the min amount
+	r.channels = []*lnrpc.Channel{newSource()}
+	params.MinAmount = 99000
+	if _, _, err := r.fitSourceFloor(context.Background(), route, satToMsat(99000)); err == nil {
+		t.Error("the amount below --min-amount should fail")
+	}
+	// no floor
+	params.RelAmountFrom = 0
+	if result, amount, err := r.fitSourceFloor(context.Background(), route, satToMsat(99000)); err != nil ||
+		result != route || amount != satToMsat(99000) {
+		t.Errorf("the route should be kept without the floor, got %d msat, error %v", amount, err)
+	}
+}
+
+// sourceUsageTest creates the pairs from the sources 1..sources to the target
+// 101.
+func sourceUsageTest(sources uint64) *regolancer {
+	r := &regolancer{channelPairs: map[string][2]*lnrpc.Channel{}, sourceUsage: map[uint64]Msat{}}
+	to := &lnrpc.Channel{ChanId: 101, LocalBalance: 1000000, RemoteBalance: 1000000, Capacity: 2000000}
+	for i := uint64(1); i <= sources; i++ {
+		from := &lnrpc.Channel{ChanId: i, LocalBalance: 1000000, RemoteBalance: 1000000, Capacity: 2000000}
+		r.channelPairs[formatChannelPair(i, to.ChanId)] = [2]*lnrpc.Channel{from, to}
+	}
+	return r
+}
+
+func TestSourceBalancedPairs(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	for _, tc := range []struct {
+		name     string
+		sources  uint64
+		limit    int64
+		usage    map[uint64]Msat
+		expected []uint64
+	}{
+		{"no limit", 3, 0, map[uint64]Msat{1: 100}, []uint64{1, 2, 3}},
+		{"nothing paid yet", 3, 50, map[uint64]Msat{}, []uint64{1, 2, 3}},
+		{"over the limit", 3, 50, map[uint64]Msat{1: 60, 2: 40}, []uint64{2, 3}},
+		{"at the limit", 3, 50, map[uint64]Msat{1: 50, 2: 50}, []uint64{1, 2, 3}},
+		{"all over the limit", 2, 30, map[uint64]Msat{1: 60, 2: 40}, []uint64{1, 2}},
+	} {
+		params.MaxSourceUsagePerc = tc.limit
+		r := sourceUsageTest(tc.sources)
+		r.sourceUsage = tc.usage
+		for _, u := range tc.usage {
+			r.totalAmountMsat += u
+		}
+		sources := []uint64{}
+		for _, pair := range r.sourceBalancedPairs() {
+			sources = append(sources, pair[0].ChanId)
+		}
+		sort.Slice(sources, func(i, j int) bool { return sources[i] < sources[j] })
+		if !reflect.DeepEqual(sources, tc.expected) {
+			t.Errorf("%s: expected sources %v, got %v", tc.name, tc.expected, sources)
+		}
+	}
+}
+
+// TestMaxSourceUsage simulates a session with many sources, none of them
+// should contribute more than the limit and one chunk.
+func TestMaxSourceUsage(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MaxSourceUsagePerc = 30
+	rand.Seed(1)
+	const chunks = 100
+	r := sourceUsageTest(4)
+	for i := 0; i < chunks; i++ {
+		from, _, _, err := r.pickChannelPair(satToMsat(1000), 0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.totalAmountMsat > 0 && int64(r.sourceUsage[from]*100/r.totalAmountMsat) > params.MaxSourceUsagePerc {
+			t.Fatalf("picked source %d over the limit at chunk %d: %v", from, i, r.sourceUsage)
+		}
+		r.sourceUsage[from] += satToMsat(1000)
+		r.totalAmountMsat += satToMsat(1000)
+	}
+	for chanId := uint64(1); chanId <= 4; chanId++ {
+		share := r.sourceUsage[chanId] * 100 / r.totalAmountMsat
+		if share == 0 || int64(share) > params.MaxSourceUsagePerc+100/chunks {
+			t.Errorf("source %d contributed %d%%", chanId, share)
+		}
+	}
+}
+
+func TestParseNodeChannelIDs(t *testing.T) {
+	pk := "03" + strings.Repeat("ab", 32)
+	pkBytes, _ := hex.DecodeString(pk)
+	digits := "02" + strings.Repeat("1", 64)
+	digitsBytes, _ := hex.DecodeString(digits)
+	scid := uint64(800000<<40 | 1234<<16 | 1)
+	for _, tc := range []struct {
+		id     string
+		chanId uint64
+		node   []byte
+		err    string
+	}{
+		{id: "123456789", chanId: 123456789},
+		{id: "800000x1234x1", chanId: scid},
+		{id: "800000X1234X1", chanId: scid},
+		{id: " 800000x1234x1 ", chanId: scid},
+		{id: pk, node: pkBytes},
+		{id: strings.ToUpper(pk), node: pkBytes},
+		{id: pk + "@127.0.0.1:9735", node: pkBytes},
+		{id: strings.ToUpper(pk) + "@[::1]:9735", node: pkBytes},
+		{id: " " + pk + " ", node: pkBytes},
+		// all digits but the length of a node id
+		{id: digits, node: digitsBytes},
+		{id: "800000x1234", err: "invalid channel id"},
+		{id: "800000x1234x1x1", err: "invalid channel id"},
+		{id: "99999999x1x1", err: "invalid channel id 99999999x1x1: not able to parse Blockheight"},
+		{id: pk[:64], err: "expected 66 hex characters, got 64"},
+		{id: pk[:64] + "zz", err: "not a hex string"},
+		{id: "04" + pk[2:], err: "expected it to start with 02 or 03"},
+		{id: "", err: "expected 66 hex characters, got 0"},
+	} {
+		chans, nodes, err := parseNodeChannelIDs([]string{tc.id})
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: expected error %q, got %v", tc.id, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", tc.id, err)
+			continue
+		}
+		if tc.node != nil && (len(nodes) != 1 || !bytes.Equal(nodes[0], tc.node) || len(chans) != 0) {
+			t.Errorf("%q: expected node %x, got %x, channels %v", tc.id, tc.node, nodes, chans)
+		}
+		if _, ok := chans[tc.chanId]; tc.node == nil && (!ok || len(chans) != 1 || len(nodes) != 0) {
+			t.Errorf("%q: expected channel %d, got %v, nodes %x", tc.id, tc.chanId, chans, nodes)
+		}
+	}
+}
+
+func TestHeadroom(t *testing.T) {
+	c := &lnrpc.Channel{Capacity: 1000000, LocalBalance: 400000, RemoteBalance: 550000}
+	if h := headroom(c, 50, true); h != 100000 {
+		t.Errorf("expected 100000 sats to receive, got %d", h)
+	}
+	if h := headroom(c, 50, false); h != -50000 {
+		t.Errorf("expected -50000 sats to send, got %d", h)
+	}
+}
+
+// TestStrictHeadroom checks the amounts around the one that brings the
+// channel exactly to pfrom or pto.
+func TestStrictHeadroom(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.StrictHeadroom, params.FailedRouteTTL, params.FailureCacheSize = true, 5, 1000
+	for _, tc := range []struct {
+		name         string
+		sourceRemote int64
+		targetLocal  int64
+		amount       int64
+		ok           bool
+	}{
+		{"target reaches pto", 300000, 400000, 100000, true},
+		{"target past pto", 300000, 400000, 100001, false},
+		{"source reaches pfrom", 400000, 300000, 100000, true},
+		{"source past pfrom", 400000, 300000, 100001, false},
+		{"both reach the limits", 400000, 400000, 100000, true},
+	} {
+		now := time.Now()
+		r := failureCacheTest(&now, 0)
+		r.fromPerc, r.toPerc = 50, 50
+		from := &lnrpc.Channel{ChanId: 1, Capacity: 1000000, LocalBalance: 1000000 - tc.sourceRemote,
+			RemoteBalance: tc.sourceRemote}
+		to := &lnrpc.Channel{ChanId: 2, Capacity: 1000000, LocalBalance: tc.targetLocal,
+			RemoteBalance: 1000000 - tc.targetLocal}
+		r.channelPairs[formatChannelPair(1, 2)] = [2]*lnrpc.Channel{from, to}
+		_, _, maxAmount, err := r.pickChannelPair(satToMsat(tc.amount), 0, 0, 0)
+		if tc.ok && (err != nil || maxAmount != satToMsat(tc.amount)) {
+			t.Errorf("%s: expected %d sats, got %d msat, error %v", tc.name, tc.amount, maxAmount, err)
+		}
+		if !tc.ok && (err == nil || r.failureCache[formatChannelPair(1, 2)].reason.code != failHeadroom) {
+			t.Errorf("%s: the pair should be skipped, got %v, failure cache %v", tc.name, err, r.failureCache)
+		}
+	}
+}
+
+func TestSpendableReceivable(t *testing.T) {
+	for _, tc := range []struct {
+		channel    *lnrpc.Channel
+		spendable  int64
+		receivable int64
+	}{
+		{&lnrpc.Channel{LocalBalance: 1000, RemoteBalance: 2000}, 1000, 2000},
+		{&lnrpc.Channel{LocalBalance: 1000, RemoteBalance: 2000,
+			LocalConstraints:  &lnrpc.ChannelConstraints{ChanReserveSat: 100},
+			RemoteConstraints: &lnrpc.ChannelConstraints{ChanReserveSat: 300}}, 900, 1700},
+		// below the reserve nothing can be moved
+		{&lnrpc.Channel{LocalBalance: 50, RemoteBalance: 200,
+			LocalConstraints:  &lnrpc.ChannelConstraints{ChanReserveSat: 100},
+			RemoteConstraints: &lnrpc.ChannelConstraints{ChanReserveSat: 300}}, 0, 0},
+	} {
+		if got := spendable(tc.channel); got != tc.spendable {
+			t.Errorf("%v: spendable %d, expected %d", tc.channel, got, tc.spendable)
+		}
+		if got := receivable(tc.channel); got != tc.receivable {
+			t.Errorf("%v: receivable %d, expected %d", tc.channel, got, tc.receivable)
+		}
+	}
+}
+
+func TestFitAmount(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	reserve := &lnrpc.ChannelConstraints{ChanReserveSat: 10000}
+	r := &regolancer{
+		fromChannels: []*lnrpc.Channel{
+			{LocalBalance: 410000, LocalConstraints: reserve},
+			{LocalBalance: 410000, LocalConstraints: reserve},
+		},
+		toChannels: []*lnrpc.Channel{
+			{RemoteBalance: 1010000, RemoteConstraints: reserve},
+		},
+	}
+	for _, tc := range []struct {
+		name      string
+		amount    int64
+		minAmount int64
+		strict    bool
+		result    int64
+		fails     bool
+	}{
+		{"fits", 500000, 0, false, 500000, false},
+		{"sources limit", 1000000, 0, false, 800000, false},
+		{"strict", 1000000, 0, true, 0, true},
+		{"strict fits", 800000, 0, true, 800000, false},
+		{"below min amount", 1000000, 900000, false, 0, true},
+		{"random amount", 0, 0, true, 0, false},
+	} {
+		params.Strict, params.MinAmount = tc.strict, tc.minAmount
+		result, err := r.fitAmount(tc.amount)
+		if result != tc.result || (err != nil) != tc.fails {
+			t.Errorf("%s: got %d, %v, expected %d, fails %v", tc.name, result, err, tc.result, tc.fails)
+		}
+	}
+	// the targets limit the amount too
+	r.toChannels[0].RemoteBalance = 310000
+	params.Strict, params.MinAmount = false, 0
+	if result, err := r.fitAmount(1000000); result != 300000 || err != nil {
+		t.Errorf("targets limit: got %d, %v, expected 300000", result, err)
+	}
+	r.toChannels[0].RemoteBalance = 0
+	if _, err := r.fitAmount(1000000); err == nil {
+		t.Error("no receivable liquidity should fail")
+	}
+}
+
+func TestPrivateChannelSelection(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	channel := func(id uint64, private bool) *lnrpc.Channel {
+		return &lnrpc.Channel{ChanId: id, RemotePubkey: testPK(int(id)), Private: private, Capacity: 1000000,
+			LocalBalance: 500000, RemoteBalance: 500000}
+	}
+	ln := &fakeLightning{channels: []*lnrpc.Channel{channel(1, false), channel(2, false), channel(3, true),
+		channel(4, true)}}
+	ids := func(channels []*lnrpc.Channel) (result []uint64) {
+		for _, c := range channels {
+			result = append(result, c.ChanId)
+		}
+		return
+	}
+	for _, tc := range []struct {
+		sources, targets bool
+		from, to         []uint64
+	}{
+		{false, false, []uint64{1, 2}, []uint64{1, 2}},
+		{true, false, []uint64{1, 2, 3, 4}, []uint64{1, 2}},
+		{false, true, []uint64{1, 2}, []uint64{1, 2, 3, 4}},
+		{true, true, []uint64{1, 2, 3, 4}, []uint64{1, 2, 3, 4}},
+	} {
+		params.PrivateSources, params.PrivateTargets = tc.sources, tc.targets
+		r := &regolancer{lnClient: ln, channelPairs: map[string][2]*lnrpc.Channel{}}
+		if err := r.getChannels(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.getChannelCandidates(100, 100, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids(r.fromChannels), tc.from) || !reflect.DeepEqual(ids(r.toChannels), tc.to) {
+			t.Errorf("private sources %v, targets %v: got sources %v and targets %v, expected %v and %v",
+				tc.sources, tc.targets, ids(r.fromChannels), ids(r.toChannels), tc.from, tc.to)
+		}
+		for _, pair := range r.channelPairs {
+			if pair[0].Private && !tc.sources || pair[1].Private && !tc.targets {
+				t.Errorf("private sources %v, targets %v: unexpected pair %d -> %d", tc.sources, tc.targets,
+					pair[0].ChanId, pair[1].ChanId)
+			}
+		}
+	}
+}
+
+func TestPrivateTargetHints(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	r, ln := newRouteTest(nil)
+	r.channels = []*lnrpc.Channel{
+		{ChanId: 2, RemotePubkey: testPeerPK, Private: true},
+		{ChanId: 3, RemotePubkey: testPK(3)},
+	}
+	ln.edges[2].Node1Policy = &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 100, TimeLockDelta: 40}
+	req, err := r.routeQuery(context.Background(), 1, 2, testPeerPK, 1000000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.RouteHints) != 1 || len(req.RouteHints[0].HopHints) != 1 {
+		t.Fatalf("expected a hop hint for the private target, got %v", req.RouteHints)
+	}
+	hint := req.RouteHints[0].HopHints[0]
+	if hint.NodeId != testPeerPK || hint.ChanId != 2 || hint.FeeBaseMsat != 1000 ||
+		hint.FeeProportionalMillionths != 100 || hint.CltvExpiryDelta != 40 {
+		t.Errorf("the hint should have the peer policy, got %v", hint)
+	}
+	if req, _ := r.routeQuery(context.Background(), 1, 3, testPK(3), 1000000, 1000); len(req.RouteHints) != 0 {
+		t.Errorf("the public target needs no hints, got %v", req.RouteHints)
+	}
+}
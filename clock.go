@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// headerClockSkew estimates the clock skew from the best block header time.
+// Blocks are always found in the past so only a local clock running behind
+// (the header seemingly coming from the future) can be detected this way.
+func headerClockSkew(headerTimestamp int64, now time.Time) time.Duration {
+	skew := time.Unix(headerTimestamp, 0).Sub(now)
+	if skew < 0 {
+		return 0
+	}
+	return skew
+}
+
+// invoiceClockSkew estimates the clock skew from the invoice creation time
+// set by lnd, it's compared to the middle of the local request time.
+func invoiceClockSkew(creationDate int64, start, end time.Time) time.Duration {
+	return time.Unix(creationDate, 0).Sub(start.Add(end.Sub(start) / 2))
+}
+
+// setClockSkew warns about a significant difference between the local and lnd
+// clocks and remembers it to extend the invoice expiry margin, a later more
+// precise estimate replaces the previous one. The skew is positive if the lnd
+// clock is ahead.
+func (r *regolancer) setClockSkew(skew time.Duration, source string) {
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs <= time.Second*time.Duration(params.MaxClockSkew) {
+		r.clockSkew = 0
+		return
+	}
+	direction := "behind"
+	if skew < 0 {
+		direction = "ahead of"
+	}
+	logErrorF("WARNING: the local clock is %s %s the lnd clock (estimated from %s), "+
+		"invoice expiry margin is extended accordingly; check time synchronization on both hosts",
+		abs.Round(time.Second), direction, source)
+	r.clockSkew = skew
+}
+
+// checkInvoiceClockSkew measures the skew using the first invoice created in
+// this session, it's more precise than the block header estimate.
+func (r *regolancer) checkInvoiceClockSkew(ctx context.Context, hash []byte, start, end time.Time) {
+	if r.invoiceSkewChecked {
+		return
+	}
+	r.invoiceSkewChecked = true
+	invoice, err := r.lnClient.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: hash})
+	if err != nil {
+		logErrorF("Error looking up invoice to check the clock skew: %s", err)
+		return
+	}
+	r.setClockSkew(invoiceClockSkew(invoice.CreationDate, start, end), "invoice creation time")
+}
+
+// invoiceExpiryMargin is the min time left before a cached invoice expires
+// for it to be reused.
+func (r *regolancer) invoiceExpiryMargin() time.Duration {
+	margin := time.Second * time.Duration(params.InvoiceExpiryMargin)
+	if r.clockSkew > 0 {
+		return margin + r.clockSkew
+	}
+	return margin - r.clockSkew
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeaderClockSkew(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	if skew := headerClockSkew(now.Add(time.Minute*5).Unix(), now); skew != time.Minute*5 {
+		t.Errorf("the header from the future means the local clock is behind, got %s", skew)
+	}
+	if skew := headerClockSkew(now.Add(-time.Minute*5).Unix(), now); skew != 0 {
+		t.Errorf("the header from the past says nothing, got %s", skew)
+	}
+}
+
+func TestInvoiceClockSkew(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	end := start.Add(time.Second * 2)
+	for _, skew := range []time.Duration{0, time.Minute * 3, -time.Minute * 3} {
+		if s := invoiceClockSkew(start.Add(time.Second+skew).Unix(), start, end); s != skew {
+			t.Errorf("expected %s skew, got %s", skew, s)
+		}
+	}
+}
+
+func TestSetClockSkew(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MaxClockSkew, params.InvoiceExpiryMargin = 120, 60
+	r := &regolancer{}
+	for _, tc := range []struct {
+		skew     time.Duration
+		expected time.Duration
+		margin   time.Duration
+	}{
+		{time.Minute, 0, time.Minute},
+		{time.Minute * 2, 0, time.Minute},
+		{time.Minute * 5, time.Minute * 5, time.Minute * 6},
+		{-time.Minute * 5, -time.Minute * 5, time.Minute * 6},
+	} {
+		r.setClockSkew(tc.skew, "test")
+		if r.clockSkew != tc.expected || r.invoiceExpiryMargin() != tc.margin {
+			t.Errorf("%s: expected %s skew and %s margin, got %s and %s", tc.skew, tc.expected, tc.margin,
+				r.clockSkew, r.invoiceExpiryMargin())
+		}
+	}
+}
+
+// TestInvoiceClockSkewInjected runs lnd with the clock ahead, the skew is
+// measured with the first invoice and extends the expiry margin.
+func TestInvoiceClockSkewInjected(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MaxClockSkew, params.InvoiceExpiryMargin = 120, 60
+	ln := &fakeLightning{clockSkew: time.Minute * 5}
+	r := &regolancer{lnClient: ln, invoiceCache: map[invoiceKey]cachedInvoice{}}
+	amount := satToMsat(1000)
+	first, err := r.createInvoice(context.Background(), amount, "rb 1->2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.clockSkew < time.Minute*5-time.Second || r.clockSkew > time.Minute*5+time.Second {
+		t.Errorf("expected about 5m skew, got %s", r.clockSkew)
+	}
+	// the invoice with 5m30s left would be reused without the skew
+	key := invoiceKey{0, amount}
+	inv := r.invoiceCache[key]
+	inv.expiration = time.Now().Add(time.Minute*5 + time.Second*30)
+	r.invoiceCache[key] = inv
+	second, err := r.createInvoice(context.Background(), amount, "rb 1->2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(second.RHash) == string(first.RHash) {
+		t.Error("the invoice should be refreshed with the extended margin")
+	}
+	if ln.lookups != 1 {
+		t.Errorf("the skew should be measured once, got %d lookups", ln.lookups)
+	}
+}
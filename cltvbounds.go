@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// chanOverride is the setting of a target channel that replaces the global
+// one.
+type chanOverride struct {
+	MaxCltv int64 `json:"max_cltv" toml:"max_cltv"`
+}
+
+// overrides maps channel or node ids to the overrides.
+type overrides map[string]chanOverride
+
+// resolveChannelOverrides maps the overrides specified by channel or node id
+// to our channels, a channel override takes precedence over the override of
+// its peer.
+func (r *regolancer) resolveChannelOverrides() error {
+	r.channelOverrides = map[uint64]chanOverride{}
+	if len(params.ChannelOverrides) == 0 {
+		return nil
+	}
+	ids := []string{}
+	for id := range params.ChannelOverrides {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	byChan := map[uint64]chanOverride{}
+	byNode := map[string]chanOverride{}
+	for _, id := range ids {
+		o := params.ChannelOverrides[id]
+		if o.MaxCltv < 0 {
+			return fmt.Errorf("channel override for %s: max_cltv should be positive, got %d", id, o.MaxCltv)
+		}
+		chans, nodes, err := parseNodeChannelIDs([]string{id})
+		if err != nil {
+			return fmt.Errorf("channel override for %s: %s", id, err)
+		}
+		for chanId := range chans {
+			byChan[chanId] = o
+		}
+		for _, pk := range nodes {
+			byNode[hex.EncodeToString(pk)] = o
+		}
+	}
+	for _, c := range r.channels {
+		o, ok := byChan[c.ChanId]
+		if !ok {
+			o, ok = byNode[c.RemotePubkey]
+		}
+		if ok {
+			r.channelOverrides[c.ChanId] = o
+		}
+	}
+	return nil
+}
+
+// learnedCltv returns the max route timelock learned for the target peer, 0
+// if it's unknown. The bounds are kept in the hop history (the hop from the
+// peer to us) so they're persisted with --hop-history-filename.
+func (r *regolancer) learnedCltv(peer string) int64 {
+	if s, ok := r.hopHistory[hopKey(peer, r.myPK)]; ok && s.MaxCltv > 0 {
+		return s.MaxCltv
+	}
+	return r.cltvBounds[peer]
+}
+
+// targetMaxCltv returns the route timelock limit of the target channel, it's
+// --max-cltv or the channel override tightened by the bound learned for the
+// target peer. 0 means no limit.
+func (r *regolancer) targetMaxCltv(to uint64) int64 {
+	limit := params.MaxCltv
+	if o, ok := r.channelOverrides[to]; ok && o.MaxCltv > 0 {
+		limit = o.MaxCltv
+	}
+	if c := r.findChannel(to); c != nil {
+		if learned := r.learnedCltv(c.RemotePubkey); learned > 0 && (limit == 0 || learned < limit) {
+			limit = learned
+		}
+	}
+	return limit
+}
+
+// learnTargetCltv tightens the bound of the target peer if it refused the
+// HTLC because the expiry is too far in the future, the next routes should
+// lock the funds for less than this route did.
+func (r *regolancer) learnTargetCltv(ctx context.Context, route *lnrpc.Route, failure *lnrpc.Failure) {
+	if failure == nil || failure.Code != lnrpc.Failure_EXPIRY_TOO_FAR ||
+		int(failure.FailureSourceIndex) != len(route.Hops)-1 || len(route.Hops) < 2 {
+		return
+	}
+	height := r.currentHeight(ctx)
+	if height == 0 {
+		return
+	}
+	bound := int64(route.TotalTimeLock) - int64(height) - 1
+	target := route.Hops[len(route.Hops)-1].ChanId
+	peer := route.Hops[len(route.Hops)-2].PubKey
+	if old := r.learnedCltv(peer); bound <= 0 || old > 0 && old <= bound {
+		return
+	}
+	if r.cltvBounds == nil {
+		r.cltvBounds = map[string]int64{}
+	}
+	r.cltvBounds[peer] = bound
+	if r.hopHistory != nil {
+		r.getHopStat(peer, r.myPK, target).MaxCltv = bound
+	}
+	log.Print(infoColorF("Target %s refused the route timelock, limiting its routes to %d blocks",
+		r.channelLabel(ctx, target), bound))
+}
+
+func (r *regolancer) printCltvBounds() {
+	bounds := map[string]int64{}
+	for _, s := range r.hopHistory {
+		if s.To == r.myPK && s.MaxCltv > 0 {
+			bounds[s.From] = s.MaxCltv
+		}
+	}
+	for peer, bound := range r.cltvBounds {
+		bounds[peer] = bound
+	}
+	if len(bounds) == 0 {
+		return
+	}
+	peers := []string{}
+	for peer := range bounds {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	log.Printf("Learned target timelock bounds:")
+	for _, peer := range peers {
+		log.Printf("  %s: %s blocks", r.cachedAlias(peer), hiWhiteColor(bounds[peer]))
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const completeChannelsTimeout = time.Second * 5
+
+// options that take our channel ids (or node ids) as arguments
+var channelOptions = map[string]struct{}{"to": {}, "from": {}, "exclude": {}}
+
+type completionOption struct {
+	short       string
+	long        string
+	description string
+	choices     []string
+	isBool      bool
+	repeatable  bool
+	channels    bool
+}
+
+// completionOptions introspects the flag definitions so that the completion
+// scripts always match the actual parameters.
+func completionOptions() []completionOption {
+	parser := flags.NewParser(&configParams{}, flags.Default)
+	options := []*flags.Option{}
+	var collect func(g *flags.Group)
+	collect = func(g *flags.Group) {
+		options = append(options, g.Options()...)
+		for _, sg := range g.Groups() {
+			collect(sg)
+		}
+	}
+	collect(parser.Command.Group)
+	result := []completionOption{}
+	for _, o := range options {
+		if o.Hidden || o.LongName == "" {
+			continue
+		}
+		co := completionOption{long: o.LongName, description: o.Description, choices: o.Choices}
+		if o.ShortName != 0 {
+			co.short = string(o.ShortName)
+		}
+		tp := o.Field().Type
+		if tp.Kind() == reflect.Slice {
+			co.repeatable = true
+			tp = tp.Elem()
+		}
+		if tp.Kind() == reflect.Ptr {
+			tp = tp.Elem()
+		}
+		co.isBool = tp.Kind() == reflect.Bool
+		_, co.channels = channelOptions[o.LongName]
+		result = append(result, co)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].long < result[j].long })
+	return result
+}
+
+func bashCompletion(options []completionOption) string {
+	all := []string{}
+	withArgs := []string{}
+	channels := []string{}
+	choices := []string{}
+	for _, o := range options {
+		names := []string{"--" + o.long}
+		if o.short != "" {
+			names = append(names, "-"+o.short)
+		}
+		all = append(all, names...)
+		switch {
+		case o.channels:
+			channels = append(channels, names...)
+		case len(o.choices) > 0:
+			choices = append(choices, fmt.Sprintf("        %s)\n            COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n            return\n            ;;",
+				strings.Join(names, "|"), strings.Join(o.choices, " ")))
+		case !o.isBool:
+			withArgs = append(withArgs, names...)
+		}
+	}
+	return fmt.Sprintf(`_regolancer() {
+    local cur prev
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    case "$prev" in
+        %s)
+            COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" --complete-channels "${COMP_WORDS[@]:1:COMP_CWORD-2}" 2>/dev/null | cut -f1)" -- "$cur"))
+            return
+            ;;
+%s
+        %s)
+            COMPREPLY=($(compgen -f -- "$cur"))
+            return
+            ;;
+    esac
+    COMPREPLY=($(compgen -W "%s" -- "$cur"))
+}
+complete -F _regolancer regolancer
+`, strings.Join(channels, "|"), strings.Join(choices, "\n"), strings.Join(withArgs, "|"), strings.Join(all, " "))
+}
+
+func zshEscape(s string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+func zshCompletion(options []completionOption) string {
+	specs := []string{}
+	for _, o := range options {
+		names := []string{"--" + o.long}
+		if o.short != "" {
+			names = append(names, "-"+o.short)
+		}
+		action := ""
+		switch {
+		case o.isBool:
+		case o.channels:
+			action = ":channel:_regolancer_channels"
+		case len(o.choices) > 0:
+			action = fmt.Sprintf(":value:(%s)", strings.Join(o.choices, " "))
+		default:
+			action = ":value:_files"
+		}
+		for _, name := range names {
+			prefix := ""
+			if o.repeatable {
+				prefix = "*"
+			}
+			if !o.isBool && strings.HasPrefix(name, "--") {
+				name += "="
+			}
+			specs = append(specs, fmt.Sprintf("        '%s%s[%s]%s'", prefix, name, zshEscape(o.description), action))
+		}
+	}
+	return fmt.Sprintf(`#compdef regolancer
+
+_regolancer_channels() {
+    local -a chans
+    chans=(${(f)"$(${words[1]} --complete-channels ${words[2,CURRENT-2]} 2>/dev/null | sed 's/:/\\:/g; s/\t/:/')"})
+    _describe 'channel' chans
+}
+
+_regolancer() {
+    _arguments \
+%s
+}
+
+if [ "$funcstack[1]" = "_regolancer" ]; then
+    _regolancer "$@"
+else
+    compdef _regolancer regolancer
+fi
+`, strings.Join(specs, " \\\n"))
+}
+
+func fishCompletion(options []completionOption) string {
+	lines := []string{`function __regolancer_channels
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    set -e tokens[-1]
+    regolancer --complete-channels $tokens 2>/dev/null
+end
+`, "complete -c regolancer -f"}
+	for _, o := range options {
+		line := "complete -c regolancer"
+		if o.short != "" {
+			line += " -s " + o.short
+		}
+		line += " -l " + o.long
+		switch {
+		case o.isBool:
+		case o.channels:
+			line += " -x -a '(__regolancer_channels)'"
+		case len(o.choices) > 0:
+			line += fmt.Sprintf(" -x -a '%s'", strings.Join(o.choices, " "))
+		default:
+			line += " -r -F"
+		}
+		line += fmt.Sprintf(" -d '%s'", strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(o.description))
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func printCompletion(shell string) {
+	options := completionOptions()
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion(options))
+	case "zsh":
+		fmt.Print(zshCompletion(options))
+	case "fish":
+		fmt.Print(fishCompletion(options))
+	}
+}
+
+// completeChannels prints our channels as "id<tab>alias" for the completion
+// scripts.
+func completeChannels() error {
+	conn, err := dialLnd()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	lnClient := lnrpc.NewLightningClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), completeChannelsTimeout)
+	defer cancel()
+	channels, err := lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		return err
+	}
+	for _, c := range channels.Channels {
+		alias := ""
+		if ctx.Err() == nil {
+			if nodeInfo, err := lnClient.GetNodeInfo(ctx, &lnrpc.NodeInfoRequest{PubKey: c.RemotePubkey}); err == nil {
+				alias = nodeInfo.Node.Alias
+			}
+		}
+		fmt.Printf("%d\t%s\n", c.ChanId, alias)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// the overlay key with this prefix appends to the list instead of replacing it
+const configAppendPrefix = "+"
+
+// config file that set each parameter (by the field name), the last one wins
+var configSources = map[string]string{}
+
+// configLayer holds the top level keys of a config file, every key is decoded
+// separately so that the layers can be merged field by field.
+type configLayer struct {
+	filename string
+	tag      string
+	keys     map[string]func(v any) error
+}
+
+func readConfigLayer(filename string) (*configLayer, error) {
+	if strings.Contains(filename, ".toml") {
+		raw := map[string]toml.Primitive{}
+		md, err := toml.DecodeFile(filename, &raw)
+		if err != nil {
+			return nil, err
+		}
+		layer := &configLayer{filename: filename, tag: "toml", keys: map[string]func(v any) error{}}
+		for k, p := range raw {
+			p := p
+			layer.keys[k] = func(v any) error { return md.PrimitiveDecode(p, v) }
+		}
+		return layer, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	layer := &configLayer{filename: filename, tag: "json", keys: map[string]func(v any) error{}}
+	for k, m := range raw {
+		m := m
+		layer.keys[k] = func(v any) error {
+			decoder := json.NewDecoder(bytes.NewReader(m))
+			decoder.UseNumber()
+			return decoder.Decode(v)
+		}
+	}
+	return layer, nil
+}
+
+// configField finds the parameter by the config key the same way the
+// decoders do: by the tag or by the field name if there's no tag, ignoring
+// the case.
+func configField(t reflect.Type, tag string, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := f.Tag.Lookup(tag)
+		if !ok {
+			name = f.Name
+		}
+		name = strings.Split(name, ",")[0]
+		if name != "-" && strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// merge sets the parameters present in the layer. The lists are replaced
+// unless the key starts with "+", then the values are appended. The tables
+// are merged with the values from the previous layers.
+func (l *configLayer) merge(params *configParams) error {
+	v := reflect.ValueOf(params).Elem()
+	for key, decode := range l.keys {
+		name := strings.TrimPrefix(key, configAppendPrefix)
+		field, ok := configField(v.Type(), l.tag, name)
+		if !ok {
+			// unknown keys are ignored like before
+			continue
+		}
+		value := v.FieldByIndex(field.Index)
+		appending := name != key
+		if appending && value.Kind() != reflect.Slice {
+			return fmt.Errorf("%s: %s is not a list and can't be appended to", key, name)
+		}
+		decoded := reflect.New(field.Type)
+		if value.Kind() != reflect.Slice {
+			decoded.Elem().Set(value)
+		}
+		if err := decode(decoded.Interface()); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		if appending {
+			value.Set(reflect.AppendSlice(value, decoded.Elem()))
+		} else {
+			value.Set(decoded.Elem())
+		}
+		configSources[field.Name] = l.filename
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigLayer(t *testing.T, name string, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func mergeConfigLayers(t *testing.T, filenames ...string) (configParams, error) {
+	result := configParams{}
+	for _, filename := range filenames {
+		layer, err := readConfigLayer(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := layer.merge(&result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func TestConfigLayers(t *testing.T) {
+	defer func(s map[string]string) { configSources = s }(configSources)
+	configSources = map[string]string{}
+	base := writeConfigLayer(t, "base.toml", `
+connect = "127.0.0.1:10009"
+amount = 10000
+fee_limit_ppm = 500
+exclude = ["111", "222"]
+to = ["333"]
+unknown_key = 1
+
+[channel_overrides.444]
+max_cltv = 100
+`)
+	overlay := writeConfigLayer(t, "overlay.json", `{
+  "amount": 20000,
+  "+exclude": ["555"],
+  "to": ["666"],
+  "channel_overrides": {"777": {"max_cltv": 200}}
+}`)
+	p, err := mergeConfigLayers(t, base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Connect != "127.0.0.1:10009" || p.FeeLimitPPM != 500 {
+		t.Errorf("the base values should be kept, got %q and %d", p.Connect, p.FeeLimitPPM)
+	}
+	if p.Amount != 20000 {
+		t.Errorf("the overlay should override the amount, got %d", p.Amount)
+	}
+	if !reflect.DeepEqual(p.Exclude, []string{"111", "222", "555"}) {
+		t.Errorf("+exclude should append to the list, got %v", p.Exclude)
+	}
+	if !reflect.DeepEqual(p.To, []string{"666"}) {
+		t.Errorf("to should replace the list, got %v", p.To)
+	}
+	if !reflect.DeepEqual(p.ChannelOverrides, overrides{"444": {MaxCltv: 100}, "777": {MaxCltv: 200}}) {
+		t.Errorf("the tables should be merged, got %v", p.ChannelOverrides)
+	}
+	for field, source := range map[string]string{"Connect": base, "FeeLimitPPM": base, "Amount": overlay,
+		"Exclude": overlay, "To": overlay} {
+		if configSources[field] != source {
+			t.Errorf("%s should come from %s, got %s", field, source, configSources[field])
+		}
+	}
+}
+
+func TestConfigLayersAppendOrder(t *testing.T) {
+	defer func(s map[string]string) { configSources = s }(configSources)
+	configSources = map[string]string{}
+	// appending to the list not set before starts it, the replacing layer
+	// drops the appended values
+	first := writeConfigLayer(t, "first.json", `{"+from": ["1"]}`)
+	second := writeConfigLayer(t, "second.toml", `"+from" = ["2"]`)
+	third := writeConfigLayer(t, "third.toml", `from = ["3"]`)
+	p, err := mergeConfigLayers(t, first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.From, []string{"1", "2"}) {
+		t.Errorf("expected [1 2], got %v", p.From)
+	}
+	p, err = mergeConfigLayers(t, first, second, third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.From, []string{"3"}) {
+		t.Errorf("expected [3], got %v", p.From)
+	}
+}
+
+func TestConfigLayersAppendScalar(t *testing.T) {
+	defer func(s map[string]string) { configSources = s }(configSources)
+	configSources = map[string]string{}
+	_, err := mergeConfigLayers(t, writeConfigLayer(t, "bad.json", `{"+amount": 1000}`))
+	if err == nil || !strings.Contains(err.Error(), "can't be appended") {
+		t.Errorf("appending to a number should fail, got %v", err)
+	}
+}
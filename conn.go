@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lncfg"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/macaroons"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	defaultRPCPort = "10009"
+	// same as lndclient uses
+	maxMsgRecvSize = 200 * 1024 * 1024
+	// the connection is checked after the pauses longer than this
+	livenessPause   = time.Minute
+	livenessTimeout = time.Second * 5
+)
+
+// keepaliveParams makes gRPC ping lnd when the connection is idle so that NAT
+// and firewalls don't drop it silently, and detect such drops if they happen.
+func keepaliveParams() keepalive.ClientParameters {
+	return keepalive.ClientParameters{
+		Time:                time.Second * time.Duration(params.KeepaliveTime),
+		Timeout:             time.Second * time.Duration(params.KeepaliveTimeout),
+		PermitWithoutStream: params.KeepaliveNoStream,
+	}
+}
+
+// dialOptions are the options of lndclient.NewBasicConn with keepalive added.
+func dialOptions(macDir string) ([]grpc.DialOption, error) {
+	creds, err := lndclient.GetTLSCredentials("", params.TLSCert, false, false)
+	if err != nil {
+		return nil, err
+	}
+	if macDir == "" {
+		macDir = filepath.Join(btcutil.AppDataDir("lnd", false), "data", "chain", "bitcoin", params.Network)
+	}
+	macBytes, err := os.ReadFile(filepath.Join(macDir, params.MacaroonFilename))
+	if err != nil {
+		return nil, err
+	}
+	mac := &macaroon.Macaroon{}
+	if err = mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, fmt.Errorf("unable to decode macaroon: %s", err)
+	}
+	cred, err := macaroons.NewMacaroonCredential(mac)
+	if err != nil {
+		return nil, fmt.Errorf("error creating macaroon credential: %s", err)
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithPerRPCCredentials(cred),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgRecvSize)),
+		grpc.WithContextDialer(lncfg.ClientAddressDialer(defaultRPCPort)),
+	}
+	if params.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepaliveParams()))
+	}
+	return opts, nil
+}
+
+func dialLnd() (*grpc.ClientConn, error) {
+	opts, err := dialOptions(params.MacaroonDir)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(params.Connect, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to RPC server: %s", err)
+	}
+	return conn, nil
+}
+
+// setConn switches the clients to the connection, the worker wrappers are
+// kept if the workers are running.
+func (r *regolancer) setConn(conn *grpc.ClientConn) {
+	r.conn = conn
+	r.invoicesClient = invoicesrpc.NewInvoicesClient(conn)
+	lnClient := lnrpc.NewLightningClient(conn)
+	routerClient := routerrpc.NewRouterClient(conn)
+	var sender paymentSender = &routerSender{client: routerClient}
+	if r.legacyRouter {
+		sender = &legacySender{client: lnClient}
+	}
+	if r.workers != nil {
+		r.lnClient = &workerClient{LightningClient: lnClient, r: r}
+		r.routerClient = &workerRouterClient{RouterClient: routerClient, r: r}
+		r.sender = &workerSender{sender: sender, r: r}
+		return
+	}
+	r.lnClient, r.routerClient, r.sender = lnClient, routerClient, sender
+}
+
+// checkConnection makes sure lnd still responds after a long pause and
+// reconnects if it doesn't.
+func (r *regolancer) checkConnection(ctx context.Context) {
+	if r.conn == nil || ctx.Err() != nil {
+		return
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, livenessTimeout)
+	defer cancel()
+	_, err := r.lnClient.GetInfo(checkCtx, &lnrpc.GetInfoRequest{})
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	logErrorF("lnd doesn't respond (%s), reconnecting", err)
+	conn, err := dialLnd()
+	if err != nil {
+		logErrorF("Error reconnecting to lnd: %s", err)
+		return
+	}
+	r.conn.Close()
+	r.setConn(conn)
+}
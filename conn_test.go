@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/macaroon.v2"
+)
+
+// writeTestCredentials creates a self-signed certificate for 127.0.0.1 and a
+// macaroon in the directory.
+func writeTestCredentials(t *testing.T, dir string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour), IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, "tls.cert"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mac, err := macaroon.New([]byte("root key"), []byte("id"), "lnd", macaroon.LatestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "admin.macaroon"), macBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// macaroonServer answers GetInfo if the call has a macaroon.
+type macaroonServer struct {
+	lnrpc.UnimplementedLightningServer
+}
+
+func (macaroonServer) GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest) (*lnrpc.GetInfoResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md.Get("macaroon")) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "no macaroon")
+	}
+	return &lnrpc.GetInfoResponse{Alias: "test"}, nil
+}
+
+func TestDialOptions(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	dir := t.TempDir()
+	writeTestCredentials(t, dir)
+	params.TLSCert = filepath.Join(dir, "tls.cert")
+	params.MacaroonFilename = "admin.macaroon"
+	params.KeepaliveTime, params.KeepaliveTimeout, params.KeepaliveNoStream = 60, 20, true
+	ka := keepaliveParams()
+	if ka.Time != time.Minute || ka.Timeout != time.Second*20 || !ka.PermitWithoutStream {
+		t.Errorf("keepalive parameters don't match the flags: %+v", ka)
+	}
+	withKeepalive, err := dialOptions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.KeepaliveTime = -1
+	withoutKeepalive, err := dialOptions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withKeepalive) != len(withoutKeepalive)+1 {
+		t.Errorf("the keepalive option should be added only if it's enabled, got %d and %d options",
+			len(withKeepalive), len(withoutKeepalive))
+	}
+	params.MacaroonFilename = "missing.macaroon"
+	if _, err := dialOptions(dir); err == nil {
+		t.Error("missing macaroon should fail")
+	}
+}
+
+func TestDialLnd(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	dir := t.TempDir()
+	cert := writeTestCredentials(t, dir)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	lnrpc.RegisterLightningServer(server, macaroonServer{})
+	go server.Serve(lis)
+	defer server.Stop()
+	params.TLSCert = filepath.Join(dir, "tls.cert")
+	params.MacaroonDir = dir
+	params.MacaroonFilename = "admin.macaroon"
+	params.Connect = lis.Addr().String()
+	params.KeepaliveTime, params.KeepaliveTimeout, params.KeepaliveNoStream = 10, 5, true
+	conn, err := dialLnd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	info, err := lnrpc.NewLightningClient(conn).GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil || info.Alias != "test" {
+		t.Errorf("GetInfo should succeed over TLS with the macaroon, got %v, %v", info, err)
+	}
+	// the dead connection is replaced after the liveness check fails
+	r := &regolancer{conn: conn, lnClient: deadLightning{}}
+	r.checkConnection(ctx)
+	if r.conn == conn {
+		t.Fatal("the connection should be replaced")
+	}
+	defer r.conn.Close()
+	info, err = r.lnClient.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil || info.Alias != "test" {
+		t.Errorf("GetInfo should succeed after reconnecting, got %v, %v", info, err)
+	}
+}
+
+// deadLightning fails GetInfo like a dropped connection.
+type deadLightning struct {
+	lnrpc.LightningClient
+}
+
+func (deadLightning) GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.GetInfoResponse, error) {
+	return nil, status.Error(codes.Unavailable, "connection reset")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// rebalanceSession tries to rebalance until the goals are reached or no more
+// pairs are left. It also returns when the context is done or after the
+// current attempt if the stop channel is closed.
+func (r *regolancer) rebalanceSession(ctx context.Context, stop <-chan struct{}) {
+	r.sessionFeesStart, r.feeBudgetErr = r.totalFeesMsat, nil
+	defer r.setPhase(phaseFinishing, nil)
+	if params.Workers > 1 {
+		r.runWorkers(ctx, stop)
+		return
+	}
+	for {
+		r.pace(ctx)
+		r.periodicSaveNodeCache()
+		err, retry := tryRebalance(ctx, r)
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Println(errColor("Rebalancing timed out"))
+			return
+		}
+		if ctx.Err() == context.Canceled {
+			log.Println(errColor("Rebalancing interrupted"))
+			return
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !retry && (err != nil || !r.goalsLeft()) {
+			return
+		}
+	}
+}
+
+// checkCandidates makes sure there's something to rebalance.
+func (r *regolancer) checkCandidates() error {
+	if len(r.fromChannels) == 0 {
+		return errors.New("no source channels selected")
+	}
+	if len(r.toChannels) == 0 {
+		return errors.New("no target channels selected")
+	}
+	if r.amountErr != nil {
+		return r.amountErr
+	}
+	if params.Distribute > 0 && len(r.targetGoals) == 0 {
+		return errors.New("no target channels left to distribute the amount between")
+	}
+	return nil
+}
+
+func copyChanSet(set map[uint64]struct{}) map[uint64]struct{} {
+	if set == nil {
+		return nil
+	}
+	result := map[uint64]struct{}{}
+	for k := range set {
+		result[k] = struct{}{}
+	}
+	return result
+}
+
+// refreshCandidates reloads our channels and selects the candidates again so
+// that the balances and policies from the previous session don't drive the
+// decisions. The failure cache is reset as well. The source and target
+// channel sets are passed explicitly because rapid rebalancing narrows them.
+func (r *regolancer) refreshCandidates(ctx context.Context, fromChannelId, toChannelId map[uint64]struct{}) error {
+	infoCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(params.TimeoutInfo))
+	defer cancel()
+	r.fromChannelId, r.toChannelId = copyChanSet(fromChannelId), copyChanSet(toChannelId)
+	r.chanCache = map[uint64]*lnrpc.ChannelEdge{}
+	r.chanCacheTimes = map[uint64]time.Time{}
+	r.forwardsOut = nil
+	err := r.getChannels(infoCtx)
+	if err != nil {
+		return err
+	}
+	if params.SkipLocallyDisabled == nil || *params.SkipLocallyDisabled {
+		err = r.getLocallyDisabled(infoCtx)
+		if err != nil {
+			return err
+		}
+	}
+	err = r.filterPendingUpdates(infoCtx)
+	if err != nil {
+		return err
+	}
+	err = r.resolveSourceRules()
+	if err != nil {
+		return err
+	}
+	err = r.resolveChannelOverrides()
+	if err != nil {
+		return err
+	}
+	r.filterPeersByAddress(infoCtx)
+	err = r.filterTargetsByDemand(infoCtx)
+	if err != nil {
+		return err
+	}
+	r.failureCache = map[string]failedRoute{}
+	r.softFailures = map[string]softFailure{}
+	r.channelPairs = map[string][2]*lnrpc.Channel{}
+	// the cached invoices could've been cancelled by another instance while
+	// sleeping, only the ones still open are reused
+	r.invoiceCache = map[invoiceKey]cachedInvoice{}
+	r.loadOpenInvoices(infoCtx)
+	r.fromChannels, r.toChannels = nil, nil
+	r.routeFound = false
+	err = r.getChannelCandidates(params.FromPerc, params.ToPerc, params.Amount)
+	if err != nil {
+		return err
+	}
+	r.amount, r.amountErr = r.fitAmount(params.Amount)
+	if params.Distribute > 0 {
+		r.planDistribution(r.amount, params.MinAmount, params.ToPerc, params.Distribute)
+	}
+	return r.checkCandidates()
+}
+
+// runDaemon repeats the rebalance sessions every --interval minutes until the
+// stop channel is closed or the context is cancelled. The first session uses
+// the candidates selected on startup.
+func runDaemon(ctx context.Context, r *regolancer, stop <-chan struct{}) {
+	fromChannelId, toChannelId := copyChanSet(r.fromChannelId), copyChanSet(r.toChannelId)
+	interval := time.Minute * time.Duration(params.Interval)
+	ready := r.checkCandidates() == nil
+	for session := 1; ; session++ {
+		if session > 1 {
+			log.Printf("Starting session %s, refreshing channels", hiWhiteColor(session))
+			r.setPhase(phaseRefreshing, nil)
+			err := r.refreshCandidates(ctx, fromChannelId, toChannelId)
+			ready = err == nil
+			if err != nil {
+				logErrorF("Skipping session: %s", err)
+			}
+		}
+		if ready {
+			sessionCtx, cancel := context.WithTimeout(ctx, time.Minute*time.Duration(params.TimeoutRebalance))
+			r.rebalanceSession(sessionCtx, stop)
+			cancel()
+			r.periodicSaveNodeCache()
+		}
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+		log.Printf("Next session in %s", hiWhiteColor(interval))
+		r.setPhase(phaseSleeping, nil)
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+		r.checkConnection(ctx)
+	}
+}
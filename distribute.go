@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+type targetGoal struct {
+	planned  int64
+	achieved int64
+}
+
+// done reports if the goal is reached or what's left is too small to send
+func (g *targetGoal) done() bool {
+	return g.achieved >= g.planned || g.planned-g.achieved < params.MinAmount
+}
+
+// allocateAmount splits amount between the channels proportionally to their
+// deficits. If the deficits sum up to less than the amount every channel gets
+// its full deficit. Channels that would get less than minAmount are dropped
+// and their share is redistributed between the rest.
+func allocateAmount(deficits map[uint64]int64, amount, minAmount int64) map[uint64]int64 {
+	result := map[uint64]int64{}
+	for chanId, d := range deficits {
+		if d > 0 && d >= minAmount {
+			result[chanId] = d
+		}
+	}
+	for {
+		total := int64(0)
+		for _, d := range result {
+			total += d
+		}
+		if total <= amount {
+			return result
+		}
+		alloc := map[uint64]int64{}
+		dropped := false
+		for chanId, d := range result {
+			a := int64(float64(amount) * float64(d) / float64(total))
+			if a < minAmount || a == 0 {
+				delete(result, chanId)
+				dropped = true
+				continue
+			}
+			alloc[chanId] = a
+		}
+		if dropped {
+			continue
+		}
+		// give the rounding leftover to the biggest deficit
+		var biggest uint64
+		left := amount
+		for chanId, a := range alloc {
+			left -= a
+			if result[chanId] > result[biggest] {
+				biggest = chanId
+			}
+		}
+		if left > 0 && len(alloc) > 0 {
+			alloc[biggest] = min(alloc[biggest]+left, result[biggest])
+		}
+		return alloc
+	}
+}
+
+func (r *regolancer) planDistribution(amount, minAmount int64, toPerc int64, count int) {
+	targets := append([]*lnrpc.Channel{}, r.toChannels...)
+	deficit := func(c *lnrpc.Channel) int64 {
+		return c.Capacity*toPerc/100 - c.LocalBalance
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return deficit(targets[i]) > deficit(targets[j])
+	})
+	if len(targets) > count {
+		targets = targets[:count]
+	}
+	deficits := map[uint64]int64{}
+	for _, c := range targets {
+		deficits[c.ChanId] = deficit(c)
+	}
+	r.targetGoals = map[uint64]*targetGoal{}
+	for chanId, a := range allocateAmount(deficits, amount, minAmount) {
+		r.targetGoals[chanId] = &targetGoal{planned: a}
+		log.Printf("Planned to rebalance %s into channel %s", formatAmt(a), hiWhiteColor(chanId))
+	}
+	for k, pair := range r.channelPairs {
+		if _, ok := r.targetGoals[pair[1].ChanId]; !ok {
+			delete(r.channelPairs, k)
+		}
+	}
+}
+
+// goalAmount limits the amount by what's left to reach the target channel goal
+// if distribution is enabled.
+func (r *regolancer) goalAmount(to uint64, amount int64) int64 {
+	if r.targetGoals == nil {
+		return amount
+	}
+	if g, ok := r.targetGoals[to]; ok {
+		return min(amount, g.planned-g.achieved)
+	}
+	return 0
+}
+
+func (r *regolancer) addGoalProgress(to uint64, amount int64) {
+	if r.targetGoals == nil {
+		return
+	}
+	g, ok := r.targetGoals[to]
+	if !ok {
+		return
+	}
+	g.achieved += amount
+	if !g.done() {
+		return
+	}
+	log.Printf("Channel %s reached its goal", hiWhiteColor(to))
+	for k, pair := range r.channelPairs {
+		if pair[1].ChanId == to {
+			delete(r.channelPairs, k)
+		}
+	}
+	for k, v := range r.failureCache {
+		if v.channelPair[1] != nil && v.channelPair[1].ChanId == to {
+			delete(r.failureCache, k)
+		}
+	}
+}
+
+func (r *regolancer) goalsLeft() bool {
+	for _, g := range r.targetGoals {
+		if !g.done() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *regolancer) printGoals() {
+	if r.targetGoals == nil {
+		return
+	}
+	log.Print("Planned and achieved amounts per target:")
+	for chanId, g := range r.targetGoals {
+		log.Printf("  %s: %s / %s", hiWhiteColor(chanId), formatAmt(g.achieved), formatAmt(g.planned))
+	}
+}
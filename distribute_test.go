@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAllocateAmount(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		deficits  map[uint64]int64
+		amount    int64
+		minAmount int64
+		expected  map[uint64]int64
+	}{
+		{"deficits below the amount", map[uint64]int64{1: 100000, 2: 200000}, 1000000, 0,
+			map[uint64]int64{1: 100000, 2: 200000}},
+		{"proportional", map[uint64]int64{1: 300000, 2: 100000}, 200000, 0,
+			map[uint64]int64{1: 150000, 2: 50000}},
+		{"no deficit", map[uint64]int64{1: -5000, 2: 0, 3: 100000}, 50000, 0, map[uint64]int64{3: 50000}},
+		// the deficit of 3 is below the min amount and the share of 2 drops
+		// below it too, everything goes to 1
+		{"share below the min amount", map[uint64]int64{1: 900000, 2: 100000, 3: 50000}, 500000, 60000,
+			map[uint64]int64{1: 500000}},
+		// 33.2, 33.2 and 33.6 are rounded down, the leftover goes to the
+		// biggest deficit
+		{"rounding leftover", map[uint64]int64{1: 100, 2: 100, 3: 101}, 100, 0,
+			map[uint64]int64{1: 33, 2: 33, 3: 34}},
+		{"rounding leftover to the first channel", map[uint64]int64{1: 101, 2: 100, 3: 100}, 100, 0,
+			map[uint64]int64{1: 34, 2: 33, 3: 33}},
+		{"everything dropped", map[uint64]int64{1: 100000, 2: 100000}, 100000, 60000, map[uint64]int64{}},
+	} {
+		result := allocateAmount(tc.deficits, tc.amount, tc.minAmount)
+		if !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, result)
+		}
+	}
+}
+
+func TestPlanDistribution(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MinAmount = 0
+	from := &lnrpc.Channel{ChanId: 1, Capacity: 1000000, LocalBalance: 1000000}
+	r := &regolancer{channelPairs: map[string][2]*lnrpc.Channel{}}
+	// the deficits to reach 50% are 400000, 100000 and 300000
+	for i, local := range []int64{100000, 400000, 200000} {
+		c := &lnrpc.Channel{ChanId: uint64(i + 2), Capacity: 1000000, LocalBalance: local}
+		r.toChannels = append(r.toChannels, c)
+		r.channelPairs[formatChannelPair(from.ChanId, c.ChanId)] = [2]*lnrpc.Channel{from, c}
+	}
+	r.planDistribution(350000, 0, 50, 2)
+	planned := map[uint64]int64{}
+	for chanId, g := range r.targetGoals {
+		planned[chanId] = g.planned
+	}
+	if expected := map[uint64]int64{2: 200000, 4: 150000}; !reflect.DeepEqual(planned, expected) {
+		t.Errorf("expected the plan %v, got %v", expected, planned)
+	}
+	if _, ok := r.channelPairs[formatChannelPair(1, 3)]; ok || len(r.channelPairs) != 2 {
+		t.Errorf("the pair of the unplanned target should be removed, got %v", r.channelPairs)
+	}
+}
+
+// TestGoalProgress checks that the paid and tracked payments move the goal of
+// their target channel.
+func TestGoalProgress(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.InFlightAction = "track"
+	params.MinAmount = 10000
+	router := &fakeRouter{}
+	sender := &fakeSender{}
+	r := &regolancer{
+		myPK:         testMyPK,
+		lnClient:     &fakeLightning{},
+		routerClient: router,
+		sender:       sender,
+		invoiceCache: map[invoiceKey]cachedInvoice{},
+		sourceUsage:  map[uint64]Msat{},
+		channelPairs: map[string][2]*lnrpc.Channel{},
+		failureCache: map[string]failedRoute{},
+		targetGoals:  map[uint64]*targetGoal{2: {planned: 500000}, 3: {planned: 500000}},
+	}
+	from := &lnrpc.Channel{ChanId: 1}
+	for _, to := range []uint64{2, 3} {
+		r.channelPairs[formatChannelPair(1, to)] = [2]*lnrpc.Channel{from, {ChanId: to}}
+	}
+	sender.send = func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+		return &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_SUCCEEDED, Route: route}, nil
+	}
+	err := r.pay(context.Background(), satToMsat(300000), 0, testRoute(1, 2, 300000000, 1000, testPeerPK), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := r.targetGoals[2]; g.achieved != 300000 || g.done() {
+		t.Errorf("expected 300000 achieved, got %+v", g)
+	}
+
+	// the payment in flight is tracked until it succeeds
+	sender.send = func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+		return nil, status.Error(codes.AlreadyExists, "already in flight")
+	}
+	router.payment = &lnrpc.Payment{Status: lnrpc.Payment_SUCCEEDED, Htlcs: []*lnrpc.HTLCAttempt{
+		{Status: lnrpc.HTLCAttempt_SUCCEEDED, Route: testRoute(1, 2, 200000000, 1000, testPeerPK)}}}
+	err = r.pay(context.Background(), satToMsat(200000), 0, testRoute(1, 2, 200000000, 1000, testPeerPK), 0)
+	if err != nil || router.tracked != 1 {
+		t.Fatalf("expected the tracked payment to succeed, got %v", err)
+	}
+	if g := r.targetGoals[2]; g.achieved != 500000 || !g.done() {
+		t.Errorf("expected the goal to be reached, got %+v", g)
+	}
+	if _, ok := r.channelPairs[formatChannelPair(1, 2)]; ok {
+		t.Error("the pair of the reached goal should be removed")
+	}
+	if g := r.targetGoals[3]; g.achieved != 0 || !r.goalsLeft() {
+		t.Errorf("the other goal shouldn't move, got %+v", g)
+	}
+}
+
+// TestGoalProgressMPP checks that only the paid parts of a multi-part payment
+// move the goal of their target channel.
+func TestGoalProgressMPP(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MinAmount = 10000
+	sender := &fakeSender{}
+	r := &regolancer{
+		myPK:           testMyPK,
+		lnClient:       &fakeLightning{},
+		sender:         sender,
+		invoiceCache:   map[invoiceKey]cachedInvoice{},
+		failedPayments: map[string]*lnrpc.Route{},
+		sourceUsage:    map[uint64]Msat{},
+		channelPairs:   map[string][2]*lnrpc.Channel{},
+		failureCache:   map[string]failedRoute{},
+		targetGoals:    map[uint64]*targetGoal{2: {planned: 400000}},
+	}
+	r.channelPairs[formatChannelPair(1, 2)] = [2]*lnrpc.Channel{{ChanId: 1}, {ChanId: 2}}
+	routes := func() []*lnrpc.Route {
+		return []*lnrpc.Route{testRoute(1, 2, 100000000, 1000, testPeerPK),
+			testRoute(1, 2, 100000000, 1000, testPeerPK)}
+	}
+	// the parts are sent concurrently
+	parts := int64(0)
+	sender.send = func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+		if atomic.AddInt64(&parts, 1) == 2 {
+			return failedHTLC(1), nil
+		}
+		return &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_SUCCEEDED, Route: route}, nil
+	}
+	if err := r.payShards(context.Background(), satToMsat(200000), routes()); err == nil {
+		t.Fatal("the failed part should fail the payment")
+	}
+	if g := r.targetGoals[2]; g.achieved != 100000 || g.done() {
+		t.Errorf("only the paid part should count, got %+v", g)
+	}
+
+	sender.send = func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+		return &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_SUCCEEDED, Route: route}, nil
+	}
+	if err := r.payShards(context.Background(), satToMsat(200000), routes()); err != nil {
+		t.Fatal(err)
+	}
+	if g := r.targetGoals[2]; g.achieved != 300000 || g.done() {
+		t.Errorf("expected 300000 achieved, got %+v", g)
+	}
+	if err := r.payShards(context.Background(), satToMsat(200000), routes()); err != nil {
+		t.Fatal(err)
+	}
+	if g := r.targetGoals[2]; g.achieved != 500000 || !g.done() || r.goalsLeft() {
+		t.Errorf("expected the goal to be reached, got %+v", g)
+	}
+	if len(r.channelPairs) != 0 {
+		t.Error("the pair of the reached goal should be removed")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	// min number of the session attempts to suggest an exclusion
+	suggestionMinSamples = 5
+	// min percentage of failures for a node to be suggested for exclusion
+	suggestionFailPerc = 80
+)
+
+// sessionTally is the session record of a node or our channel, the failures
+// are broken down by reason.
+type sessionTally struct {
+	attempts int
+	failures int
+	reasons  map[string]int
+}
+
+func (t *sessionTally) add(failed bool, reason string) {
+	t.attempts++
+	if !failed {
+		return
+	}
+	t.failures++
+	if t.reasons == nil {
+		t.reasons = map[string]int{}
+	}
+	t.reasons[reason]++
+}
+
+// breakdown returns the failure reasons as "all no_route" or
+// "5 no_route, 2 temporary_channel_failure".
+func (t *sessionTally) breakdown() string {
+	codes := []string{}
+	for code := range t.reasons {
+		codes = append(codes, code)
+	}
+	if len(codes) == 1 && t.reasons[codes[0]] == t.attempts {
+		return "all " + codes[0]
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return t.reasons[codes[i]] > t.reasons[codes[j]] ||
+			t.reasons[codes[i]] == t.reasons[codes[j]] && codes[i] < codes[j]
+	})
+	result := []string{}
+	for _, code := range codes {
+		result = append(result, fmt.Sprintf("%d %s", t.reasons[code], code))
+	}
+	return strings.Join(result, ", ")
+}
+
+// sessionTallies are the failure records of the nodes between our peers and
+// our source and target channels collected during the session.
+type sessionTallies struct {
+	nodes   map[string]*sessionTally
+	sources map[uint64]*sessionTally
+	targets map[uint64]*sessionTally
+}
+
+func (t *sessionTallies) init() {
+	if t.nodes == nil {
+		t.nodes = map[string]*sessionTally{}
+		t.sources = map[uint64]*sessionTally{}
+		t.targets = map[uint64]*sessionTally{}
+	}
+}
+
+func (t *sessionTallies) node(pk string) *sessionTally {
+	if _, ok := t.nodes[pk]; !ok {
+		t.nodes[pk] = &sessionTally{}
+	}
+	return t.nodes[pk]
+}
+
+func channelTally(m map[uint64]*sessionTally, chanId uint64) *sessionTally {
+	if _, ok := m[chanId]; !ok {
+		m[chanId] = &sessionTally{}
+	}
+	return m[chanId]
+}
+
+// tallyPayment records the payment result, failure is nil if it succeeded.
+// The node at the failure source index failed to forward to the next hop.
+func (r *regolancer) tallyPayment(route *lnrpc.Route, failure *lnrpc.Failure) {
+	if len(route.Hops) < 2 {
+		return
+	}
+	t := &r.sessionTallies
+	t.init()
+	reason := ""
+	failedNode := -1
+	if failure != nil {
+		reason = strings.ToLower(failure.Code.String())
+		failedNode = int(failure.FailureSourceIndex) - 1
+	}
+	// the first hop is our source peer and the two last are the target peer
+	// and our node
+	for i := 1; i < len(route.Hops)-2; i++ {
+		t.node(route.Hops[i].PubKey).add(i == failedNode, reason)
+	}
+	channelTally(t.sources, route.Hops[0].ChanId).add(failure != nil, reason)
+	channelTally(t.targets, route.Hops[len(route.Hops)-1].ChanId).add(failure != nil, reason)
+}
+
+// tallyRouteFailure records the channel pairs that failed before paying, only
+// the failures caused by the lack of routes count.
+func (r *regolancer) tallyRouteFailure(from, to uint64, code string) {
+	if code != failNoRoute && code != failNotEnoughRoutes {
+		return
+	}
+	t := &r.sessionTallies
+	t.init()
+	channelTally(t.sources, from).add(true, code)
+	channelTally(t.targets, to).add(true, code)
+}
+
+// exclusionSuggestion is a node or channel that failed often enough during
+// the session to be excluded.
+type exclusionSuggestion struct {
+	flag   string
+	value  string
+	reason string
+}
+
+func (s exclusionSuggestion) String() string {
+	return fmt.Sprintf("--%s=%s", s.flag, s.value)
+}
+
+// exclusionSuggestions returns the nodes that failed in at least
+// suggestionFailPerc of the attempts to forward our payments and the channels
+// that never worked as sources or targets, every one with at least
+// suggestionMinSamples attempts. The worst ones go first.
+func (r *regolancer) exclusionSuggestions() (result []exclusionSuggestion) {
+	type candidate struct {
+		exclusionSuggestion
+		tally *sessionTally
+	}
+	candidates := []candidate{}
+	t := r.sessionTallies
+	for pk, s := range t.nodes {
+		if s.attempts < suggestionMinSamples || s.failures*100 < s.attempts*suggestionFailPerc {
+			continue
+		}
+		candidates = append(candidates, candidate{exclusionSuggestion{flag: "exclude", value: pk,
+			reason: fmt.Sprintf("node %s (failed %d/%d attempts as hop)", r.cachedAlias(pk), s.failures, s.attempts)},
+			s})
+	}
+	channels := []struct {
+		tallies map[uint64]*sessionTally
+		flag    string
+		role    string
+	}{{t.sources, "exclude-channel-out", "source"}, {t.targets, "exclude-channel-in", "target"}}
+	for _, c := range channels {
+		for chanId, s := range c.tallies {
+			if s.attempts < suggestionMinSamples || s.failures < s.attempts {
+				continue
+			}
+			candidates = append(candidates, candidate{exclusionSuggestion{flag: c.flag, value: formatScid(chanId),
+				reason: fmt.Sprintf("channel %s (0/%d as %s, %s)", formatScid(chanId), s.attempts, c.role,
+					s.breakdown())}, s})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].tally, candidates[j].tally
+		if a.failures*b.attempts != b.failures*a.attempts {
+			return a.failures*b.attempts > b.failures*a.attempts
+		}
+		if a.attempts != b.attempts {
+			return a.attempts > b.attempts
+		}
+		return candidates[i].String() < candidates[j].String()
+	})
+	for _, c := range candidates {
+		result = append(result, c.exclusionSuggestion)
+	}
+	return
+}
+
+// cachedAlias returns the node alias if it's in the node cache or the node id
+// otherwise, it never queries lnd.
+func (r *regolancer) cachedAlias(pk string) string {
+	if n, ok := r.nodeCache[pk]; ok && n.NodeInfo != nil && n.NodeInfo.Node != nil {
+		return sanitizeAlias(n.NodeInfo.Node.Alias)
+	}
+	return pk
+}
+
+func (r *regolancer) printExclusionSuggestions() {
+	suggestions := r.exclusionSuggestions()
+	if len(suggestions) == 0 {
+		return
+	}
+	reasons := []string{}
+	for _, s := range suggestions {
+		reasons = append(reasons, s.reason)
+	}
+	log.Printf("Consider excluding: %s", strings.Join(reasons, ", "))
+	if params.WriteSuggestions == "" {
+		return
+	}
+	if err := writeExclusionSuggestions(params.WriteSuggestions, suggestions); err != nil {
+		logErrorF("Error writing exclusion suggestions: %s", err)
+		return
+	}
+	log.Printf("Exclusion suggestions saved to %s", params.WriteSuggestions)
+}
+
+// writeExclusionSuggestions saves the flags one per line preceded by the
+// reason comments.
+func writeExclusionSuggestions(filename string, suggestions []exclusionSuggestion) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, s := range suggestions {
+		if _, err := fmt.Fprintf(f, "# %s\n%s\n", s.reason, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// suggestionsTest replays a synthetic session failure log.
+func suggestionsTest() *regolancer {
+	r := &regolancer{nodeCache: map[string]cachedNodeInfo{
+		testPK(10): {NodeInfo: &lnrpc.NodeInfo{Node: &lnrpc.LightningNode{Alias: "hub"}}},
+	}}
+	failAt := func(hop int, code lnrpc.Failure_FailureCode) *lnrpc.Failure {
+		return &lnrpc.Failure{Code: code, FailureSourceIndex: uint32(hop + 1)}
+	}
+	// testPK(10) always fails to forward, testPK(11) after it is never tried
+	// but the route through it succeeds
+	viaHub := testRoute(1, 2, 100000, 10, testPK(1), testPK(10), testPK(11), testPeerPK)
+	for i := 0; i < 5; i++ {
+		r.tallyPayment(viaHub, failAt(1, lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE))
+	}
+	good := testRoute(3, 2, 100000, 10, testPK(3), testPK(11), testPeerPK)
+	for i := 0; i < 3; i++ {
+		r.tallyPayment(good, nil)
+	}
+	// the target channel 4 is never reachable, the other failures before
+	// paying don't count
+	for i := 0; i < 6; i++ {
+		r.tallyRouteFailure(3, 4, failNoRoute)
+	}
+	r.tallyRouteFailure(3, 4, "timeout")
+	// testPK(12) fails in 4 attempts, too few to tell
+	flaky := testRoute(7, 8, 100000, 10, testPK(7), testPK(12), testPeerPK)
+	for i := 0; i < 4; i++ {
+		r.tallyPayment(flaky, failAt(1, lnrpc.Failure_UNKNOWN_NEXT_PEER))
+	}
+	// testPK(13) fails in 80% of the attempts with different codes
+	mostly := testRoute(5, 6, 100000, 10, testPK(5), testPK(13), testPeerPK)
+	for _, code := range []lnrpc.Failure_FailureCode{lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE,
+		lnrpc.Failure_FEE_INSUFFICIENT, lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE, lnrpc.Failure_UNKNOWN_NEXT_PEER} {
+		r.tallyPayment(mostly, failAt(1, code))
+	}
+	r.tallyPayment(mostly, nil)
+	return r
+}
+
+func TestExclusionSuggestions(t *testing.T) {
+	r := suggestionsTest()
+	if s := r.sessionTallies.nodes[testPK(11)]; s.attempts != 8 || s.failures != 0 {
+		t.Errorf("the node after the failing one should have 8 successful attempts, got %+v", s)
+	}
+	if s := r.sessionTallies.sources[3]; s.attempts != 9 || s.failures != 6 {
+		t.Errorf("the source channel 3 should have 6/9 failures, got %+v", s)
+	}
+	suggestions := r.exclusionSuggestions()
+	flags := []string{}
+	for _, s := range suggestions {
+		flags = append(flags, s.String())
+	}
+	expected := []string{"--exclude-channel-in=0x0x4", "--exclude-channel-out=0x0x1", "--exclude=" + testPK(10),
+		"--exclude=" + testPK(13)}
+	if !reflect.DeepEqual(flags, expected) {
+		t.Fatalf("expected %v, got %v", expected, flags)
+	}
+	for i, reason := range []string{
+		"channel 0x0x4 (0/6 as target, all no_route)",
+		"channel 0x0x1 (0/5 as source, all temporary_channel_failure)",
+		"node hub (failed 5/5 attempts as hop)",
+		"node " + testPK(13) + " (failed 4/5 attempts as hop)",
+	} {
+		if suggestions[i].reason != reason {
+			t.Errorf("expected reason %q, got %q", reason, suggestions[i].reason)
+		}
+	}
+	mixed := sessionTally{}
+	for _, code := range []string{"b", "a", "b", "c", "a", "b"} {
+		mixed.add(true, code)
+	}
+	mixed.add(false, "")
+	if got := mixed.breakdown(); got != "3 b, 2 a, 1 c" {
+		t.Errorf("unexpected breakdown %q", got)
+	}
+}
+
+func TestWriteExclusionSuggestions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "suggestions.txt")
+	if err := writeExclusionSuggestions(filename, suggestionsTest().exclusionSuggestions()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 8 || lines[0] != "# channel 0x0x4 (0/6 as target, all no_route)" ||
+		lines[1] != "--exclude-channel-in=0x0x4" || lines[5] != "--exclude="+testPK(10) {
+		t.Errorf("unexpected suggestions file:\n%s", data)
+	}
+	// the flags can be passed back as is
+	args := []string{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "#") {
+			args = append(args, line)
+		}
+	}
+	p := configParams{}
+	if _, err := flags.NewParser(&p, flags.None).ParseArgs(args); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.ExcludeChannelsIn, []string{"0x0x4"}) ||
+		!reflect.DeepEqual(p.ExcludeChannelsOut, []string{"0x0x1"}) ||
+		!reflect.DeepEqual(p.Exclude, []string{testPK(10), testPK(13)}) {
+		t.Errorf("unexpected parsed exclusions %v, %v, %v", p.ExcludeChannelsIn, p.ExcludeChannelsOut, p.Exclude)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	exclusionListLimit = 10
+	// the --from, --to and --exclude entries with this prefix are alias patterns
+	aliasPrefix = "alias:"
+)
+
+// paramSource tells if the parameter value came from the config file (and
+// which one) or the command line, name is the parameter field name.
+func paramSource(name string, value, fileValue any) string {
+	if reflect.DeepEqual(value, fileValue) {
+		if filename, ok := configSources[name]; ok {
+			return "config " + filename
+		}
+		return "config"
+	}
+	return "command line"
+}
+
+// parseExclusions fills the excluded channel and node lists from the
+// parameters and records where every id came from. The --exclude list
+// replaces the deprecated --exclude-channel and --exclude-node lists.
+func (r *regolancer) parseExclusions(ctx context.Context) error {
+	r.excludeIn = makeChanSet(convertChanStringToInt(params.ExcludeChannelsIn))
+	r.addExclusions(r.excludeIn, nil, "--exclude-channel-in from "+
+		paramSource("ExcludeChannelsIn", params.ExcludeChannelsIn, fileParams.ExcludeChannelsIn))
+	r.excludeOut = makeChanSet(convertChanStringToInt(params.ExcludeChannelsOut))
+	r.addExclusions(r.excludeOut, nil, "--exclude-channel-out from "+
+		paramSource("ExcludeChannelsOut", params.ExcludeChannelsOut, fileParams.ExcludeChannelsOut))
+
+	r.excludeBoth = makeChanSet(convertChanStringToInt(params.ExcludeChannels))
+	bothSource := "--exclude-channel from " +
+		paramSource("ExcludeChannels", params.ExcludeChannels, fileParams.ExcludeChannels)
+	err := r.makeNodeList(params.ExcludeNodes)
+	if err != nil {
+		return fmt.Errorf("error parsing excluded node list: %s", err)
+	}
+	nodeSource := "--exclude-node from " + paramSource("ExcludeNodes", params.ExcludeNodes, fileParams.ExcludeNodes)
+
+	excludeSource := "--exclude from " + paramSource("Exclude", params.Exclude, fileParams.Exclude)
+	excludeIds, excludePatterns := splitAliasPatterns(params.Exclude)
+	if len(excludeIds) > 0 {
+		chans, nodes, err := parseNodeChannelIDs(excludeIds)
+		if err != nil {
+			return fmt.Errorf("error parsing excluded node/channel list: %s", err)
+		}
+		r.excludeBoth = chans
+		r.excludeNodes = nodes
+		bothSource = excludeSource
+		nodeSource = bothSource
+	}
+	r.addExclusions(r.excludeBoth, nil, bothSource)
+	r.addExclusions(nil, r.excludeNodes, nodeSource)
+
+	err = r.excludeAliases(ctx, excludePatterns, excludeSource)
+	if err == nil {
+		err = r.excludeAliases(ctx, params.ExcludeAlias, "--exclude-alias from "+
+			paramSource("ExcludeAlias", params.ExcludeAlias, fileParams.ExcludeAlias))
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing excluded alias list: %s", err)
+	}
+	return nil
+}
+
+// addExclusions records the source of the excluded channels and nodes, the
+// same id can be excluded by several sources and all of them are kept.
+func (r *regolancer) addExclusions(chans map[uint64]struct{}, nodes [][]byte, source string) {
+	if r.exclusionSources == nil {
+		r.exclusionSources = map[string][]string{}
+	}
+	add := func(id string) {
+		for _, s := range r.exclusionSources[id] {
+			if s == source {
+				return
+			}
+		}
+		r.exclusionSources[id] = append(r.exclusionSources[id], source)
+	}
+	for chanId := range chans {
+		add(fmt.Sprint(chanId))
+	}
+	for _, n := range nodes {
+		add(hex.EncodeToString(n))
+	}
+}
+
+// formatSources returns the recorded sources of the id as a suffix for the
+// exclusion list.
+func (r *regolancer) formatSources(id string) string {
+	sources := r.exclusionSources[id]
+	if len(sources) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(sources, ", ") + ")"
+}
+
+func (r *regolancer) formatChanList(ctx context.Context, chans map[uint64]struct{}) string {
+	ids := []uint64{}
+	for chanId := range chans {
+		ids = append(ids, chanId)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	result := []string{}
+	for i, chanId := range ids {
+		if i == exclusionListLimit {
+			result = append(result, fmt.Sprintf("and %d more", len(ids)-exclusionListLimit))
+			break
+		}
+		alias := ""
+		for _, c := range r.channels {
+			if c.ChanId == chanId {
+				if nodeInfo, err := r.getNodeInfo(ctx, c.RemotePubkey); err == nil {
+					alias = " " + cyanColor(sanitizeAlias(nodeInfo.Node.Alias))
+				}
+				break
+			}
+		}
+		result = append(result, fmt.Sprintf("%d%s%s", chanId, alias, r.formatSources(fmt.Sprint(chanId))))
+	}
+	return strings.Join(result, ", ")
+}
+
+// printExclusions shows the effective exclusions after all lists are parsed
+// and node ids are expanded, every id is followed by the sources that
+// excluded it.
+func (r *regolancer) printExclusions(ctx context.Context) {
+	exclusions := []struct {
+		name  string
+		chans map[uint64]struct{}
+	}{
+		{"as source", r.excludeOut},
+		{"as target", r.excludeIn},
+		{"completely", r.excludeBoth},
+		{"as disabled on our side", r.locallyDisabled},
+		{"as pending an update", r.pendingUpdates},
+	}
+	printed := false
+	for _, e := range exclusions {
+		if len(e.chans) == 0 {
+			continue
+		}
+		if !printed {
+			log.Print("Exclusions:")
+			printed = true
+		}
+		log.Printf("  %s channels excluded %s: %s", hiWhiteColor(len(e.chans)), e.name,
+			r.formatChanList(ctx, e.chans))
+	}
+	if len(r.excludeNodes) > 0 {
+		if !printed {
+			log.Print("Exclusions:")
+		}
+		nodes := []string{}
+		for i, n := range r.excludeNodes {
+			if i == exclusionListLimit {
+				nodes = append(nodes, fmt.Sprintf("and %d more", len(r.excludeNodes)-exclusionListLimit))
+				break
+			}
+			pk := hex.EncodeToString(n)
+			name := pk
+			if nodeInfo, err := r.getNodeInfo(ctx, pk); err == nil {
+				name = cyanColor(nodeInfo.Node.Alias)
+			}
+			nodes = append(nodes, name+r.formatSources(pk))
+		}
+		log.Printf("  %s nodes ignored for routing: %s", hiWhiteColor(len(r.excludeNodes)),
+			strings.Join(nodes, ", "))
+	}
+}
+
+// aliasRegexp compiles the alias pattern, it's either a glob with * and ?
+// wildcards that should match the whole alias or a regular expression
+// enclosed in slashes that should match a part of it. The case is ignored.
+func aliasRegexp(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+	}
+	glob := regexp.QuoteMeta(pattern)
+	glob = strings.ReplaceAll(glob, `\*`, ".*")
+	glob = strings.ReplaceAll(glob, `\?`, ".")
+	return regexp.Compile("(?i)^" + glob + "$")
+}
+
+// splitAliasPatterns separates the alias: entries from the channel and node
+// ids.
+func splitAliasPatterns(ids []string) (rest []string, patterns []string) {
+	for _, id := range ids {
+		if strings.HasPrefix(strings.ToLower(id), aliasPrefix) {
+			patterns = append(patterns, id[len(aliasPrefix):])
+			continue
+		}
+		rest = append(rest, id)
+	}
+	return
+}
+
+// nodesByAlias returns the peers and the nodes from the node cache whose alias
+// matches any of the patterns. The patterns that match nothing are reported so
+// that typos don't go unnoticed.
+func (r *regolancer) nodesByAlias(ctx context.Context, patterns []string) ([][]byte, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	aliases := map[string]string{}
+	for _, c := range r.channels {
+		if nodeInfo, err := r.getNodeInfo(ctx, c.RemotePubkey); err == nil {
+			aliases[c.RemotePubkey] = nodeInfo.Node.Alias
+		}
+	}
+	for pk, n := range r.nodeCache {
+		if n.NodeInfo != nil && n.NodeInfo.Node != nil {
+			aliases[pk] = n.NodeInfo.Node.Alias
+		}
+	}
+	matched := map[string]struct{}{}
+	for _, pattern := range patterns {
+		re, err := aliasRegexp(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alias pattern %s: %s", pattern, err)
+		}
+		found := 0
+		for pk, alias := range aliases {
+			if re.MatchString(alias) {
+				matched[pk] = struct{}{}
+				found++
+			}
+		}
+		if found == 0 {
+			logErrorF("Alias pattern %s matches no known node", pattern)
+			continue
+		}
+		log.Printf("Alias pattern %s matches %s nodes", cyanColor(pattern), hiWhiteColor(found))
+	}
+	pks := []string{}
+	for pk := range matched {
+		pks = append(pks, pk)
+	}
+	sort.Strings(pks)
+	result := [][]byte{}
+	for _, pk := range pks {
+		node, err := hex.DecodeString(pk)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, node)
+	}
+	return result, nil
+}
+
+// excludeAliases ignores the nodes matching --exclude-alias and the alias:
+// entries of --exclude for routing, our channels with them aren't used at all.
+// The excluded nodes and channels are recorded with the source.
+func (r *regolancer) excludeAliases(ctx context.Context, patterns []string, source string) error {
+	nodes, err := r.nodesByAlias(ctx, patterns)
+	if err != nil {
+		return err
+	}
+	if len(nodes) > 0 && r.excludeBoth == nil {
+		r.excludeBoth = map[uint64]struct{}{}
+	}
+	chans := map[uint64]struct{}{}
+	for _, node := range nodes {
+		r.excludeNodes = append(r.excludeNodes, node)
+		pk := hex.EncodeToString(node)
+		for _, c := range r.channels {
+			if c.RemotePubkey == pk {
+				r.excludeBoth[c.ChanId] = struct{}{}
+				chans[c.ChanId] = struct{}{}
+			}
+		}
+	}
+	r.addExclusions(chans, nodes, source)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// TestExclusionSources checks that every excluded id is recorded with the
+// sources that excluded it and that all of them are printed.
+func TestExclusionSources(t *testing.T) {
+	defer func(p, fp configParams) { params, fileParams = p, fp }(params, fileParams)
+	fileParams = configParams{ExcludeChannelsIn: []string{"2", "3"}}
+	params = configParams{ExcludeChannelsIn: []string{"2", "3"}, ExcludeChannelsOut: []string{"1"},
+		Exclude: []string{"3", testPK(9)}}
+	r, ln := newRouteTest(nil)
+	for i := 1; i <= 4; i++ {
+		r.channels = append(r.channels, &lnrpc.Channel{ChanId: uint64(i), RemotePubkey: testPK(i)})
+		ln.edges[uint64(i)] = &lnrpc.ChannelEdge{ChannelId: uint64(i), Node1Pub: testMyPK, Node2Pub: testPK(i),
+			Node1Policy: &lnrpc.RoutingPolicy{Disabled: i == 1 || i == 4}}
+		r.nodeCache[testPK(i)] = cachedNodeInfo{NodeInfo: &lnrpc.NodeInfo{Node: &lnrpc.LightningNode{Alias: "peer"}}}
+	}
+	if err := r.parseExclusions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.getLocallyDisabled(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		id      string
+		sources []string
+	}{
+		{"1", []string{"--exclude-channel-out from command line", "channel policy"}},
+		{"2", []string{"--exclude-channel-in from config"}},
+		{"3", []string{"--exclude-channel-in from config", "--exclude from command line"}},
+		{"4", []string{"channel policy"}},
+		{testPK(9), []string{"--exclude from command line"}},
+	} {
+		if sources := r.exclusionSources[tc.id]; !reflect.DeepEqual(sources, tc.sources) {
+			t.Errorf("%s: expected the sources %v, got %v", tc.id, tc.sources, sources)
+		}
+	}
+
+	// the excluded node is unknown and printed by its id
+	r.nodeCache[testPK(9)] = cachedNodeInfo{Timestamp: time.Now()}
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	r.printExclusions(context.Background())
+	for _, expected := range []string{
+		"excluded as source: 1 peer (--exclude-channel-out from command line, channel policy)",
+		"excluded as target: 2 peer (--exclude-channel-in from config), " +
+			"3 peer (--exclude-channel-in from config, --exclude from command line)",
+		"excluded completely: 3 peer (--exclude-channel-in from config, --exclude from command line)",
+		"excluded as disabled on our side: 1 peer (--exclude-channel-out from command line, channel policy), " +
+			"4 peer (channel policy)",
+		"ignored for routing: " + testPK(9) + " (--exclude from command line)",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected %q in the output:\n%s", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// explainf records a step of the fee limit calculation for --explain-fee.
+func (r *regolancer) explainf(format string, args ...any) {
+	if r.feeExplain == nil {
+		return
+	}
+	*r.feeExplain = append(*r.feeExplain, fmt.Sprintf(format, args...))
+}
+
+func parseExplainFee(s string) (from, to uint64, amount int64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("explain-fee should be from_chan,to_chan,amount, got %s", s)
+	}
+	chans := convertChanStringToInt(parts[:2])
+	amount, err = strconv.ParseInt(strings.TrimSpace(parts[2]), 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("error parsing amount %s: %s", parts[2], err)
+	}
+	return chans[0], chans[1], amount, nil
+}
+
+// explainFee prints how the max fee for the channel pair and amount is
+// calculated, it uses the same functions as the actual rebalance.
+func (r *regolancer) explainFee(ctx context.Context) error {
+	from, to, amount, err := parseExplainFee(params.ExplainFee)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(params.TimeoutInfo))
+	defer cancel()
+	steps := []string{}
+	r.feeExplain = &steps
+	defer func() {
+		r.feeExplain = nil
+	}()
+	feeMsat, _, neededPPM, err := r.calcFeeMsat(ctx, from, to, satToMsat(amount))
+	log.Printf("Max fee for %s sats from %s to %s:", hiWhiteColor(amount), hiWhiteColor(from), hiWhiteColor(to))
+	for i, step := range steps {
+		log.Printf("  %d. %s", i+1, step)
+	}
+	if err != nil {
+		return err
+	}
+	bound := "econ-ratio"
+	switch {
+	case r.feeBound == feeBoundCap:
+		bound = "fee-limit-ppm cap"
+	case params.FeeLimitPPM > 0 && !params.FeeLimitIsCap:
+		bound = "fee-limit-ppm"
+	case neededPPM > 0:
+		bound = "econ-ratio-max-ppm"
+	}
+	if r.feeScale.scale != 0 && r.feeScale.scale != 1 && r.feeBound != feeBoundCap {
+		bound += " with fee-limit-scale"
+	}
+	if r.feeMultiplier != 1 && r.feeBound != feeBoundCap {
+		bound += " with fee schedule"
+	}
+	log.Printf("Fee limit passed to QueryRoutes: %s msat (%s ppm), bound by %s", hiWhiteColor(feeMsat),
+		formatFeePPM(satToMsat(amount), feeMsat), hiWhiteColor(bound))
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestParseExplainFee(t *testing.T) {
+	from, to, amount, err := parseExplainFee("1,2,1000")
+	if err != nil || from != 1 || to != 2 || amount != 1000 {
+		t.Errorf("unexpected result %d, %d, %d, %v", from, to, amount, err)
+	}
+	for _, s := range []string{"1,2", "1,2,3,4", "1,2,x"} {
+		if _, _, _, err := parseExplainFee(s); err == nil {
+			t.Errorf("%q should fail", s)
+		}
+	}
+}
+
+// TestExplainFee checks that the explanation ends with the same fee limit as
+// the one used for rebalancing and names the bound.
+func TestExplainFee(t *testing.T) {
+	defer func(p configParams, noColor bool, flags int) {
+		params = p
+		color.NoColor = noColor
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}(params, color.NoColor, log.Flags())
+	color.NoColor = true
+	log.SetFlags(0)
+	r, ln := newRouteTest(nil)
+	ln.edges[1] = &lnrpc.ChannelEdge{ChannelId: 1, Node1Pub: testMyPK, Node2Pub: testPK(1),
+		Node1Policy: &lnrpc.RoutingPolicy{FeeRateMilliMsat: 100}}
+	ln.edges[2].Node2Policy = &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 500}
+	for _, tc := range []struct {
+		name        string
+		feeLimitPPM int64
+		isCap       bool
+		maxPPM      int64
+		expected    Msat
+		bound       string
+		step        string
+	}{
+		{"fee limit ppm", 1000, false, 0, 1000, "fee-limit-ppm", "fee-limit-ppm 1000"},
+		// (1000 + 500) * 0.5 - 100
+		{"econ ratio", 0, false, 0, 650, "econ-ratio", "lost profit 100 msat"},
+		{"econ ratio max ppm", 0, false, 300, 300, "econ-ratio-max-ppm", "econ-ratio-max-ppm 300 caps 650 ppm"},
+		{"fee limit cap", 500, true, 0, 500, "fee-limit-ppm cap", "fee-limit-ppm 500 caps the fee"},
+	} {
+		params.ExplainFee = "1,2,1000"
+		params.FeeLimitPPM, params.FeeLimitIsCap, params.EconRatioMaxPPM = tc.feeLimitPPM, tc.isCap, tc.maxPPM
+		params.EconRatio, params.LostProfit = 0.5, true
+		feeMsat, _, _, err := r.calcFeeMsat(context.Background(), 1, 2, satToMsat(1000))
+		if err != nil || feeMsat != tc.expected {
+			t.Fatalf("%s: expected %d msat, got %d msat, error %v", tc.name, tc.expected, feeMsat, err)
+		}
+		buf := &bytes.Buffer{}
+		log.SetOutput(buf)
+		err = r.explainFee(context.Background())
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		out := buf.String()
+		if !strings.Contains(out, fmt.Sprintf("Fee limit passed to QueryRoutes: %d msat", feeMsat)) ||
+			!strings.HasSuffix(out, "bound by "+tc.bound+"\n") || !strings.Contains(out, tc.step) {
+			t.Errorf("%s: unexpected explanation\n%s", tc.name, out)
+		}
+		if r.feeExplain != nil {
+			t.Errorf("%s: the steps should only be collected while explaining", tc.name)
+		}
+	}
+	params.ExplainFee = "1,2"
+	if err := r.explainFee(context.Background()); err == nil {
+		t.Error("the invalid --explain-fee should fail")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// explorer spends a bounded budget at the start of the run on the corridors
+// (the nodes between our peers) that never forwarded our payments according
+// to the hop history.
+type explorer struct {
+	until       time.Time
+	feesStart   Msat
+	done        bool
+	discoveries []string
+}
+
+// exploring reports if the explore window is open and the budget isn't spent
+// yet. The window starts with the first session.
+func (r *regolancer) exploring() bool {
+	e := &r.explorer
+	if params.ExploreMinutes == 0 || e.done {
+		return false
+	}
+	if e.until.IsZero() {
+		e.until = time.Now().Add(time.Minute * time.Duration(params.ExploreMinutes))
+		e.feesStart = r.totalFeesMsat
+		log.Print(infoColorF("Exploring new corridors for %d minutes", params.ExploreMinutes))
+	}
+	if time.Now().After(e.until) {
+		r.stopExploring("explore window is over")
+		return false
+	}
+	if params.ExploreBudget > 0 && r.exploreBudgetLeft() <= 0 {
+		r.stopExploring("explore budget is spent")
+		return false
+	}
+	return true
+}
+
+func (r *regolancer) exploreBudgetLeft() Msat {
+	return satToMsat(params.ExploreBudget) - (r.totalFeesMsat - r.explorer.feesStart)
+}
+
+func (r *regolancer) stopExploring(reason string) {
+	r.explorer.done = true
+	log.Print(infoColorF("Stopped exploring: %s, back to normal", reason))
+}
+
+// knownCorridor reports if every hop between our peers forwarded our payments
+// before.
+func (r *regolancer) knownCorridor(route *lnrpc.Route) bool {
+	for i := 1; i < len(route.Hops)-1; i++ {
+		s, ok := r.hopHistory[hopKey(route.Hops[i-1].PubKey, route.Hops[i].PubKey)]
+		if !ok || s.Attempts <= s.Failures {
+			return false
+		}
+	}
+	return true
+}
+
+// exploreRoutes shuffles the routes and puts the new corridors first. If all
+// routes go through the known corridors lnd is asked once more ignoring them.
+func (r *regolancer) exploreRoutes(ctx context.Context, a *rebalanceAttempt) {
+	rand.Shuffle(len(a.routes), func(i, j int) { a.routes[i], a.routes[j] = a.routes[j], a.routes[i] })
+	sort.SliceStable(a.routes, func(i, j int) bool {
+		return !r.knownCorridor(a.routes[i]) && r.knownCorridor(a.routes[j])
+	})
+	if !r.knownCorridor(a.routes[0]) {
+		return
+	}
+	defer func() {
+		r.routeChoicePairs = nil
+	}()
+	for _, route := range a.routes {
+		pairs, err := routeNodePairs(route)
+		if err != nil {
+			return
+		}
+		r.routeChoicePairs = append(r.routeChoicePairs, pairs...)
+	}
+	routes, _, err := r.getRoutes(ctx, a.from, a.to, a.amount)
+	if err != nil || r.knownCorridor(routes[0]) {
+		return
+	}
+	log.Print(infoColor("Found a new corridor ignoring the known ones"))
+	a.routes = append(routes[:1], a.routes...)
+}
+
+// fitExploreBudget skips the routes that cost more than the rest of the
+// explore budget.
+func (r *regolancer) fitExploreBudget(route *lnrpc.Route) error {
+	if params.ExploreBudget == 0 {
+		return nil
+	}
+	if left := r.exploreBudgetLeft(); Msat(route.TotalFeesMsat) > left {
+		return fmt.Errorf("route fee %s sat exceeds the explore budget left %s sat, skipping it",
+			formatFee(Msat(route.TotalFeesMsat)), formatFee(left))
+	}
+	return nil
+}
+
+// addDiscovery records the successfully paid route if its corridor is new,
+// it's called before the hop history is updated.
+func (r *regolancer) addDiscovery(ctx context.Context, route *lnrpc.Route) {
+	if r.explorer.until.IsZero() || r.explorer.done || r.knownCorridor(route) {
+		return
+	}
+	nodes := []string{}
+	for _, h := range route.Hops[:len(route.Hops)-1] {
+		alias := h.PubKey
+		if nodeInfo, err := r.getNodeInfo(ctx, h.PubKey); err == nil {
+			alias = nodeInfo.Node.Alias
+		}
+		nodes = append(nodes, alias)
+	}
+	corridor := fmt.Sprintf("%s via %s", r.pairLabel(ctx, route.Hops[0].ChanId, route.Hops[len(route.Hops)-1].ChanId),
+		strings.Join(nodes, " ⇒ "))
+	log.Printf("%s %s", greenColor("New corridor discovered:"), corridor)
+	r.explorer.discoveries = append(r.explorer.discoveries, corridor)
+}
+
+func (r *regolancer) printDiscoveries() {
+	if len(r.explorer.discoveries) == 0 {
+		return
+	}
+	log.Printf("Discovered %s new corridors:", hiWhiteColor(len(r.explorer.discoveries)))
+	for _, d := range r.explorer.discoveries {
+		log.Printf("  %s", d)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeLightning is an lnd client for the tests, only the calls used by the
+// test need to be implemented, the rest panic on the nil interface.
+type fakeLightning struct {
+	lnrpc.LightningClient
+	invoices     int64
+	edges        map[uint64]*lnrpc.ChannelEdge
+	routes       func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error)
+	queries      int
+	nodes        func(pk string) *lnrpc.NodeInfo
+	forwards     []*lnrpc.ForwardingEvent
+	forwardPages int
+	channels     []*lnrpc.Channel
+	pending      *lnrpc.PendingChannelsResponse
+	// GetInfo returns height or fails with infoErr
+	height  uint32
+	infoErr error
+	infos   int
+	// the lnd clock is ahead by clockSkew
+	clockSkew    time.Duration
+	lookups      int
+	openInvoices []*lnrpc.Invoice
+}
+
+// test node ids, the channel 2 is the target with testPeerPK
+var (
+	testMyPK   = "02" + strings.Repeat("aa", 32)
+	testPeerPK = "03" + strings.Repeat("bb", 32)
+)
+
+func testPK(n int) string {
+	return fmt.Sprintf("02%064x", n)
+}
+
+// testRoute builds a valid route delivering amtMsat to our node through the
+// nodes, the last one should be testPeerPK.
+func testRoute(from, to uint64, amtMsat, feeMsat int64, nodes ...string) *lnrpc.Route {
+	route := &lnrpc.Route{TotalAmtMsat: amtMsat + feeMsat, TotalFeesMsat: feeMsat}
+	for i, pk := range append(nodes, testMyPK) {
+		chanId := uint64(1000 + i)
+		switch i {
+		case 0:
+			chanId = from
+		case len(nodes):
+			chanId = to
+		}
+		route.Hops = append(route.Hops, &lnrpc.Hop{ChanId: chanId, PubKey: pk, AmtToForwardMsat: amtMsat})
+	}
+	return route
+}
+
+// newRouteTest returns the session with the target channel 2 and the source
+// channel 1, the routes are returned by routes.
+func newRouteTest(routes func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error)) (*regolancer,
+	*fakeLightning) {
+	params.TimeoutRoute = routeTimeout{seconds: 10}
+	params.FeeLimitPPM = 1000
+	params.MaxRequeries = 3
+	params.FailTolerance = 1000
+	ln := &fakeLightning{routes: routes, edges: map[uint64]*lnrpc.ChannelEdge{
+		2: {ChannelId: 2, Node1Pub: testPeerPK, Node2Pub: testMyPK,
+			Node1Policy: &lnrpc.RoutingPolicy{}, Node2Policy: &lnrpc.RoutingPolicy{}},
+	}}
+	return &regolancer{
+		myPK:           testMyPK,
+		lnClient:       ln,
+		chanCache:      map[uint64]*lnrpc.ChannelEdge{},
+		chanCacheTimes: map[uint64]time.Time{},
+		nodeCache:      map[string]cachedNodeInfo{},
+		mcCache:        map[string]failedAmount{},
+	}, ln
+}
+
+func (f *fakeLightning) QueryRoutes(ctx context.Context, in *lnrpc.QueryRoutesRequest,
+	opts ...grpc.CallOption) (*lnrpc.QueryRoutesResponse, error) {
+	f.queries++
+	return f.routes(in)
+}
+
+func (f *fakeLightning) GetChanInfo(ctx context.Context, in *lnrpc.ChanInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.ChannelEdge, error) {
+	if edge, ok := f.edges[in.ChanId]; ok {
+		return edge, nil
+	}
+	return nil, status.Error(codes.NotFound, "edge not found")
+}
+
+func (f *fakeLightning) GetNodeInfo(ctx context.Context, in *lnrpc.NodeInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.NodeInfo, error) {
+	if f.nodes == nil {
+		return nil, status.Error(codes.NotFound, "node not found")
+	}
+	node := f.nodes(in.PubKey)
+	if !in.IncludeChannels {
+		node.Channels = nil
+	}
+	return node, nil
+}
+
+func (f *fakeLightning) ListChannels(ctx context.Context, in *lnrpc.ListChannelsRequest,
+	opts ...grpc.CallOption) (*lnrpc.ListChannelsResponse, error) {
+	resp := &lnrpc.ListChannelsResponse{}
+	peer := hex.EncodeToString(in.Peer)
+	for _, c := range f.channels {
+		if (!in.PublicOnly || !c.Private) && (peer == "" || c.RemotePubkey == peer) {
+			// lnd returns fresh messages on every call
+			resp.Channels = append(resp.Channels, proto.Clone(c).(*lnrpc.Channel))
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeLightning) PendingChannels(ctx context.Context, in *lnrpc.PendingChannelsRequest,
+	opts ...grpc.CallOption) (*lnrpc.PendingChannelsResponse, error) {
+	if f.pending == nil {
+		return &lnrpc.PendingChannelsResponse{}, nil
+	}
+	return f.pending, nil
+}
+
+func (f *fakeLightning) GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.GetInfoResponse, error) {
+	f.infos++
+	if f.infoErr != nil {
+		return nil, f.infoErr
+	}
+	return &lnrpc.GetInfoResponse{IdentityPubkey: testMyPK, BlockHeight: f.height}, nil
+}
+
+func (f *fakeLightning) AddInvoice(ctx context.Context, in *lnrpc.Invoice,
+	opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+	n := atomic.AddInt64(&f.invoices, 1)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	hash := sha256.Sum256(b[:])
+	return &lnrpc.AddInvoiceResponse{RHash: hash[:], PaymentAddr: hash[:]}, nil
+}
+
+func (f *fakeLightning) ForwardingHistory(ctx context.Context, in *lnrpc.ForwardingHistoryRequest,
+	opts ...grpc.CallOption) (*lnrpc.ForwardingHistoryResponse, error) {
+	f.forwardPages++
+	resp := &lnrpc.ForwardingHistoryResponse{LastOffsetIndex: in.IndexOffset}
+	for i := int(in.IndexOffset); i < len(f.forwards) && len(resp.ForwardingEvents) < int(in.NumMaxEvents); i++ {
+		resp.LastOffsetIndex = uint32(i + 1)
+		if e := f.forwards[i]; e.Timestamp >= in.StartTime && e.Timestamp <= in.EndTime {
+			resp.ForwardingEvents = append(resp.ForwardingEvents, e)
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeLightning) ListInvoices(ctx context.Context, in *lnrpc.ListInvoiceRequest,
+	opts ...grpc.CallOption) (*lnrpc.ListInvoiceResponse, error) {
+	resp := &lnrpc.ListInvoiceResponse{}
+	for i := in.IndexOffset; i < uint64(len(f.openInvoices)) && uint64(len(resp.Invoices)) < in.NumMaxInvoices; i++ {
+		resp.Invoices = append(resp.Invoices, f.openInvoices[i])
+		resp.LastIndexOffset = i + 1
+	}
+	return resp, nil
+}
+
+func (f *fakeLightning) LookupInvoice(ctx context.Context, in *lnrpc.PaymentHash,
+	opts ...grpc.CallOption) (*lnrpc.Invoice, error) {
+	f.lookups++
+	return &lnrpc.Invoice{RHash: in.RHash, CreationDate: time.Now().Add(f.clockSkew).Unix()}, nil
+}
+
+// fakeSender pays the routes with send or sendHash if the payment hash
+// matters.
+type fakeSender struct {
+	send     func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error)
+	sendHash func(ctx context.Context, hash []byte, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error)
+}
+
+func (s *fakeSender) sendToRoute(ctx context.Context, hash []byte, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+	if s.sendHash != nil {
+		return s.sendHash(ctx, hash, route)
+	}
+	return s.send(ctx, route)
+}
+
+// failedHTLC is the attempt that failed at the hop index.
+func failedHTLC(index uint32) *lnrpc.HTLCAttempt {
+	return &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_FAILED,
+		Failure: &lnrpc.Failure{Code: lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE, FailureSourceIndex: index}}
+}
+
+// fakeRouter reports the final payment state for TrackPaymentV2, builds the
+// routes with build and counts the mission control resets.
+type fakeRouter struct {
+	routerrpc.RouterClient
+	payment *lnrpc.Payment
+	build   func(req *routerrpc.BuildRouteRequest) (*lnrpc.Route, error)
+	tracked int
+	resets  int
+}
+
+func (f *fakeRouter) ResetMissionControl(ctx context.Context, in *routerrpc.ResetMissionControlRequest,
+	opts ...grpc.CallOption) (*routerrpc.ResetMissionControlResponse, error) {
+	f.resets++
+	return &routerrpc.ResetMissionControlResponse{}, nil
+}
+
+func (f *fakeRouter) BuildRoute(ctx context.Context, in *routerrpc.BuildRouteRequest,
+	opts ...grpc.CallOption) (*routerrpc.BuildRouteResponse, error) {
+	route, err := f.build(in)
+	if err != nil {
+		return nil, err
+	}
+	return &routerrpc.BuildRouteResponse{Route: route}, nil
+}
+
+type fakeTrackStream struct {
+	routerrpc.Router_TrackPaymentV2Client
+	payments []*lnrpc.Payment
+}
+
+func (s *fakeTrackStream) Recv() (*lnrpc.Payment, error) {
+	if len(s.payments) == 0 {
+		return nil, io.EOF
+	}
+	p := s.payments[0]
+	s.payments = s.payments[1:]
+	return p, nil
+}
+
+func (f *fakeRouter) TrackPaymentV2(ctx context.Context, in *routerrpc.TrackPaymentRequest,
+	opts ...grpc.CallOption) (routerrpc.Router_TrackPaymentV2Client, error) {
+	f.tracked++
+	return &fakeTrackStream{payments: []*lnrpc.Payment{{Status: lnrpc.Payment_IN_FLIGHT}, f.payment}}, nil
+}
+
+// fakeInvoices records the cancelled invoices or fails with err, onCancel is
+// called for every cancelled invoice if set.
+type fakeInvoices struct {
+	invoicesrpc.InvoicesClient
+	err       error
+	cancelled [][]byte
+	onCancel  func()
+}
+
+func (f *fakeInvoices) CancelInvoice(ctx context.Context, in *invoicesrpc.CancelInvoiceMsg,
+	opts ...grpc.CallOption) (*invoicesrpc.CancelInvoiceResp, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.cancelled = append(f.cancelled, in.PaymentHash)
+	if f.onCancel != nil {
+		f.onCancel()
+	}
+	return &invoicesrpc.CancelInvoiceResp{}, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrDailyFeeBudgetReached = fmt.Errorf("daily fee budget reached")
+
+// readFeeLedger sums the fees in msat paid today according to the fee ledger
+// file. Every line is the payment time in unix seconds and the fee in msat,
+// the malformed lines are skipped.
+func readFeeLedger(filename string) (Msat, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return 0, fmt.Errorf("error opening fee ledger file: %s", err)
+		}
+		return 0, nil
+	}
+	defer f.Close()
+	today := time.Now().Format(ledgerDateFormat)
+	var result Msat
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		fee, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if time.Unix(ts, 0).Format(ledgerDateFormat) == today {
+			result += Msat(fee)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// dailyFees returns the fees paid today by all instances sharing the fee
+// ledger.
+func dailyFees(filename string) (Msat, error) {
+	l := lock()
+	l.RLock()
+	defer l.Unlock()
+	return readFeeLedger(filename)
+}
+
+// addFeeLedger appends the fee to the ledger file. The lines are short and
+// written with a single append under the lock so the concurrently running
+// instances don't mix them up.
+func addFeeLedger(filename string, fee Msat) error {
+	if filename == "" {
+		return nil
+	}
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening fee ledger file: %s", err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%d %d\n", time.Now().Unix(), fee)
+	return err
+}
+
+// checkDailyFeeBudget rereads the fee ledger before the payment as other
+// instances could've spent the budget in the meantime.
+func (r *regolancer) checkDailyFeeBudget(fee Msat) error {
+	if params.DailyFeeBudget == 0 {
+		return nil
+	}
+	spent, err := dailyFees(params.FeeLedger)
+	if err != nil {
+		return err
+	}
+	left := satToMsat(params.DailyFeeBudget) - spent
+	if fee <= left {
+		return nil
+	}
+	if left < 0 {
+		left = 0
+	}
+	r.feeBudgetErr = ErrDailyFeeBudgetReached
+	logErrorF("Route fee %s sat doesn't fit in the daily fee budget, %s of %d sat left, stopping", formatFee(fee),
+		formatFee(left), params.DailyFeeBudget)
+	return ErrDailyFeeBudgetReached
+}
+
+// dailyFeeBudgetLeft prints the remaining daily fee budget, it returns false if
+// nothing is left.
+func dailyFeeBudgetLeft() (bool, error) {
+	spent, err := dailyFees(params.FeeLedger)
+	if err != nil {
+		return false, err
+	}
+	left := satToMsat(params.DailyFeeBudget) - spent
+	if left <= 0 {
+		log.Printf("Paid %s sat in fees today, the daily fee budget of %s sat is reached", formatFee(spent),
+			hiWhiteColor(params.DailyFeeBudget))
+		return false, nil
+	}
+	log.Printf("Paid %s sat in fees today, %s sat of the daily fee budget left", formatFee(spent), formatFee(left))
+	return true, nil
+}
@@ -3,8 +3,17 @@ package main
 import (
 	"fmt"
 	"log"
+	"strings"
+	"unicode"
 
 	"github.com/fatih/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+const (
+	maxAliasLen     = 20
+	liquidityBarLen = 20
 )
 
 var (
@@ -12,6 +21,7 @@ var (
 	hiWhiteColor    = color.New(color.FgHiWhite, color.Bold).SprintFunc()
 	hiWhiteColorF   = color.New(color.FgHiWhite, color.Bold).SprintfFunc()
 	cyanColor       = color.New(color.FgBlue, color.Bold).SprintFunc()
+	greenColor      = color.New(color.FgGreen, color.Bold).SprintFunc()
 	errColor        = color.New(color.FgHiRed, color.Bold).SprintFunc()
 	errColorF       = color.New(color.FgHiRed, color.Bold).SprintfFunc()
 	infoColor       = color.New(color.FgHiYellow, color.Bold).SprintFunc()
@@ -39,18 +49,74 @@ func formatAmt(amt int64) string {
 	return errColor("error: ", amt)
 }
 
-func formatFee(amtMsat int64) string {
+// liquidityBar shows the local (green) and remote (blue) balance shares of the
+// channel, the local part is red if it's below our reserve. Without colors the
+// local part is drawn with # (! below the reserve) and the remote with -.
+func liquidityBar(c *lnrpc.Channel) string {
+	local := 0
+	if c.Capacity > 0 {
+		local = int((c.LocalBalance*liquidityBarLen*2 + c.Capacity) / (c.Capacity * 2))
+	}
+	if local > liquidityBarLen {
+		local = liquidityBarLen
+	}
+	belowReserve := c.LocalConstraints != nil && c.LocalBalance < int64(c.LocalConstraints.ChanReserveSat)
+	if color.NoColor {
+		localChar := "#"
+		if belowReserve {
+			localChar = "!"
+		}
+		return "[" + strings.Repeat(localChar, local) + strings.Repeat("-", liquidityBarLen-local) + "]"
+	}
+	localColor := greenColor
+	if belowReserve {
+		localColor = errColor
+	}
+	result := "["
+	if local > 0 {
+		result += localColor(strings.Repeat("█", local))
+	}
+	if local < liquidityBarLen {
+		result += cyanColor(strings.Repeat("█", liquidityBarLen-local))
+	}
+	return result + "]"
+}
+
+func formatFee(amtMsat Msat) string {
 	if amtMsat < 1000 {
 		return hiWhiteColorF("0.%03d", amtMsat)
 	}
-	return hiWhiteColor(amtMsat / 1000)
+	return hiWhiteColor(amtMsat.sats())
 }
 
-func formatFeePPM(amtMsat int64, feeMsat int64) string {
-
-	return hiWhiteColor(int64(float64(feeMsat) / float64(amtMsat) * 1e6))
+func formatFeePPM(amtMsat Msat, feeMsat Msat) string {
+	return hiWhiteColor(feePPM(amtMsat, feeMsat))
 }
 
 func logErrorF(fmt string, args ...any) {
+	if jsonLog() {
+		emitEvent(logEvent{Level: "error", Event: "log", Msg: errColorF(fmt, args...)})
+		return
+	}
 	log.Print(errColorF(fmt, args...))
 }
+
+func formatScid(chanId uint64) string {
+	scid := lnwire.NewShortChanIDFromInt(chanId)
+	return fmt.Sprintf("%dx%dx%d", scid.BlockHeight, scid.TxIndex, scid.TxPosition)
+}
+
+// sanitizeAlias replaces invalid UTF-8 sequences, drops control characters and
+// truncates long aliases.
+func sanitizeAlias(alias string) string {
+	alias = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(alias, "\uFFFD"))
+	if runes := []rune(alias); len(runes) > maxAliasLen {
+		alias = string(runes[:maxAliasLen-1]) + "…"
+	}
+	return alias
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden compares the output with testdata/name or updates it with
+// -update.
+func checkGolden(t *testing.T, name string, output []byte) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(golden, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, expected) {
+		t.Errorf("output differs from %s, run the test with -update if it's expected:\n%s", golden, output)
+	}
+}
+
+func candidatesTest() *regolancer {
+	node := func(alias string) cachedNodeInfo {
+		return cachedNodeInfo{NodeInfo: &lnrpc.NodeInfo{Node: &lnrpc.LightningNode{Alias: alias}}}
+	}
+	channels := []*lnrpc.Channel{
+		{ChanId: 850000<<40 | 1<<16 | 1, RemotePubkey: "alice", Capacity: 1000000, LocalBalance: 900000,
+			RemoteBalance: 100000},
+		{ChanId: 850000<<40 | 2<<16 | 1, RemotePubkey: "bob", Capacity: 1000000, LocalBalance: 150000,
+			RemoteBalance: 850000, LocalConstraints: &lnrpc.ChannelConstraints{ChanReserveSat: 200000}},
+		{ChanId: 850000<<40 | 3<<16 | 1, RemotePubkey: "unknown", Capacity: 500000, LocalBalance: 0,
+			RemoteBalance: 500000},
+		{ChanId: 850000<<40 | 4<<16 | 1, RemotePubkey: "carol", Capacity: 5000000, LocalBalance: 5000000},
+	}
+	return &regolancer{
+		lnClient: &fakeLightning{},
+		channels: channels,
+		nodeCache: map[string]cachedNodeInfo{
+			"alice": node("Alice"),
+			"bob":   node("Bob's very long alias that is truncated"),
+			"carol": node("Carol"),
+		},
+		fromChannels: []*lnrpc.Channel{channels[0], channels[3]},
+		toChannels:   []*lnrpc.Channel{channels[1], channels[2]},
+		channelPairs: map[string][2]*lnrpc.Channel{},
+	}
+}
+
+func TestCandidatesGolden(t *testing.T) {
+	defer func(noColor bool, flags int) {
+		color.NoColor = noColor
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}(color.NoColor, log.Flags())
+	for _, tc := range []struct {
+		golden  string
+		noColor bool
+	}{
+		{"candidates_color.golden", false},
+		{"candidates_nocolor.golden", true},
+	} {
+		color.NoColor = tc.noColor
+		buf := &bytes.Buffer{}
+		log.SetOutput(buf)
+		log.SetFlags(0)
+		candidatesTest().printCandidates(context.Background())
+		checkGolden(t, tc.golden, buf.Bytes())
+	}
+}
+
+func TestLiquidityBar(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+	for _, tc := range []struct {
+		channel *lnrpc.Channel
+		bar     string
+	}{
+		{&lnrpc.Channel{Capacity: 1000, LocalBalance: 500}, "[##########----------]"},
+		// rounded to the nearest character
+		{&lnrpc.Channel{Capacity: 1000, LocalBalance: 24}, "[--------------------]"},
+		{&lnrpc.Channel{Capacity: 1000, LocalBalance: 25}, "[#-------------------]"},
+		{&lnrpc.Channel{Capacity: 1000, LocalBalance: 1000}, "[####################]"},
+		{&lnrpc.Channel{Capacity: 1000, LocalBalance: 1200}, "[####################]"},
+		{&lnrpc.Channel{Capacity: 0}, "[--------------------]"},
+		{&lnrpc.Channel{Capacity: 1000, LocalBalance: 100,
+			LocalConstraints: &lnrpc.ChannelConstraints{ChanReserveSat: 200}}, "[!!------------------]"},
+	} {
+		if got := liquidityBar(tc.channel); got != tc.bar {
+			t.Errorf("%d/%d: got %s, expected %s", tc.channel.LocalBalance, tc.channel.Capacity, got, tc.bar)
+		}
+	}
+}
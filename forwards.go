@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const forwardingHistoryPage = 10000
+
+// forwardedOut sums the amounts (in sats) forwarded out through our channels
+// in the last hours, the result is cached for the session.
+func (r *regolancer) forwardedOut(ctx context.Context, hours int) (map[uint64]int64, error) {
+	if r.forwardsOut != nil && r.forwardsHours == hours {
+		return r.forwardsOut, nil
+	}
+	result := map[uint64]int64{}
+	end := time.Now()
+	req := &lnrpc.ForwardingHistoryRequest{
+		StartTime:    uint64(end.Add(-time.Hour * time.Duration(hours)).Unix()),
+		EndTime:      uint64(end.Unix()),
+		NumMaxEvents: forwardingHistoryPage,
+	}
+	for {
+		resp, err := r.lnClient.ForwardingHistory(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		sumForwardedOut(result, resp.ForwardingEvents)
+		if len(resp.ForwardingEvents) < forwardingHistoryPage {
+			break
+		}
+		req.IndexOffset = resp.LastOffsetIndex
+	}
+	r.forwardsOut = result
+	r.forwardsHours = hours
+	return result, nil
+}
+
+func sumForwardedOut(result map[uint64]int64, events []*lnrpc.ForwardingEvent) {
+	for _, e := range events {
+		result[e.ChanIdOut] += int64(e.AmtOut)
+	}
+}
+
+// filterTargetsByDemand skips the target channels that didn't forward enough
+// out recently, refilling them is likely pointless.
+func (r *regolancer) filterTargetsByDemand(ctx context.Context) error {
+	r.demandExcludedTo = map[uint64]struct{}{}
+	if params.MinTargetActivity == 0 {
+		return nil
+	}
+	forwarded, err := r.forwardedOut(ctx, params.TargetActivityHours)
+	if err != nil {
+		return err
+	}
+	for _, c := range r.channels {
+		if forwarded[c.ChanId] >= params.MinTargetActivity {
+			continue
+		}
+		r.demandExcludedTo[c.ChanId] = struct{}{}
+		log.Printf("Channel %s skipped as target, no recent demand: %s sats forwarded out in the last %d hours",
+			hiWhiteColor(c.ChanId), hiWhiteColor(forwarded[c.ChanId]), params.TargetActivityHours)
+	}
+	return nil
+}
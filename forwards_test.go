@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// TestTargetDemand checks the targets against the amounts forwarded out
+// through them, the history is read in pages and only once.
+func TestTargetDemand(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MinTargetActivity, params.TargetActivityHours = 100000, 24
+	recent := uint64(time.Now().Add(-time.Hour).Unix())
+	old := uint64(time.Now().Add(-time.Hour * 48).Unix())
+	ln := &fakeLightning{}
+	// the channel 1 forwards a lot in small amounts spanning two pages
+	for i := 0; i < forwardingHistoryPage+10; i++ {
+		ln.forwards = append(ln.forwards, &lnrpc.ForwardingEvent{ChanIdIn: 3, ChanIdOut: 1, AmtOut: 10,
+			Timestamp: recent})
+	}
+	ln.forwards = append(ln.forwards,
+		// exactly the threshold
+		&lnrpc.ForwardingEvent{ChanIdIn: 1, ChanIdOut: 2, AmtOut: 100000, Timestamp: recent},
+		// the forwards into the channel don't count
+		&lnrpc.ForwardingEvent{ChanIdIn: 3, ChanIdOut: 4, AmtOut: 50000, Timestamp: recent},
+		&lnrpc.ForwardingEvent{ChanIdIn: 4, ChanIdOut: 1, AmtOut: 500000, Timestamp: recent},
+		// too old
+		&lnrpc.ForwardingEvent{ChanIdIn: 1, ChanIdOut: 3, AmtOut: 500000, Timestamp: old},
+	)
+	r := &regolancer{lnClient: ln}
+	for id := uint64(1); id <= 5; id++ {
+		r.channels = append(r.channels, &lnrpc.Channel{ChanId: id})
+	}
+	if err := r.filterTargetsByDemand(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ln.forwardPages != 2 {
+		t.Errorf("expected 2 pages, got %d", ln.forwardPages)
+	}
+	if r.forwardsOut[1] != 10*(forwardingHistoryPage+10)+500000 || r.forwardsOut[4] != 50000 {
+		t.Errorf("unexpected forwarded amounts %v", r.forwardsOut)
+	}
+	for id, excluded := range map[uint64]bool{1: false, 2: false, 3: true, 4: true, 5: true} {
+		if _, ok := r.demandExcludedTo[id]; ok != excluded {
+			t.Errorf("channel %d excluded: %t", id, ok)
+		}
+	}
+	// the history is cached
+	if err := r.filterTargetsByDemand(context.Background()); err != nil || ln.forwardPages != 2 {
+		t.Errorf("the forwarding history should be read once, got %d pages, error %v", ln.forwardPages, err)
+	}
+	params.MinTargetActivity = 0
+	if err := r.filterTargetsByDemand(context.Background()); err != nil || len(r.demandExcludedTo) != 0 {
+		t.Errorf("nothing should be excluded without the threshold, got %v", r.demandExcludedTo)
+	}
+}
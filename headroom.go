@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// the exploratory query uses this multiple of the fee limit
+const feeHeadroomFactor = 2
+
+// feeHeadroomStat keeps the channel pairs that had no routes within the fee
+// limit and how much more in ppm the cheapest route found with the
+// exploratory query would cost.
+type feeHeadroomStat struct {
+	explored  map[string]struct{}
+	overshoot map[string]int64
+}
+
+// exploreFeeHeadroom queries the route again with feeHeadroomFactor times the
+// fee limit. The route is only recorded and never paid.
+func (r *regolancer) exploreFeeHeadroom(ctx context.Context, from, to uint64, lastPKstr string, amtMsat Msat,
+	feeMsat Msat) {
+	if r.feeHeadroomStat.explored == nil {
+		r.feeHeadroomStat.explored = map[string]struct{}{}
+		r.feeHeadroomStat.overshoot = map[string]int64{}
+	}
+	k := formatChannelPair(from, to)
+	r.feeHeadroomStat.explored[k] = struct{}{}
+	// the overshoot of the previous attempt is stale
+	delete(r.feeHeadroomStat.overshoot, k)
+	req, err := r.routeQuery(ctx, from, to, lastPKstr, amtMsat, feeMsat*feeHeadroomFactor)
+	if err != nil {
+		return
+	}
+	routes, err := r.lnClient.QueryRoutes(ctx, req)
+	if err != nil {
+		return
+	}
+	var cheapest *lnrpc.Route
+	for _, route := range routes.Routes {
+		if r.validateRouteShape(route, lastPKstr) != nil {
+			continue
+		}
+		if cheapest == nil || route.TotalFeesMsat < cheapest.TotalFeesMsat {
+			cheapest = route
+		}
+	}
+	if cheapest == nil {
+		return
+	}
+	overshoot := feePPM(amtMsat, Msat(cheapest.TotalFeesMsat)) - feePPM(amtMsat, feeMsat)
+	r.feeHeadroomStat.overshoot[k] = overshoot
+	log.Printf("%s has a route for %s sat (%s ppm), %s ppm above the limit", r.pairLabel(ctx, from, to),
+		formatFee(Msat(cheapest.TotalFeesMsat)), formatFeePPM(amtMsat, Msat(cheapest.TotalFeesMsat)),
+		hiWhiteColor(overshoot))
+	emitEvent(logEvent{Event: "fee_headroom", FromChan: from, ToChan: to, Amount: amtMsat.sats(),
+		FeeMsat: cheapest.TotalFeesMsat, MaxFeeMsat: int64(feeMsat),
+		FeePPM: feePPM(amtMsat, Msat(cheapest.TotalFeesMsat)), Overshoot: overshoot})
+}
+
+func (r *regolancer) printFeeHeadroomStats() {
+	if len(r.feeHeadroomStat.explored) == 0 {
+		return
+	}
+	overshoots := []int64{}
+	for _, o := range r.feeHeadroomStat.overshoot {
+		overshoots = append(overshoots, o)
+	}
+	if len(overshoots) == 0 {
+		log.Printf("None of %s pairs without routes had routes within %dx of the fee limit",
+			hiWhiteColor(len(r.feeHeadroomStat.explored)), feeHeadroomFactor)
+		return
+	}
+	log.Printf("%s of %s pairs without routes had routes within %dx of the fee limit, median overshoot %s ppm",
+		hiWhiteColor(len(overshoots)), hiWhiteColor(len(r.feeHeadroomStat.explored)), feeHeadroomFactor,
+		hiWhiteColor(percentile(overshoots, 0.5)))
+}
+
+// routeQueryEvent reports the fee limit of the route query, how many routes
+// lnd returned and how many are left after the checks.
+func routeQueryEvent(from, to uint64, amtMsat Msat, feeMsat Msat, routes []*lnrpc.Route, kept int, err error) {
+	e := logEvent{Event: "routes_queried", FromChan: from, ToChan: to, Amount: amtMsat.sats(),
+		MaxFeeMsat: int64(feeMsat), Kept: &kept}
+	returned := len(routes)
+	e.Returned = &returned
+	for _, route := range routes {
+		if e.FeeMsat == 0 || route.TotalFeesMsat < e.FeeMsat {
+			e.FeeMsat = route.TotalFeesMsat
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	emitEvent(e)
+}
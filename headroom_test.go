@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// TestFeeHeadroomStat checks that the exploratory query keeps the CLTV limit
+// of the target and that the overshoot is saved with the no route attempt.
+func TestFeeHeadroomStat(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	var cltvLimit uint32
+	var feeLimit int64
+	r, _ := newRouteTest(func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+		cltvLimit, feeLimit = req.CltvLimit, req.FeeLimit.GetFixedMsat()
+		return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{{TotalAmtMsat: 1001500, TotalFeesMsat: 1500,
+			Hops: []*lnrpc.Hop{
+				{ChanId: 1, PubKey: testPeerPK, AmtToForwardMsat: 1000000},
+				{ChanId: 2, PubKey: testMyPK, AmtToForwardMsat: 1000000},
+			}}}}, nil
+	})
+	params.MaxCltv = 500
+	params.StatFailures = true
+	r.statFilename = filepath.Join(t.TempDir(), "stat.csv")
+	r.exploreFeeHeadroom(context.Background(), 1, 2, testPeerPK, satToMsat(1000), 1000)
+	if cltvLimit != 500 {
+		t.Errorf("the exploratory query should be limited to 500 blocks, got %d", cltvLimit)
+	}
+	if feeLimit != 1000*feeHeadroomFactor {
+		t.Errorf("the exploratory query should allow %d msat, got %d", 1000*feeHeadroomFactor, feeLimit)
+	}
+	r.saveFailedAttempt(1, 2, satToMsat(1000), 1000, nil, failureStageNoRoute, failNoRoute, -1)
+	r.saveFailedAttempt(1, 3, satToMsat(1000), 1000, nil, failureStageNoRoute, failNoRoute, -1)
+	rows := readStatColumns(t, r.statFilename)
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %v", rows)
+	}
+	if rows[0]["fee_headroom_ppm"] != "500" {
+		t.Errorf("the overshoot should be 500 ppm, got %q", rows[0]["fee_headroom_ppm"])
+	}
+	if rows[1]["fee_headroom_ppm"] != "" {
+		t.Errorf("the unexplored pair should have no overshoot, got %q", rows[1]["fee_headroom_ppm"])
+	}
+}
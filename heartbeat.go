@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatInterval = time.Second * 5
+	// added to the longest expected phase time before the session is
+	// considered stalled
+	heartbeatStallGrace = time.Minute
+)
+
+const (
+	phaseStarting   = "starting"
+	phaseSelecting  = "selecting_pair"
+	phaseRouting    = "querying_routes"
+	phasePaying     = "paying"
+	phaseProbing    = "probing"
+	phaseRapid      = "rapid_rebalance"
+	phaseWaiting    = "waiting"
+	phaseRefreshing = "refreshing"
+	phaseSleeping   = "sleeping"
+	phaseFinishing  = "finishing"
+)
+
+// the phases that last as long as configured, they're never considered
+// stalled
+var heartbeatIdlePhases = map[string]struct{}{
+	phaseWaiting:  {},
+	phaseSleeping: {},
+}
+
+// heartbeatPhase is what the session (or a worker) is doing right now.
+type heartbeatPhase struct {
+	Worker      int    `json:"worker,omitempty"`
+	Phase       string `json:"phase"`
+	Since       int64  `json:"phase_since"`
+	Attempt     int    `json:"attempt,omitempty"`
+	FromChannel uint64 `json:"from_channel,omitempty"`
+	ToChannel   uint64 `json:"to_channel,omitempty"`
+}
+
+// heartbeatRecord is written to --heartbeat-file and posted to
+// --heartbeat-url, the top level phase is the longest running one.
+type heartbeatRecord struct {
+	Timestamp int64 `json:"timestamp"`
+	Pid       int   `json:"pid"`
+	Started   int64 `json:"started"`
+	heartbeatPhase
+	Workers []heartbeatPhase `json:"workers,omitempty"`
+}
+
+// heartbeat reports the session phases from its own goroutine so that the
+// watchdog can tell a slow route query from a hung process: the phases are
+// updated under a separate lock at the phase transitions and the heartbeat
+// stops once a phase takes longer than the timeouts allow.
+type heartbeat struct {
+	file    string
+	url     string
+	client  *http.Client
+	started time.Time
+	lock    sync.Mutex
+	phases  map[int]heartbeatPhase
+	stalled bool
+	failing bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newHeartbeat(file, url string) *heartbeat {
+	h := &heartbeat{
+		file:    file,
+		url:     url,
+		client:  &http.Client{Timeout: heartbeatInterval},
+		started: time.Now(),
+		phases:  map[int]heartbeatPhase{0: {Phase: phaseStarting, Since: time.Now().Unix()}},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+func (h *heartbeat) close() {
+	close(h.stop)
+	<-h.done
+}
+
+func (h *heartbeat) set(p heartbeatPhase) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.phases[p.Worker] = p
+}
+
+// resetPhases replaces all phases, it's used when the workers start and
+// finish.
+func (h *heartbeat) resetPhases(phases ...heartbeatPhase) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.phases = map[int]heartbeatPhase{}
+	for _, p := range phases {
+		h.phases[p.Worker] = p
+	}
+}
+
+// stallLimit is the longest time a phase may take, the route queries and the
+// payments are limited by the attempt and payment timeouts.
+func stallLimit() time.Duration {
+	limit := time.Minute * time.Duration(params.TimeoutAttempt)
+	if payment := time.Second * time.Duration(params.TimeoutPayment); payment > limit {
+		limit = payment
+	}
+	return limit + heartbeatStallGrace
+}
+
+// record returns the current heartbeat, ok is false if a phase is stalled.
+func (h *heartbeat) record(now time.Time) (rec heartbeatRecord, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	rec = heartbeatRecord{Timestamp: now.Unix(), Pid: os.Getpid(), Started: h.started.Unix()}
+	workers := []int{}
+	for w := range h.phases {
+		workers = append(workers, w)
+	}
+	sort.Ints(workers)
+	ok = true
+	for i, w := range workers {
+		p := h.phases[w]
+		if i == 0 || p.Since < rec.Since {
+			rec.heartbeatPhase = p
+		}
+		if len(workers) > 1 {
+			rec.Workers = append(rec.Workers, p)
+		}
+		if _, idle := heartbeatIdlePhases[p.Phase]; !idle && now.Sub(time.Unix(p.Since, 0)) > stallLimit() {
+			ok = false
+		}
+	}
+	return
+}
+
+func (h *heartbeat) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		h.beat(time.Now())
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *heartbeat) beat(now time.Time) {
+	rec, ok := h.record(now)
+	if !ok {
+		if !h.stalled {
+			logErrorF("Phase %s has been running since %s, stopping the heartbeat", rec.Phase,
+				time.Unix(rec.Since, 0).Format(time.RFC3339))
+			h.stalled = true
+		}
+		return
+	}
+	if h.stalled {
+		log.Print(infoColor("Session is moving again, resuming the heartbeat"))
+		h.stalled = false
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logErrorF("Error encoding heartbeat: %s", err)
+		return
+	}
+	if h.file != "" {
+		if err := writeHeartbeatFile(h.file, data); err != nil {
+			h.fail("Error writing heartbeat file %s: %s", h.file, err)
+			return
+		}
+	}
+	if h.url != "" {
+		if err := h.post(data); err != nil {
+			h.fail("Error posting heartbeat to %s: %s", h.url, err)
+			return
+		}
+	}
+	h.failing = false
+}
+
+// fail logs the first error in a row only so that a broken endpoint doesn't
+// flood the log every few seconds.
+func (h *heartbeat) fail(format string, args ...any) {
+	if !h.failing {
+		logErrorF(format, args...)
+	}
+	h.failing = true
+}
+
+// writeHeartbeatFile replaces the file atomically so that the watchdog never
+// reads a partial record.
+func writeHeartbeatFile(filename string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (h *heartbeat) post(data []byte) error {
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// setPhase records the phase transition of the current worker, a is the
+// attempt in progress if any.
+func (r *regolancer) setPhase(phase string, a *rebalanceAttempt) {
+	if r.heartbeat == nil {
+		return
+	}
+	p := heartbeatPhase{Worker: r.workerId, Phase: phase, Since: time.Now().Unix()}
+	if a != nil {
+		p.Attempt, p.FromChannel, p.ToChannel = r.currentAttempt(), a.from, a.to
+	}
+	r.heartbeat.set(p)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHeartbeat doesn't start the goroutine so that the test decides when the
+// heartbeat beats.
+func testHeartbeat(file, url string) *heartbeat {
+	return &heartbeat{
+		file:    file,
+		url:     url,
+		client:  &http.Client{Timeout: heartbeatInterval},
+		started: time.Now(),
+		phases:  map[int]heartbeatPhase{0: {Phase: phaseStarting, Since: time.Now().Unix()}},
+	}
+}
+
+func readHeartbeatFile(t *testing.T, filename string) heartbeatRecord {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := heartbeatRecord{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// TestHeartbeatPhases checks that the heartbeat follows the attempt through
+// its phases and posts the same record it writes.
+func TestHeartbeatPhases(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.TimeoutAttempt, params.TimeoutPayment = 5, 300
+	var lock sync.Mutex
+	posted := []heartbeatRecord{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := heartbeatRecord{}
+		json.NewDecoder(req.Body).Decode(&rec)
+		lock.Lock()
+		posted = append(posted, rec)
+		lock.Unlock()
+	}))
+	defer server.Close()
+	filename := filepath.Join(t.TempDir(), "heartbeat.json")
+	r := &regolancer{heartbeat: testHeartbeat(filename, server.URL), attempt: 3}
+	a := &rebalanceAttempt{from: 1, to: 2}
+	phases := []string{}
+	for _, step := range []struct {
+		phase   string
+		attempt *rebalanceAttempt
+	}{
+		{phaseSelecting, nil},
+		{phaseRouting, a},
+		{phaseProbing, a},
+		{phasePaying, a},
+		{phaseWaiting, nil},
+	} {
+		r.setPhase(step.phase, step.attempt)
+		r.heartbeat.beat(time.Now())
+		rec := readHeartbeatFile(t, filename)
+		if rec.Phase != step.phase || rec.Pid != os.Getpid() || rec.Workers != nil {
+			t.Errorf("unexpected heartbeat %+v in phase %s", rec, step.phase)
+		}
+		if step.attempt != nil && (rec.Attempt != 3 || rec.FromChannel != 1 || rec.ToChannel != 2) {
+			t.Errorf("the heartbeat should carry the attempt and pair, got %+v", rec)
+		}
+		if step.attempt == nil && (rec.Attempt != 0 || rec.FromChannel != 0) {
+			t.Errorf("the heartbeat shouldn't carry the attempt in phase %s, got %+v", step.phase, rec)
+		}
+		phases = append(phases, rec.Phase)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(posted) != len(phases) {
+		t.Fatalf("expected %d posts, got %d", len(phases), len(posted))
+	}
+	for i := range posted {
+		if posted[i].Phase != phases[i] {
+			t.Errorf("post %d has phase %s, expected %s", i, posted[i].Phase, phases[i])
+		}
+	}
+	if matches, _ := filepath.Glob(filename + ".*"); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+// TestHeartbeatWorkers checks that the longest running worker phase is
+// reported on top.
+func TestHeartbeatWorkers(t *testing.T) {
+	h := testHeartbeat("", "")
+	now := time.Now()
+	h.resetPhases(
+		heartbeatPhase{Worker: 1, Phase: phaseRouting, Since: now.Unix() - 5},
+		heartbeatPhase{Worker: 2, Phase: phasePaying, Since: now.Unix() - 30},
+		heartbeatPhase{Worker: 3, Phase: phaseSelecting, Since: now.Unix()},
+	)
+	rec, ok := h.record(now)
+	if !ok || rec.Worker != 2 || rec.Phase != phasePaying || len(rec.Workers) != 3 ||
+		rec.Workers[0].Worker != 1 || rec.Workers[2].Worker != 3 {
+		t.Errorf("unexpected heartbeat %+v", rec)
+	}
+}
+
+// TestHeartbeatStall checks that the heartbeat stops once a phase takes
+// longer than the timeouts allow, except for the configured waits, and
+// resumes when the session moves again.
+func TestHeartbeatStall(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.TimeoutAttempt, params.TimeoutPayment = 5, 300
+	filename := filepath.Join(t.TempDir(), "heartbeat.json")
+	h := testHeartbeat(filename, "")
+	now := time.Now()
+	old := now.Add(-stallLimit() - time.Second).Unix()
+	h.set(heartbeatPhase{Phase: phaseSleeping, Since: old})
+	h.beat(now)
+	if rec := readHeartbeatFile(t, filename); rec.Phase != phaseSleeping || h.stalled {
+		t.Errorf("a long sleep isn't a stall, got %+v", rec)
+	}
+	h.set(heartbeatPhase{Phase: phaseRouting, Since: old})
+	h.beat(now.Add(time.Second))
+	if rec := readHeartbeatFile(t, filename); rec.Phase != phaseSleeping || !h.stalled {
+		t.Errorf("the heartbeat should stop on a stall, got %+v", rec)
+	}
+	h.set(heartbeatPhase{Phase: phasePaying, Since: now.Unix()})
+	h.beat(now.Add(time.Second * 2))
+	if rec := readHeartbeatFile(t, filename); rec.Phase != phasePaying || h.stalled {
+		t.Errorf("the heartbeat should resume, got %+v", rec)
+	}
+}
+
+// TestHeartbeatPostFailure checks that the failing endpoint is reported once
+// and that the file is still written before the post.
+func TestHeartbeatPostFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	filename := filepath.Join(t.TempDir(), "heartbeat.json")
+	h := testHeartbeat(filename, server.URL)
+	h.beat(time.Now())
+	if !h.failing {
+		t.Error("the heartbeat should be failing")
+	}
+	if rec := readHeartbeatFile(t, filename); rec.Phase != phaseStarting {
+		t.Errorf("unexpected heartbeat %+v", rec)
+	}
+	h.url = ""
+	h.beat(time.Now())
+	if h.failing {
+		t.Error("the heartbeat should recover")
+	}
+}
+
+// TestHeartbeatClose checks that the goroutine beats right away and stops on
+// close.
+func TestHeartbeatClose(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "heartbeat.json")
+	h := newHeartbeat(filename, "")
+	h.close()
+	if rec := readHeartbeatFile(t, filename); rec.Phase != phaseStarting {
+		t.Errorf("unexpected heartbeat %+v", rec)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const blockHeightRefresh = time.Minute
+
+// currentHeight returns the block height reported by lnd, it's refreshed if
+// the cached value is older than a minute. The cached value is used if lnd
+// can't be queried.
+func (r *regolancer) currentHeight(ctx context.Context) uint32 {
+	if time.Since(r.heightUpdated) < blockHeightRefresh {
+		return r.blockHeight
+	}
+	info, err := r.lnClient.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		logErrorF("Error refreshing the block height: %s", err)
+		return r.blockHeight
+	}
+	r.setHeight(info.BlockHeight)
+	return r.blockHeight
+}
+
+func (r *regolancer) setHeight(height uint32) {
+	r.blockHeight = height
+	r.heightUpdated = time.Now()
+}
+
+// checkRouteExpiry rejects the routes with the first hop HTLC expiring too
+// close to the chain tip. It's an abnormal condition meaning a stale route or
+// a wrong block height and such an HTLC could lead to a force close.
+func checkRouteExpiry(route *lnrpc.Route, height uint32, minBlocks int64) error {
+	if height == 0 || minBlocks <= 0 {
+		return nil
+	}
+	if left := int64(route.TotalTimeLock) - int64(height); left < minBlocks {
+		return fmt.Errorf("route expires at height %d which is only %d blocks from the current height %d (min %d), skipping it",
+			route.TotalTimeLock, left, height, minBlocks)
+	}
+	return nil
+}
+
+func (r *regolancer) validateRouteExpiry(ctx context.Context, route *lnrpc.Route) error {
+	err := checkRouteExpiry(route, r.currentHeight(ctx), params.MinExpiryBlocks)
+	if err != nil {
+		log.Print(errColor(err))
+	}
+	return err
+}
+
+// checkRouteCltv rejects the routes whose total timelock is more than maxBlocks
+// from the current height, the funds sent along such a route could be locked
+// for too long if an HTLC gets stuck.
+func checkRouteCltv(route *lnrpc.Route, height uint32, maxBlocks int64) error {
+	if height == 0 || maxBlocks <= 0 {
+		return nil
+	}
+	if locked := int64(route.TotalTimeLock) - int64(height); locked > maxBlocks {
+		return fmt.Errorf("route timelock is %d blocks (until height %d), more than the limit of %d blocks, skipping it",
+			locked, route.TotalTimeLock, maxBlocks)
+	}
+	return nil
+}
+
+// validateRouteCltv checks the route timelock against the limit of its target
+// channel.
+func (r *regolancer) validateRouteCltv(ctx context.Context, route *lnrpc.Route) error {
+	if len(route.Hops) == 0 {
+		return nil
+	}
+	limit := r.targetMaxCltv(route.Hops[len(route.Hops)-1].ChanId)
+	if limit == 0 {
+		return nil
+	}
+	err := checkRouteCltv(route, r.currentHeight(ctx), limit)
+	if err != nil {
+		log.Print(errColor(err))
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestValidateRouteExpiry checks the routes expiring around the threshold
+// with the block height from GetInfo.
+func TestValidateRouteExpiry(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MinExpiryBlocks = 40
+	r, ln := newRouteTest(nil)
+	ln.height = 800000
+	route := func(timeLock uint32) *lnrpc.Route {
+		route := testRoute(1, 2, 1000000, 100, testPK(1), testPeerPK)
+		route.TotalTimeLock = timeLock
+		return route
+	}
+	for _, tc := range []struct {
+		name     string
+		timeLock uint32
+		refused  bool
+	}{
+		{"below the threshold", 800039, true},
+		{"at the threshold", 800040, false},
+		{"above the threshold", 800041, false},
+	} {
+		if err := r.validateRouteExpiry(context.Background(), route(tc.timeLock)); (err != nil) != tc.refused {
+			t.Errorf("%s: expected refused %t, got %v", tc.name, tc.refused, err)
+		}
+	}
+	if ln.infos != 1 {
+		t.Errorf("the height should be cached, got %d GetInfo calls", ln.infos)
+	}
+
+	// the stale cached height is used if it can't be refreshed
+	ln.infoErr = status.Error(codes.Unavailable, "lnd is down")
+	r.heightUpdated = time.Now().Add(-blockHeightRefresh)
+	if err := r.validateRouteExpiry(context.Background(), route(800039)); err == nil || ln.infos != 2 {
+		t.Errorf("the route should be refused with the cached height, got %v after %d calls", err, ln.infos)
+	}
+	// without any known height the check is skipped
+	r, ln = newRouteTest(nil)
+	ln.infoErr = status.Error(codes.Unavailable, "lnd is down")
+	if err := r.validateRouteExpiry(context.Background(), route(1)); err != nil {
+		t.Errorf("the route shouldn't be refused without the height, got %v", err)
+	}
+	params.MinExpiryBlocks = 0
+	r.setHeight(800000)
+	if err := r.validateRouteExpiry(context.Background(), route(800001)); err != nil {
+		t.Errorf("the check should be disabled, got %v", err)
+	}
+}
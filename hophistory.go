@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// hopStat counts how many times the directed hop between two nodes was used in
+// our payment attempts and how many times it was the failure source.
+type hopStat struct {
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	ChanId     uint64    `json:"chan_id"`
+	Attempts   int       `json:"attempts"`
+	Failures   int       `json:"failures"`
+	LastUpdate time.Time `json:"last_update"`
+	// max route timelock the target peer accepts, only set for the hops to us
+	MaxCltv int64 `json:"max_cltv,omitempty"`
+}
+
+func hopKey(from, to string) string {
+	return from + ":" + to
+}
+
+func (r *regolancer) loadHopHistory(filename string) error {
+	r.hopHistory = map[string]*hopStat{}
+	if filename == "" {
+		return nil
+	}
+	l := lock()
+	l.RLock()
+	defer l.Unlock()
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error opening hop history file: %s", err)
+		}
+		return nil
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&r.hopHistory)
+	if err != nil {
+		return err
+	}
+	for k, v := range r.hopHistory {
+		if time.Since(v.LastUpdate) > time.Hour*time.Duration(params.BadHopTTL) {
+			delete(r.hopHistory, k)
+		}
+	}
+	return nil
+}
+
+func (r *regolancer) saveHopHistory(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating hop history file: %s", err)
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(r.hopHistory)
+}
+
+func (r *regolancer) getHopStat(from, to string, chanId uint64) *hopStat {
+	k := hopKey(from, to)
+	s, ok := r.hopHistory[k]
+	if !ok {
+		s = &hopStat{From: from, To: to, ChanId: chanId}
+		r.hopHistory[k] = s
+	}
+	s.LastUpdate = time.Now()
+	return s
+}
+
+// addHopHistory records the payment attempt, failureSourceIndex is 0 if the
+// payment didn't fail at a specific hop.
+func (r *regolancer) addHopHistory(route *lnrpc.Route, failureSourceIndex uint32) {
+	if r.hopHistory == nil {
+		return
+	}
+	prevPK := r.myPK
+	for i, h := range route.Hops {
+		s := r.getHopStat(prevPK, h.PubKey, h.ChanId)
+		s.Attempts++
+		if failureSourceIndex > 0 && i == int(failureSourceIndex) {
+			s.Failures++
+		}
+		prevPK = h.PubKey
+	}
+}
+
+func (s *hopStat) isBad() bool {
+	return s.Attempts >= params.BadHopMinSamples &&
+		int64(s.Failures*100/s.Attempts) > params.BadHopFailPerc
+}
+
+func (r *regolancer) badHops() (result []*hopStat) {
+	for _, s := range r.hopHistory {
+		if s.isBad() {
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Failures*result[j].Attempts > result[j].Failures*result[i].Attempts
+	})
+	return
+}
+
+// badHopPairs returns the historically bad hops to be ignored in route
+// queries.
+func (r *regolancer) badHopPairs() (result []*lnrpc.NodePair) {
+	for _, s := range r.badHops() {
+		from, err := hex.DecodeString(s.From)
+		if err != nil {
+			continue
+		}
+		to, err := hex.DecodeString(s.To)
+		if err != nil {
+			continue
+		}
+		result = append(result, &lnrpc.NodePair{From: from, To: to})
+	}
+	return
+}
+
+func (r *regolancer) printBadHops() {
+	bad := r.badHops()
+	log.Printf("%s bad hops out of %s recorded (more than %d%% failures in at least %d attempts):",
+		hiWhiteColor(len(bad)), hiWhiteColor(len(r.hopHistory)), params.BadHopFailPerc, params.BadHopMinSamples)
+	for _, s := range bad {
+		log.Printf("  %s %s ⇒ %s: %s failures in %s attempts, last seen %s", faintWhiteColor(s.ChanId), s.From, s.To,
+			hiWhiteColor(s.Failures), hiWhiteColor(s.Attempts), s.LastUpdate.Format(time.RFC3339))
+	}
+}
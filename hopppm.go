@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+type ErrHopPPMRoute struct {
+	maxPPM int64
+}
+
+func (e ErrHopPPMRoute) Error() string {
+	return fmt.Sprintf("only found routes with a hop charging over %d ppm, skipping under --max-hop-ppm", e.maxPPM)
+}
+
+// hopPPM is a node charging too much to forward the amount, the ppm is -1 if
+// its policy is unknown.
+type hopPPM struct {
+	pubKey string
+	chanID uint64
+	ppm    int64
+}
+
+// hopPPMPairs returns the intermediate route nodes that charge more than
+// maxPPM for the amount they forward (or have no known policy) and their node
+// pairs that can be ignored. The fee of the target peer is limited by the max
+// fee of the pair so the last hop isn't checked.
+func (r *regolancer) hopPPMPairs(ctx context.Context, route *lnrpc.Route, maxPPM int64) (pairs []*lnrpc.NodePair,
+	offenders []hopPPM, err error) {
+	nodePairs, err := routeNodePairs(route)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 1; i < len(route.Hops)-1; i++ {
+		policy, err := r.hopPolicy(ctx, route, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		hop := hopPPM{pubKey: route.Hops[i-1].PubKey, chanID: route.Hops[i].ChanId, ppm: -1}
+		if policy != nil {
+			amt := Msat(route.Hops[i].AmtToForwardMsat)
+			hop.ppm = feePPM(amt, policyFee(policy, amt))
+			if hop.ppm <= maxPPM {
+				continue
+			}
+		}
+		offenders = append(offenders, hop)
+		pairs = append(pairs, nodePairs[i-1])
+	}
+	return
+}
+
+// logHopPPM prints the nodes that made the route rejected.
+func (r *regolancer) logHopPPM(ctx context.Context, offenders []hopPPM, maxPPM int64) {
+	for _, hop := range offenders {
+		alias := hop.pubKey
+		if nodeInfo, err := r.getNodeInfo(ctx, hop.pubKey); err == nil {
+			alias = nodeInfo.Node.Alias
+		}
+		ppm := "unknown"
+		if hop.ppm >= 0 {
+			ppm = fmt.Sprintf("%d ppm", hop.ppm)
+		}
+		log.Print(infoColorF("Route goes through %s (%s) charging %s in channel %d, more than %d ppm", alias,
+			hop.pubKey, ppm, hop.chanID, maxPPM))
+	}
+}
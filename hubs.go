@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	// max number of channel pairs to remember the last route for
+	pairRoutesLimit = 1000
+	// the pairs sharing a failed hub are put in the failure cache for this time
+	hubCoolingTTL = time.Minute * 5
+)
+
+// pairRoute is the hubs (the nodes between our peers) of the cheapest route
+// last returned for the channel pair.
+type pairRoute struct {
+	from uint64
+	to   uint64
+	hubs []string
+}
+
+// hubIndex keeps the last route of the channel pairs and which pairs go
+// through every hub so that the pairs can be cooled together when a hub
+// fails.
+type hubIndex struct {
+	routes map[string]pairRoute
+	pairs  map[string]map[string]struct{}
+	order  []string
+}
+
+type hubCoolingStats struct {
+	failures int
+	cooled   int
+}
+
+func (h *hubIndex) remove(k string) {
+	for _, hub := range h.routes[k].hubs {
+		delete(h.pairs[hub], k)
+		if len(h.pairs[hub]) == 0 {
+			delete(h.pairs, hub)
+		}
+	}
+	delete(h.routes, k)
+}
+
+// recordPairRoute remembers the route found for the channel pair, the oldest
+// pairs are dropped when the index is full.
+func (r *regolancer) recordPairRoute(from, to uint64, route *lnrpc.Route) {
+	h := &r.hubIndex
+	if h.routes == nil {
+		h.routes = map[string]pairRoute{}
+		h.pairs = map[string]map[string]struct{}{}
+	}
+	k := formatChannelPair(from, to)
+	if _, ok := h.routes[k]; ok {
+		h.remove(k)
+	} else {
+		h.order = append(h.order, k)
+	}
+	pr := pairRoute{from: from, to: to}
+	for i := 1; i < len(route.Hops)-2; i++ {
+		hub := route.Hops[i].PubKey
+		pr.hubs = append(pr.hubs, hub)
+		if h.pairs[hub] == nil {
+			h.pairs[hub] = map[string]struct{}{}
+		}
+		h.pairs[hub][k] = struct{}{}
+	}
+	h.routes[k] = pr
+	for len(h.order) > pairRoutesLimit {
+		h.remove(h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+// coolHubPairs puts the other candidate pairs whose last route went through
+// the failed hub in the failure cache for a short time, they would most
+// likely fail the same way.
+func (r *regolancer) coolHubPairs(ctx context.Context, hub string, from, to uint64) {
+	current := formatChannelPair(from, to)
+	cool := []pairRoute{}
+	for k := range r.hubIndex.pairs[hub] {
+		pair, ok := r.channelPairs[k]
+		// the pairs used by the other workers are left to them
+		if !ok || k == current || r.channelBusy(pair[0].ChanId) || r.channelBusy(pair[1].ChanId) {
+			continue
+		}
+		cool = append(cool, r.hubIndex.routes[k])
+	}
+	if len(cool) == 0 {
+		return
+	}
+	alias := hub
+	if nodeInfo, err := r.getNodeInfo(ctx, hub); err == nil {
+		alias = nodeInfo.Node.Alias
+	}
+	log.Printf("Preemptively cooling %s pairs sharing hub %s", hiWhiteColor(len(cool)), cyanColor(alias))
+	for _, pr := range cool {
+		r.addFailedRouteTTL(pr.from, pr.to, hubCoolingTTL, failHubCooling, 0)
+	}
+	r.hubCoolingStats.failures++
+	r.hubCoolingStats.cooled += len(cool)
+}
+
+func (r *regolancer) printHubCoolingStats() {
+	if r.hubCoolingStats.failures == 0 {
+		return
+	}
+	log.Printf("Hub cooling: %s pairs skipped after %s hub failures", hiWhiteColor(r.hubCoolingStats.cooled),
+		hiWhiteColor(r.hubCoolingStats.failures))
+}
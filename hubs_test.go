@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func hubTestRoute(from, to uint64, hub string) *lnrpc.Route {
+	return &lnrpc.Route{Hops: []*lnrpc.Hop{{ChanId: from, PubKey: "peer1"}, {ChanId: 10, PubKey: hub},
+		{ChanId: 11, PubKey: "peer2"}, {ChanId: to, PubKey: "me"}}}
+}
+
+// TestCoolHubPairsBusy checks that the pairs used by the other workers aren't
+// cooled and that failing a cooled pair never puts a nil pair back.
+func TestCoolHubPairsBusy(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FailedRouteTTL, params.FailureCacheSize = 1, 100
+	r := &regolancer{
+		channelPairs: map[string][2]*lnrpc.Channel{},
+		failureCache: map[string]failedRoute{},
+		nodeCache:    map[string]cachedNodeInfo{"hub": {NodeInfo: &lnrpc.NodeInfo{Node: &lnrpc.LightningNode{Alias: "hub"}}}},
+		workers:      &workerPool{busy: map[uint64]int{}},
+	}
+	for _, p := range [][2]uint64{{1, 2}, {3, 4}, {5, 6}} {
+		r.channelPairs[formatChannelPair(p[0], p[1])] = [2]*lnrpc.Channel{{ChanId: p[0]}, {ChanId: p[1]}}
+		r.recordPairRoute(p[0], p[1], hubTestRoute(p[0], p[1], "hub"))
+	}
+	r.workers.busy[3], r.workers.busy[4] = 2, 2
+	r.coolHubPairs(context.Background(), "hub", 1, 2)
+	if _, ok := r.failureCache["5-6"]; !ok {
+		t.Error("idle pair 5-6 should be cooled")
+	}
+	if _, ok := r.failureCache["3-4"]; ok {
+		t.Error("busy pair 3-4 shouldn't be cooled")
+	}
+	// the attempt of the pair that was cooled meanwhile fails too
+	r.addFailedRoute(5, 6, failNoRoute, 0)
+	cached := r.failureCache["5-6"]
+	if cached.channelPair[0] == nil || cached.channelPair[1] == nil {
+		t.Fatal("the cooled pair was replaced with a nil pair")
+	}
+	if cached.expiration.Before(time.Now().Add(hubCoolingTTL - time.Minute)) {
+		t.Error("the later expiration should be kept")
+	}
+	// a pair that is neither a candidate nor cached is never inserted
+	r.addFailedRoute(7, 8, failNoRoute, 0)
+	if _, ok := r.failureCache["7-8"]; ok {
+		t.Error("unknown pair 7-8 was put in the failure cache")
+	}
+	r.failureCache["9-9"] = failedRoute{expiration: &time.Time{}}
+	r.expireFailedRoutes()
+	for k, pair := range r.channelPairs {
+		if pair[0] == nil || pair[1] == nil {
+			t.Errorf("nil pair %s returned to the candidates", k)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// invoices listed per ListInvoices call when looking for the stale ones
+const staleInvoicesPage = 1000
+
+// invoiceMemoPattern matches the memos created by invoiceMemo with the
+// current --invoice-memo-template and --invoice-memo-tag, the placeholders
+// match any channel id, amount and date.
+func invoiceMemoPattern() *regexp.Regexp {
+	if params.InvoiceMemoTemplate == "" {
+		return regexp.MustCompile("^" + regexp.QuoteMeta(defaultInvoiceMemo) + "$")
+	}
+	pattern := strings.NewReplacer(
+		regexp.QuoteMeta("{from_scid}"), `\d+`,
+		regexp.QuoteMeta("{to_scid}"), `\d+`,
+		regexp.QuoteMeta("{amount}"), `\d+`,
+		regexp.QuoteMeta("{date}"), `\d{4}-\d{2}-\d{2}`,
+		regexp.QuoteMeta("{tag}"), regexp.QuoteMeta(params.InvoiceMemoTag),
+	).Replace(regexp.QuoteMeta(params.InvoiceMemoTemplate))
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// staleInvoiceAge is the age after which our open invoices are not used
+// anymore, the cached invoices are never reused past their expiry.
+func staleInvoiceAge() time.Duration {
+	return invoiceExpiry
+}
+
+// cleanupStaleInvoices cancels the open invoices created by the previous runs
+// that crashed before paying them. Only the invoices with our memo that are
+// older than the invoice expiry are cancelled so that the invoices of the
+// other running instances are left alone.
+func (r *regolancer) cleanupStaleInvoices(ctx context.Context) {
+	if params.CleanupInvoices == nil && params.InvoiceMemoTemplate == "" ||
+		params.CleanupInvoices != nil && !*params.CleanupInvoices || r.invoicesClient == nil {
+		return
+	}
+	if params.DryRun {
+		log.Print(infoColor("Dry run, not cancelling the stale invoices"))
+		return
+	}
+	memo := invoiceMemoPattern()
+	cancelled := 0
+	offset := uint64(0)
+	for {
+		resp, err := r.lnClient.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{PendingOnly: true,
+			IndexOffset: offset, NumMaxInvoices: staleInvoicesPage})
+		if err != nil {
+			logErrorF("Error listing invoices to cancel the stale ones: %s", err)
+			return
+		}
+		for _, inv := range resp.Invoices {
+			if inv.State != lnrpc.Invoice_OPEN || !memo.MatchString(inv.Memo) ||
+				time.Since(time.Unix(inv.CreationDate, 0)) < staleInvoiceAge() {
+				continue
+			}
+			_, err := r.invoicesClient.CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: inv.RHash})
+			// lnd reports the missing macaroon permissions with the unknown code
+			if code := status.Code(err); code == codes.PermissionDenied || code == codes.Unimplemented ||
+				err != nil && strings.Contains(err.Error(), "permission denied") {
+				log.Print(infoColorF("Can't cancel the stale invoices (%s), the macaroon needs the invoices:write "+
+					"permission", err))
+				return
+			}
+			if err != nil {
+				logErrorF("Error cancelling stale invoice %x: %s", inv.RHash, err)
+				continue
+			}
+			cancelled++
+		}
+		if len(resp.Invoices) < staleInvoicesPage {
+			break
+		}
+		offset = resp.LastIndexOffset
+	}
+	if cancelled > 0 {
+		log.Printf("Cancelled %s stale invoices left by the previous runs", hiWhiteColor(cancelled))
+	}
+}
+
+// loadOpenInvoices puts the open invoices with our memo into the invoice cache
+// so that a restarted run pays the same payment hashes as the crashed one
+// instead of creating new invoices, a payment still in flight for them is then
+// handled by --in-flight-action. The invoices of the same amount are assigned
+// to the different workers.
+func (r *regolancer) loadOpenInvoices(ctx context.Context) {
+	if r.invoiceCache == nil {
+		r.invoiceCache = map[invoiceKey]cachedInvoice{}
+	}
+	memo := invoiceMemoPattern()
+	firstWorker := 0
+	if params.Workers > 0 {
+		firstWorker = 1
+	}
+	loaded := 0
+	offset := uint64(0)
+	for {
+		resp, err := r.lnClient.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{PendingOnly: true,
+			IndexOffset: offset, NumMaxInvoices: staleInvoicesPage})
+		if err != nil {
+			logErrorF("Error listing invoices to reuse the open ones: %s", err)
+			return
+		}
+		for _, inv := range resp.Invoices {
+			expiration := time.Unix(inv.CreationDate+inv.Expiry, 0)
+			if inv.State != lnrpc.Invoice_OPEN || !memo.MatchString(inv.Memo) ||
+				time.Until(expiration) <= r.invoiceExpiryMargin() {
+				continue
+			}
+			key := invoiceKey{firstWorker, Msat(inv.ValueMsat)}
+			for ; ; key.worker++ {
+				if _, ok := r.invoiceCache[key]; !ok {
+					break
+				}
+			}
+			r.invoiceCache[key] = cachedInvoice{AddInvoiceResponse: &lnrpc.AddInvoiceResponse{RHash: inv.RHash,
+				PaymentRequest: inv.PaymentRequest, AddIndex: inv.AddIndex, PaymentAddr: inv.PaymentAddr},
+				expiration: expiration, memo: inv.Memo}
+			loaded++
+		}
+		if len(resp.Invoices) < staleInvoicesPage {
+			break
+		}
+		offset = resp.LastIndexOffset
+	}
+	if loaded > 0 {
+		log.Printf("Reusing %s open invoices left by the previous runs", hiWhiteColor(loaded))
+	}
+}
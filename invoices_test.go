@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInvoiceMemoPattern(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	for _, tc := range []struct {
+		template string
+		tag      string
+		memo     string
+		match    bool
+	}{
+		{"", "", "Rebalance attempt", true},
+		{"", "", "Rebalance attempt 2", false},
+		{"", "", "Coffee", false},
+		{"regolancer {from_scid}->{to_scid} {tag}", "cron", "regolancer 123->456 cron", true},
+		{"regolancer {from_scid}->{to_scid} {tag}", "cron", "regolancer 123->456 manual", false},
+		{"regolancer {from_scid}->{to_scid} {tag}", "cron", "regolancer abc->456 cron", false},
+		{"regolancer {from_scid}->{to_scid} {tag}", "cron", "xregolancer 123->456 cron", false},
+		{"rb {amount} sat on {date}", "", "rb 50000 sat on 2026-10-15", true},
+		{"rb {amount} sat on {date}", "", "rb 50000 sat on 15.10.2026", false},
+		// the regexp special characters of the template and the tag are literal
+		{"rb (auto) {tag}", "a+b", "rb (auto) a+b", true},
+		{"rb (auto) {tag}", "a+b", "rb auto aab", false},
+		{"rb.*", "", "rb anything", false},
+	} {
+		params.InvoiceMemoTemplate, params.InvoiceMemoTag = tc.template, tc.tag
+		if got := invoiceMemoPattern().MatchString(tc.memo); got != tc.match {
+			t.Errorf("template %q tag %q memo %q: got %v, expected %v", tc.template, tc.tag, tc.memo, got, tc.match)
+		}
+	}
+}
+
+func staleInvoicesTest(invoices *fakeInvoices) *regolancer {
+	old := time.Now().Add(-invoiceExpiry - time.Hour).Unix()
+	fresh := time.Now().Add(-time.Hour).Unix()
+	return &regolancer{
+		lnClient: &fakeLightning{openInvoices: []*lnrpc.Invoice{
+			{RHash: []byte("old"), Memo: "rb 1->2", CreationDate: old, State: lnrpc.Invoice_OPEN},
+			{RHash: []byte("fresh"), Memo: "rb 1->2", CreationDate: fresh, State: lnrpc.Invoice_OPEN},
+			{RHash: []byte("foreign"), Memo: "Coffee", CreationDate: old, State: lnrpc.Invoice_OPEN},
+			{RHash: []byte("accepted"), Memo: "rb 3->4", CreationDate: old, State: lnrpc.Invoice_ACCEPTED},
+		}},
+		invoicesClient: invoices,
+	}
+}
+
+func TestCleanupStaleInvoices(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.InvoiceMemoTemplate = "rb {from_scid}->{to_scid}"
+	invoices := &fakeInvoices{}
+	staleInvoicesTest(invoices).cleanupStaleInvoices(context.Background())
+	if len(invoices.cancelled) != 1 || string(invoices.cancelled[0]) != "old" {
+		t.Errorf("only the old invoice with our memo should be cancelled, got %q", invoices.cancelled)
+	}
+	disabled := false
+	params.CleanupInvoices = &disabled
+	invoices = &fakeInvoices{}
+	staleInvoicesTest(invoices).cleanupStaleInvoices(context.Background())
+	if len(invoices.cancelled) != 0 {
+		t.Errorf("cleanup is disabled but %q were cancelled", invoices.cancelled)
+	}
+}
+
+func TestCleanupStaleInvoicesPermission(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.InvoiceMemoTemplate = "rb {from_scid}->{to_scid}"
+	for _, err := range []error{
+		status.Error(codes.PermissionDenied, "no"),
+		status.Error(codes.Unimplemented, "no invoices rpc"),
+		status.Error(codes.Unknown, "permission denied"),
+	} {
+		invoices := &fakeInvoices{err: err}
+		staleInvoicesTest(invoices).cleanupStaleInvoices(context.Background())
+		if len(invoices.cancelled) != 0 {
+			t.Errorf("%s: nothing can be cancelled", err)
+		}
+	}
+	// without the invoices client the cleanup is skipped, listing the
+	// invoices would panic on the nil client
+	r := &regolancer{lnClient: struct{ lnrpc.LightningClient }{}}
+	r.cleanupStaleInvoices(context.Background())
+}
+
+func TestLoadOpenInvoices(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.InvoiceMemoTemplate = "rb {from_scid}->{to_scid}"
+	params.InvoiceExpiryMargin = 60
+	params.Workers = 0
+	created := time.Now().Add(-time.Hour).Unix()
+	expiry := int64(invoiceExpiry.Seconds())
+	r := &regolancer{invoiceSkewChecked: true, lnClient: &fakeLightning{openInvoices: []*lnrpc.Invoice{
+		{RHash: []byte("a"), Memo: "rb 1->2", ValueMsat: 1000000, CreationDate: created, Expiry: expiry,
+			State: lnrpc.Invoice_OPEN},
+		{RHash: []byte("b"), Memo: "rb 1->2", ValueMsat: 1000000, CreationDate: created, Expiry: expiry,
+			State: lnrpc.Invoice_OPEN},
+		{RHash: []byte("expiring"), Memo: "rb 1->2", ValueMsat: 2000000, CreationDate: created, Expiry: 3600,
+			State: lnrpc.Invoice_OPEN},
+		{RHash: []byte("foreign"), Memo: "Coffee", ValueMsat: 3000000, CreationDate: created, Expiry: expiry,
+			State: lnrpc.Invoice_OPEN},
+		{RHash: []byte("accepted"), Memo: "rb 1->2", ValueMsat: 4000000, CreationDate: created, Expiry: expiry,
+			State: lnrpc.Invoice_ACCEPTED},
+	}}}
+	r.loadOpenInvoices(context.Background())
+	if len(r.invoiceCache) != 2 {
+		t.Fatalf("expected 2 reusable invoices, got %v", r.invoiceCache)
+	}
+	for worker, hash := range []string{"a", "b"} {
+		inv, ok := r.invoiceCache[invoiceKey{worker, satToMsat(1000)}]
+		if !ok || string(inv.RHash) != hash {
+			t.Errorf("worker %d should reuse invoice %q, got %v", worker, hash, inv)
+		}
+	}
+	res, err := r.createInvoice(context.Background(), satToMsat(1000), "rb 1->2")
+	if err != nil || string(res.RHash) != "a" {
+		t.Errorf("the restored invoice should be reused, got %v, %v", res, err)
+	}
+	res, err = r.createInvoice(context.Background(), satToMsat(1000), "rb 3->4")
+	if err != nil || string(res.RHash) == "a" {
+		t.Errorf("the invoice with a different memo should not be reused, got %v, %v", res, err)
+	}
+}
+
+// TestInvoiceRefreshNearExpiry simulates the cached invoice expiring while the
+// route is probed, the next payment should get a new one.
+func TestInvoiceRefreshNearExpiry(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.InvoiceExpiryMargin = 60
+	ln := &fakeLightning{}
+	r := &regolancer{lnClient: ln, invoiceSkewChecked: true, invoiceCache: map[invoiceKey]cachedInvoice{}}
+	amount := satToMsat(1000)
+	first, err := r.createInvoice(context.Background(), amount, "rb 1->2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := invoiceKey{0, amount}
+	if until := time.Until(r.invoiceCache[key].expiration); until < invoiceExpiry-time.Minute {
+		t.Errorf("the invoice should expire in %s, got %s", invoiceExpiry, until)
+	}
+	// the first probe iteration
+	if res, _ := r.createInvoice(context.Background(), amount, "rb 1->2"); string(res.RHash) != string(first.RHash) {
+		t.Error("the fresh invoice should be reused")
+	}
+	// the probing took most of the invoice lifetime
+	inv := r.invoiceCache[key]
+	inv.expiration = time.Now().Add(time.Second * 30)
+	r.invoiceCache[key] = inv
+	second, err := r.createInvoice(context.Background(), amount, "rb 1->2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(second.RHash) == string(first.RHash) || ln.invoices != 2 {
+		t.Errorf("a new invoice should be created, %d invoices created", ln.invoices)
+	}
+	if string(r.invoiceCache[key].RHash) != string(second.RHash) ||
+		time.Until(r.invoiceCache[key].expiration) < invoiceExpiry-time.Minute {
+		t.Error("the stale invoice should be replaced in the cache")
+	}
+	// the node clock running ahead eats into the margin
+	r.clockSkew = time.Minute
+	inv = r.invoiceCache[key]
+	inv.expiration = time.Now().Add(time.Second * 90)
+	r.invoiceCache[key] = inv
+	if res, _ := r.createInvoice(context.Background(), amount, "rb 1->2"); string(res.RHash) == string(second.RHash) {
+		t.Error("the clock skew should be added to the margin")
+	}
+	// the other workers have their own invoices
+	r.workerId = 1
+	if res, _ := r.createInvoice(context.Background(), amount, "rb 1->2"); ln.invoices != 4 ||
+		string(r.invoiceCache[invoiceKey{1, amount}].RHash) != string(res.RHash) {
+		t.Errorf("worker 1 should create its own invoice, %d invoices created", ln.invoices)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	ledgerDateFormat = "2006-01-02"
+	ledgerLifetime   = time.Hour * 24 * 7
+)
+
+var ErrDailyCapReached = fmt.Errorf("daily rebalance cap reached")
+
+type dailyCaps struct {
+	Total      int64 `long:"daily-cap-total" description:"max amount in sats to rebalance per day in all sessions (requires --daily-ledger)" json:"total" toml:"total"`
+	PerChannel int64 `long:"daily-cap-channel" description:"max amount in sats to rebalance into a single channel per day in all sessions (requires --daily-ledger)" json:"per_channel" toml:"per_channel"`
+}
+
+// dailyLedger keeps the rebalanced amounts (in sats) per day and target
+// channel.
+type dailyLedger map[string]map[uint64]int64
+
+func readDailyLedger(filename string) (dailyLedger, error) {
+	result := dailyLedger{}
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error opening daily ledger file: %s", err)
+		}
+		return result, nil
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	for day := range result {
+		t, err := time.ParseInLocation(ledgerDateFormat, day, time.Local)
+		if err != nil || time.Since(t) > ledgerLifetime {
+			delete(result, day)
+		}
+	}
+	return result, nil
+}
+
+func (r *regolancer) loadDailyLedger(filename string) error {
+	l := lock()
+	l.RLock()
+	defer l.Unlock()
+	ledger, err := readDailyLedger(filename)
+	if err != nil {
+		return err
+	}
+	r.dailyLedger = ledger
+	return nil
+}
+
+// addDailyLedger records the amount in the ledger file. The file is reread
+// under the lock so that the amounts of the concurrently running instances
+// are not lost.
+func (r *regolancer) addDailyLedger(filename string, chanId uint64, amount int64) error {
+	if filename == "" {
+		return nil
+	}
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	ledger, err := readDailyLedger(filename)
+	if err != nil {
+		return err
+	}
+	day := time.Now().Format(ledgerDateFormat)
+	if ledger[day] == nil {
+		ledger[day] = map[uint64]int64{}
+	}
+	ledger[day][chanId] += amount
+	r.dailyLedger = ledger
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating daily ledger file: %s", err)
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(ledger)
+}
+
+func (r *regolancer) dailyAmounts() (total int64, perChannel map[uint64]int64) {
+	perChannel = r.dailyLedger[time.Now().Format(ledgerDateFormat)]
+	for _, amount := range perChannel {
+		total += amount
+	}
+	return
+}
+
+// dailyCapAmount limits the amount by the remaining daily caps. If the total
+// cap is reached ErrDailyCapReached is returned.
+func (r *regolancer) dailyCapAmount(to uint64, amount int64) (int64, error) {
+	if params.DailyLedger == "" {
+		return amount, nil
+	}
+	total, perChannel := r.dailyAmounts()
+	if params.DailyCaps.Total > 0 {
+		left := params.DailyCaps.Total - total
+		if left <= 0 {
+			return 0, ErrDailyCapReached
+		}
+		if amount > left {
+			amount = left
+		}
+	}
+	if params.DailyCaps.PerChannel > 0 {
+		left := params.DailyCaps.PerChannel - perChannel[to]
+		if left <= 0 {
+			log.Printf("Daily cap of %s sats for channel %s reached, skipping it",
+				hiWhiteColor(params.DailyCaps.PerChannel), hiWhiteColor(to))
+			return 0, nil
+		}
+		if amount > left {
+			amount = left
+		}
+	}
+	return amount, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// the CLTV delta of the last hop, it's what our invoices require
+const finalCltvDelta = 144
+
+// buildRoute builds the route for the amount through the channels leading to
+// the nodes pks. Without the router service the route is built from the
+// channel policies like lnd does it.
+func (r *regolancer) buildRoute(ctx context.Context, chans []uint64, pks [][]byte,
+	amount Msat) (*lnrpc.Route, error) {
+	if !r.legacyRouter {
+		resp, err := r.routerClient.BuildRoute(ctx, &routerrpc.BuildRouteRequest{
+			AmtMsat:        int64(amount),
+			OutgoingChanId: chans[0],
+			HopPubkeys:     pks,
+			FinalCltvDelta: finalCltvDelta,
+		})
+		if !r.routerUnavailable(err) {
+			if err != nil {
+				return nil, err
+			}
+			return resp.Route, nil
+		}
+	}
+	return r.buildLocalRoute(ctx, chans, pks, amount)
+}
+
+// buildLocalRoute walks the route backwards from the destination adding the
+// fee and the timelock delta of every forwarding node.
+func (r *regolancer) buildLocalRoute(ctx context.Context, chans []uint64, pks [][]byte,
+	amount Msat) (*lnrpc.Route, error) {
+	if len(chans) != len(pks) {
+		return nil, fmt.Errorf("%d channels don't match %d nodes", len(chans), len(pks))
+	}
+	height := r.currentHeight(ctx)
+	if height == 0 {
+		return nil, fmt.Errorf("block height is unknown")
+	}
+	route := &lnrpc.Route{}
+	for i, chanId := range chans {
+		edge, err := r.getChanInfo(ctx, chanId)
+		if err != nil {
+			return nil, fmt.Errorf("error getting channel %d info: %s", chanId, err)
+		}
+		route.Hops = append(route.Hops, &lnrpc.Hop{ChanId: chanId, ChanCapacity: edge.Capacity,
+			PubKey: hex.EncodeToString(pks[i]), TlvPayload: true})
+	}
+	amtToForward := amount
+	timeLock := height + finalCltvDelta
+	for i := len(route.Hops) - 1; i >= 0; i-- {
+		hop := route.Hops[i]
+		hop.AmtToForwardMsat, hop.AmtToForward = int64(amtToForward), amtToForward.sats()
+		hop.Expiry = timeLock
+		if i == len(route.Hops)-1 {
+			continue
+		}
+		policy, err := r.hopPolicy(ctx, route, i+1)
+		if err != nil {
+			return nil, err
+		}
+		if policy == nil {
+			return nil, fmt.Errorf("channel %d has no policy of node %s", route.Hops[i+1].ChanId, hop.PubKey)
+		}
+		fee := policyFee(policy, amtToForward)
+		hop.FeeMsat, hop.Fee = int64(fee), fee.sats()
+		amtToForward += fee
+		timeLock += policy.TimeLockDelta
+	}
+	route.TotalAmtMsat = route.Hops[0].AmtToForwardMsat + route.Hops[0].FeeMsat
+	route.TotalFeesMsat = route.TotalAmtMsat - int64(amount)
+	route.TotalAmt, route.TotalFees = Msat(route.TotalAmtMsat).sats(), Msat(route.TotalFeesMsat).sats()
+	route.TotalTimeLock = timeLock
+	return route, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logEvent is a single line of the JSON log output. The plain log messages
+// become the "log" events, the notable steps of the attempts have their own
+// events with the structured fields.
+type logEvent struct {
+	Ts         string   `json:"ts"`
+	Level      string   `json:"level"`
+	Event      string   `json:"event"`
+	Msg        string   `json:"msg,omitempty"`
+	Attempt    int      `json:"attempt,omitempty"`
+	FromChan   uint64   `json:"from_chan,omitempty"`
+	ToChan     uint64   `json:"to_chan,omitempty"`
+	Amount     int64    `json:"amount,omitempty"`
+	FeeMsat    int64    `json:"fee_msat,omitempty"`
+	MaxFeeMsat int64    `json:"max_fee_msat,omitempty"`
+	FeePPM     int64    `json:"fee_ppm,omitempty"`
+	Returned   *int     `json:"routes_returned,omitempty"`
+	Kept       *int     `json:"routes_kept,omitempty"`
+	Overshoot  int64    `json:"overshoot_ppm,omitempty"`
+	CacheHits  *int     `json:"node_cache_hits,omitempty"`
+	CacheMiss  *int     `json:"node_cache_misses,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	Hops       []logHop `json:"hops,omitempty"`
+}
+
+type logHop struct {
+	ChanId  uint64 `json:"chan_id"`
+	PubKey  string `json:"pubkey"`
+	Alias   string `json:"alias,omitempty"`
+	FeeMsat int64  `json:"fee_msat"`
+}
+
+var jsonLogger = struct {
+	lock sync.Mutex
+	out  io.Writer
+}{out: os.Stderr}
+
+func jsonLog() bool {
+	return params.LogFormat == logFormatJSON
+}
+
+// jsonLogWriter turns the log lines into the "log" events so that every line
+// of the output stays a valid JSON object.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if msg != "" {
+		emitEvent(logEvent{Event: "log", Msg: msg})
+	}
+	return len(p), nil
+}
+
+// setupLogFormat switches the log to JSON output, the colors are disabled as
+// the messages are embedded as is. They're also disabled with --no-color.
+func setupLogFormat() {
+	if params.NoColor {
+		color.NoColor = true
+	}
+	if !jsonLog() {
+		return
+	}
+	color.NoColor = true
+	log.SetFlags(0)
+	log.SetOutput(jsonLogWriter{})
+}
+
+func emitEvent(e logEvent) {
+	if !jsonLog() {
+		return
+	}
+	e.Ts = time.Now().Format(time.RFC3339Nano)
+	if e.Level == "" {
+		e.Level = "info"
+	}
+	jsonLogger.lock.Lock()
+	defer jsonLogger.lock.Unlock()
+	json.NewEncoder(jsonLogger.out).Encode(e)
+}
+
+// textPrintln prints the line only in the text log format, it's used for the
+// unstructured output that goes around the log.
+func textPrintln(a ...any) {
+	if !jsonLog() {
+		fmt.Println(a...)
+	}
+}
+
+func (r *regolancer) emitRoute(ctx context.Context, route *lnrpc.Route, tally routeCacheTally) {
+	e := logEvent{
+		Event:    "route_found",
+		Attempt:  r.currentAttempt(),
+		FromChan: route.Hops[0].ChanId,
+		ToChan:   route.Hops[len(route.Hops)-1].ChanId,
+		Amount:   Msat(route.TotalAmtMsat - route.TotalFeesMsat).sats(),
+		FeeMsat:  route.TotalFeesMsat,
+		FeePPM:   feePPM(Msat(route.TotalAmtMsat), Msat(route.TotalFeesMsat)),
+	}
+	if params.NodeCacheInfo {
+		e.CacheHits, e.CacheMiss = &tally.hits, &tally.misses
+	}
+	for i, hop := range route.Hops {
+		h := logHop{ChanId: hop.ChanId, PubKey: hop.PubKey}
+		if i > 0 {
+			h.FeeMsat = route.Hops[i-1].FeeMsat
+		}
+		if nodeInfo, err := r.getNodeInfo(ctx, hop.PubKey); err == nil {
+			h.Alias = nodeInfo.Node.Alias
+		}
+		e.Hops = append(e.Hops, h)
+	}
+	emitEvent(e)
+}
+
+func (r *regolancer) emitSuccess(route *lnrpc.Route, amount Msat) {
+	if len(route.Hops) == 0 {
+		return
+	}
+	emitEvent(logEvent{Event: "rebalance_succeeded", Attempt: r.currentAttempt(), FromChan: route.Hops[0].ChanId,
+		ToChan: route.Hops[len(route.Hops)-1].ChanId, Amount: amount.sats(), FeeMsat: route.TotalFeesMsat,
+		FeePPM: feePPM(Msat(route.TotalAmtMsat), Msat(route.TotalFeesMsat))})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// testLargeNode is a hub with many channels and addresses like the ones that
+// made long sessions run out of memory.
+func testLargeNode(pk string) *lnrpc.NodeInfo {
+	node := &lnrpc.NodeInfo{
+		Node: &lnrpc.LightningNode{
+			PubKey:     pk,
+			Alias:      "hub " + pk[:8],
+			Color:      "#3399ff",
+			LastUpdate: 1700000000,
+			Addresses:  []*lnrpc.NodeAddress{{Network: "tcp", Addr: "1.2.3.4:9735"}},
+			Features:   map[uint32]*lnrpc.Feature{},
+		},
+		NumChannels:   2000,
+		TotalCapacity: 2000 * 5000000,
+	}
+	for i := uint32(0); i < 50; i++ {
+		node.Node.Features[i] = &lnrpc.Feature{Name: fmt.Sprintf("feature-%d", i), IsKnown: true}
+	}
+	for i := 0; i < 2000; i++ {
+		policy := &lnrpc.RoutingPolicy{TimeLockDelta: 40, MinHtlc: 1000, FeeBaseMsat: 1000, FeeRateMilliMsat: 100,
+			MaxHtlcMsat: 5000000000}
+		node.Channels = append(node.Channels, &lnrpc.ChannelEdge{ChannelId: uint64(i), ChanPoint: "txid:0",
+			Node1Pub: pk, Node2Pub: testPK(i), Capacity: 5000000, Node1Policy: policy, Node2Policy: policy})
+	}
+	return node
+}
+
+func loadTestNodes(r *regolancer, count int) {
+	for i := 0; i < count; i++ {
+		r.getNodeInfo(context.Background(), testPK(i))
+	}
+}
+
+// TestLowMemoryNodeInfo checks that the route printing fields and the features
+// are the same with --low-memory, including the nodes loaded from a full node
+// cache.
+func TestLowMemoryNodeInfo(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	for _, lowMemory := range []bool{false, true} {
+		params.LowMemory = lowMemory
+		r := &regolancer{nodeCache: map[string]cachedNodeInfo{},
+			lnClient: &fakeLightning{nodes: testLargeNode}}
+		info, err := r.getNodeInfo(context.Background(), testPK(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Node.Alias != "hub "+testPK(1)[:8] || info.Node.PubKey != testPK(1) ||
+			info.NumChannels != 2000 || info.TotalCapacity != 2000*5000000 || len(info.Node.Addresses) != 1 {
+			t.Errorf("low memory %v: unexpected node info %v", lowMemory, info.Node)
+		}
+		if len(info.Channels) > 0 {
+			t.Error("the node channels shouldn't be requested")
+		}
+		if len(info.Node.Features) != 50 {
+			t.Errorf("low memory %v: expected 50 features, got %d", lowMemory, len(info.Node.Features))
+		}
+		if lowMemory && info.Node.Color != "" {
+			t.Error("the color shouldn't be kept in the low memory mode")
+		}
+	}
+	filename := t.TempDir() + "/nodes.dat"
+	params.LowMemory = false
+	r := &regolancer{nodeCache: map[string]cachedNodeInfo{}, lnClient: &fakeLightning{nodes: testLargeNode}}
+	loadTestNodes(r, 3)
+	if err := r.saveNodeCache(filename, 60); err != nil {
+		t.Fatal(err)
+	}
+	params.LowMemory = true
+	r = &regolancer{nodeCache: map[string]cachedNodeInfo{}}
+	if err := r.loadNodeCache(filename, 60, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.nodeCache) != 3 {
+		t.Fatalf("expected 3 cached nodes, got %d", len(r.nodeCache))
+	}
+	for pk, v := range r.nodeCache {
+		if v.NodeInfo.Node.Color != "" || len(v.NodeInfo.Node.Features) != 50 || v.NodeInfo.Node.Alias != "hub "+pk[:8] {
+			t.Errorf("the cached node %s isn't compacted: color %q, %d features, alias %s", pk, v.NodeInfo.Node.Color,
+				len(v.NodeInfo.Node.Features), v.NodeInfo.Node.Alias)
+		}
+	}
+}
+
+// BenchmarkNodeCacheMemory reports the heap used by the node cache with and
+// without --low-memory, run with -bench NodeCacheMemory -benchtime 1x.
+func BenchmarkNodeCacheMemory(b *testing.B) {
+	defer func(p configParams) { params = p }(params)
+	const nodes = 200
+	for _, lowMemory := range []bool{false, true} {
+		b.Run(fmt.Sprintf("low-memory=%v", lowMemory), func(b *testing.B) {
+			params.LowMemory = lowMemory
+			var heap uint64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				r := &regolancer{nodeCache: map[string]cachedNodeInfo{},
+					lnClient: &fakeLightning{nodes: testLargeNode}}
+				loadTestNodes(r, nodes)
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				if after.HeapAlloc > before.HeapAlloc {
+					heap += after.HeapAlloc - before.HeapAlloc
+				}
+				runtime.KeepAlive(r)
+			}
+			b.ReportMetric(float64(heap)/float64(b.N)/nodes, "heap-B/node")
+		})
+	}
+}
+
+func TestLowMemoryRoutes(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	r, _ := newRouteTest(func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+		resp := &lnrpc.QueryRoutesResponse{}
+		for i := 0; i < 3; i++ {
+			resp.Routes = append(resp.Routes, testRoute(1, 2, req.AmtMsat, 1000, testPK(i), testPeerPK))
+		}
+		return resp, nil
+	})
+	for _, lowMemory := range []bool{false, true} {
+		params.LowMemory = lowMemory
+		routes, _, err := r.getRoutes(context.Background(), 1, 2, 100000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 3
+		if lowMemory {
+			expected = 1
+		}
+		if len(routes) != expected || routes[0].Hops[0].PubKey != testPK(0) {
+			t.Errorf("low memory %t: expected %d routes starting with the first one, got %d", lowMemory,
+				expected, len(routes))
+		}
+	}
+}
@@ -3,69 +3,192 @@ package main
 import (
 	"context"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/jessevdk/go-flags"
-	"github.com/lightninglabs/lndclient"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc"
 )
 
 type configParams struct {
-	Config              string   `short:"f" long:"config" description:"config file path"`
-	Connect             string   `short:"c" long:"connect" description:"connect to lnd using host:port" json:"connect" toml:"connect"`
-	TLSCert             string   `short:"t" long:"tlscert" description:"path to tls.cert to connect" required:"false" json:"tlscert" toml:"tlscert"`
-	MacaroonDir         string   `long:"macaroon-dir" description:"path to the macaroon directory" required:"false" json:"macaroon_dir" toml:"macaroon_dir"`
-	MacaroonFilename    string   `long:"macaroon-filename" description:"macaroon filename" json:"macaroon_filename" toml:"macaroon_filename"`
-	Network             string   `short:"n" long:"network" description:"bitcoin network to use" json:"network" toml:"network"`
-	FromPerc            int64    `long:"pfrom" description:"channels with less than this inbound liquidity percentage will be considered as source channels" json:"pfrom" toml:"pfrom"`
-	ToPerc              int64    `long:"pto" description:"channels with less than this outbound liquidity percentage will be considered as target channels" json:"pto" toml:"pto"`
-	Perc                int64    `short:"p" long:"perc" description:"use this value as both pfrom and pto from above" json:"perc" toml:"perc"`
-	Amount              int64    `short:"a" long:"amount" description:"amount to rebalance" json:"amount" toml:"amount"`
-	RelAmountTo         float64  `long:"rel-amount-to" description:"calculate amount as the target channel capacity fraction (for example, 0.2 means you want to achieve at most 20% target channel local balance)"`
-	RelAmountFrom       float64  `long:"rel-amount-from" description:"calculate amount as the source channel capacity fraction (for example, 0.2 means you want to achieve at most 20% source channel remote balance)"`
-	EconRatio           float64  `short:"r" long:"econ-ratio" description:"economical ratio for fee limit calculation as a multiple of target channel fee (for example, 0.5 means you want to pay at max half the fee you might earn for routing out of the target channel)" json:"econ_ratio" toml:"econ_ratio"`
-	EconRatioMaxPPM     int64    `long:"econ-ratio-max-ppm" description:"limits the max fee ppm for a rebalance when using econ ratio" json:"econ_ratio_max_ppm" toml:"econ_ratio_max_ppm"`
-	FeeLimitPPM         int64    `short:"F" long:"fee-limit-ppm" description:"don't consider the target channel fee and use this max fee ppm instead (can rebalance at a loss, be careful)" json:"fee_limit_ppm" toml:"fee_limit_ppm"`
-	LostProfit          bool     `short:"l" long:"lost-profit" description:"also consider the outbound channel fees when looking for profitable routes so that outbound_fee+inbound_fee < route_fee" json:"lost_profit" toml:"lost_profit"`
-	ProbeSteps          int      `short:"b" long:"probe-steps" description:"if the payment fails at the last hop try to probe lower amount using this many steps" json:"probe_steps" toml:"probe_steps"`
-	AllowRapidRebalance bool     `long:"allow-rapid-rebalance" description:"if a rebalance succeeds the route will be used for further rebalances until criteria for channels is not satifsied" json:"allow_rapid_rebalance" toml:"allow_rapid_rebalance"`
-	MinAmount           int64    `long:"min-amount" description:"if probing is enabled this will be the minimum amount to try" json:"min_amount" toml:"min_amount"`
-	ExcludeChannelsIn   []string `short:"i" long:"exclude-channel-in" description:"don't use this channel as incoming (can be specified multiple times)" json:"exclude_channels_in" toml:"exclude_channels_in"`
-	ExcludeChannelsOut  []string `short:"o" long:"exclude-channel-out" description:"don't use this channel as outgoing (can be specified multiple times)" json:"exclude_channels_out" toml:"exclude_channels_out"`
-	ExcludeChannels     []string `short:"e" long:"exclude-channel" description:"(DEPRECATED) don't use this channel at all (can be specified multiple times)" json:"exclude_channels" toml:"exclude_channels"`
-	ExcludeNodes        []string `short:"d" long:"exclude-node" description:"(DEPRECATED) don't use this node for routing (can be specified multiple times)" json:"exclude_nodes" toml:"exclude_nodes"`
-	Exclude             []string `long:"exclude" description:"don't use this node or your channel for routing (can be specified multiple times)" json:"exclude" toml:"exclude"`
-	To                  []string `long:"to" description:"try only this channel or node as target (should satisfy other constraints too; can be specified multiple times)" json:"to" toml:"to"`
-	From                []string `long:"from" description:"try only this channel or node as source (should satisfy other constraints too; can be specified multiple times)" json:"from" toml:"from"`
-	FailTolerance       int64    `long:"fail-tolerance" description:"a payment that differs from the prior attempt by this ppm will be cancelled" json:"fail_tolerance" toml:"fail_tolerance"`
-	AllowUnbalanceFrom  bool     `long:"allow-unbalance-from" description:"let the source channel go below 50% local liquidity, use if you want to drain a channel; you should also set --pfrom to >50" json:"allow_unbalance_from" toml:"allow_unbalance_from"`
-	AllowUnbalanceTo    bool     `long:"allow-unbalance-to" description:"let the target channel go above 50% local liquidity, use if you want to refill a channel; you should also set --pto to >50" json:"allow_unbalance_to" toml:"allow_unbalance_to"`
-	StatFilename        string   `short:"s" long:"stat" description:"save successful rebalance information to the specified CSV file" json:"stat" toml:"stat"`
-	NodeCacheFilename   string   `long:"node-cache-filename" description:"save and load other nodes information to this file, improves cold start performance"  json:"node_cache_filename" toml:"node_cache_filename"`
-	NodeCacheLifetime   int      `long:"node-cache-lifetime" description:"nodes with last update older than this time (in minutes) will be removed from cache after loading it" json:"node_cache_lifetime" toml:"node_cache_lifetime"`
-	NodeCacheInfo       bool     `long:"node-cache-info" description:"show red and cyan 'x' characters in routes to indicate node cache misses and hits respectively" json:"node_cache_info" toml:"node_cache_info"`
-	TimeoutRebalance    int      `long:"timeout-rebalance" description:"max rebalance session time in minutes" json:"timeout_rebalance" toml:"timeout_rebalance"`
-	TimeoutAttempt      int      `long:"timeout-attempt" description:"max attempt time in minutes" json:"timeout_attempt" toml:"timeout_attempt"`
-	TimeoutInfo         int      `long:"timeout-info" description:"max general info query time (local channels, node id etc.) in seconds" json:"timeout_info" toml:"timeout_info"`
-	TimeoutRoute        int      `long:"timeout-route" description:"max channel selection and route query time in seconds" json:"timeout_route" toml:"timeout_route"`
-	Version             bool     `short:"v" long:"version" description:"show program version and exit"`
+	Config              []string     `short:"f" long:"config" description:"config file path, can be repeated or comma separated to merge several files, the later files override the earlier ones"`
+	Connect             string       `short:"c" long:"connect" description:"connect to lnd using host:port" json:"connect" toml:"connect"`
+	TLSCert             string       `short:"t" long:"tlscert" description:"path to tls.cert to connect" required:"false" json:"tlscert" toml:"tlscert"`
+	MacaroonDir         string       `long:"macaroon-dir" description:"path to the macaroon directory" required:"false" json:"macaroon_dir" toml:"macaroon_dir"`
+	MacaroonFilename    string       `long:"macaroon-filename" description:"macaroon filename" json:"macaroon_filename" toml:"macaroon_filename"`
+	Network             string       `short:"n" long:"network" description:"bitcoin network to use" json:"network" toml:"network"`
+	KeepaliveTime       int          `long:"keepalive-time" description:"ping lnd after this many seconds without activity to keep the connection alive and detect when it's dropped (default: 60, minimum: 10, -1 disables the pings)" json:"keepalive_time" toml:"keepalive_time"`
+	KeepaliveTimeout    int          `long:"keepalive-timeout" description:"consider the connection dead if lnd doesn't answer the ping in this many seconds (default: 20)" json:"keepalive_timeout" toml:"keepalive_timeout"`
+	KeepaliveNoStream   bool         `long:"keepalive-without-stream" description:"also ping lnd when no calls are active, lnd must be started with grpc.client-allow-ping-without-stream=true" json:"keepalive_without_stream" toml:"keepalive_without_stream"`
+	FromPerc            int64        `long:"pfrom" description:"channels with less than this inbound liquidity percentage will be considered as source channels" json:"pfrom" toml:"pfrom"`
+	ToPerc              int64        `long:"pto" description:"channels with less than this outbound liquidity percentage will be considered as target channels" json:"pto" toml:"pto"`
+	MaxSourceUsagePerc  int64        `long:"max-source-usage-perc" description:"skip the source channels that provided more than this percentage of the total amount rebalanced in this session while other sources are available" json:"max_source_usage_perc" toml:"max_source_usage_perc"`
+	FromPercStrict      int64        `long:"pfrom-strict" description:"use this percentage instead of pfrom for the channels specified with --from" json:"pfrom_strict" toml:"pfrom_strict"`
+	ToPercStrict        int64        `long:"pto-strict" description:"use this percentage instead of pto for the channels specified with --to" json:"pto_strict" toml:"pto_strict"`
+	StrictHeadroom      bool         `long:"strict-target-headroom" description:"only use the channel pairs that stay below pto (target) and pfrom (source) after rebalancing the full amount" json:"strict_target_headroom" toml:"strict_target_headroom"`
+	Perc                int64        `short:"p" long:"perc" description:"use this value as both pfrom and pto from above" json:"perc" toml:"perc"`
+	Amount              int64        `short:"a" long:"amount" description:"amount to rebalance" json:"amount" toml:"amount"`
+	Strict              bool         `long:"strict" description:"fail instead of reducing the amount if the candidate channels can't send or receive it in total" json:"strict" toml:"strict"`
+	RelAmountTo         float64      `long:"rel-amount-to" description:"calculate amount as the target channel capacity fraction (for example, 0.2 means you want to achieve at most 20% target channel local balance)"`
+	RelAmountFrom       float64      `long:"rel-amount-from" description:"calculate amount as the source channel capacity fraction (for example, 0.2 means you want to achieve at most 20% source channel remote balance)"`
+	EconRatio           float64      `short:"r" long:"econ-ratio" description:"economical ratio for fee limit calculation as a multiple of target channel fee (for example, 0.5 means you want to pay at max half the fee you might earn for routing out of the target channel)" json:"econ_ratio" toml:"econ_ratio"`
+	EconRatioMaxPPM     int64        `long:"econ-ratio-max-ppm" description:"limits the max fee ppm for a rebalance when using econ ratio" json:"econ_ratio_max_ppm" toml:"econ_ratio_max_ppm"`
+	DefaultTargetPPM    int64        `long:"default-target-ppm" description:"assume this fee rate for target channels that have no policy yet when using econ ratio" json:"default_target_ppm" toml:"default_target_ppm"`
+	FeeLimitPPM         int64        `short:"F" long:"fee-limit-ppm" description:"don't consider the target channel fee and use this max fee ppm instead (can rebalance at a loss, be careful)" json:"fee_limit_ppm" toml:"fee_limit_ppm"`
+	FeeLimitIsCap       bool         `long:"fee-limit-is-cap" description:"use the econ ratio to calculate the max fee and fee-limit-ppm as its hard cap" json:"fee_limit_is_cap" toml:"fee_limit_is_cap"`
+	FeeLimitScale       float64      `long:"fee-limit-scale" description:"multiply the max fee by this factor for the target channels with local balance at or below --fee-limit-scale-perc, the factor goes down linearly to 1 at --pto" json:"fee_limit_scale" toml:"fee_limit_scale"`
+	FeeLimitScalePerc   int64        `long:"fee-limit-scale-perc" description:"target channel local balance percentage at which the full --fee-limit-scale is applied (default: 10)" json:"fee_limit_scale_perc" toml:"fee_limit_scale_perc"`
+	MaxTotalFee         int64        `long:"max-total-fee-sat" description:"stop the session when the fees paid in it would exceed this amount in sats, the payment that doesn't fit is skipped" json:"max_total_fee_sat" toml:"max_total_fee_sat"`
+	ExploreFeeHeadroom  bool         `long:"explore-fee-headroom" description:"if no route is found within the fee limit query again with twice the limit (without paying) and report how much more the routes would cost" json:"explore_fee_headroom" toml:"explore_fee_headroom"`
+	LostProfit          bool         `short:"l" long:"lost-profit" description:"also consider the outbound channel fees when looking for profitable routes so that outbound_fee+inbound_fee < route_fee" json:"lost_profit" toml:"lost_profit"`
+	ProbeSteps          int          `short:"b" long:"probe-steps" description:"if the payment fails at the last hop try to probe lower amount using this many steps" json:"probe_steps" toml:"probe_steps"`
+	SpeculativeHalf     bool         `long:"speculative-half-query" description:"if the target peer failed to forward the amount before also query the routes for half the amount at the same time and use them if there's no route for the full amount" json:"speculative_half_query" toml:"speculative_half_query"`
+	AllowNodeRepeats    bool         `long:"allow-node-repeats" description:"use the routes that go through the same node more than once (for debugging), such routes are skipped by default" json:"allow_node_repeats" toml:"allow_node_repeats"`
+	AcceptAnySource     bool         `long:"accept-any-source" description:"if lnd returns a route that starts with a different channel than requested use it if that channel is a valid source, otherwise such routes are skipped" json:"accept_any_source" toml:"accept_any_source"`
+	PrivateSources      bool         `long:"include-private-sources" description:"also use our private (unannounced) channels as sources" json:"include_private_sources" toml:"include_private_sources"`
+	PrivateTargets      bool         `long:"include-private-targets" description:"also use our private (unannounced) channels as targets, the peer policy is passed to lnd as a route hint" json:"include_private_targets" toml:"include_private_targets"`
+	MinRouteChoices     int          `long:"min-route-choices" description:"skip the channel pair for a short time if less than this number of distinct routes is found (default: 1)" json:"min_route_choices" toml:"min_route_choices"`
+	MaxHops             int          `long:"max-hops" description:"skip the routes with more hops (channels) than this, lnd is queried again a few times ignoring the long routes' hops" json:"max_hops" toml:"max_hops"`
+	PreferZeroBaseFee   bool         `long:"prefer-zero-base-fee" description:"try the routes without base fees first even if they're more expensive (with --min-route-choices)" json:"prefer_zero_base_fee" toml:"prefer_zero_base_fee"`
+	RequireZeroBaseFee  bool         `long:"require-zero-base-fee" description:"skip the routes with any hop charging a base fee, lnd is queried again a few times ignoring such hops" json:"require_zero_base_fee" toml:"require_zero_base_fee"`
+	MaxHopBaseFee       int64        `long:"max-hop-base-fee-msat" description:"skip the routes with any hop charging more base fee than this, lnd is queried again a few times ignoring such hops" json:"max_hop_base_fee_msat" toml:"max_hop_base_fee_msat"`
+	MaxHopPPM           int64        `long:"max-hop-ppm" description:"skip the routes with any intermediate hop charging more than this fee rate in ppm for the forwarded amount (base fee included), lnd is queried again a few times ignoring such hops" json:"max_hop_ppm" toml:"max_hop_ppm"`
+	MaxRequeries        int          `long:"max-requeries" description:"max number of the repeated route queries ignoring the hops of a route rejected by --max-hops, --require-zero-base-fee, --max-hop-base-fee-msat or --max-hop-ppm (default: 3)" json:"max_requeries" toml:"max_requeries"`
+	AllowRapidRebalance bool         `long:"allow-rapid-rebalance" description:"if a rebalance succeeds the route will be used for further rebalances until criteria for channels is not satifsied" json:"allow_rapid_rebalance" toml:"allow_rapid_rebalance"`
+	MinAmount           int64        `long:"min-amount" description:"if probing is enabled this will be the minimum amount to try" json:"min_amount" toml:"min_amount"`
+	ExcludeChannelsIn   []string     `short:"i" long:"exclude-channel-in" description:"don't use this channel as incoming (can be specified multiple times)" json:"exclude_channels_in" toml:"exclude_channels_in"`
+	ExcludeChannelsOut  []string     `short:"o" long:"exclude-channel-out" description:"don't use this channel as outgoing (can be specified multiple times)" json:"exclude_channels_out" toml:"exclude_channels_out"`
+	ExcludeChannels     []string     `short:"e" long:"exclude-channel" description:"(DEPRECATED) don't use this channel at all (can be specified multiple times)" json:"exclude_channels" toml:"exclude_channels"`
+	ExcludeNodes        []string     `short:"d" long:"exclude-node" description:"(DEPRECATED) don't use this node for routing (can be specified multiple times)" json:"exclude_nodes" toml:"exclude_nodes"`
+	Exclude             []string     `long:"exclude" description:"don't use this node or your channel for routing (can be specified multiple times)" json:"exclude" toml:"exclude"`
+	ExcludeAlias        []string     `long:"exclude-alias" description:"don't use the nodes whose alias matches this glob or /regex/ pattern (case-insensitive) for routing and your channels with them at all, also accepted as alias:pattern in --exclude, --from and --to (can be specified multiple times)" json:"exclude_alias" toml:"exclude_alias"`
+	RequireClearnetPeer string       `long:"require-clearnet-peer" description:"only use channels to peers with a clearnet address as targets, sources or both (to|from|both)" json:"require_clearnet_peer" toml:"require_clearnet_peer"`
+	MinTargetActivity   int64        `long:"min-target-remote-activity" description:"only use the channels that forwarded at least this amount in sats out during the last --target-activity-hours as targets" json:"min_target_remote_activity" toml:"min_target_remote_activity"`
+	TargetActivityHours int          `long:"target-activity-hours" description:"the period in hours to check --min-target-remote-activity in (default: 24)" json:"target_activity_hours" toml:"target_activity_hours"`
+	RequireTorPeer      string       `long:"require-tor-peer" description:"only use channels to peers with a tor address as targets, sources or both (to|from|both)" json:"require_tor_peer" toml:"require_tor_peer"`
+	ExcludePairs        []string     `long:"exclude-pair" description:"don't route from the first to the second node, specified as two comma separated node ids (the pair is directed; can be specified multiple times)" json:"exclude_pairs" toml:"exclude_pairs"`
+	To                  []string     `long:"to" description:"try only this channel or node as target (should satisfy other constraints too; can be specified multiple times; \"all\" means any channel)" json:"to" toml:"to"`
+	From                []string     `long:"from" description:"try only this channel or node as source (should satisfy other constraints too; can be specified multiple times; \"all\" means any channel)" json:"from" toml:"from"`
+	FailedRouteTTL      int          `long:"failed-route-expiration" description:"failed channel pairs are not tried again for this time in minutes (default: 5)" json:"failed_route_expiration" toml:"failed_route_expiration"`
+	FailureCacheSize    int          `long:"failure-cache-size" description:"max number of failed channel pairs to remember, the ones expiring first are tried again when it's exceeded (default: 10000)" json:"failure_cache_size" toml:"failure_cache_size"`
+	SoftFailureDecay    bool         `long:"soft-failure-decay" description:"don't exclude the channel pairs that found no route, make them less likely to be picked instead; the penalty of every failure decays over time" json:"soft_failure_decay" toml:"soft_failure_decay"`
+	SoftFailureHalfLife int          `long:"soft-failure-half-life" description:"time in minutes after which the soft failure penalty halves (default: same as --failed-route-expiration)" json:"soft_failure_half_life" toml:"soft_failure_half_life"`
+	FailTolerance       int64        `long:"fail-tolerance" description:"a payment that differs from the prior attempt by this ppm will be cancelled, a route with the fee that differs from the failed route's fee by less than this ppm is skipped if it's similar to that route (see --fail-overlap-perc)" json:"fail_tolerance" toml:"fail_tolerance"`
+	FailOverlapPerc     int64        `long:"fail-overlap-perc" description:"a route that shares at least this percentage of channels with the route that failed for the same channel pair is considered similar to it (default: 80)" json:"fail_overlap_perc" toml:"fail_overlap_perc"`
+	AllowUnbalanceFrom  bool         `long:"allow-unbalance-from" description:"let the source channel go below 50% local liquidity, use if you want to drain a channel; you should also set --pfrom to >50" json:"allow_unbalance_from" toml:"allow_unbalance_from"`
+	AllowUnbalanceTo    bool         `long:"allow-unbalance-to" description:"let the target channel go above 50% local liquidity, use if you want to refill a channel; you should also set --pto to >50" json:"allow_unbalance_to" toml:"allow_unbalance_to"`
+	StatFilename        string       `short:"s" long:"stat" description:"save successful rebalance information to the specified CSV file" json:"stat" toml:"stat"`
+	StatPostURL         string       `long:"stat-post-url" description:"also POST every stat record as JSON to this URL, undelivered records are spooled and sent on the next run" json:"stat_post_url" toml:"stat_post_url"`
+	StatPostToken       string       `long:"stat-post-token" description:"bearer token for --stat-post-url, can also be set with the REGOLANCER_STAT_POST_TOKEN environment variable" json:"stat_post_token" toml:"stat_post_token"`
+	StatPostSpool       string       `long:"stat-post-spool" description:"file to keep the undelivered stat records in (default: regolancer-stat-spool.jsonl in the temp directory)" json:"stat_post_spool" toml:"stat_post_spool"`
+	StatDB              string       `long:"stat-db" description:"also save successful rebalances to this SQLite database" json:"stat_db" toml:"stat_db"`
+	StatFailures        bool         `long:"stat-failures" description:"also save the failed attempts to --stat and --stat-db with the failure stage (no_route, fee_too_high or payment), the lnd failure code and the failing hop" json:"stat_failures" toml:"stat_failures"`
+	StateExport         string       `long:"state-export" description:"save the failure cache, failed hop amounts and hop history to this JSON file on exit" json:"state_export" toml:"state_export"`
+	StateImport         string       `long:"state-import" description:"merge the state saved with --state-export into this session, newer entries win" json:"state_import" toml:"state_import"`
+	ResetMc             bool         `long:"reset-mc" description:"reset lnd mission control at startup if it's poisoned by an outage, refused if it was reset less than an hour ago" json:"reset_mc" toml:"reset_mc"`
+	McExport            string       `long:"mc-export" description:"save the lnd mission control pair history to this JSON file on exit" json:"mc_export" toml:"mc_export"`
+	McImport            string       `long:"mc-import" description:"merge the pair history saved with --mc-export into lnd mission control at startup, lnd keeps its newer results" json:"mc_import" toml:"mc_import"`
+	McImportMaxAge      int          `long:"mc-import-max-age" description:"skip the imported mission control results older than this time in hours (default: 24)" json:"mc_import_max_age" toml:"mc_import_max_age"`
+	NodeCacheFilename   string       `long:"node-cache-filename" description:"save and load other nodes information to this file, improves cold start performance"  json:"node_cache_filename" toml:"node_cache_filename"`
+	NodeCacheLifetime   int          `long:"node-cache-lifetime" description:"nodes with last update older than this time (in minutes) will be removed from cache after loading it" json:"node_cache_lifetime" toml:"node_cache_lifetime"`
+	McCacheFilename     string       `long:"mc-cache-filename" description:"save and load the amounts that failed to go through the hops to this file (default: regolancer-mc-cache.dat next to the node cache file)" json:"mc_cache_filename" toml:"mc_cache_filename"`
+	McCacheLifetime     int          `long:"mc-cache-lifetime" description:"failed hop amounts older than this time in minutes are not loaded (default: 60, -1 disables saving them)" json:"mc_cache_lifetime" toml:"mc_cache_lifetime"`
+	NodeCacheSaveMins   int          `long:"node-cache-save-minutes" description:"also save the node cache in background every this many minutes (default: 30, -1 means only on exit)" json:"node_cache_save_minutes" toml:"node_cache_save_minutes"`
+	NodeCacheCompress   bool         `long:"node-cache-compress" description:"save the node cache compressed with gzip (always done if the file name ends with .gz), the uncompressed cache is still loaded and converted on the next save" json:"node_cache_compress" toml:"node_cache_compress"`
+	WarmCache           bool         `long:"warm-cache" description:"fill the node cache from the whole graph at startup (limited by --timeout-info), it's saved if --node-cache-filename is set" json:"warm_cache" toml:"warm_cache"`
+	NodeCacheInfo       bool         `long:"node-cache-info" description:"show red and cyan 'x' characters in routes to indicate node cache misses and hits respectively" json:"node_cache_info" toml:"node_cache_info"`
+	Interval            int          `long:"interval" description:"keep running and start a new rebalance session with refreshed channels this many minutes after the previous one ends (default: 0, run a single session)" json:"interval" toml:"interval"`
+	TimeoutRebalance    int          `long:"timeout-rebalance" description:"max rebalance session time in minutes" json:"timeout_rebalance" toml:"timeout_rebalance"`
+	TimeoutAttempt      int          `long:"timeout-attempt" description:"max attempt time in minutes" json:"timeout_attempt" toml:"timeout_attempt"`
+	TimeoutInfo         int          `long:"timeout-info" description:"max general info query time (local channels, node id etc.) in seconds" json:"timeout_info" toml:"timeout_info"`
+	TimeoutPayment      int          `long:"timeout-payment-seconds" description:"max time to wait for a payment (including probing) in seconds, by default the payment can take the rest of the attempt time" json:"timeout_payment_seconds" toml:"timeout_payment_seconds"`
+	TimeoutRoute        routeTimeout `long:"timeout-route" description:"max channel selection and route query time in seconds or \"auto\" to adjust it to the observed route query time" json:"timeout_route" toml:"timeout_route"`
+	PaceRouteLatency    int          `long:"pace-route-latency" description:"pause between attempts if the 90th percentile of the route query time exceeds this value in milliseconds, the pause grows while lnd is slow" json:"pace_route_latency" toml:"pace_route_latency"`
+	PacePaymentLatency  int          `long:"pace-payment-latency" description:"pause between attempts if the 90th percentile of the payment time exceeds this value in milliseconds, the pause grows while lnd is slow" json:"pace_payment_latency" toml:"pace_payment_latency"`
+	MaxFailedHTLCs      int          `long:"max-failed-htlcs-per-hour" description:"pause between attempts when this many sent HTLCs failed in the last hour, probes count too" json:"max_failed_htlcs_per_hour" toml:"max_failed_htlcs_per_hour"`
+	TimeoutRouteMax     int          `long:"timeout-route-max" description:"max route query time in seconds when --timeout-route=auto (default: 120)" json:"timeout_route_max" toml:"timeout_route_max"`
+	Seesaw              string       `long:"seesaw" description:"rebalance between these two channels (specified as comma separated channel ids) back and forth, flipping the direction after every success" json:"seesaw" toml:"seesaw"`
+	SeesawCycles        int          `long:"seesaw-cycles" description:"number of back and forth cycles for --seesaw (default: 1)" json:"seesaw_cycles" toml:"seesaw_cycles"`
+	SeesawMaxFee        int64        `long:"seesaw-max-fee" description:"stop --seesaw when the total fees exceed this amount in sats" json:"seesaw_max_fee" toml:"seesaw_max_fee"`
+	SeesawMaxFeeFwd     int64        `long:"seesaw-max-fee-forward" description:"stop --seesaw when the fees paid from the first channel to the second exceed this amount in sats" json:"seesaw_max_fee_forward" toml:"seesaw_max_fee_forward"`
+	SeesawMaxFeeBack    int64        `long:"seesaw-max-fee-backward" description:"stop --seesaw when the fees paid from the second channel to the first exceed this amount in sats" json:"seesaw_max_fee_backward" toml:"seesaw_max_fee_backward"`
+	Distribute          int          `long:"distribute" description:"split the amount between up to this many target channels with the biggest deficit (to reach --pto) proportionally to their deficits" json:"distribute" toml:"distribute"`
+	MppParts            int          `long:"mpp-parts" description:"split the amount into this many parts paid along different routes to the same invoice, the max fee applies to the sum of the part fees" json:"mpp_parts" toml:"mpp_parts"`
+	ShardSize           int64        `long:"shard-size" description:"split the amount into equal parts of at most this size in sats instead of --mpp-parts" json:"shard_size" toml:"shard_size"`
+	Workers             int          `long:"workers" description:"run this many attempts concurrently using different source and target channels" json:"workers" toml:"workers"`
+	DryRun              bool         `long:"dry-run" description:"select the channels and find the routes as usual but never create invoices or pay, every pair is tried once" json:"dry_run" toml:"dry_run"`
+	ManualRoute         string       `long:"manual-route" description:"pay --amount once along this route specified as comma separated channel ids (the first and the last channels are ours) and exit; exits with 2 if the payment fails and 3 if the route is rejected"`
+	ChannelsSnapshot    string       `long:"channels-snapshot" description:"save our channels, their policies and peers to this JSON file for --offline" json:"channels_snapshot" toml:"channels_snapshot"`
+	Offline             string       `long:"offline" description:"read the channels from this snapshot file instead of lnd, only --list-candidates, --explain-fee and --simulate-econ work offline" json:"offline" toml:"offline"`
+	ListCandidates      bool         `long:"list-candidates" description:"print the selected source and target channels and exit" json:"list_candidates" toml:"list_candidates"`
+	ExplainFee          string       `long:"explain-fee" description:"print how the max fee is calculated for the channel pair and amount specified as from_chan,to_chan,amount and exit"`
+	SimulateEcon        bool         `long:"simulate-econ" description:"recompute the max fee of the successful rebalances saved to the --stat file with the current channel policies and fee parameters, print how many would be rejected and exit"`
+	Suggest             bool         `long:"suggest" description:"inspect your channels and print suggested pfrom, pto, amount, min-amount and econ-ratio parameters without rebalancing" json:"suggest" toml:"suggest"`
+	SkipLocallyDisabled *bool        `long:"skip-locally-disabled" description:"don't use channels disabled on our side as sources or targets (default: true, set to false in the config file to use them)" json:"skip_locally_disabled" toml:"skip_locally_disabled"`
+	SkipPendingUpdates  *bool        `long:"skip-pending-updates" description:"don't use channels that are being closed or have a status or commitment type indicating a pending update (default: true, set to false in the config file to use them)" json:"skip_pending_updates" toml:"skip_pending_updates"`
+	LowMemory           bool         `long:"low-memory" description:"only keep the node information needed to print routes and limit the channel cache size, useful on low end devices" json:"low_memory" toml:"low_memory"`
+	FeeLedger           string       `long:"fee-ledger" description:"append the fees of successful payments to this file to enforce the daily fee budget across runs" json:"fee_ledger" toml:"fee_ledger"`
+	DailyFeeBudget      int64        `long:"daily-fee-budget-sat" description:"max fees in sats to pay per day in all runs, payments that would exceed it are skipped (requires --fee-ledger)" json:"daily_fee_budget_sat" toml:"daily_fee_budget_sat"`
+	DailyLedger         string       `long:"daily-ledger" description:"record the daily rebalanced amounts to this file to enforce the daily caps across sessions" json:"daily_ledger" toml:"daily_ledger"`
+	DailyCaps           dailyCaps    `json:"daily_caps" toml:"daily_caps"`
+	SourceRules         sourceRules  `json:"source_rules" toml:"source_rules"`
+	ChannelOverrides    overrides    `json:"channel_overrides" toml:"channel_overrides"`
+	FeeSchedule         feeSchedule  `json:"fee_schedule" toml:"fee_schedule"`
+	HopHistoryFilename  string       `long:"hop-history-filename" description:"save and load the statistics of hops used in payment attempts to this file" json:"hop_history_filename" toml:"hop_history_filename"`
+	AvoidBadHops        bool         `long:"avoid-historically-bad-hops" description:"don't route through hops that failed too often in the previous sessions (requires --hop-history-filename)" json:"avoid_historically_bad_hops" toml:"avoid_historically_bad_hops"`
+	BadHopFailPerc      int64        `long:"bad-hop-fail-perc" description:"hops that failed in more than this percentage of attempts are considered bad (default: 80)" json:"bad_hop_fail_perc" toml:"bad_hop_fail_perc"`
+	BadHopMinSamples    int          `long:"bad-hop-min-samples" description:"min number of attempts through a hop to consider it bad (default: 10)" json:"bad_hop_min_samples" toml:"bad_hop_min_samples"`
+	BadHopTTL           int          `long:"bad-hop-ttl" description:"forget hops not used for this time in hours (default: 168)" json:"bad_hop_ttl" toml:"bad_hop_ttl"`
+	PrintBadHops        bool         `long:"print-bad-hops" description:"print the historically bad hops and exit"`
+	WriteSuggestions    string       `long:"write-suggestions" description:"save the exclusions suggested at the end of the session to this file as --exclude, --exclude-channel-in and --exclude-channel-out flags" json:"write_suggestions" toml:"write_suggestions"`
+	ExploreMinutes      int          `long:"explore-minutes" description:"spend this many minutes from the start trying the corridors that never forwarded our payments according to the hop history, with --min-amount (requires --hop-history-filename)" json:"explore_minutes" toml:"explore_minutes"`
+	ExploreBudget       int64        `long:"explore-budget-sat" description:"stop exploring when the fees paid while exploring reach this amount in sats" json:"explore_budget_sat" toml:"explore_budget_sat"`
+	InvoiceMemoTemplate string       `long:"invoice-memo-template" description:"memo of the rebalance invoices, {from_scid}, {to_scid}, {amount}, {date} and {tag} are replaced with the source and target channel ids, amount in sats, current date and --invoice-memo-tag (default: Rebalance attempt)" json:"invoice_memo_template" toml:"invoice_memo_template"`
+	InvoiceMemoTag      string       `long:"invoice-memo-tag" description:"value of the {tag} placeholder in --invoice-memo-template" json:"invoice_memo_tag" toml:"invoice_memo_tag"`
+	CleanupInvoices     *bool        `long:"cleanup-stale-invoices" description:"cancel the open invoices with our memo left by the crashed runs at startup, they're stale after the 24 hour invoice expiry (default: true if --invoice-memo-template is set)" json:"cleanup_stale_invoices" toml:"cleanup_stale_invoices"`
+	MinExpiryBlocks     int64        `long:"min-htlc-expiry-blocks" description:"don't pay along the routes with the first hop HTLC expiring within this number of blocks from the current height (default: 30, -1 disables the check)" json:"min_htlc_expiry_blocks" toml:"min_htlc_expiry_blocks"`
+	MaxCltv             int64        `long:"max-cltv" description:"don't use the routes that can lock the funds for more than this number of blocks from the current height if an HTLC gets stuck (the route's total timelock)" json:"max_cltv" toml:"max_cltv"`
+	MaxClockSkew        int          `long:"max-clock-skew" description:"warn if the local and lnd clocks differ by more than this time in seconds and extend the invoice expiry margin by the difference (default: 120)" json:"max_clock_skew" toml:"max_clock_skew"`
+	InvoiceExpiryMargin int          `long:"invoice-expiry-margin" description:"create a new invoice if the cached one expires in less than this time (in seconds, default: 60)" json:"invoice_expiry_margin" toml:"invoice_expiry_margin"`
+	InFlightAction      string       `long:"inflight-action" description:"what to do if the payment is already in flight (e.g. after a crash): 'track' waits for its result and counts it, 'fail' treats it as an error (default: track)" json:"inflight_action" toml:"inflight_action"`
+	Completion          string       `long:"completion" description:"print the shell completion script and exit" choice:"bash" choice:"zsh" choice:"fish"`
+	CompleteChannels    bool         `long:"complete-channels" description:"list own channels for shell completion and exit" hidden:"true"`
+	NoColor             bool         `long:"no-color" description:"disable colored output, the liquidity bars are drawn with ASCII characters" json:"no_color" toml:"no_color"`
+	LogFormat           string       `long:"log-format" description:"log output format: 'text' is colored and human readable, 'json' prints every event as a JSON object per line (default: text)" json:"log_format" toml:"log_format"`
+	NotifyLocal         bool         `long:"notify-local" description:"ring the terminal bell and show a desktop notification on the first success and when the session finishes (only when running in a terminal)" json:"notify_local" toml:"notify_local"`
+	HeartbeatFile       string       `long:"heartbeat-file" description:"write the current phase, attempt and channel pair as JSON to this file every few seconds, it stops being updated if the session hangs" json:"heartbeat_file" toml:"heartbeat_file"`
+	HeartbeatURL        string       `long:"heartbeat-url" description:"POST the same heartbeat JSON to this URL every few seconds" json:"heartbeat_url" toml:"heartbeat_url"`
+	Version             bool         `short:"v" long:"version" description:"show program version and exit"`
 }
 
 var params, cfgParams configParams
 
+// params loaded from the config file only
+var fileParams configParams
+
+// max payment size for channels without large channel support
+const maxHTLCAmount = 16777215
+
 type failedRoute struct {
 	channelPair [2]*lnrpc.Channel
 	expiration  *time.Time
+	reason      failReason
+}
+
+type failureCacheStats struct {
+	expired int
+	evicted int
+	reasons map[string]int
 }
 
 type cachedNodeInfo struct {
@@ -74,64 +197,133 @@ type cachedNodeInfo struct {
 }
 
 type regolancer struct {
-	lnClient      lnrpc.LightningClient
-	routerClient  routerrpc.RouterClient
-	myPK          string
-	channels      []*lnrpc.Channel
-	fromChannels  []*lnrpc.Channel
-	fromChannelId map[uint64]struct{}
-	toChannels    []*lnrpc.Channel
-	toChannelId   map[uint64]struct{}
-	channelPairs  map[string][2]*lnrpc.Channel
-	nodeCache     map[string]cachedNodeInfo
-	chanCache     map[uint64]*lnrpc.ChannelEdge
-	failureCache  map[string]failedRoute
-	excludeIn     map[uint64]struct{}
-	excludeOut    map[uint64]struct{}
-	excludeBoth   map[uint64]struct{}
-	excludeNodes  [][]byte
-	statFilename  string
-	routeFound    bool
-	invoiceCache  map[int64]*lnrpc.AddInvoiceResponse
-	mcCache       map[string]int64
-	failedPairs   []*lnrpc.NodePair
+	lnClient            lnrpc.LightningClient
+	routerClient        routerrpc.RouterClient
+	myPK                string
+	channels            []*lnrpc.Channel
+	fromChannels        []*lnrpc.Channel
+	fromChannelId       map[uint64]struct{}
+	toChannels          []*lnrpc.Channel
+	toChannelId         map[uint64]struct{}
+	fromPerc            int64
+	toPerc              int64
+	channelPairs        map[string][2]*lnrpc.Channel
+	nodeCache           map[string]cachedNodeInfo
+	chanCache           map[uint64]*lnrpc.ChannelEdge
+	chanCacheTimes      map[uint64]time.Time
+	chanUpdates         map[uint64]uint32
+	failureCache        map[string]failedRoute
+	softFailures        map[string]softFailure
+	excludeIn           map[uint64]struct{}
+	excludeOut          map[uint64]struct{}
+	excludeBoth         map[uint64]struct{}
+	excludeNodes        [][]byte
+	excludePairs        []*lnrpc.NodePair
+	statFilename        string
+	statPoster          *statPoster
+	statDB              *statDB
+	heartbeat           *heartbeat
+	clock               func() time.Time
+	nodeRepeats         int
+	blockHeight         uint32
+	heightUpdated       time.Time
+	nodeCacheSaved      time.Time
+	nodeCacheSaving     chan struct{}
+	sourceRules         map[uint64]sourceRule
+	clockSkew           time.Duration
+	invoiceSkewChecked  bool
+	routeFound          bool
+	routeChoicePairs    []*lnrpc.NodePair
+	requeryPairs        []*lnrpc.NodePair
+	requeries           int
+	longRouteSkips      int
+	amount              int64
+	amountErr           error
+	feeScale            feeScale
+	feeSchedule         []scheduledFee
+	feeMultiplier       feeMultiplier
+	feeBound            feeBound
+	routePacer          latencyPacer
+	paymentPacer        latencyPacer
+	failedHTLCs         failedHTLCLimiter
+	feeExplain          *[]string
+	invoiceCache        map[invoiceKey]cachedInvoice
+	invoicesClient      invoicesrpc.InvoicesClient
+	mcCache             map[string]failedAmount
+	failedPayments      map[string]*lnrpc.Route
+	failedPairs         []*lnrpc.NodePair
+	capStats            map[uint64]*capStat
+	targetGoals         map[uint64]*targetGoal
+	sender              paymentSender
+	legacyRouter        bool
+	conn                *grpc.ClientConn
+	nodeCacheStats      nodeCacheStats
+	chanCacheOrder      []uint64
+	attempt             int
+	attemptInfo         *attemptInfo
+	locallyDisabled     map[uint64]struct{}
+	exclusionSources    map[string][]string
+	pendingUpdates      map[uint64]struct{}
+	noPolicyLogged      map[uint64]struct{}
+	routeStat           routeStat
+	dailyLedger         dailyLedger
+	rapidStat           rapidStat
+	routeLatencies      []time.Duration
+	routeTimeoutCurrent time.Duration
+	hopHistory          map[string]*hopStat
+	badPairs            []*lnrpc.NodePair
+	paymentTimeouts     int
+	addrExcludedFrom    map[uint64]struct{}
+	addrExcludedTo      map[uint64]struct{}
+	demandExcludedTo    map[uint64]struct{}
+	forwardsOut         map[uint64]int64
+	forwardsHours       int
+	failureCacheStats   failureCacheStats
+	feeHeadroomStat     feeHeadroomStat
+	hubIndex            hubIndex
+	hubCoolingStats     hubCoolingStats
+	routeMemo           routeMemo
+	baseFeeStats        baseFeeStats
+	explorer            explorer
+	speculative         *speculativeQuery
+	speculativeStats    speculativeStats
+	sessionTallies      sessionTallies
+	channelOverrides    map[uint64]chanOverride
+	cltvBounds          map[string]int64
+	totalAmountMsat     Msat
+	totalFeesMsat       Msat
+	sessionFeesStart    Msat
+	feeBudgetErr        error
+	seesaw              *seesawState
+	sourceUsage         map[uint64]Msat
+	successes           int
+	successRoutesTried  int
+	workers             *workerPool
+	workerId            int
 }
 
 func loadConfig() {
 	flags.NewParser(&cfgParams, flags.None).Parse()
 
-	if cfgParams.Config == "" {
+	if len(cfgParams.Config) == 0 {
 		return
 	}
-	if strings.Contains(cfgParams.Config, ".toml") {
-		_, err := toml.DecodeFile(cfgParams.Config, &params)
-
+	defer func() {
+		fileParams = params
+	}()
+	for _, filename := range strings.Split(strings.Join(cfgParams.Config, ","), ",") {
+		layer, err := readConfigLayer(filename)
+		if err == nil {
+			err = layer.merge(&params)
+		}
 		if err != nil {
-			if strings.Contains(err.Error(), "TOML value of type int64 into a Go string") {
+			if strings.Contains(err.Error(), "TOML value of type int64 into a Go string") ||
+				strings.Contains(err.Error(), "cannot unmarshal number into Go") {
 				log.Print(infoColor("Info: all prior int channel arrays are now string arrays. " +
 					"Make sure the following arguments in the config files are now strings:\n" +
 					"ExcludeChannelsIn,ExcludeChannelsOut, ExcludeChannels,ToChannel, FromChannel"))
 			}
-			log.Fatalf("Error opening config file %s: %s", cfgParams.Config, err.Error())
-		}
-
-	} else {
-		f, err := os.Open(cfgParams.Config)
-		if err != nil {
-			log.Fatalf("Error opening config file %s: %s", cfgParams.Config, err)
-		} else {
-			defer f.Close()
-			decoder := json.NewDecoder(f)
-			decoder.UseNumber()
-			err := decoder.Decode(&params)
-			if err != nil {
-				if strings.Contains(err.Error(), "cannot unmarshal number into Go struct field") {
-					log.Print(infoColor("Info: all prior int channel arrays are now string arrays. " +
-						"Make sure the following arguments in the config files are now strings:\n" +
-						"ExcludeChannelsIn,ExcludeChannelsOut, ExcludeChannels,ToChannel, FromChannel"))
-				}
-				log.Fatalf("Error reading config file %s: %s", cfgParams.Config, err)
-			}
+			log.Fatalf("Error reading config file %s: %s", filename, err)
 		}
 	}
 }
@@ -140,20 +332,13 @@ func convertChanStringToInt(chanIds []string) (channels []uint64) {
 
 	for _, cid := range chanIds {
 
-		chanId, err := strconv.ParseInt(cid, 10, 64)
+		chanId, err := parseChanID(cid)
 
 		if err != nil {
+			log.Fatalf("error: %s", err)
 
-			isScid := strings.Count(strings.ToLower(cid), "x") == 2
-			if isScid {
-				chanId = parseScid(cid)
-
-			} else {
-				log.Fatalf("error: parsing Channel with Id %s, %s ", cid, err)
-
-			}
 		}
-		channels = append(channels, uint64(chanId))
+		channels = append(channels, chanId)
 
 	}
 
@@ -161,102 +346,43 @@ func convertChanStringToInt(chanIds []string) (channels []uint64) {
 
 }
 
-func tryRebalance(ctx context.Context, r *regolancer, attempt *int) (err error,
-	repeat bool) {
-	attemptCtx, attemptCancel := context.WithTimeout(ctx, time.Minute*time.Duration(params.TimeoutAttempt))
-
-	defer attemptCancel()
+func tryRapidRebalance(ctx context.Context, r *regolancer, from, to uint64, route *lnrpc.Route, amt Msat) (successfullAtempts int, err error) {
 
-	from, to, amt, err := r.pickChannelPair(params.Amount, params.MinAmount, params.RelAmountFrom, params.RelAmountTo)
-	if err != nil {
-		log.Printf(errColor("Error during picking channel: %s"), err)
-		return err, false
-	}
-	routeCtx, routeCtxCancel := context.WithTimeout(attemptCtx, time.Second*time.Duration(params.TimeoutRoute))
-	defer routeCtxCancel()
-	routes, fee, err := r.getRoutes(routeCtx, from, to, amt*1000)
-	if err != nil {
-		if routeCtx.Err() == context.DeadlineExceeded {
-			log.Print(errColor("Timed out looking for a route"))
-			return err, false
-		}
-		r.addFailedRoute(from, to)
-		return err, true
-	}
-	routeCtxCancel()
-	for _, route := range routes {
-		log.Printf("Attempt %s, amount: %s (max fee: %s sat | %s ppm )",
-			hiWhiteColorF("#%d", *attempt), hiWhiteColor(amt), formatFee(fee), formatFeePPM(amt*1000, fee))
-		r.printRoute(attemptCtx, route)
-		err = r.pay(attemptCtx, amt, params.MinAmount, route, params.ProbeSteps)
-		if err == nil {
-
-			if params.AllowRapidRebalance {
-				_, err := tryRapidRebalance(ctx, r, from, to, route, amt)
-
-				if err != nil {
-					log.Printf("Rapid rebalance failed with %s", err)
-				} else {
-					log.Printf("Finished rapid rebalancing")
-				}
-			}
-
-			return nil, false
+	rapidAttempt := 0
+	reason, detail := "", ""
+	defer func() {
+		if reason == "" {
+			return
 		}
-		if retryErr, ok := err.(ErrRetry); ok {
-			amt = retryErr.amount
-			log.Printf("Trying to rebalance again with %s", hiWhiteColor(amt))
-			probedRoute, err := r.rebuildRoute(attemptCtx, route, amt)
-			if err != nil {
-				log.Printf("Error rebuilding the route for probed payment: %s", errColor(err))
-			} else {
-				err = r.pay(ctx, amt, 0, probedRoute, 0)
-				if err == nil {
-					if params.AllowRapidRebalance && params.MinAmount > 0 {
-						_, err := tryRapidRebalance(ctx, r, from, to, probedRoute, amt)
-
-						if err != nil {
-							log.Printf("Rapid rebalance failed with %s", err)
-						} else {
-							log.Printf("Finished rapid rebalancing")
-						}
-					}
-
-					return nil, false
-				} else {
-					r.invalidateInvoice(amt)
-					log.Printf("Probed rebalance failed with error: %s", errColor(err))
-				}
-			}
+		r.addRapidStop(reason, rapidAttempt)
+		r.saveRapidStop(from, to, reason, rapidAttempt)
+		if detail != "" {
+			reason += ": " + detail
 		}
-		*attempt++
-	}
-	attemptCancel()
-	if attemptCtx.Err() == context.DeadlineExceeded {
-		log.Print(errColor("Attempt timed out"))
-	}
-
-	return nil, true
-}
-
-func tryRapidRebalance(ctx context.Context, r *regolancer, from, to uint64, route *lnrpc.Route, amt int64) (successfullAtempts int, err error) {
-
-	rapidAttempt := 0
+		log.Printf("Rapid rebalancing stopped after %s successful iterations, %s", hiWhiteColor(rapidAttempt),
+			infoColor(reason))
+	}()
 
 	for {
 
-		log.Printf("Rapid rebalance attempt %s", hiWhiteColor(rapidAttempt+1))
+		r.attemptInfo = &attemptInfo{number: r.nextAttempt(), routesTried: 1, start: time.Now(),
+			rapidIteration: rapidAttempt + 1}
+		log.Printf("Attempt %s, rapid rebalance %s", hiWhiteColorF("#%d", r.currentAttempt()),
+			hiWhiteColor(rapidAttempt+1))
+		r.setPhase(phaseRapid, &rebalanceAttempt{from: from, to: to})
 
 		cTo, err := r.getChanInfo(ctx, to)
 
 		if err != nil {
 			logErrorF("Error fetching target channel: %s", err)
+			reason = rapidStopError
 			return rapidAttempt, err
 		}
 		cFrom, err := r.getChanInfo(ctx, from)
 
 		if err != nil {
 			logErrorF("Error fetching source channel: %s", err)
+			reason = rapidStopError
 			return rapidAttempt, err
 		}
 
@@ -264,10 +390,11 @@ func tryRapidRebalance(ctx context.Context, r *regolancer, from, to uint64, rout
 		if cFrom.Node1Pub == r.myPK {
 			fromPeer, _ = hex.DecodeString(cFrom.Node2Pub)
 		}
-		fromChan, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: true, Peer: fromPeer})
+		fromChan, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: publicOnly(), Peer: fromPeer})
 
 		if err != nil {
 			logErrorF("Error fetching source channel: %s", err)
+			reason = rapidStopError
 			return rapidAttempt, err
 
 		}
@@ -276,10 +403,11 @@ func tryRapidRebalance(ctx context.Context, r *regolancer, from, to uint64, rout
 			toPeer, _ = hex.DecodeString(cTo.Node2Pub)
 		}
 
-		toChan, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: true, Peer: toPeer})
+		toChan, err := r.lnClient.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: publicOnly(), Peer: toPeer})
 
 		if err != nil {
 			logErrorF("Error fetching target channel: %s", err)
+			reason = rapidStopError
 			return rapidAttempt, err
 		}
 
@@ -304,48 +432,88 @@ func tryRapidRebalance(ctx context.Context, r *regolancer, from, to uint64, rout
 			delete(r.failureCache, k)
 		}
 
+		for k := range r.softFailures {
+			delete(r.softFailures, k)
+		}
+
 		for k := range r.channelPairs {
 			delete(r.channelPairs, k)
 		}
 
-		err = r.getChannelCandidates(params.FromPerc, params.ToPerc, amt)
+		err = r.getChannelCandidates(params.FromPerc, params.ToPerc, amt.sats())
 
 		if err != nil {
 			logErrorF("Error selecting channel candidates: %s", err)
+			reason = rapidStopError
 			return rapidAttempt, err
 		}
 
-		from, to, amt, err = r.pickChannelPair(amt, params.MinAmount, params.RelAmountFrom, params.RelAmountTo)
+		switch {
+		case len(r.toChannels) == 0:
+			reason = rapidStopTargetReached
+			return rapidAttempt, nil
+		case len(r.fromChannels) == 0:
+			reason = rapidStopSourceExhausted
+			return rapidAttempt, nil
+		}
+
+		from, to, amt, err = r.pickChannelPair(amt, satToMsat(params.MinAmount), params.RelAmountFrom,
+			params.RelAmountTo)
 
 		if err != nil {
-			log.Printf(errColor("Error during picking channel: %s"), err)
-			return rapidAttempt, err
+			// the channels are still candidates but can't fit the min amount
+			reason = rapidStopLiquidity
+			return rapidAttempt, nil
 		}
 
-		log.Printf("rapid fire starting with amount %s", hiWhiteColor(amt))
+		log.Printf("rapid fire starting with amount %s", hiWhiteColor(amt.sats()))
 
 		route, err = r.rebuildRoute(ctx, route, amt)
 
 		if err != nil {
 			log.Printf(errColor("Error building route: %s"), err)
+			reason, detail = rapidStopRouteBroken, err.Error()
+			return rapidAttempt, nil
+		}
+
+		maxFeeMsat, _, _, err := r.calcFeeMsat(ctx, from, to, amt)
+		if err != nil {
+			reason = rapidStopError
 			return rapidAttempt, err
 		}
+		if Msat(route.TotalFeesMsat) > maxFeeMsat {
+			reason = rapidStopFee
+			detail = fmt.Sprintf("%s sat > %s sat", formatFee(Msat(route.TotalFeesMsat)), formatFee(maxFeeMsat))
+			return rapidAttempt, nil
+		}
 
 		attemptCtx, attemptCancel := context.WithTimeout(ctx, time.Minute*time.Duration(params.TimeoutAttempt))
 
 		defer attemptCancel()
 
-		err = r.pay(attemptCtx, amt, params.MinAmount, route, 0)
+		err = r.payWithTimeout(attemptCtx, amt, satToMsat(params.MinAmount), route, 0)
 
 		attemptCancel()
 
 		if attemptCtx.Err() == context.DeadlineExceeded {
 			log.Print(errColor("Rapid rebalance attempt timed out"))
+			reason = rapidStopTimeout
 			return rapidAttempt, attemptCtx.Err()
 		}
 
 		if err != nil {
 			log.Printf("Rebalance failed with %s", err)
+			reason = rapidStopError
+			if err == ErrFeeBudgetExhausted || err == ErrSeesawFeeLimit {
+				reason = rapidStopFeeBudget
+			} else if err == ErrDailyFeeBudgetReached {
+				reason = rapidStopDailyFeeBudget
+			} else if failed, ok := err.(ErrPaymentFailed); ok {
+				reason = rapidStopHopFailed
+				detail = fmt.Sprintf("%s at hop %d", failed.code, failed.index)
+			} else if err == ErrPaymentTimeout {
+				reason = rapidStopTimeout
+			}
 			break
 		} else {
 			rapidAttempt++
@@ -354,14 +522,21 @@ func tryRapidRebalance(ctx context.Context, r *regolancer, from, to uint64, rout
 	}
 	log.Printf("%s rapid rebalances were successful\n", hiWhiteColor(rapidAttempt))
 	return rapidAttempt, nil
-
 }
 
 func preflightChecks(params *configParams) error {
+	errs := []string{}
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
 	if params.Version {
 		printVersion()
 		os.Exit(1)
 	}
+	if params.Completion != "" {
+		printCompletion(params.Completion)
+		os.Exit(0)
+	}
 	if params.Connect == "" {
 		params.Connect = "127.0.0.1:10009"
 	}
@@ -371,41 +546,168 @@ func preflightChecks(params *configParams) error {
 	if params.Network == "" {
 		params.Network = "mainnet"
 	}
+	if params.KeepaliveTime == 0 {
+		params.KeepaliveTime = 60
+	}
+	if params.KeepaliveTime < 10 && params.KeepaliveTime != -1 {
+		fail("--keepalive-time should be at least 10 seconds or -1")
+	}
+	if params.KeepaliveTimeout == 0 {
+		params.KeepaliveTimeout = 20
+	}
+	if params.KeepaliveTimeout < 0 {
+		fail("--keepalive-timeout should be positive")
+	}
 	if params.FromPerc == 0 {
 		params.FromPerc = 50
 	}
 	if params.ToPerc == 0 {
 		params.ToPerc = 50
 	}
-	if params.EconRatio == 0 && params.FeeLimitPPM == 0 {
+	if params.FeeLimitIsCap && params.FeeLimitPPM == 0 {
+		fail("fee-limit-is-cap requires fee-limit-ppm")
+	}
+	if params.EconRatio == 0 && (params.FeeLimitPPM == 0 || params.FeeLimitIsCap) {
 		params.EconRatio = 1
 	}
-	if params.EconRatioMaxPPM != 0 && params.FeeLimitPPM != 0 {
-		return fmt.Errorf("use either econ-ratio-max-ppm or fee-limit-ppm but not both")
+	if params.EconRatioMaxPPM != 0 && params.FeeLimitPPM != 0 && !params.FeeLimitIsCap {
+		fail("use either econ-ratio-max-ppm or fee-limit-ppm but not both (or set fee-limit-is-cap)")
 	}
 	if params.Perc > 0 {
 		params.FromPerc = params.Perc
 		params.ToPerc = params.Perc
 	}
+	if params.Seesaw != "" {
+		if len(params.From) > 0 || len(params.To) > 0 || params.Distribute > 0 {
+			fail("seesaw can't be used with --from, --to or --distribute")
+		}
+		chans, err := parseSeesaw(params.Seesaw)
+		if err != nil {
+			fail("%s", err)
+		} else {
+			params.From = chans[:1]
+			params.To = chans[1:]
+		}
+		if params.SeesawCycles == 0 {
+			params.SeesawCycles = 1
+		}
+	}
+	var err error
+	if params.From, err = parseAllKeyword(params.From); err != nil {
+		fail("error parsing source list: %s", err)
+	}
+	if params.To, err = parseAllKeyword(params.To); err != nil {
+		fail("error parsing target list: %s", err)
+	}
+	for _, list := range [][]string{params.From, params.To, params.Exclude} {
+		_, patterns := splitAliasPatterns(list)
+		for _, pattern := range append(patterns, params.ExcludeAlias...) {
+			if _, err := aliasRegexp(pattern); err != nil {
+				fail("invalid alias pattern %s: %s", pattern, err)
+			}
+		}
+	}
+	if params.FromPercStrict > 0 && len(params.From) == 0 {
+		fail("pfrom-strict requires source channels or nodes specified with --from")
+	}
+	if params.ToPercStrict > 0 && len(params.To) == 0 {
+		fail("pto-strict requires target channels or nodes specified with --to")
+	}
 	if params.MinAmount > 0 && params.Amount > 0 &&
 		params.MinAmount > params.Amount {
-		return fmt.Errorf("minimum amount should be less than amount")
+		fail("minimum amount should be less than amount")
+	}
+	if params.ManualRoute != "" && params.Amount == 0 {
+		fail("manual-route requires --amount")
 	}
 	if params.Amount > 0 &&
 		(params.RelAmountFrom > 0 || params.RelAmountTo > 0) {
-		return fmt.Errorf("use either precise amount or relative amounts but not both")
+		fail("use either precise amount or relative amounts but not both")
 	}
-	if params.Amount == 0 && params.RelAmountFrom == 0 && params.RelAmountTo == 0 {
-		return fmt.Errorf("no amount specified, use either --amount, --rel-amount-from, or --rel-amount-to")
+	if params.Amount == 0 && params.RelAmountFrom == 0 && params.RelAmountTo == 0 && !params.Suggest && !params.PrintBadHops && params.ExplainFee == "" &&
+		!params.CompleteChannels && !params.SimulateEcon {
+		fail("no amount specified, use either --amount, --rel-amount-from, or --rel-amount-to")
 	}
 	if params.FailTolerance == 0 {
 		params.FailTolerance = 1000
 	}
+	if params.MinRouteChoices == 0 {
+		params.MinRouteChoices = 1
+	}
+	if params.MinRouteChoices < 0 {
+		fail("min-route-choices should be positive, got %d", params.MinRouteChoices)
+	}
+	if params.MaxHops < 0 || params.MaxHops == 1 {
+		fail("max-hops should be at least 2, got %d", params.MaxHops)
+	}
+	if params.MaxHopBaseFee < 0 {
+		fail("max-hop-base-fee-msat should be positive, got %d", params.MaxHopBaseFee)
+	}
+	if params.McImportMaxAge == 0 {
+		params.McImportMaxAge = 24
+	}
+	if params.McImportMaxAge < 0 {
+		fail("mc-import-max-age should be positive, got %d", params.McImportMaxAge)
+	}
+	if params.MaxHopPPM < 0 {
+		fail("max-hop-ppm should be positive, got %d", params.MaxHopPPM)
+	}
+	if params.MaxRequeries == 0 {
+		params.MaxRequeries = 3
+	}
+	if params.MaxRequeries < 0 {
+		fail("max-requeries should be positive, got %d", params.MaxRequeries)
+	}
+	if params.StatPostURL != "" {
+		if u, err := url.Parse(params.StatPostURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fail("stat-post-url should be an http(s) URL, got %s", params.StatPostURL)
+		}
+		if params.StatPostToken == "" {
+			params.StatPostToken = os.Getenv(statPostTokenEnv)
+		}
+		if params.StatPostSpool == "" {
+			params.StatPostSpool = defaultStatSpool()
+		}
+	}
+	if params.HeartbeatURL != "" {
+		if u, err := url.Parse(params.HeartbeatURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fail("heartbeat-url should be an http(s) URL, got %s", params.HeartbeatURL)
+		}
+	}
+	if params.TargetActivityHours == 0 {
+		params.TargetActivityHours = 24
+	}
+	if params.MinTargetActivity < 0 || params.TargetActivityHours < 0 {
+		fail("min-target-remote-activity and target-activity-hours should be positive")
+	}
+	if params.MaxFailedHTLCs < 0 {
+		fail("max-failed-htlcs-per-hour should be positive, got %d", params.MaxFailedHTLCs)
+	}
+	if params.PaceRouteLatency < 0 || params.PacePaymentLatency < 0 {
+		fail("pacing latencies should be positive")
+	}
+	if params.FailOverlapPerc == 0 {
+		params.FailOverlapPerc = 80
+	}
+	if params.FailOverlapPerc < 0 || params.FailOverlapPerc > 100 {
+		fail("fail overlap percentage should be between 0 and 100")
+	}
 
 	if (params.RelAmountFrom > 0 || params.RelAmountTo > 0) && params.AllowRapidRebalance {
-		return fmt.Errorf("use either relative amounts or rapid rebalance but not both")
+		fail("use either relative amounts or rapid rebalance but not both")
 
 	}
+	if params.NodeCacheSaveMins == 0 {
+		params.NodeCacheSaveMins = 30
+	}
+	if params.McCacheLifetime == 0 {
+		params.McCacheLifetime = 60
+	}
+	if params.McCacheLifetime < 0 {
+		params.McCacheFilename = ""
+	} else if params.McCacheFilename == "" && params.NodeCacheFilename != "" {
+		params.McCacheFilename = filepath.Join(filepath.Dir(params.NodeCacheFilename), "regolancer-mc-cache.dat")
+	}
 	if params.NodeCacheLifetime == 0 {
 		params.NodeCacheLifetime = 1440
 	}
@@ -413,7 +715,7 @@ func preflightChecks(params *configParams) error {
 	if len(params.ExcludeChannels) > 0 || len(params.ExcludeNodes) > 0 {
 		log.Print(infoColor("--exclude-channel and exclude_channel parameter are deprecated, use --exclude or exclude parameter instead for both channels and nodes"))
 		if len(params.Exclude) > 0 {
-			return fmt.Errorf("can't use --exclude and --exclude-channel/--exclude-node (or config parameters) at the same time")
+			fail("can't use --exclude and --exclude-channel/--exclude-node (or config parameters) at the same time")
 		}
 	}
 
@@ -433,10 +735,180 @@ func preflightChecks(params *configParams) error {
 		params.TimeoutInfo = 30
 	}
 
-	if params.TimeoutRoute == 0 {
-		params.TimeoutRoute = 30
+	if params.TimeoutRoute.seconds == 0 {
+		params.TimeoutRoute.seconds = 30
+	}
+
+	if params.TimeoutRouteMax == 0 {
+		params.TimeoutRouteMax = 120
+	}
+
+	if params.Distribute > 0 && params.Amount == 0 {
+		fail("--distribute requires --amount to be set")
+	}
+
+	if params.BadHopFailPerc == 0 {
+		params.BadHopFailPerc = 80
+	}
+	if params.BadHopMinSamples == 0 {
+		params.BadHopMinSamples = 10
+	}
+	if params.BadHopTTL == 0 {
+		params.BadHopTTL = 168
+	}
+	if params.DailyCaps.Total < 0 || params.DailyCaps.PerChannel < 0 {
+		fail("daily caps should be positive")
+	}
+	if (params.DailyCaps.Total > 0 || params.DailyCaps.PerChannel > 0) && params.DailyLedger == "" {
+		fail("daily caps require --daily-ledger")
+	}
+	if params.DailyFeeBudget < 0 {
+		fail("daily-fee-budget-sat should be positive, got %d", params.DailyFeeBudget)
+	}
+	if params.DailyFeeBudget > 0 && params.FeeLedger == "" {
+		fail("daily-fee-budget-sat requires --fee-ledger")
+	}
+	if (params.AvoidBadHops || params.PrintBadHops) && params.HopHistoryFilename == "" {
+		fail("avoid-historically-bad-hops and print-bad-hops require hop-history-filename")
+	}
+	if params.ExploreMinutes < 0 || params.ExploreBudget < 0 {
+		fail("explore-minutes and explore-budget-sat should be positive")
+	}
+	if params.ExploreMinutes > 0 && (params.HopHistoryFilename == "" || params.MinAmount == 0) {
+		fail("explore-minutes requires hop-history-filename and min-amount")
+	}
+	if params.ExploreBudget > 0 && params.ExploreMinutes == 0 {
+		fail("explore-budget-sat requires explore-minutes")
+	}
+
+	if err := checkDirectionParam("require-clearnet-peer", params.RequireClearnetPeer); err != nil {
+		fail("%s", err)
+	}
+	if err := checkDirectionParam("require-tor-peer", params.RequireTorPeer); err != nil {
+		fail("%s", err)
 	}
 
+	if params.FailedRouteTTL == 0 {
+		params.FailedRouteTTL = 5
+	}
+	if params.SoftFailureHalfLife == 0 {
+		params.SoftFailureHalfLife = params.FailedRouteTTL
+	}
+	if params.FailureCacheSize == 0 {
+		params.FailureCacheSize = 10000
+	}
+
+	if params.InvoiceExpiryMargin == 0 {
+		params.InvoiceExpiryMargin = 60
+	}
+	if params.MinExpiryBlocks == 0 {
+		params.MinExpiryBlocks = 30
+	}
+	if params.MaxCltv < 0 {
+		fail("max-cltv should be positive, got %d", params.MaxCltv)
+	}
+	if params.MaxClockSkew == 0 {
+		params.MaxClockSkew = 120
+	}
+
+	if params.LogFormat == "" {
+		params.LogFormat = logFormatText
+	}
+	if params.LogFormat != logFormatText && params.LogFormat != logFormatJSON {
+		fail("log-format should be either 'text' or 'json'")
+	}
+
+	if params.Offline != "" && !params.ListCandidates && params.ExplainFee == "" && !params.SimulateEcon {
+		fail("offline requires list-candidates, explain-fee or simulate-econ, route queries and payments need lnd")
+	}
+	if params.SimulateEcon && params.StatFilename == "" {
+		fail("simulate-econ requires --stat with the rebalances to simulate")
+	}
+	if params.Offline != "" && params.ChannelsSnapshot != "" {
+		fail("channels-snapshot can't be used with offline")
+	}
+	if params.Interval < 0 {
+		fail("interval should be positive, got %d", params.Interval)
+	}
+	if params.Interval > 0 && (params.Seesaw != "" || params.ManualRoute != "") {
+		fail("interval can't be used with seesaw or manual-route")
+	}
+
+	if params.InFlightAction == "" {
+		params.InFlightAction = "track"
+	}
+	if params.InFlightAction != "track" && params.InFlightAction != "fail" {
+		fail("inflight-action should be either 'track' or 'fail'")
+	}
+
+	if params.Perc < 0 || params.Perc > 100 {
+		fail("perc should be between 1 and 100 or 0 to leave it unset, got %d", params.Perc)
+	}
+	if params.FromPerc < 1 || params.FromPerc > 100 {
+		fail("pfrom should be between 1 and 100, got %d", params.FromPerc)
+	}
+	if params.ToPerc < 1 || params.ToPerc > 100 {
+		fail("pto should be between 1 and 100, got %d", params.ToPerc)
+	}
+	if params.MaxSourceUsagePerc < 0 || params.MaxSourceUsagePerc > 100 {
+		fail("max-source-usage-perc should be between 0 and 100, got %d", params.MaxSourceUsagePerc)
+	}
+	if params.FromPercStrict < 0 || params.FromPercStrict > 100 {
+		fail("pfrom-strict should be between 1 and 100 or 0 to leave it unset, got %d", params.FromPercStrict)
+	}
+	if params.ToPercStrict < 0 || params.ToPercStrict > 100 {
+		fail("pto-strict should be between 1 and 100 or 0 to leave it unset, got %d", params.ToPercStrict)
+	}
+	if params.FeeLimitScale < 0 {
+		fail("fee-limit-scale should be positive, got %g", params.FeeLimitScale)
+	}
+	if params.FeeLimitScalePerc == 0 {
+		params.FeeLimitScalePerc = 10
+	}
+	if params.FeeLimitScale > 0 && (params.FeeLimitScalePerc < 0 || params.FeeLimitScalePerc >= params.ToPerc) {
+		fail("fee-limit-scale-perc should be between 0 and pto, got %d", params.FeeLimitScalePerc)
+	}
+	if params.MppParts < 0 || params.ShardSize < 0 {
+		fail("mpp-parts and shard-size should be positive")
+	}
+	if params.MppParts > 0 && params.ShardSize > 0 {
+		fail("use either mpp-parts or shard-size but not both")
+	}
+	if (params.MppParts > 1 || params.ShardSize > 0) && (params.Workers > 1 || params.AllowRapidRebalance) {
+		fail("mpp-parts and shard-size can't be used with --workers or --allow-rapid-rebalance")
+	}
+	if params.Workers < 0 {
+		fail("workers should be positive, got %d", params.Workers)
+	}
+	if params.Workers > 1 && (params.AllowRapidRebalance || params.Seesaw != "" || params.ManualRoute != "") {
+		fail("workers can't be used with --allow-rapid-rebalance, --seesaw or --manual-route")
+	}
+	if params.MaxTotalFee < 0 {
+		fail("max-total-fee-sat should be positive, got %d", params.MaxTotalFee)
+	}
+	if params.Amount < 0 {
+		fail("amount should be positive, got %d", params.Amount)
+	}
+	if params.MinAmount < 0 {
+		fail("min-amount should be positive, got %d", params.MinAmount)
+	}
+	if params.Amount > maxHTLCAmount {
+		log.Print(infoColorF("Amount %d is above the usual max HTLC size of %d sats, most channels won't be able to route it",
+			params.Amount, maxHTLCAmount))
+	}
+	if params.EconRatio < 0 {
+		fail("econ-ratio should be positive, got %g", params.EconRatio)
+	}
+	if params.RelAmountFrom < 0 || params.RelAmountFrom > 1 {
+		fail("rel-amount-from should be greater than 0 and at most 1, got %g", params.RelAmountFrom)
+	}
+	if params.RelAmountTo < 0 || params.RelAmountTo > 1 {
+		fail("rel-amount-to should be greater than 0 and at most 1, got %g", params.RelAmountTo)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid parameters:\n%s", strings.Join(errs, "\n"))
+	}
 	return nil
 
 }
@@ -450,27 +922,94 @@ func main() {
 	}
 
 	err = preflightChecks(&params)
+	setupLogFormat()
 
 	if err != nil {
 		log.Fatal(errColor(err))
 	}
+	if params.CompleteChannels {
+		if err := completeChannels(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	conn, err := lndclient.NewBasicConn(params.Connect, params.TLSCert, params.MacaroonDir, params.Network,
-		lndclient.MacFilename(params.MacaroonFilename))
+	r := regolancer{
+		nodeCache:      map[string]cachedNodeInfo{},
+		chanCache:      map[uint64]*lnrpc.ChannelEdge{},
+		chanCacheTimes: map[uint64]time.Time{},
+		channelPairs:   map[string][2]*lnrpc.Channel{},
+		failureCache:   map[string]failedRoute{},
+		softFailures:   map[string]softFailure{},
+		mcCache:        map[string]failedAmount{},
+		failedPayments: map[string]*lnrpc.Route{},
+		capStats:       map[uint64]*capStat{},
+		sourceUsage:    map[uint64]Msat{},
+		routePacer:     latencyPacer{name: "Route query", threshold: time.Millisecond * time.Duration(params.PaceRouteLatency)},
+		paymentPacer:   latencyPacer{name: "Payment", threshold: time.Millisecond * time.Duration(params.PacePaymentLatency)},
+		failedHTLCs:    failedHTLCLimiter{limit: params.MaxFailedHTLCs},
+		noPolicyLogged: map[uint64]struct{}{},
+		statFilename:   params.StatFilename,
+	}
+	r.feeSchedule, err = params.FeeSchedule.parse()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Error parsing fee schedule: ", err)
 	}
-	r := regolancer{
-		nodeCache:    map[string]cachedNodeInfo{},
-		chanCache:    map[uint64]*lnrpc.ChannelEdge{},
-		channelPairs: map[string][2]*lnrpc.Channel{},
-		failureCache: map[string]failedRoute{},
-		mcCache:      map[string]int64{},
-		statFilename: params.StatFilename,
-	}
-	r.lnClient = lnrpc.NewLightningClient(conn)
-	r.routerClient = routerrpc.NewRouterClient(conn)
-	mainCtx, mainCtxCancel := context.WithTimeout(context.Background(), time.Minute*time.Duration(params.TimeoutRebalance))
+	if params.DailyLedger != "" {
+		err = r.loadDailyLedger(params.DailyLedger)
+		if err != nil {
+			log.Fatal("Error loading daily ledger: ", err)
+		}
+		if total, _ := r.dailyAmounts(); params.DailyCaps.Total > 0 && total >= params.DailyCaps.Total {
+			log.Printf("Rebalanced %s sats today, the daily cap is reached", hiWhiteColor(total))
+			if params.Interval == 0 {
+				return
+			}
+		}
+	}
+	if params.DailyFeeBudget > 0 {
+		left, err := dailyFeeBudgetLeft()
+		if err != nil {
+			log.Fatal("Error reading fee ledger: ", err)
+		}
+		if !left && params.Interval == 0 {
+			return
+		}
+	}
+	if params.HopHistoryFilename != "" {
+		err = r.loadHopHistory(params.HopHistoryFilename)
+		if err != nil {
+			logErrorF("Error loading hop history: %s", err)
+		}
+		if params.PrintBadHops {
+			r.printBadHops()
+			return
+		}
+		if params.AvoidBadHops {
+			r.badPairs = r.badHopPairs()
+			log.Printf("Avoiding %s historically bad hops", hiWhiteColor(len(r.badPairs)))
+		}
+		defer r.saveHopHistory(params.HopHistoryFilename)
+	}
+
+	if params.Offline != "" {
+		snapshot, err := loadChannelSnapshot(params.Offline)
+		if err != nil {
+			log.Fatal("Error loading channel snapshot: ", err)
+		}
+		log.Printf("Offline mode, using the channel snapshot created at %s", snapshot.Created.Format(time.RFC3339))
+		r.lnClient = newOfflineClient(snapshot)
+		r.sender = offlineSender{}
+	} else {
+		conn, err := dialLnd()
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.setConn(conn)
+	}
+	rootCtx, rootCtxCancel := context.WithCancel(context.Background())
+	defer rootCtxCancel()
+	mainCtx, mainCtxCancel := context.WithTimeout(rootCtx, time.Minute*time.Duration(params.TimeoutRebalance))
 	defer mainCtxCancel()
 	infoCtx, infoCtxCancel := context.WithTimeout(mainCtx, time.Second*time.Duration(params.TimeoutInfo))
 	defer infoCtxCancel()
@@ -479,21 +1018,80 @@ func main() {
 		log.Fatal(err)
 	}
 	r.myPK = info.IdentityPubkey
+	r.setHeight(info.BlockHeight)
+	r.setClockSkew(headerClockSkew(info.BestHeaderTimestamp, time.Now()), "best block header time")
 	err = r.getChannels(infoCtx)
 	if err != nil {
 		log.Fatal("Error listing own channels: ", err)
 	}
+	if params.ChannelsSnapshot != "" {
+		err = r.saveChannelSnapshot(infoCtx, params.ChannelsSnapshot, info.BlockHeight)
+		if err != nil {
+			logErrorF("Error saving channel snapshot: %s", err)
+		}
+	}
+	if params.DryRun {
+		log.Print(infoColor("Dry run, the routes will be found but not paid"))
+	}
+	if params.ManualRoute != "" {
+		r.invoiceCache = map[invoiceKey]cachedInvoice{}
+		if code := runManualRoute(mainCtx, &r); code != 0 {
+			os.Exit(code)
+		}
+		return
+	}
+	if params.ExplainFee != "" {
+		err = r.explainFee(mainCtx)
+		if err != nil {
+			log.Fatal("Error explaining the fee: ", err)
+		}
+		return
+	}
+	if params.SimulateEcon {
+		err = r.simulateEcon(mainCtx)
+		if err != nil {
+			log.Fatal("Error simulating the fee parameters: ", err)
+		}
+		return
+	}
+	if params.Suggest {
+		feeReport, err := r.lnClient.FeeReport(infoCtx, &lnrpc.FeeReportRequest{})
+		if err != nil {
+			log.Fatal("Error getting fee report: ", err)
+		}
+		feeRates := []int64{}
+		for _, f := range feeReport.ChannelFees {
+			feeRates = append(feeRates, f.FeePerMil)
+		}
+		s := suggestParams(r.channels, feeRates)
+		log.Printf("Found %s target candidates, suggested parameters:", hiWhiteColor(s.candidates))
+		fmt.Println(s)
+		return
+	}
+	r.cleanupStaleInvoices(infoCtx)
+	err = r.loadNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime,
+		true)
+	if err != nil {
+		logErrorF("%s", err)
+	}
+	r.loadMcCache(params.McCacheFilename, params.McCacheLifetime)
 	if len(params.From) > 0 {
-		chans, nodes, err := parseNodeChannelIDs(params.From)
+		ids, patterns := splitAliasPatterns(params.From)
+		chans, nodes, err := parseNodeChannelIDs(ids)
+		if err != nil {
+			log.Fatal("Error parsing source node/channel list:", err)
+		}
+		aliasNodes, err := r.nodesByAlias(infoCtx, patterns)
 		if err != nil {
 			log.Fatal("Error parsing source node/channel list:", err)
 		}
+		nodes = append(nodes, aliasNodes...)
 
 		r.fromChannelId = chans
 
 		for _, node := range nodes {
 
-			channels, err := r.lnClient.ListChannels(infoCtx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: true, Peer: node})
+			channels, err := r.lnClient.ListChannels(infoCtx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: publicOnly(), Peer: node})
 
 			if err != nil {
 				log.Fatalf("Error fetching channels when filtering for source node \"%x\": %s", node, err)
@@ -506,19 +1104,29 @@ func main() {
 			}
 
 		}
+		if len(r.fromChannelId) == 0 {
+			// an empty set would mean any channel
+			log.Fatal("No source channels match --from")
+		}
 
 	}
 	if len(params.To) > 0 {
-		chans, nodes, err := parseNodeChannelIDs(params.To)
+		ids, patterns := splitAliasPatterns(params.To)
+		chans, nodes, err := parseNodeChannelIDs(ids)
 		if err != nil {
 			log.Fatal("Error parsing target node/channel list:", err)
 		}
+		aliasNodes, err := r.nodesByAlias(infoCtx, patterns)
+		if err != nil {
+			log.Fatal("Error parsing target node/channel list:", err)
+		}
+		nodes = append(nodes, aliasNodes...)
 
 		r.toChannelId = chans
 
 		for _, node := range nodes {
 
-			channels, err := r.lnClient.ListChannels(infoCtx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: true, Peer: node})
+			channels, err := r.lnClient.ListChannels(infoCtx, &lnrpc.ListChannelsRequest{ActiveOnly: true, PublicOnly: publicOnly(), Peer: node})
 
 			if err != nil {
 				log.Fatalf("Error fetching channels when filtering for target node \"%x\": %s", node, err)
@@ -530,65 +1138,168 @@ func main() {
 				}
 			}
 		}
+		if len(r.toChannelId) == 0 {
+			log.Fatal("No target channels match --to")
+		}
 
 	}
 
-	r.excludeIn = makeChanSet(convertChanStringToInt(params.ExcludeChannelsIn))
-	r.excludeOut = makeChanSet(convertChanStringToInt(params.ExcludeChannelsOut))
-	r.excludeBoth = makeChanSet(convertChanStringToInt(params.ExcludeChannels))
-
-	err = r.makeNodeList(params.ExcludeNodes)
+	err = r.parseExclusions(infoCtx)
 	if err != nil {
-		log.Fatal("Error parsing excluded node list: ", err)
+		log.Fatal(err)
 	}
 
-	if len(params.Exclude) > 0 {
-		chans, nodes, err := parseNodeChannelIDs(params.Exclude)
+	if params.SkipLocallyDisabled == nil || *params.SkipLocallyDisabled {
+		err = r.getLocallyDisabled(infoCtx)
 		if err != nil {
-			log.Fatal("Error parsing excluded node/channel list:", err)
+			log.Fatal("Error checking own channel policies: ", err)
 		}
-		r.excludeBoth = chans
-		r.excludeNodes = nodes
 	}
 
-	r.invoiceCache = map[int64]*lnrpc.AddInvoiceResponse{}
+	err = r.filterPendingUpdates(infoCtx)
+	if err != nil {
+		log.Fatal("Error checking pending channels: ", err)
+	}
+
+	r.excludePairs, err = parseNodePairs(params.ExcludePairs)
+	if err != nil {
+		log.Fatal("Error parsing excluded node pair list: ", err)
+	}
+
+	err = r.resolveSourceRules()
+	if err != nil {
+		log.Fatal("Error parsing source rules: ", err)
+	}
+	err = r.resolveChannelOverrides()
+	if err != nil {
+		log.Fatal("Error parsing channel overrides: ", err)
+	}
+	r.filterPeersByAddress(infoCtx)
+	err = r.filterTargetsByDemand(infoCtx)
+	if err != nil {
+		log.Fatal("Error getting forwarding history: ", err)
+	}
+	r.printExclusions(infoCtx)
+
+	r.invoiceCache = map[invoiceKey]cachedInvoice{}
+	r.loadOpenInvoices(infoCtx)
 
 	err = r.getChannelCandidates(params.FromPerc, params.ToPerc, params.Amount)
 
 	if err != nil {
 		log.Fatal("Error choosing channels: ", err)
 	}
-	if len(r.fromChannels) == 0 {
-		log.Fatal("No source channels selected")
+	r.amount, r.amountErr = r.fitAmount(params.Amount)
+	if params.Distribute > 0 && len(r.toChannels) > 0 {
+		r.planDistribution(r.amount, params.MinAmount, params.ToPerc, params.Distribute)
+	}
+	if params.ListCandidates {
+		r.printCandidates(infoCtx)
+		return
 	}
-	if len(r.toChannels) == 0 {
-		log.Fatal("No target channels selected")
+	if err := r.checkCandidates(); err != nil {
+		if params.Interval == 0 {
+			log.Fatal(err)
+		}
+		logErrorF("Waiting for the next session: %s", err)
 	}
 	infoCtxCancel()
-	attempt := 1
+	if params.StateImport != "" {
+		err = r.importState(params.StateImport)
+		if err != nil {
+			logErrorF("Error importing state: %s", err)
+		}
+	}
+	if params.ResetMc {
+		mcCtx, mcCtxCancel := context.WithTimeout(mainCtx, time.Second*time.Duration(params.TimeoutInfo))
+		err = r.resetMissionControl(mcCtx)
+		mcCtxCancel()
+		if err != nil {
+			logErrorF("Mission control is not reset: %s", err)
+		}
+	}
+	if params.McImport != "" {
+		mcCtx, mcCtxCancel := context.WithTimeout(mainCtx, time.Second*time.Duration(params.TimeoutInfo))
+		err = r.importMissionControl(mcCtx, params.McImport)
+		mcCtxCancel()
+		if err != nil {
+			logErrorF("Error importing mission control: %s", err)
+		}
+	}
 
-	err = r.loadNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime,
-		true)
-	if err != nil {
-		logErrorF("%s", err)
+	if params.WarmCache {
+		warmCtx, warmCtxCancel := context.WithTimeout(mainCtx, time.Second*time.Duration(params.TimeoutInfo))
+		err = r.warmNodeCache(warmCtx)
+		warmCtxCancel()
+		if err != nil {
+			logErrorF("Error warming up the node cache: %s", err)
+		}
+	}
+	if params.StatPostURL != "" {
+		r.statPoster = newStatPoster(params.StatPostURL, params.StatPostToken, params.StatPostSpool)
+		defer r.statPoster.close()
+	}
+	if params.StatDB != "" {
+		r.statDB, err = openStatDB(params.StatDB)
+		if err != nil {
+			log.Fatalf("Error opening stat database %s: %s", params.StatDB, err)
+		}
+		defer r.statDB.close()
+	}
+	if params.HeartbeatFile != "" || params.HeartbeatURL != "" {
+		r.heartbeat = newHeartbeat(params.HeartbeatFile, params.HeartbeatURL)
+		defer r.heartbeat.close()
 	}
+	r.nodeCacheSaved = time.Now()
 	defer r.saveNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime)
-	stopChan := make(chan os.Signal)
+	defer func() {
+		if err := r.saveMcCache(params.McCacheFilename, params.McCacheLifetime); err != nil {
+			logErrorF("Error saving mc cache: %s", err)
+		}
+	}()
+	if params.StateExport != "" {
+		defer func() {
+			if err := r.exportState(params.StateExport); err != nil {
+				logErrorF("Error exporting state: %s", err)
+			}
+		}()
+	}
+	if params.McExport != "" {
+		defer func() {
+			// the contexts might be expired or cancelled with Ctrl+C by now
+			mcCtx, mcCtxCancel := context.WithTimeout(context.Background(), time.Second*time.Duration(params.TimeoutInfo))
+			defer mcCtxCancel()
+			if err := r.exportMissionControl(mcCtx, params.McExport); err != nil {
+				logErrorF("Error exporting mission control: %s", err)
+			}
+		}()
+	}
+	defer r.notifyFinished()
+	defer r.printSummary()
+	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt)
+	stopDaemon := make(chan struct{})
 	go func() {
 		<-stopChan
-		r.saveNodeCache(params.NodeCacheFilename, params.NodeCacheLifetime)
+		if params.Interval > 0 {
+			log.Print(infoColor("Interrupt received, stopping after the current attempt... (press Ctrl+C again to abort it)"))
+			close(stopDaemon)
+			<-stopChan
+		}
+		log.Print(infoColor("Interrupt received, aborting current route query/payment... (press Ctrl+C again to exit immediately)"))
+		rootCtxCancel()
+		<-stopChan
 		os.Exit(1)
 	}()
 
-	for {
-		_, retry := tryRebalance(mainCtx, &r, &attempt)
-		if mainCtx.Err() == context.DeadlineExceeded {
-			log.Println(errColor("Rebalancing timed out"))
-			return
-		}
-		if !retry {
-			return
-		}
+	if params.Seesaw != "" {
+		runSeesaw(mainCtx, &r)
+		return
+	}
+
+	if params.Interval > 0 {
+		runDaemon(rootCtx, &r, stopDaemon)
+		return
 	}
+	r.rebalanceSession(mainCtx, nil)
 }
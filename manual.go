@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// exit codes of --manual-route, other errors exit with 1
+const (
+	exitManualPaymentFailed = 2
+	exitManualRouteRejected = 3
+)
+
+func parseManualRoute(s string) (chans []uint64, err error) {
+	for _, id := range strings.Split(s, ",") {
+		chanId, err := parseChanID(strings.TrimSpace(id))
+		if err != nil {
+			return nil, err
+		}
+		chans = append(chans, chanId)
+	}
+	if len(chans) < 2 {
+		return nil, fmt.Errorf("manual route should have at least two channels, got %d", len(chans))
+	}
+	return
+}
+
+// manualRouteNodes walks the channels from our node and returns the node
+// each hop leads to. The first and the last channels should be ours.
+func (r *regolancer) manualRouteNodes(ctx context.Context, chans []uint64) (pks [][]byte, err error) {
+	if r.findChannel(chans[0]) == nil {
+		return nil, fmt.Errorf("the first channel %d is not our active public channel", chans[0])
+	}
+	if r.findChannel(chans[len(chans)-1]) == nil {
+		return nil, fmt.Errorf("the last channel %d is not our active public channel", chans[len(chans)-1])
+	}
+	prev := r.myPK
+	for i, chanId := range chans {
+		edge, err := r.getChanInfo(ctx, chanId)
+		if err != nil {
+			return nil, fmt.Errorf("error getting channel %d info: %s", chanId, err)
+		}
+		next := ""
+		switch prev {
+		case edge.Node1Pub:
+			next = edge.Node2Pub
+		case edge.Node2Pub:
+			next = edge.Node1Pub
+		default:
+			return nil, fmt.Errorf("channel %d (hop %d) doesn't start at node %s", chanId, i+1, prev)
+		}
+		if next == r.myPK && i != len(chans)-1 {
+			return nil, fmt.Errorf("channel %d (hop %d) returns to our node before the end of the route", chanId, i+1)
+		}
+		pk, err := hex.DecodeString(next)
+		if err != nil {
+			return nil, err
+		}
+		pks = append(pks, pk)
+		prev = next
+	}
+	if prev != r.myPK {
+		return nil, fmt.Errorf("the route ends at node %s instead of ours", prev)
+	}
+	return
+}
+
+func (r *regolancer) buildManualRoute(ctx context.Context, chans []uint64, amount Msat) (*lnrpc.Route, error) {
+	pks, err := r.manualRouteNodes(ctx, chans)
+	if err != nil {
+		return nil, err
+	}
+	route, err := r.buildRoute(ctx, chans, pks, amount)
+	if err != nil {
+		return nil, fmt.Errorf("error building route: %s", err)
+	}
+	if err := r.validateRouteShape(route, ""); err != nil {
+		return nil, err
+	}
+	for i, h := range route.Hops {
+		if h.ChanId != chans[i] {
+			log.Print(infoColorF("lnd picked channel %d instead of %d for hop %d", h.ChanId, chans[i], i+1))
+		}
+	}
+	return route, nil
+}
+
+// runManualRoute pays once along the specified route and returns the exit
+// code.
+func runManualRoute(ctx context.Context, r *regolancer) int {
+	chans, err := parseManualRoute(params.ManualRoute)
+	if err != nil {
+		logErrorF("%s", err)
+		return exitManualRouteRejected
+	}
+	amount := satToMsat(params.Amount)
+	route, err := r.buildManualRoute(ctx, chans, amount)
+	if err != nil {
+		logErrorF("%s", err)
+		return exitManualRouteRejected
+	}
+	from, to := route.Hops[0].ChanId, route.Hops[len(route.Hops)-1].ChanId
+	feeMsat, _, _, err := r.calcFeeMsat(ctx, from, to, amount)
+	if err != nil {
+		logErrorF("Error calculating the max fee: %s", err)
+		return exitManualRouteRejected
+	}
+	r.attemptInfo = &attemptInfo{number: r.nextAttempt(), routesTried: 1, start: r.now()}
+	log.Printf("Manual route %s, amount: %s (max fee: %s sat | %s ppm%s%s%s)", r.pairLabel(ctx, from, to),
+		hiWhiteColor(amount.sats()), formatFee(feeMsat), formatFeePPM(amount, feeMsat), r.feeScale, r.feeBound,
+		r.feeMultiplier)
+	r.addRouteCacheTally(r.printRoute(ctx, route))
+	if Msat(route.TotalFeesMsat) > feeMsat {
+		logErrorF("Route fee %d msat exceeds the max fee %d msat", route.TotalFeesMsat, feeMsat)
+		return exitManualRouteRejected
+	}
+	if params.DryRun {
+		log.Print(infoColor("Dry run, not paying"))
+		return 0
+	}
+	err = r.payWithTimeout(ctx, amount, 0, route, 0)
+	if err != nil {
+		if e, ok := err.(ErrPaymentFailed); ok && int(e.index) < len(route.Hops) {
+			logErrorF("Payment failed with %s at hop %d (channel %d)", e.code, e.index, route.Hops[e.index].ChanId)
+		} else {
+			logErrorF("Payment failed: %s", err)
+		}
+		return exitManualPaymentFailed
+	}
+	return 0
+}
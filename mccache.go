@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// mcCacheEntry is the amount that failed to go through a hop saved to the mc
+// cache file, the key is the node pair.
+type mcCacheEntry struct {
+	AmountMsat int64
+	Updated    time.Time
+}
+
+// readMcCache reads the failed hop amounts that are not expired yet.
+func readMcCache(filename string, exp int) (result map[string]mcCacheEntry, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			result, err = nil, fmt.Errorf("mc cache format might be outdated: %s", p)
+		}
+	}()
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]mcCacheEntry{}, nil
+		}
+		return nil, fmt.Errorf("error opening mc cache file: %s", err)
+	}
+	defer f.Close()
+	result = map[string]mcCacheEntry{}
+	if err = gob.NewDecoder(f).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error reading mc cache file: %s", err)
+	}
+	for k, v := range result {
+		if time.Since(v.Updated) > time.Minute*time.Duration(exp) {
+			delete(result, k)
+		}
+	}
+	return result, nil
+}
+
+// loadMcCache adds the failed hop amounts saved by the previous runs to
+// mcCache so that they're not learned again the expensive way. A missing or
+// broken file is not an error, the cache is just empty then.
+func (r *regolancer) loadMcCache(filename string, exp int) {
+	if filename == "" {
+		return
+	}
+	l := lock()
+	l.RLock()
+	cache, err := readMcCache(filename, exp)
+	l.Unlock()
+	if err != nil {
+		logErrorF("Error loading mc cache, starting with an empty one: %s", err)
+		return
+	}
+	for k, v := range cache {
+		if cached, ok := r.mcCache[k]; ok && !cached.updated.Before(v.Updated) {
+			continue
+		}
+		r.mcCache[k] = failedAmount{amount: v.AmountMsat, updated: v.Updated}
+	}
+	if len(cache) > 0 {
+		log.Printf("Loaded %s failed hop amounts from %s", hiWhiteColor(len(cache)), filename)
+	}
+}
+
+// saveMcCache merges mcCache with the file saved by other instances (newer
+// entries win) and atomically replaces it.
+func (r *regolancer) saveMcCache(filename string, exp int) error {
+	if filename == "" {
+		return nil
+	}
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	cache, err := readMcCache(filename, exp)
+	if err != nil {
+		logErrorF("Error merging mc cache, saving anew: %s", err)
+		cache = map[string]mcCacheEntry{}
+	}
+	for k, v := range r.mcCache {
+		if time.Since(v.updated) > time.Minute*time.Duration(exp) {
+			continue
+		}
+		if saved, ok := cache[k]; ok && saved.Updated.After(v.updated) {
+			continue
+		}
+		cache[k] = mcCacheEntry{AmountMsat: v.amount, Updated: v.updated}
+	}
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating mc cache file: %s", err)
+	}
+	err = gob.NewEncoder(f).Encode(cache)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+const mcVersion = 1
+
+// mission control isn't reset more often than this so that a looping
+// invocation doesn't wipe the pathfinding data permanently
+const mcResetInterval = time.Hour
+
+var ErrNoMissionControl = fmt.Errorf("mission control is not available without the router service")
+
+// mcFile is the mission control state of lnd (the pair history its
+// pathfinding learned from) that can be loaded into another lnd instance.
+type mcFile struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	Pairs    []mcPair  `json:"pairs"`
+}
+
+// mcPair is the last failure and success of a node pair, the times are unix
+// timestamps.
+type mcPair struct {
+	From           string `json:"from"`
+	To             string `json:"to"`
+	FailTime       int64  `json:"fail_time,omitempty"`
+	FailAmtMsat    int64  `json:"fail_amt_msat,omitempty"`
+	SuccessTime    int64  `json:"success_time,omitempty"`
+	SuccessAmtMsat int64  `json:"success_amt_msat,omitempty"`
+}
+
+func (r *regolancer) exportMissionControl(ctx context.Context, filename string) error {
+	if r.legacyRouter {
+		return ErrNoMissionControl
+	}
+	mc, err := r.routerClient.QueryMissionControl(ctx, &routerrpc.QueryMissionControlRequest{})
+	if r.routerUnavailable(err) {
+		return ErrNoMissionControl
+	}
+	if err != nil {
+		return fmt.Errorf("error querying mission control: %s", err)
+	}
+	state := mcFile{Version: mcVersion, Exported: time.Now()}
+	for _, p := range mc.Pairs {
+		if p.History == nil {
+			continue
+		}
+		state.Pairs = append(state.Pairs, mcPair{From: hex.EncodeToString(p.NodeFrom),
+			To: hex.EncodeToString(p.NodeTo), FailTime: p.History.FailTime, FailAmtMsat: p.History.FailAmtMsat,
+			SuccessTime: p.History.SuccessTime, SuccessAmtMsat: p.History.SuccessAmtMsat})
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating mission control file: %s", err)
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(state); err != nil {
+		return err
+	}
+	log.Printf("Exported %s mission control pairs", hiWhiteColor(len(state.Pairs)))
+	return nil
+}
+
+// importMissionControl merges the pair history exported with --mc-export into
+// lnd mission control, the results older than --mc-import-max-age are
+// skipped. lnd keeps its own results if they're newer.
+func (r *regolancer) importMissionControl(ctx context.Context, filename string) error {
+	if r.legacyRouter {
+		return ErrNoMissionControl
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening mission control file: %s", err)
+	}
+	defer f.Close()
+	state := mcFile{}
+	if err = json.NewDecoder(f).Decode(&state); err != nil {
+		return fmt.Errorf("error reading mission control file: %s", err)
+	}
+	if state.Version != mcVersion {
+		return fmt.Errorf("unsupported mission control file version %d, expected %d", state.Version, mcVersion)
+	}
+	oldest := time.Now().Add(-time.Hour * time.Duration(params.McImportMaxAge)).Unix()
+	req := &routerrpc.XImportMissionControlRequest{}
+	skipped := 0
+	for _, p := range state.Pairs {
+		from, err := hex.DecodeString(p.From)
+		if err != nil {
+			return err
+		}
+		to, err := hex.DecodeString(p.To)
+		if err != nil {
+			return err
+		}
+		history := &routerrpc.PairData{}
+		if p.FailTime >= oldest {
+			history.FailTime, history.FailAmtMsat = p.FailTime, p.FailAmtMsat
+			history.FailAmtSat = Msat(p.FailAmtMsat).sats()
+		}
+		if p.SuccessTime >= oldest {
+			history.SuccessTime, history.SuccessAmtMsat = p.SuccessTime, p.SuccessAmtMsat
+			history.SuccessAmtSat = Msat(p.SuccessAmtMsat).sats()
+		}
+		if history.FailTime == 0 && history.SuccessTime == 0 {
+			skipped++
+			continue
+		}
+		req.Pairs = append(req.Pairs, &routerrpc.PairHistory{NodeFrom: from, NodeTo: to, History: history})
+	}
+	if len(req.Pairs) > 0 {
+		_, err = r.routerClient.XImportMissionControl(ctx, req)
+		if r.routerUnavailable(err) {
+			return ErrNoMissionControl
+		}
+		if err != nil {
+			return fmt.Errorf("error importing mission control: %s", err)
+		}
+	}
+	log.Printf("Imported %s mission control pairs exported at %s, skipped %s older than %d hours",
+		hiWhiteColor(len(req.Pairs)), state.Exported.Format(time.RFC3339), hiWhiteColor(skipped),
+		params.McImportMaxAge)
+	return nil
+}
+
+// mcResetFilename is the file that keeps the time of the last mission control
+// reset of the node between the runs, it's saved next to the node cache or
+// the state file or in the user cache directory.
+func mcResetFilename(pk string) (string, error) {
+	var dir string
+	switch {
+	case params.NodeCacheFilename != "":
+		dir = filepath.Dir(params.NodeCacheFilename)
+	case params.StateExport != "":
+		dir = filepath.Dir(params.StateExport)
+	default:
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cacheDir, "regolancer")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "regolancer-mc-reset-"+pk), nil
+}
+
+func readMcResetTime(filename string) (time.Time, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+}
+
+func writeMcResetTime(filename string, t time.Time) error {
+	tmp := filename + ".tmp"
+	err := os.WriteFile(tmp, []byte(t.Format(time.RFC3339)+"\n"), 0600)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// resetMissionControl makes lnd forget the pair history, it's refused if it
+// was done less than an hour ago.
+func (r *regolancer) resetMissionControl(ctx context.Context) error {
+	if r.legacyRouter {
+		return ErrNoMissionControl
+	}
+	filename, err := mcResetFilename(r.myPK)
+	if err != nil {
+		return fmt.Errorf("error locating the mission control reset file: %s", err)
+	}
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	last, err := readMcResetTime(filename)
+	if err != nil {
+		return fmt.Errorf("error reading the mission control reset time from %s: %s", filename, err)
+	}
+	if time.Since(last) < mcResetInterval {
+		return fmt.Errorf("mission control was already reset %s ago, refusing to reset it more than once per hour",
+			time.Since(last).Round(time.Second))
+	}
+	_, err = r.routerClient.ResetMissionControl(ctx, &routerrpc.ResetMissionControlRequest{})
+	if r.routerUnavailable(err) {
+		return ErrNoMissionControl
+	}
+	if err != nil {
+		return fmt.Errorf("error resetting mission control: %s", err)
+	}
+	if err := writeMcResetTime(filename, time.Now()); err != nil {
+		logErrorF("Error saving the mission control reset time to %s: %s", filename, err)
+	}
+	log.Print(infoColor("Mission control has been reset, lnd forgot all the pair history"))
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestResetMissionControl checks that the reset time is kept per node next to
+// the node cache and that the reset is refused within an hour.
+func TestResetMissionControl(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	dir := t.TempDir()
+	params.NodeCacheFilename = filepath.Join(dir, "nodes.dat")
+	router := &fakeRouter{}
+	r := &regolancer{myPK: testMyPK, routerClient: router}
+	if err := r.resetMissionControl(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "regolancer-mc-reset-"+testMyPK)
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected the reset file %s with mode 0600, got %v", filename, err)
+	}
+	if err := r.resetMissionControl(context.Background()); err == nil {
+		t.Error("the second reset within an hour should be refused")
+	}
+	other := &regolancer{myPK: testPeerPK, routerClient: router}
+	if err := other.resetMissionControl(context.Background()); err != nil {
+		t.Errorf("another node should be reset independently: %s", err)
+	}
+	if router.resets != 2 {
+		t.Errorf("expected 2 resets, got %d", router.resets)
+	}
+	if err := writeMcResetTime(filename, time.Now().Add(-mcResetInterval-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.resetMissionControl(context.Background()); err != nil {
+		t.Errorf("the reset should be allowed after an hour: %s", err)
+	}
+}
+
+// TestResetMissionControlSymlink checks that the reset file replaces a
+// symlink instead of writing to its target.
+func TestResetMissionControlSymlink(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	dir := t.TempDir()
+	params.NodeCacheFilename = ""
+	params.StateExport = filepath.Join(dir, "state.json")
+	victim := filepath.Join(dir, "victim")
+	content := []byte(time.Now().Add(-2*time.Hour).Format(time.RFC3339) + "\n")
+	if err := os.WriteFile(victim, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "regolancer-mc-reset-"+testMyPK)
+	if err := os.Symlink(victim, filename); err != nil {
+		t.Fatal(err)
+	}
+	r := &regolancer{myPK: testMyPK, routerClient: &fakeRouter{}}
+	if err := r.resetMissionControl(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(victim); err != nil || string(data) != string(content) {
+		t.Errorf("the symlink target was modified: %q, %v", data, err)
+	}
+	if fi, err := os.Lstat(filename); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("the symlink should be replaced with a regular file, got %v", err)
+	}
+}
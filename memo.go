@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// max number of channel pairs to remember the paid route for
+const routeMemoLimit = 1000
+
+// routeMemo keeps the last successfully paid route of the channel pairs so
+// that it can be tried again without querying lnd when the pair comes back
+// from the failure cache.
+type routeMemo struct {
+	routes map[string]*lnrpc.Route
+	order  []string
+	stats  routeMemoStats
+}
+
+type routeMemoStats struct {
+	hits      int
+	misses    int
+	fallbacks int
+}
+
+func (m *routeMemo) remove(k string) {
+	if _, ok := m.routes[k]; !ok {
+		return
+	}
+	delete(m.routes, k)
+	for i, o := range m.order {
+		if o == k {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// memoRoute remembers the paid route, the oldest pairs are dropped when the
+// memo is full.
+func (r *regolancer) memoRoute(route *lnrpc.Route) {
+	m := &r.routeMemo
+	if m.routes == nil {
+		m.routes = map[string]*lnrpc.Route{}
+	}
+	k := formatChannelPair(route.Hops[0].ChanId, route.Hops[len(route.Hops)-1].ChanId)
+	m.remove(k)
+	m.routes[k] = route
+	m.order = append(m.order, k)
+	for len(m.order) > routeMemoLimit {
+		delete(m.routes, m.order[0])
+		m.order = m.order[1:]
+	}
+}
+
+// forgetRoute drops the memoized route of the pair after a failed payment.
+func (r *regolancer) forgetRoute(route *lnrpc.Route) {
+	r.routeMemo.remove(formatChannelPair(route.Hops[0].ChanId, route.Hops[len(route.Hops)-1].ChanId))
+}
+
+// memoizedRoute rebuilds the memoized route of the pair for the attempt
+// amount, which refreshes the fees. The route isn't used (and is forgotten)
+// if it can't be built anymore or the new fee exceeds the max fee, then lnd
+// should be queried as usual.
+func (r *regolancer) memoizedRoute(ctx context.Context, a *rebalanceAttempt) (*lnrpc.Route, Msat, bool) {
+	k := formatChannelPair(a.from, a.to)
+	route, ok := r.routeMemo.routes[k]
+	if !ok {
+		r.routeMemo.stats.misses++
+		return nil, 0, false
+	}
+	feeMsat, _, _, err := r.calcFeeMsat(ctx, a.from, a.to, a.amount)
+	var rebuilt *lnrpc.Route
+	if err == nil {
+		rebuilt, err = r.rebuildRoute(ctx, route, a.amount)
+	}
+	if err == nil && Msat(rebuilt.TotalFeesMsat) > feeMsat {
+		err = fmt.Errorf("the fee %s sat exceeds the max fee %s sat", formatFee(Msat(rebuilt.TotalFeesMsat)),
+			formatFee(feeMsat))
+	}
+	if err == nil {
+		err = r.validateRoute(rebuilt)
+	}
+	if maxBaseMsat, ok := maxHopBaseFee(); ok && err == nil {
+		var offenders []baseFeeHop
+		if _, offenders, err = r.baseFeePairs(ctx, rebuilt, maxBaseMsat); err == nil && len(offenders) > 0 {
+			err = ErrBaseFeeRoute{maxMsat: maxBaseMsat}
+		}
+	}
+	if params.MaxHopPPM > 0 && err == nil {
+		var offenders []hopPPM
+		if _, offenders, err = r.hopPPMPairs(ctx, rebuilt, params.MaxHopPPM); err == nil && len(offenders) > 0 {
+			err = ErrHopPPMRoute{maxPPM: params.MaxHopPPM}
+		}
+	}
+	if err != nil {
+		log.Printf("%s %s", infoColor("Memoized route can't be used, querying lnd:"), err)
+		r.routeMemo.stats.fallbacks++
+		r.routeMemo.remove(k)
+		return nil, 0, false
+	}
+	log.Printf("Using the memoized route for %s", r.pairLabel(ctx, a.from, a.to))
+	r.routeMemo.stats.hits++
+	r.routeFound = true
+	return rebuilt, feeMsat, true
+}
+
+func (r *regolancer) printRouteMemoStats() {
+	s := r.routeMemo.stats
+	if s.hits == 0 && s.fallbacks == 0 {
+		return
+	}
+	log.Printf("Memoized routes: %s hits, %s fallbacks to route queries, %s misses", hiWhiteColor(s.hits),
+		hiWhiteColor(s.fallbacks), hiWhiteColor(s.misses))
+}
@@ -1,21 +1,30 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
 )
 
+// failedAmount is the amount that failed to go through a hop.
+type failedAmount struct {
+	amount  int64
+	updated time.Time
+}
+
 func (r *regolancer) addFailedChan(fromStr string, toStr string, amount int64) {
-	r.mcCache[fromStr+toStr] = amount
+	r.mcCache[fromStr+toStr] = failedAmount{amount: amount, updated: time.Now()}
 }
 
 func (r *regolancer) validateRoute(route *lnrpc.Route) error {
 	prevHopPK := r.myPK
 	for _, h := range route.Hops {
 		hopPK := h.PubKey
-		if fp, ok := r.mcCache[prevHopPK+hopPK]; ok && absoluteDeltaPPM(fp, h.AmtToForwardMsat) < params.FailTolerance {
+		if fp, ok := r.mcCache[prevHopPK+hopPK]; ok && absoluteDeltaPPM(fp.amount, h.AmtToForwardMsat) < params.FailTolerance {
 			from, err := hex.DecodeString(prevHopPK)
 			if err != nil {
 				return err
@@ -25,9 +34,150 @@ func (r *regolancer) validateRoute(route *lnrpc.Route) error {
 				return err
 			}
 			r.failedPairs = append(r.failedPairs, &lnrpc.NodePair{From: from, To: to})
-			return fmt.Errorf("chan %d failed before with %d msat and will not be used anymore during this rebalance, payment attempt with %d msat cancelled", h.ChanId, fp, h.AmtToForwardMsat)
+			return fmt.Errorf("chan %d failed before with %d msat and will not be used anymore during this rebalance, payment attempt with %d msat cancelled", h.ChanId, fp.amount, h.AmtToForwardMsat)
 		}
 		prevHopPK = hopPK
 	}
+	return r.validateRouteSimilarity(route)
+}
+
+func (r *regolancer) addFailedPayment(route *lnrpc.Route) {
+	if len(route.Hops) == 0 {
+		return
+	}
+	r.failedPayments[formatChannelPair(route.Hops[0].ChanId, route.Hops[len(route.Hops)-1].ChanId)] = route
+}
+
+// routeOverlap returns the share of channels of route b that are also used in
+// route a relative to the longest of them.
+func routeOverlap(a, b *lnrpc.Route) float64 {
+	maxLen := len(a.Hops)
+	if len(b.Hops) > maxLen {
+		maxLen = len(b.Hops)
+	}
+	if maxLen == 0 {
+		return 0
+	}
+	chans := map[uint64]struct{}{}
+	for _, h := range a.Hops {
+		chans[h.ChanId] = struct{}{}
+	}
+	common := 0
+	for _, h := range b.Hops {
+		if _, ok := chans[h.ChanId]; ok {
+			common++
+		}
+	}
+	return float64(common) / float64(maxLen)
+}
+
+// validateRouteSimilarity rejects a route that is likely to fail the same way
+// the previous route for this channel pair did: the fee is almost the same and
+// most channels are shared. The shared pairs except our own channels are
+// ignored in the next route queries so lnd returns something different.
+func (r *regolancer) validateRouteSimilarity(route *lnrpc.Route) error {
+	if len(route.Hops) == 0 {
+		return nil
+	}
+	failed, ok := r.failedPayments[formatChannelPair(route.Hops[0].ChanId, route.Hops[len(route.Hops)-1].ChanId)]
+	if !ok || failed.TotalFeesMsat == 0 ||
+		absoluteDeltaPPM(failed.TotalFeesMsat, route.TotalFeesMsat) >= params.FailTolerance ||
+		routeOverlap(failed, route)*100 < float64(params.FailOverlapPerc) {
+		return nil
+	}
+	chans := map[uint64]struct{}{}
+	for _, h := range failed.Hops {
+		chans[h.ChanId] = struct{}{}
+	}
+	prevHopPK := r.myPK
+	ignored := 0
+	for i, h := range route.Hops {
+		if _, ok := chans[h.ChanId]; ok && i > 0 && i < len(route.Hops)-1 {
+			from, err := hex.DecodeString(prevHopPK)
+			if err != nil {
+				return err
+			}
+			to, err := hex.DecodeString(h.PubKey)
+			if err != nil {
+				return err
+			}
+			r.failedPairs = append(r.failedPairs, &lnrpc.NodePair{From: from, To: to})
+			ignored++
+		}
+		prevHopPK = h.PubKey
+	}
+	if ignored == 0 {
+		return nil
+	}
+	return fmt.Errorf("route is similar to the one that failed before (fee %d msat, %.0f%% channels overlap), looking for alternatives",
+		route.TotalFeesMsat, routeOverlap(failed, route)*100)
+}
+
+// hopPubKey returns the node the hop leads to, it's resolved from the channel
+// info if lnd didn't fill it.
+func (r *regolancer) hopPubKey(ctx context.Context, prevPK string, h *lnrpc.Hop) (string, error) {
+	if h.PubKey != "" {
+		return h.PubKey, nil
+	}
+	edge, err := r.getChanInfo(ctx, h.ChanId)
+	if err != nil {
+		return "", err
+	}
+	if edge.Node1Pub == prevPK {
+		return edge.Node2Pub, nil
+	}
+	return edge.Node1Pub, nil
+}
+
+// ErrNodeRepeat is returned for the routes that go through the same node more
+// than once, pair leads to the repeated node.
+type ErrNodeRepeat struct {
+	pk     string
+	first  int
+	second int
+	pair   *lnrpc.NodePair
+}
+
+func (e ErrNodeRepeat) Error() string {
+	return fmt.Sprintf("node %s appears twice in the route (hops %d and %d)", e.pk, e.first, e.second)
+}
+
+// validateNodeRepeats rejects the routes that go through the same node more
+// than once with ErrNodeRepeat, its pair should be ignored when querying the
+// routes again.
+func (r *regolancer) validateNodeRepeats(ctx context.Context, route *lnrpc.Route) error {
+	seen := map[string]int{}
+	pks := []string{r.myPK}
+	for i, h := range route.Hops {
+		pk, err := r.hopPubKey(ctx, pks[i], h)
+		if err != nil {
+			return err
+		}
+		pks = append(pks, pk)
+		first, ok := seen[pk]
+		if !ok {
+			seen[pk] = i + 1
+			continue
+		}
+		r.nodeRepeats++
+		if params.AllowNodeRepeats {
+			log.Printf("Node %s appears twice in the route, allowed by --allow-node-repeats", pk)
+			return nil
+		}
+		// the last hop is our node so the route got through it before
+		repeated := i + 1
+		if i == len(route.Hops)-1 {
+			repeated = first
+		}
+		from, err := hex.DecodeString(pks[repeated-1])
+		if err != nil {
+			return err
+		}
+		to, err := hex.DecodeString(pks[repeated])
+		if err != nil {
+			return err
+		}
+		return ErrNodeRepeat{pk: pk, first: first, second: i + 1, pair: &lnrpc.NodePair{From: from, To: to}}
+	}
 	return nil
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func ignoresPair(req *lnrpc.QueryRoutesRequest, from, to string) bool {
+	fromPK, _ := hex.DecodeString(from)
+	toPK, _ := hex.DecodeString(to)
+	for _, p := range req.IgnoredPairs {
+		if bytes.Equal(p.From, fromPK) && bytes.Equal(p.To, toPK) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRouteOverlap(t *testing.T) {
+	base := testRoute(1, 2, 1000000, 100, testPK(1), testPK(2), testPeerPK)
+	detour := testRoute(1, 2, 1000000, 100, testPK(1), testPK(2), testPeerPK)
+	detour.Hops[2].ChanId = 3000
+	short := testRoute(1, 2, 1000000, 100, testPK(1), testPeerPK)
+	disjoint := testRoute(1, 2, 1000000, 100, testPK(3), testPK(4), testPeerPK)
+	for i := 1; i < len(disjoint.Hops)-1; i++ {
+		disjoint.Hops[i].ChanId += 2000
+	}
+	for _, tc := range []struct {
+		name     string
+		a, b     *lnrpc.Route
+		expected float64
+	}{
+		{"same", base, base, 1},
+		{"one channel differs", base, detour, 0.75},
+		// the shorter route is compared to the longest of the two
+		{"shorter", base, short, 0.75},
+		{"longer", short, base, 0.75},
+		{"only our channels", base, disjoint, 0.5},
+		{"empty", &lnrpc.Route{}, &lnrpc.Route{}, 0},
+	} {
+		if overlap := routeOverlap(tc.a, tc.b); overlap != tc.expected {
+			t.Errorf("%s: expected %g, got %g", tc.name, tc.expected, overlap)
+		}
+	}
+}
+
+// TestRouteSimilarity checks that the route with about the same fee and
+// mostly the same channels as the failed one is skipped and its shared pairs
+// are ignored.
+func TestRouteSimilarity(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FailTolerance, params.FailOverlapPerc = 1000, 80
+	candidate := func(fee int64) *lnrpc.Route {
+		return testRoute(1, 2, 100000000, fee, testPK(1), testPK(2), testPeerPK)
+	}
+	detour := candidate(100050)
+	detour.Hops[2].ChanId = 3000
+	for _, tc := range []struct {
+		name        string
+		route       *lnrpc.Route
+		overlapPerc int64
+		similar     bool
+	}{
+		{"same route and fee", candidate(100050), 80, true},
+		{"fee differs", candidate(100200), 80, false},
+		{"one channel differs", detour, 80, false},
+		{"one channel differs, lower overlap", detour, 70, true},
+		{"another pair", testRoute(3, 2, 100000000, 100000, testPK(1), testPK(2), testPeerPK), 80, false},
+	} {
+		params.FailOverlapPerc = tc.overlapPerc
+		r := &regolancer{myPK: testMyPK, failedPayments: map[string]*lnrpc.Route{}}
+		r.addFailedPayment(candidate(100000))
+		err := r.validateRouteSimilarity(tc.route)
+		if (err != nil) != tc.similar {
+			t.Errorf("%s: expected similar %t, got %v", tc.name, tc.similar, err)
+			continue
+		}
+		req := &lnrpc.QueryRoutesRequest{IgnoredPairs: r.failedPairs}
+		if !tc.similar {
+			if len(r.failedPairs) > 0 {
+				t.Errorf("%s: nothing should be ignored, got %d pairs", tc.name, len(r.failedPairs))
+			}
+			continue
+		}
+		// only the shared channels between the other nodes are ignored
+		if ignoresPair(req, testMyPK, testPK(1)) || !ignoresPair(req, testPK(1), testPK(2)) {
+			t.Errorf("%s: unexpected ignored pairs", tc.name)
+		}
+		if shared := ignoresPair(req, testPK(2), testPeerPK); shared != (tc.route != detour) {
+			t.Errorf("%s: the pair %s → %s ignored: %t", tc.name, testPK(2), testPeerPK, shared)
+		}
+	}
+	// the direct route only shares our own channels
+	r := &regolancer{myPK: testMyPK, failedPayments: map[string]*lnrpc.Route{}}
+	r.addFailedPayment(testRoute(1, 2, 100000000, 100000, testPeerPK))
+	if err := r.validateRouteSimilarity(testRoute(1, 2, 100000000, 100000, testPeerPK)); err != nil {
+		t.Errorf("the route through our channels only can't be avoided, got %v", err)
+	}
+}
+
+// TestNodeRepeatRequery checks that the pair leading to the repeated node is
+// ignored in the next query and that the requeries are limited.
+func TestNodeRepeatRequery(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	repeat := testRoute(1, 2, 1000000, 100, testPK(1), testPK(2), testPK(1), testPeerPK)
+	good := testRoute(1, 2, 1000000, 100, testPK(1), testPK(3), testPeerPK)
+	r, ln := newRouteTest(func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+		if ignoresPair(req, testPK(2), testPK(1)) {
+			return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{good}}, nil
+		}
+		return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{repeat}}, nil
+	})
+	routes, _, err := r.getRoutes(context.Background(), 1, 2, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0] != good || ln.queries != 2 {
+		t.Errorf("expected the good route after a requery, got %d routes in %d queries", len(routes), ln.queries)
+	}
+	if len(r.requeryPairs) != 0 || r.requeries != 0 || len(r.failedPairs) != 0 {
+		t.Error("the requery pairs should only be ignored during the attempt")
+	}
+
+	// lnd keeps returning the repeated node through another pair
+	r, ln = newRouteTest(func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+		return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{repeat}}, nil
+	})
+	_, _, err = r.getRoutes(context.Background(), 1, 2, 1000000)
+	if _, ok := err.(ErrNodeRepeat); !ok {
+		t.Errorf("expected ErrNodeRepeat, got %v", err)
+	}
+	if ln.queries != params.MaxRequeries+1 {
+		t.Errorf("expected %d queries, got %d", params.MaxRequeries+1, ln.queries)
+	}
+}
+
+func TestNodeRepeatAllowed(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	repeat := testRoute(1, 2, 1000000, 100, testPK(1), testPK(2), testPK(1), testPeerPK)
+	r, _ := newRouteTest(nil)
+	err := r.validateNodeRepeats(context.Background(), repeat)
+	if e, ok := err.(ErrNodeRepeat); !ok || e.first != 1 || e.second != 3 {
+		t.Errorf("expected the repeat at hops 1 and 3, got %v", err)
+	}
+	params.AllowNodeRepeats = true
+	if err := r.validateNodeRepeats(context.Background(), repeat); err != nil {
+		t.Errorf("repeats are allowed: %s", err)
+	}
+}
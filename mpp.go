@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+)
+
+// mppShards splits the amount into --mpp-parts equal parts or the parts of
+// --shard-size, the result is nil if the amount should be paid in one part.
+func mppShards(amount Msat) []Msat {
+	// the invoices are paid in whole sats so are the parts
+	sats := amount.sats()
+	parts := int64(params.MppParts)
+	if params.ShardSize > 0 {
+		parts = (sats + params.ShardSize - 1) / params.ShardSize
+	}
+	if parts <= 1 || sats < parts {
+		return nil
+	}
+	result := make([]Msat, parts)
+	for i := range result {
+		shard := sats / parts
+		if int64(i) < sats%parts {
+			shard++
+		}
+		result[i] = satToMsat(shard)
+	}
+	return result
+}
+
+// shardRoutes finds a route for every part. The hops of the routes found so
+// far are ignored so that the parts take different paths if possible, if
+// there's no such path the same hops can be used again.
+func (r *regolancer) shardRoutes(ctx context.Context, from, to uint64, shards []Msat) ([]*lnrpc.Route, error) {
+	defer func() {
+		r.routeChoicePairs = nil
+	}()
+	result := []*lnrpc.Route{}
+	for i, shard := range shards {
+		routes, _, err := r.getRoutes(ctx, from, to, shard)
+		if err != nil && len(r.routeChoicePairs) > 0 {
+			ignored := r.routeChoicePairs
+			r.routeChoicePairs = nil
+			routes, _, err = r.getRoutes(ctx, from, to, shard)
+			r.routeChoicePairs = ignored
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no route for part %d (%d sats): %s", i+1, shard.sats(), err)
+		}
+		route := routes[0]
+		result = append(result, route)
+		for j := 1; j < len(route.Hops)-1; j++ {
+			pairFrom, err := hex.DecodeString(route.Hops[j-1].PubKey)
+			if err != nil {
+				return nil, err
+			}
+			pairTo, err := hex.DecodeString(route.Hops[j].PubKey)
+			if err != nil {
+				return nil, err
+			}
+			r.routeChoicePairs = append(r.routeChoicePairs, &lnrpc.NodePair{From: pairFrom, To: pairTo})
+		}
+	}
+	return result, nil
+}
+
+// executeMPP pays the attempt amount in several parts to the same invoice.
+// The max fee applies to the sum of the part fees.
+func (r *regolancer) executeMPP(ctx context.Context, a *rebalanceAttempt, shards []Msat) error {
+	r.attemptInfo.number = r.nextAttempt()
+	var err error
+	a.fee, _, _, err = r.calcFeeMsat(ctx, a.from, a.to, a.amount)
+	if err != nil {
+		return err
+	}
+	r.attemptInfo.feeLimit = a.fee
+	attempt := "Attempt"
+	if params.DryRun {
+		attempt = infoColor("Simulated attempt")
+	}
+	log.Printf("%s %s %s, amount: %s in %s parts (max fee: %s sat | %s ppm%s%s%s)", attempt,
+		hiWhiteColorF("#%d", r.currentAttempt()), r.pairLabel(ctx, a.from, a.to), hiWhiteColor(a.amount.sats()),
+		hiWhiteColor(len(shards)), formatFee(a.fee), formatFeePPM(a.amount, a.fee), r.feeScale,
+		r.feeBound, r.feeMultiplier)
+	emitEvent(logEvent{Event: "attempt_started", Attempt: r.currentAttempt(), FromChan: a.from, ToChan: a.to,
+		Amount: a.amount.sats(), MaxFeeMsat: int64(a.fee), FeePPM: feePPM(a.amount, a.fee)})
+	routes, err := r.shardRoutes(ctx, a.from, a.to, shards)
+	if err != nil {
+		r.addFailedRoute(a.from, a.to, failNoRoute, 0)
+		r.saveFailedAttempt(a.from, a.to, a.amount, a.fee, nil, failureStageNoRoute, failNoRoute, -1)
+		return err
+	}
+	var fee Msat
+	for _, route := range routes {
+		r.addRouteCacheTally(r.printRoute(ctx, route))
+		fee += Msat(route.TotalFeesMsat)
+	}
+	if fee > a.fee {
+		r.saveFailedAttempt(a.from, a.to, a.amount, a.fee, nil, failureStageFee, "mpp_total_fee", -1)
+		return fmt.Errorf("total fee of the parts %s sat exceeds the max fee %s sat", formatFee(fee), formatFee(a.fee))
+	}
+	if params.DryRun {
+		log.Print(infoColor("Dry run, not paying"))
+		return ErrDryRun
+	}
+	payCtx := ctx
+	if params.TimeoutPayment > 0 {
+		var cancel context.CancelFunc
+		payCtx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(params.TimeoutPayment))
+		defer cancel()
+	}
+	payStart := time.Now()
+	err = r.payShards(payCtx, a.amount, routes)
+	r.paymentPacer.add(time.Since(payStart))
+	return err
+}
+
+// payShards sends all parts at once to the same invoice. Our node settles the
+// invoice only when all parts arrive, if any part fails the invoice is
+// cancelled so that the parts held by our node fail right away instead of
+// waiting for the MPP timeout. The payment is tracked if the result of a part
+// is unknown (an RPC or timeout error) as it could still settle.
+func (r *regolancer) payShards(ctx context.Context, amount Msat, routes []*lnrpc.Route) error {
+	textPrintln()
+	defer textPrintln()
+	var fee Msat
+	for _, route := range routes {
+		if err := r.validateRouteExpiry(ctx, route); err != nil {
+			return err
+		}
+		fee += Msat(route.TotalFeesMsat)
+	}
+	from, to := routes[0].Hops[0].ChanId, routes[0].Hops[len(routes[0].Hops)-1].ChanId
+	if err := r.checkFeeBudget(fee); err != nil {
+		r.saveFailedAttempt(from, to, amount, 0, nil, failureStageFee, "session_fee_budget", -1)
+		return err
+	}
+	if err := r.checkDailyFeeBudget(fee); err != nil {
+		r.saveFailedAttempt(from, to, amount, 0, nil, failureStageFee, "daily_fee_budget", -1)
+		return err
+	}
+	invoice, err := r.createInvoice(ctx, amount, invoiceMemo(routes[0], amount))
+	if err != nil {
+		log.Printf("Error creating invoice: %s", err)
+		return err
+	}
+	for _, route := range routes {
+		route.Hops[len(route.Hops)-1].MppRecord = &lnrpc.MPPRecord{
+			PaymentAddr:  invoice.PaymentAddr,
+			TotalAmtMsat: int64(amount),
+		}
+	}
+	results := make([]*lnrpc.HTLCAttempt, len(routes))
+	errs := make([]error, len(routes))
+	cancel := invoiceCanceller{client: r.invoicesClient, hash: invoice.RHash}
+	wg := sync.WaitGroup{}
+	for i := range routes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = r.sender.sendToRoute(ctx, invoice.RHash, routes[i])
+			if errs[i] == nil && results[i].Status == lnrpc.HTLCAttempt_FAILED {
+				cancel.cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	// the same invoice can't be paid again after some parts were tried
+	r.invalidateInvoice(amount)
+	if cancel.done && cancel.err != nil {
+		logErrorF("Error cancelling the invoice after a part failed, the other parts are released on the MPP "+
+			"timeout: %s", cancel.err)
+	}
+	settled := r.unknownShardsSettled(ctx, invoice.RHash, errs, cancel.done && cancel.err == nil)
+	failed := 0
+	for i, route := range routes {
+		lastHop := route.Hops[len(route.Hops)-1]
+		shard := Msat(route.TotalAmtMsat - route.TotalFeesMsat)
+		switch {
+		case errs[i] != nil && !settled:
+			logErrorF("Part %d failed: %s", i+1, errs[i])
+			failed++
+		case errs[i] == nil && results[i].Status == lnrpc.HTLCAttempt_FAILED:
+			r.failedHTLCs.add(time.Now())
+			r.addHopHistory(route, results[i].Failure.FailureSourceIndex)
+			r.tallyPayment(route, results[i].Failure)
+			r.learnTargetCltv(ctx, route, results[i].Failure)
+			r.addChanUpdate(results[i].Failure)
+			r.saveFailedAttempt(route.Hops[0].ChanId, lastHop.ChanId, shard, 0, route, failureStagePayment,
+				results[i].Failure.Code.String(), int(results[i].Failure.FailureSourceIndex))
+			r.addFailedPayment(route)
+			logErrorF("Part %d failed with %s at hop %d", i+1, results[i].Failure.Code,
+				results[i].Failure.FailureSourceIndex)
+			failed++
+		default:
+			r.emitSuccess(route, shard)
+			r.addHopHistory(route, 0)
+			r.tallyPayment(route, nil)
+			r.saveStat(route)
+			r.addGoalProgress(lastHop.ChanId, shard.sats())
+			r.adjustBalances(route)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d parts failed, the payment is cancelled", failed, len(routes))
+	}
+	log.Printf("%s Success! %s paid %s in fees in %s parts, %s ppm", hiWhiteColorF("#%d", r.currentAttempt()),
+		r.pairLabel(ctx, routes[0].Hops[0].ChanId, routes[0].Hops[len(routes[0].Hops)-1].ChanId), formatFee(fee),
+		hiWhiteColor(len(routes)), formatFeePPM(amount, fee))
+	return nil
+}
+
+// invoiceCanceller cancels the MPP invoice once when the first part fails.
+type invoiceCanceller struct {
+	client invoicesrpc.InvoicesClient
+	hash   []byte
+	once   sync.Once
+	done   bool
+	err    error
+}
+
+func (c *invoiceCanceller) cancel() {
+	c.once.Do(func() {
+		c.done = true
+		if c.client == nil {
+			c.err = errors.New("invoices RPC is not available")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(params.TimeoutInfo))
+		defer cancel()
+		_, c.err = c.client.CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: c.hash})
+	})
+}
+
+// unknownShardsSettled waits for the result of the payment if some parts
+// returned an error instead of the result, they're all settled together if it
+// succeeded. Nothing can settle once the invoice is cancelled.
+func (r *regolancer) unknownShardsSettled(ctx context.Context, hash []byte, errs []error, cancelled bool) bool {
+	unknown := 0
+	for _, err := range errs {
+		if err != nil {
+			unknown++
+		}
+	}
+	if unknown == 0 || cancelled {
+		return false
+	}
+	if params.InFlightAction != "track" {
+		log.Print(errColorF("%d parts of payment %x returned an error, they may still settle", unknown, hash))
+		return false
+	}
+	log.Printf("%s parts of payment %x returned an error, tracking it", hiWhiteColor(unknown), hash)
+	// the payment context could be expired already
+	trackCtx, cancel := context.WithTimeout(context.Background(), time.Minute*time.Duration(params.TimeoutAttempt))
+	defer cancel()
+	payment, err := r.paymentResult(trackCtx, hash)
+	if err != nil {
+		logErrorF("Error tracking payment %x, its parts may still settle: %s", hash, err)
+		return false
+	}
+	return payment.Status == lnrpc.Payment_SUCCEEDED
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func mppTest(send func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error)) (*regolancer,
+	*fakeInvoices) {
+	invoices := &fakeInvoices{}
+	r := &regolancer{
+		myPK:               testMyPK,
+		lnClient:           &fakeLightning{},
+		invoicesClient:     invoices,
+		sender:             &fakeSender{send: send},
+		invoiceCache:       map[invoiceKey]cachedInvoice{},
+		invoiceSkewChecked: true,
+		heightUpdated:      time.Now(),
+		failedPayments:     map[string]*lnrpc.Route{},
+		mcCache:            map[string]failedAmount{},
+		sourceUsage:        map[uint64]Msat{},
+	}
+	return r, invoices
+}
+
+func mppRoutes() []*lnrpc.Route {
+	return []*lnrpc.Route{
+		testRoute(1, 2, 500000, 50, testPK(1), testPeerPK),
+		testRoute(1, 2, 500000, 50, testPK(2), testPeerPK),
+	}
+}
+
+// TestPayShardsCancel checks that the part held by our node is released as
+// soon as another part fails instead of waiting for the MPP timeout.
+func TestPayShardsCancel(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.TimeoutInfo = 5
+	released := make(chan struct{})
+	r, invoices := mppTest(func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+		if route.Hops[0].PubKey == testPK(1) {
+			return failedHTLC(1), nil
+		}
+		select {
+		case <-released:
+			return failedHTLC(2), nil
+		case <-time.After(5 * time.Second):
+			return &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_SUCCEEDED}, nil
+		}
+	})
+	invoices.onCancel = func() { close(released) }
+	start := time.Now()
+	err := r.payShards(context.Background(), satToMsat(1000), mppRoutes())
+	if err == nil {
+		t.Fatal("the payment should fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("the held part wasn't released, the payment took %s", time.Since(start))
+	}
+	if len(invoices.cancelled) != 1 {
+		t.Errorf("the invoice should be cancelled once, got %d", len(invoices.cancelled))
+	}
+	if r.successes != 0 {
+		t.Errorf("nothing should be counted as paid, got %d successes", r.successes)
+	}
+}
+
+// TestPayShardsUnknown checks that the parts that returned an error are
+// counted if the payment turns out to be settled.
+func TestPayShardsUnknown(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.TimeoutAttempt = 1
+	send := func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+		if route.Hops[0].PubKey == testPK(1) {
+			return nil, context.DeadlineExceeded
+		}
+		return &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_SUCCEEDED}, nil
+	}
+	for _, tc := range []struct {
+		action    string
+		status    lnrpc.Payment_PaymentStatus
+		successes int
+		fail      bool
+	}{
+		{"track", lnrpc.Payment_SUCCEEDED, 2, false},
+		{"track", lnrpc.Payment_FAILED, 1, true},
+		{"fail", lnrpc.Payment_SUCCEEDED, 1, true},
+	} {
+		params.InFlightAction = tc.action
+		r, invoices := mppTest(send)
+		router := &fakeRouter{payment: &lnrpc.Payment{Status: tc.status}}
+		r.routerClient = router
+		err := r.payShards(context.Background(), satToMsat(1000), mppRoutes())
+		if (err != nil) != tc.fail || r.successes != tc.successes {
+			t.Errorf("%s %s: got error %v and %d successes, expected %d", tc.action, tc.status, err, r.successes,
+				tc.successes)
+		}
+		if len(invoices.cancelled) != 0 {
+			t.Errorf("%s %s: the invoice shouldn't be cancelled without a failed part", tc.action, tc.status)
+		}
+		if tc.action == "fail" && router.tracked != 0 {
+			t.Errorf("the payment shouldn't be tracked with --inflight-action=fail")
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+const notifyTimeout = time.Second * 5
+
+// notifyLocal rings the terminal bell and shows a desktop notification if
+// --notify-local is set and we run in a terminal. Notification errors are
+// ignored.
+func notifyLocal(text string) {
+	if !params.NotifyLocal || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return
+	}
+	fmt.Print("\a")
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	switch runtime.GOOS {
+	case "linux":
+		exec.CommandContext(ctx, "notify-send", "regolancer", text).Run()
+	case "darwin":
+		text = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text)
+		exec.CommandContext(ctx, "osascript", "-e",
+			fmt.Sprintf(`display notification "%s" with title "regolancer"`, text)).Run()
+	}
+}
+
+func (r *regolancer) summaryLine() string {
+	return fmt.Sprintf("%d successful rebalances, %d sat moved, %.3f sat paid in fees", r.successes,
+		r.totalAmountMsat.sats(), float64(r.totalFeesMsat)/1000)
+}
+
+func (r *regolancer) notifyFinished() {
+	notifyLocal("Rebalancing finished: " + r.summaryLine())
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	pacingSamples    = 20
+	pacingMinSamples = 5
+	pacingPauseMin   = time.Second
+	pacingPauseMax   = time.Minute
+	failedHTLCWindow = time.Hour
+)
+
+// latencyPacer tracks the rolling p90 latency of an lnd call and grows the
+// pause between attempts while it's above the threshold. The pause is halved
+// when p90 drops below half of the threshold.
+type latencyPacer struct {
+	name      string
+	threshold time.Duration
+	latencies []time.Duration
+	pause     time.Duration
+}
+
+func (p *latencyPacer) p90() time.Duration {
+	sorted := append([]time.Duration{}, p.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)*90/100]
+}
+
+func (p *latencyPacer) add(latency time.Duration) {
+	if p.threshold == 0 {
+		return
+	}
+	p.latencies = append(p.latencies, latency)
+	if len(p.latencies) > pacingSamples {
+		p.latencies = p.latencies[1:]
+	}
+	if len(p.latencies) < pacingMinSamples {
+		return
+	}
+	p90 := p.p90()
+	pause := p.pause
+	switch {
+	case p90 > p.threshold:
+		pause *= 2
+		if pause < pacingPauseMin {
+			pause = pacingPauseMin
+		}
+		if pause > pacingPauseMax {
+			pause = pacingPauseMax
+		}
+	case p90 < p.threshold/2:
+		pause /= 2
+		if pause < pacingPauseMin {
+			pause = 0
+		}
+	}
+	if pause != p.pause {
+		log.Print(infoColorF("%s p90 latency is %s (threshold %s), pause between attempts is now %s", p.name,
+			p90.Round(time.Millisecond), p.threshold, pause))
+		p.pause = pause
+	}
+}
+
+// failedHTLCLimiter counts the HTLCs that were actually sent and failed in the
+// sliding window of the last hour.
+type failedHTLCLimiter struct {
+	limit    int
+	failures []time.Time
+}
+
+func (l *failedHTLCLimiter) prune(now time.Time) {
+	for len(l.failures) > 0 && now.Sub(l.failures[0]) >= failedHTLCWindow {
+		l.failures = l.failures[1:]
+	}
+}
+
+func (l *failedHTLCLimiter) add(now time.Time) {
+	l.prune(now)
+	l.failures = append(l.failures, now)
+}
+
+// wait returns the time left until the window has room for another failure,
+// zero if the limit isn't reached or not set.
+func (l *failedHTLCLimiter) wait(now time.Time) time.Duration {
+	if l.limit == 0 {
+		return 0
+	}
+	l.prune(now)
+	if len(l.failures) < l.limit {
+		return 0
+	}
+	return failedHTLCWindow - now.Sub(l.failures[len(l.failures)-l.limit])
+}
+
+// pace waits before the next attempt if lnd is slow to respond or too many
+// HTLCs failed in the last hour.
+func (r *regolancer) pace(ctx context.Context) {
+	pause := r.routePacer.pause
+	if r.paymentPacer.pause > pause {
+		pause = r.paymentPacer.pause
+	}
+	if wait := r.failedHTLCs.wait(time.Now()); wait > pause {
+		log.Printf("Failed HTLCs in the last hour: %s/%s, waiting %s for the window to free up",
+			hiWhiteColor(len(r.failedHTLCs.failures)), hiWhiteColor(r.failedHTLCs.limit), hiWhiteColor(wait.Round(time.Second)))
+		r.setPhase(phaseWaiting, nil)
+		r.unlocked(func() {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		})
+		if wait >= livenessPause {
+			r.checkConnection(ctx)
+		}
+		return
+	}
+	if pause == 0 {
+		return
+	}
+	log.Printf("Waiting %s for lnd to catch up", hiWhiteColor(pause))
+	r.setPhase(phaseWaiting, nil)
+	r.unlocked(func() {
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+		}
+	})
+	if pause >= livenessPause {
+		r.checkConnection(ctx)
+	}
+}
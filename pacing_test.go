@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// feedPacer adds the latencies and returns the pause after each of them.
+func feedPacer(p *latencyPacer, latency time.Duration, n int) []time.Duration {
+	result := []time.Duration{}
+	for i := 0; i < n; i++ {
+		p.add(latency)
+		result = append(result, p.pause)
+	}
+	return result
+}
+
+func TestLatencyPacer(t *testing.T) {
+	p := &latencyPacer{name: "Test", threshold: time.Millisecond * 100}
+	// lnd slows down
+	pauses := feedPacer(p, time.Millisecond*300, 20)
+	for i, pause := range pauses[:pacingMinSamples-1] {
+		if pause != 0 {
+			t.Errorf("no pause expected before %d samples, got %s at %d", pacingMinSamples, pause, i)
+		}
+	}
+	if pauses[pacingMinSamples-1] != pacingPauseMin || pauses[pacingMinSamples] != pacingPauseMin*2 {
+		t.Errorf("the pause should start at %s and double, got %v", pacingPauseMin, pauses)
+	}
+	if last := pauses[len(pauses)-1]; last != pacingPauseMax {
+		t.Errorf("the pause should be limited by %s, got %s", pacingPauseMax, last)
+	}
+	if len(p.latencies) != pacingSamples {
+		t.Errorf("only the last %d samples should be kept, got %d", pacingSamples, len(p.latencies))
+	}
+	// the latency is close to the threshold, the pause stays
+	for _, pause := range feedPacer(p, time.Millisecond*70, 20) {
+		if pause != pacingPauseMax {
+			t.Fatalf("the pause should stay at %s, got %s", pacingPauseMax, pause)
+		}
+	}
+	// lnd recovers
+	pauses = feedPacer(p, time.Millisecond*10, 30)
+	for i := 1; i < len(pauses); i++ {
+		if pauses[i] > pauses[i-1] {
+			t.Fatalf("the pause shouldn't grow while lnd is fast, got %v", pauses)
+		}
+	}
+	if last := pauses[len(pauses)-1]; last != 0 {
+		t.Errorf("the pause should be gone, got %s", last)
+	}
+	// a single slow call doesn't affect p90
+	pauses = feedPacer(p, time.Second, 1)
+	if pauses[0] != 0 {
+		t.Errorf("an outlier shouldn't cause a pause, got %s", pauses[0])
+	}
+}
+
+func TestLatencyPacerDisabled(t *testing.T) {
+	p := &latencyPacer{name: "Test"}
+	feedPacer(p, time.Minute, 20)
+	if p.pause != 0 || len(p.latencies) != 0 {
+		t.Errorf("the pacer without the threshold should do nothing, got %s pause, %d samples", p.pause,
+			len(p.latencies))
+	}
+}
+
+func TestFailedHTLCLimiter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	l := &failedHTLCLimiter{limit: 3}
+	for _, m := range []int{0, 10, 20} {
+		if wait := l.wait(start.Add(time.Minute * time.Duration(m))); wait != 0 {
+			t.Fatalf("the window isn't full at %d minutes, got %s wait", m, wait)
+		}
+		l.add(start.Add(time.Minute * time.Duration(m)))
+	}
+	// the first failure leaves the window in 30 minutes
+	if wait := l.wait(start.Add(time.Minute * 30)); wait != time.Minute*30 {
+		t.Errorf("expected 30m wait, got %s", wait)
+	}
+	if wait := l.wait(start.Add(time.Hour)); wait != 0 || len(l.failures) != 2 {
+		t.Errorf("the first failure should leave the window, got %s wait and %d failures", wait, len(l.failures))
+	}
+	l.add(start.Add(time.Hour + time.Minute))
+	l.add(start.Add(time.Hour + time.Minute*2))
+	// the oldest of the last three failures counts
+	if wait := l.wait(start.Add(time.Hour + time.Minute*2)); wait != time.Minute*18 {
+		t.Errorf("expected 18m wait, got %s", wait)
+	}
+	l.limit = 0
+	if wait := l.wait(start.Add(time.Hour + time.Minute*2)); wait != 0 {
+		t.Errorf("no limit, got %s wait", wait)
+	}
+}
+
+// TestFailedHTLCsCounted checks that only the HTLCs that were actually sent
+// and failed are counted.
+func TestFailedHTLCsCounted(t *testing.T) {
+	var result *lnrpc.HTLCAttempt
+	var sendErr error
+	r := &regolancer{failedHTLCs: failedHTLCLimiter{limit: 10}, sender: &fakeSender{
+		send: func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+			return result, sendErr
+		}}}
+	for _, tc := range []struct {
+		name    string
+		result  *lnrpc.HTLCAttempt
+		err     error
+		counted bool
+	}{
+		{"failed", failedHTLC(1), nil, true},
+		{"succeeded", &lnrpc.HTLCAttempt{Status: lnrpc.HTLCAttempt_SUCCEEDED}, nil, false},
+		{"not sent", nil, status.Error(codes.Unavailable, "no connection"), false},
+		{"already exists", nil, status.Error(codes.AlreadyExists, "payment is in transition"), false},
+	} {
+		result, sendErr = tc.result, tc.err
+		failures := len(r.failedHTLCs.failures)
+		r.sendToRoute(context.Background(), []byte("hash"), testRoute(1, 2, 1000000, 100, testPeerPK))
+		if counted := len(r.failedHTLCs.failures) > failures; counted != tc.counted {
+			t.Errorf("%s: counted %t", tc.name, counted)
+		}
+	}
+}
@@ -2,47 +2,156 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type ErrRetry struct {
-	amount int64
+	amount Msat
 }
 
 func (e ErrRetry) Error() string {
-	return fmt.Sprintf("retry payment with %d sats", e.amount)
+	return fmt.Sprintf("retry payment with %d sats", e.amount.sats())
+}
+
+type ErrPaymentFailed struct {
+	code  lnrpc.Failure_FailureCode
+	index uint32
+}
+
+func (e ErrPaymentFailed) Error() string {
+	return fmt.Sprintf("error: %s @ %d", e.code.String(), e.index)
 }
 
 var ErrProbeFailed = fmt.Errorf("probe failed")
 
-func (r *regolancer) createInvoice(ctx context.Context, amount int64) (result *lnrpc.AddInvoiceResponse, err error) {
-	var ok bool
-	if result, ok = r.invoiceCache[amount]; ok {
+var ErrDryRun = fmt.Errorf("dry run, not paying")
+
+var ErrFeeBudgetExhausted = fmt.Errorf("session fee budget exhausted")
+
+var ErrPaymentTimeout = fmt.Errorf("gave up waiting for the payment, it might still settle")
+
+type cachedInvoice struct {
+	*lnrpc.AddInvoiceResponse
+	expiration time.Time
+	memo       string
+}
+
+// invoiceKey is the amount of the cached invoice and the worker that uses it,
+// two workers paying the same amount must not share the payment hash.
+type invoiceKey struct {
+	worker int
+	amount Msat
+}
+
+const (
+	invoiceExpiry       = time.Hour * 24
+	defaultInvoiceMemo  = "Rebalance attempt"
+	maxInvoiceMemoBytes = 1024 // lnd limit
+)
+
+// invoiceMemo expands the --invoice-memo-template placeholders for the route.
+func invoiceMemo(route *lnrpc.Route, amount Msat) string {
+	if params.InvoiceMemoTemplate == "" {
+		return defaultInvoiceMemo
+	}
+	from, to := uint64(0), uint64(0)
+	if len(route.Hops) > 0 {
+		from = route.Hops[0].ChanId
+		to = route.Hops[len(route.Hops)-1].ChanId
+	}
+	memo := strings.NewReplacer(
+		"{from_scid}", strconv.FormatUint(from, 10),
+		"{to_scid}", strconv.FormatUint(to, 10),
+		"{amount}", strconv.FormatInt(amount.sats(), 10),
+		"{date}", time.Now().Format("2006-01-02"),
+		"{tag}", params.InvoiceMemoTag,
+	).Replace(params.InvoiceMemoTemplate)
+	if len(memo) > maxInvoiceMemoBytes {
+		log.Print(infoColorF("Invoice memo is longer than %d bytes, truncating it", maxInvoiceMemoBytes))
+		memo = strings.ToValidUTF8(memo[:maxInvoiceMemoBytes], "")
+	}
+	return memo
+}
+
+func (r *regolancer) createInvoice(ctx context.Context, amount Msat, memo string) (result *lnrpc.AddInvoiceResponse, err error) {
+	if invoice, ok := r.invoiceCache[invoiceKey{r.workerId, amount}]; ok && invoice.memo == memo {
+		if time.Until(invoice.expiration) > r.invoiceExpiryMargin() {
+			return invoice.AddInvoiceResponse, nil
+		}
+		log.Printf("Invoice for %s expires soon, creating a new one", hiWhiteColor(amount.sats()))
+		r.invalidateInvoice(amount)
+	}
+	start := time.Now()
+	result, err = r.lnClient.AddInvoice(ctx, &lnrpc.Invoice{ValueMsat: int64(amount),
+		Memo:   memo,
+		Expiry: int64(invoiceExpiry.Seconds())})
+	if err != nil {
 		return
 	}
-	result, err = r.lnClient.AddInvoice(ctx, &lnrpc.Invoice{Value: amount,
-		Memo:   "Rebalance attempt",
-		Expiry: int64(time.Hour.Seconds() * 24)})
-	r.invoiceCache[amount] = result
+	r.checkInvoiceClockSkew(ctx, result.RHash, start, time.Now())
+	r.invoiceCache[invoiceKey{r.workerId, amount}] = cachedInvoice{AddInvoiceResponse: result, expiration: time.Now().Add(invoiceExpiry), memo: memo}
 
 	return
 }
 
-func (r *regolancer) invalidateInvoice(amount int64) {
-	delete(r.invoiceCache, amount)
+func (r *regolancer) invalidateInvoice(amount Msat) {
+	delete(r.invoiceCache, invoiceKey{r.workerId, amount})
 }
 
-func (r *regolancer) pay(ctx context.Context, amount int64, minAmount int64,
+// payWithTimeout limits the payment time with --timeout-payment if it's set,
+// otherwise the payment can take the rest of the attempt time.
+func (r *regolancer) payWithTimeout(ctx context.Context, amount Msat, minAmount Msat,
 	route *lnrpc.Route, probeSteps int) error {
-	fmt.Println()
-	defer fmt.Println()
-	invoice, err := r.createInvoice(ctx, amount)
+	payCtx := ctx
+	if params.TimeoutPayment > 0 {
+		var cancel context.CancelFunc
+		payCtx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(params.TimeoutPayment))
+		defer cancel()
+	}
+	payStart := time.Now()
+	err := r.pay(payCtx, amount, minAmount, route, probeSteps)
+	r.paymentPacer.add(time.Since(payStart))
+	if err != nil && payCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		r.paymentTimeouts++
+		from, to := routeEnds(route)
+		r.saveFailedAttempt(from, to, amount, 0, route, failureStagePayment, "timeout", -1)
+		logErrorF("Payment timed out: %s", ErrPaymentTimeout)
+		return ErrPaymentTimeout
+	}
+	return err
+}
+
+func (r *regolancer) pay(ctx context.Context, amount Msat, minAmount Msat,
+	route *lnrpc.Route, probeSteps int) error {
+	textPrintln()
+	defer textPrintln()
+	if err := r.validateRouteShape(route, ""); err != nil {
+		return err
+	}
+	if err := r.validateRouteExpiry(ctx, route); err != nil {
+		return err
+	}
+	if err := r.checkFeeBudget(Msat(route.TotalFeesMsat)); err != nil {
+		from, to := routeEnds(route)
+		r.saveFailedAttempt(from, to, amount, 0, route, failureStageFee, "session_fee_budget", -1)
+		return err
+	}
+	if err := r.checkDailyFeeBudget(Msat(route.TotalFeesMsat)); err != nil {
+		from, to := routeEnds(route)
+		r.saveFailedAttempt(from, to, amount, 0, route, failureStageFee, "daily_fee_budget", -1)
+		return err
+	}
+	invoice, err := r.createInvoice(ctx, amount, invoiceMemo(route, amount))
 	if err != nil {
 		log.Printf("Error creating invoice: %s", err)
 		return err
@@ -55,29 +164,34 @@ func (r *regolancer) pay(ctx context.Context, amount int64, minAmount int64,
 	lastHop := route.Hops[len(route.Hops)-1]
 	lastHop.MppRecord = &lnrpc.MPPRecord{
 		PaymentAddr:  invoice.PaymentAddr,
-		TotalAmtMsat: amount * 1000,
+		TotalAmtMsat: int64(amount),
 	}
 
-	result, err := r.routerClient.SendToRouteV2(ctx,
-		&routerrpc.SendToRouteRequest{
-			PaymentHash: invoice.RHash,
-			Route:       route,
-		})
+	result, err := r.sendToRoute(ctx, invoice.RHash, route)
 	if err != nil {
+		if status.Code(err) == codes.AlreadyExists && params.InFlightAction == "track" {
+			return r.trackPayment(ctx, amount, invoice.RHash)
+		}
 		return err
 	}
 	if result.Status == lnrpc.HTLCAttempt_FAILED {
+		r.addHopHistory(route, result.Failure.FailureSourceIndex)
+		r.tallyPayment(route, result.Failure)
+		r.learnTargetCltv(ctx, route, result.Failure)
+		r.addChanUpdate(result.Failure)
+		r.saveFailedAttempt(route.Hops[0].ChanId, lastHop.ChanId, amount, 0, route, failureStagePayment,
+			result.Failure.Code.String(), int(result.Failure.FailureSourceIndex))
+		r.addFailedPayment(route)
+		r.forgetRoute(route)
 		if result.Failure.FailureSourceIndex >= uint32(len(route.Hops)) {
 			logErrorF("%s (unexpected hop index %d, should be less than %d)", result.Failure.Code.String(),
 				result.Failure.FailureSourceIndex, len(route.Hops))
-			return fmt.Errorf("error: %s @ %d", result.Failure.Code.String(),
-				result.Failure.FailureSourceIndex)
+			return ErrPaymentFailed{code: result.Failure.Code, index: result.Failure.FailureSourceIndex}
 		}
 		if result.Failure.FailureSourceIndex == 0 {
 			logErrorF("%s (unexpected hop index %d, should be greater than 0)", result.Failure.Code.String(),
 				result.Failure.FailureSourceIndex)
-			return fmt.Errorf("error: %s @ %d", result.Failure.Code.String(),
-				result.Failure.FailureSourceIndex)
+			return ErrPaymentFailed{code: result.Failure.Code, index: result.Failure.FailureSourceIndex}
 		}
 		prevHop := route.Hops[result.Failure.FailureSourceIndex-1]
 		failedHop := route.Hops[result.Failure.FailureSourceIndex]
@@ -97,23 +211,36 @@ func (r *regolancer) pay(ctx context.Context, amount int64, minAmount int64,
 		} else {
 			node2name = node2.Node.Alias
 		}
-		log.Printf("%s %s ⇒ %s", faintWhiteColor(result.Failure.Code.String()), cyanColor(node1name), cyanColor(node2name))
+		log.Printf("%s %s %s ⇒ %s", hiWhiteColorF("#%d", r.currentAttempt()), faintWhiteColor(result.Failure.Code.String()),
+			cyanColor(node1name), cyanColor(node2name))
+		emitEvent(logEvent{Level: "warning", Event: "payment_failed", Attempt: r.currentAttempt(),
+			FromChan: route.Hops[0].ChanId, ToChan: lastHop.ChanId, Amount: amount.sats(), FeeMsat: route.TotalFeesMsat,
+			Error: fmt.Sprintf("%s at %s ⇒ %s", result.Failure.Code, node1name, node2name)})
+		if idx := int(result.Failure.FailureSourceIndex); idx >= 2 && idx <= len(route.Hops)-2 {
+			r.coolHubPairs(nodeCtx, prevHop.PubKey, route.Hops[0].ChanId, lastHop.ChanId)
+		}
 		if result.Failure.Code == lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE {
-			r.addFailedChan(node1.Node.PubKey, node2.Node.PubKey, prevHop.
+			r.addFailedChan(prevHop.PubKey, failedHop.PubKey, prevHop.
 				AmtToForwardMsat)
 		}
 		if probeSteps > 0 && int(result.Failure.FailureSourceIndex) == len(route.Hops)-2 &&
 			result.Failure.Code == lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE {
-			fmt.Println("Probing route...")
+			textPrintln("Probing route...")
+			// the probed amounts are whole sats
 			min := int64(0)
-			start := amount / 2
+			start := amount.sats() / 2
 			if minAmount > 0 && minAmount < amount {
 				// need to use -1 so we do not fail the first probing attempt
-				min = -minAmount - 1
-				start = minAmount
+				min = -minAmount.sats() - 1
+				start = minAmount.sats()
+			}
+			maxFeeMsat, _, _, err := r.calcFeeMsat(ctx, route.Hops[0].ChanId, lastHop.ChanId, amount)
+			if err != nil {
+				logErrorF("Probe error: %s", err)
+				return err
 			}
-			maxAmount, err := r.probeRoute(ctx, route, min, amount, start,
-				probeSteps)
+			maxAmount, err := r.probeRoute(ctx, route, min, amount.sats(), start,
+				probeSteps, feePPM(amount, maxFeeMsat))
 
 			if err != nil {
 				logErrorF("Probe error: %s", err)
@@ -122,28 +249,139 @@ func (r *regolancer) pay(ctx context.Context, amount int64, minAmount int64,
 			if maxAmount == 0 {
 				return ErrProbeFailed
 			}
-			return ErrRetry{amount: maxAmount}
+			return ErrRetry{amount: satToMsat(maxAmount)}
 		}
-		return fmt.Errorf("error: %s @ %d", result.Failure.Code.String(), result.Failure.FailureSourceIndex)
+		return ErrPaymentFailed{code: result.Failure.Code, index: result.Failure.FailureSourceIndex}
 	} else {
-		log.Printf("Success! Paid %s in fees, %s ppm",
-			formatFee(result.Route.TotalFeesMsat), formatFeePPM(result.Route.TotalAmtMsat, result.Route.TotalFeesMsat))
-		if r.statFilename != "" {
-			_, err := os.Stat(r.statFilename)
-			f, ferr := os.OpenFile(r.statFilename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			if ferr != nil {
-				logErrorF("Error saving rebalance stats to %s: %s", r.statFilename, ferr)
-				return nil
+		log.Printf("%s Success! %s paid %s in fees, %s ppm", hiWhiteColorF("#%d", r.currentAttempt()),
+			r.pairLabel(ctx, route.Hops[0].ChanId, lastHop.ChanId), formatFee(Msat(result.Route.TotalFeesMsat)),
+			formatFeePPM(Msat(result.Route.TotalAmtMsat), Msat(result.Route.TotalFeesMsat)))
+		r.emitSuccess(result.Route, amount)
+		r.addDiscovery(ctx, route)
+		r.addHopHistory(route, 0)
+		r.tallyPayment(route, nil)
+		r.saveStat(route)
+		r.memoRoute(route)
+		r.addGoalProgress(lastHop.ChanId, amount.sats())
+		r.adjustBalances(route)
+		// Necessary for Rapid Rebalancing
+		r.invalidateInvoice(amount)
+		return nil
+	}
+}
+
+func (r *regolancer) trackPayment(ctx context.Context, amount Msat, hash []byte) error {
+	log.Printf("Payment %x is already in flight, tracking it", hash)
+	payment, err := r.paymentResult(ctx, hash)
+	if err != nil {
+		return err
+	}
+	// the hash can't be paid anymore either way, get a new invoice next time
+	r.invalidateInvoice(amount)
+	if payment.Status == lnrpc.Payment_FAILED {
+		return fmt.Errorf("tracked payment failed: %s", payment.FailureReason)
+	}
+	log.Printf("Success! Paid %s in fees, %s ppm",
+		formatFee(Msat(payment.FeeMsat)), formatFeePPM(Msat(payment.ValueMsat), Msat(payment.FeeMsat)))
+	for _, htlc := range payment.Htlcs {
+		if htlc.Status == lnrpc.HTLCAttempt_SUCCEEDED {
+			r.emitSuccess(htlc.Route, amount)
+			r.saveStat(htlc.Route)
+			if len(htlc.Route.Hops) > 0 {
+				r.addGoalProgress(htlc.Route.Hops[len(htlc.Route.Hops)-1].ChanId, amount.sats())
+				r.adjustBalances(htlc.Route)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// paymentResult waits until the payment succeeds or fails.
+func (r *regolancer) paymentResult(ctx context.Context, hash []byte) (*lnrpc.Payment, error) {
+	if r.legacyRouter {
+		return r.pollPaymentResult(ctx, hash)
+	}
+	stream, err := r.routerClient.TrackPaymentV2(ctx,
+		&routerrpc.TrackPaymentRequest{PaymentHash: hash, NoInflightUpdates: true})
+	if r.routerUnavailable(err) {
+		return r.pollPaymentResult(ctx, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for {
+		payment, err := stream.Recv()
+		if r.routerUnavailable(err) {
+			return r.pollPaymentResult(ctx, hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if payment.Status == lnrpc.Payment_SUCCEEDED || payment.Status == lnrpc.Payment_FAILED {
+			return payment, nil
+		}
+	}
+}
+
+// how often the in-flight payment is looked up without the router service
+var paymentPollInterval = 5 * time.Second
+
+// the number of the latest payments searched for the in-flight one
+const paymentPollDepth = 100
+
+// pollPaymentResult looks up the payment in the latest payments until it's
+// settled, it's used to track the payments without the router service.
+func (r *regolancer) pollPaymentResult(ctx context.Context, hash []byte) (*lnrpc.Payment, error) {
+	hashStr := hex.EncodeToString(hash)
+	for {
+		resp, err := r.lnClient.ListPayments(ctx, &lnrpc.ListPaymentsRequest{IncludeIncomplete: true,
+			Reversed: true, MaxPayments: paymentPollDepth})
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, payment := range resp.Payments {
+			if payment.PaymentHash != hashStr {
+				continue
 			}
-			defer f.Close()
-			if os.IsNotExist(err) {
-				f.WriteString("timestamp,from_channel,to_channel,amount_msat,fees_msat\n")
+			found = true
+			if payment.Status == lnrpc.Payment_SUCCEEDED || payment.Status == lnrpc.Payment_FAILED {
+				return payment, nil
 			}
-			f.Write([]byte(fmt.Sprintf("%d,%d,%d,%d,%d\n", time.Now().Unix(), route.Hops[0].ChanId,
-				lastHop.ChanId, route.TotalAmtMsat-route.TotalFeesMsat, route.TotalFeesMsat)))
 		}
-		// Necessary for Rapid Rebalancing
-		r.invalidateInvoice(amount)
+		if !found {
+			return nil, fmt.Errorf("payment %s not found", hashStr)
+		}
+		r.unlocked(func() {
+			select {
+			case <-time.After(paymentPollInterval):
+			case <-ctx.Done():
+			}
+		})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// checkFeeBudget makes sure the route fee fits in what's left of
+// --max-total-fee-sat in this session. Only the successful payments are
+// counted so the failed ones don't use the budget.
+func (r *regolancer) checkFeeBudget(fee Msat) error {
+	if err := r.checkSeesawBudget(fee); err != nil {
+		r.feeBudgetErr = err
+		return err
+	}
+	if params.MaxTotalFee == 0 {
+		return nil
+	}
+	spent := r.totalFeesMsat - r.sessionFeesStart
+	if spent+fee <= satToMsat(params.MaxTotalFee) {
 		return nil
 	}
+	r.feeBudgetErr = ErrFeeBudgetExhausted
+	logErrorF("Route fee %s sat doesn't fit in the session fee budget, spent %s of %d sat, stopping",
+		formatFee(fee), formatFee(spent), params.MaxTotalFee)
+	return ErrFeeBudgetExhausted
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// blockingSend waits until the payment context is done like a stuck HTLC.
+func blockingSend(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// TestPaymentTimeout checks which of the payment and attempt timeouts ends
+// the payment and that only the payment timeout is reported as such.
+func TestPaymentTimeout(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.StatFailures = true
+	params.TimeoutInfo = 5
+	r, _ := newRouteTest(nil)
+	r.statFilename = filepath.Join(t.TempDir(), "stat.csv")
+	r.invoiceCache = map[invoiceKey]cachedInvoice{}
+	r.failureCache = map[string]failedRoute{}
+	r.channelPairs = map[string][2]*lnrpc.Channel{}
+	r.failedPayments = map[string]*lnrpc.Route{}
+	route := func() *lnrpc.Route { return testRoute(1, 2, 1000000, 100, testPK(1), testPeerPK) }
+	for _, tc := range []struct {
+		name           string
+		paymentTimeout int
+		attemptTimeout time.Duration
+		send           func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error)
+		timedOut       bool
+		invalidated    bool
+		maxDuration    time.Duration
+	}{
+		// the payment gives up before the attempt
+		{"payment timeout", 1, time.Minute, blockingSend, true, true, time.Second * 5},
+		// the attempt times out first, it's not a payment timeout
+		{"attempt timeout", 5, time.Millisecond * 100, blockingSend, false, true, time.Second},
+		// without the payment timeout the payment takes the rest of the
+		// attempt time
+		{"no payment timeout", 0, time.Millisecond * 100, blockingSend, false, true, time.Second},
+		// the payment fails before any timeout
+		{"failed", 1, time.Minute, func(ctx context.Context, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+			return failedHTLC(1), nil
+		}, false, false, time.Second},
+	} {
+		params.TimeoutPayment = tc.paymentTimeout
+		r.sender = &fakeSender{send: tc.send}
+		timeouts := r.paymentTimeouts
+		ctx, cancel := context.WithTimeout(context.Background(), tc.attemptTimeout)
+		start := time.Now()
+		err := r.payWithTimeout(ctx, satToMsat(1000), 0, route(), 0)
+		cancel()
+		if err == nil {
+			t.Errorf("%s: the payment should fail", tc.name)
+		}
+		if (err == ErrPaymentTimeout) != tc.timedOut || (r.paymentTimeouts > timeouts) != tc.timedOut {
+			t.Errorf("%s: unexpected error %v, %d payment timeouts", tc.name, err, r.paymentTimeouts)
+		}
+		if d := time.Since(start); d > tc.maxDuration {
+			t.Errorf("%s: the payment took %s", tc.name, d)
+		}
+		// the HTLC of the timed out payment might still settle
+		if _, ok := r.invoiceCache[invoiceKey{0, satToMsat(1000)}]; ok == tc.invalidated {
+			t.Errorf("%s: the invoice cached: %t", tc.name, ok)
+		}
+	}
+	rows := readStatColumns(t, r.statFilename)
+	timeoutRows := 0
+	for _, row := range rows {
+		if row["failure_code"] == "timeout" {
+			timeoutRows++
+			if row["failure_stage"] != failureStagePayment {
+				t.Errorf("unexpected timeout row %v", row)
+			}
+		}
+	}
+	if timeoutRows != 1 {
+		t.Errorf("expected one timeout row, got %v", rows)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func isOnionAddr(addr string) bool {
+	host := addr
+	if idx := strings.LastIndex(addr, ":"); idx >= 0 {
+		host = addr[:idx]
+	}
+	return strings.HasSuffix(host, ".onion")
+}
+
+// nodeAddrTypes reports if the node advertises any clearnet and tor addresses.
+func nodeAddrTypes(node *lnrpc.LightningNode) (clearnet bool, tor bool) {
+	if node == nil {
+		return
+	}
+	for _, a := range node.Addresses {
+		if isOnionAddr(a.Addr) {
+			tor = true
+		} else {
+			clearnet = true
+		}
+	}
+	return
+}
+
+func checkDirectionParam(name, value string) error {
+	switch value {
+	case "", "to", "from", "both":
+		return nil
+	}
+	return fmt.Errorf("%s should be one of 'to', 'from' or 'both', got '%s'", name, value)
+}
+
+func directionMatches(value string, to bool) bool {
+	return value == "both" || to && value == "to" || !to && value == "from"
+}
+
+// filterPeersByAddress finds the channels that shouldn't be used as sources or
+// targets because their peers don't have the required address types. Peers
+// with unknown addresses are filtered out as well.
+func (r *regolancer) filterPeersByAddress(ctx context.Context) {
+	r.addrExcludedFrom = map[uint64]struct{}{}
+	r.addrExcludedTo = map[uint64]struct{}{}
+	if params.RequireClearnetPeer == "" && params.RequireTorPeer == "" {
+		return
+	}
+	for _, c := range r.channels {
+		clearnet, tor := false, false
+		if nodeInfo, err := r.getNodeInfo(ctx, c.RemotePubkey); err == nil {
+			clearnet, tor = nodeAddrTypes(nodeInfo.Node)
+		}
+		for _, to := range []bool{false, true} {
+			reason := ""
+			if directionMatches(params.RequireClearnetPeer, to) && !clearnet {
+				reason = "has no clearnet address"
+			}
+			if directionMatches(params.RequireTorPeer, to) && !tor {
+				reason = "has no tor address"
+			}
+			if reason == "" {
+				continue
+			}
+			if to {
+				r.addrExcludedTo[c.ChanId] = struct{}{}
+				log.Printf("Channel %s skipped as target, peer %s", hiWhiteColor(c.ChanId), reason)
+			} else {
+				r.addrExcludedFrom[c.ChanId] = struct{}{}
+				log.Printf("Channel %s skipped as source, peer %s", hiWhiteColor(c.ChanId), reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// channel status flags of lnd meaning that the channel state is being changed
+// and HTLCs may be rejected
+var pendingUpdateFlags = map[string]struct{}{
+	"ChanStatusBorked":            {},
+	"ChanStatusCommitBroadcasted": {},
+	"ChanStatusCoopBroadcasted":   {},
+	"ChanStatusLocalDataLoss":     {},
+	"ChanStatusRestored":          {},
+}
+
+// pendingUpdateReason tells why the channel is considered to be in a pending
+// update state, it's empty if the channel looks fine. The pending map holds
+// the channel points found in PendingChannels. lnd doesn't expose splicing or
+// dynamic commitment updates explicitly yet so the status flags and the
+// commitment types unknown to this build are checked.
+func pendingUpdateReason(c *lnrpc.Channel, pending map[string]string) string {
+	if reason, ok := pending[c.ChannelPoint]; ok {
+		return reason
+	}
+	for _, flag := range strings.Split(c.ChanStatusFlags, "|") {
+		if _, ok := pendingUpdateFlags[strings.TrimSpace(flag)]; ok {
+			return "status " + strings.TrimSpace(flag)
+		}
+	}
+	if _, ok := lnrpc.CommitmentType_name[int32(c.CommitmentType)]; !ok {
+		return fmt.Sprintf("unknown commitment type %d", c.CommitmentType)
+	}
+	return ""
+}
+
+// pendingChannelPoints returns the channel points of our channels that are
+// being closed.
+func (r *regolancer) pendingChannelPoints(ctx context.Context) (map[string]string, error) {
+	resp, err := r.lnClient.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	for _, c := range resp.WaitingCloseChannels {
+		if c.Channel != nil {
+			result[c.Channel.ChannelPoint] = "waiting for close"
+		}
+	}
+	for _, c := range resp.PendingForceClosingChannels {
+		if c.Channel != nil {
+			result[c.Channel.ChannelPoint] = "pending force close"
+		}
+	}
+	for _, c := range resp.PendingClosingChannels {
+		if c.Channel != nil {
+			result[c.Channel.ChannelPoint] = "pending close"
+		}
+	}
+	return result, nil
+}
+
+// filterPendingUpdates excludes the channels in a pending update state from
+// the candidates for the session.
+func (r *regolancer) filterPendingUpdates(ctx context.Context) error {
+	r.pendingUpdates = map[uint64]struct{}{}
+	if params.SkipPendingUpdates != nil && !*params.SkipPendingUpdates {
+		return nil
+	}
+	pending, err := r.pendingChannelPoints(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range r.channels {
+		reason := pendingUpdateReason(c, pending)
+		if reason == "" {
+			continue
+		}
+		r.pendingUpdates[c.ChanId] = struct{}{}
+		log.Printf("Channel %s skipped, pending update: %s", hiWhiteColor(c.ChanId), reason)
+	}
+	r.addExclusions(r.pendingUpdates, nil, "channel status")
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestPendingUpdateReason(t *testing.T) {
+	pending := map[string]string{"closing:0": "pending close"}
+	for _, tc := range []struct {
+		name    string
+		channel *lnrpc.Channel
+		reason  string
+	}{
+		{"default", &lnrpc.Channel{ChannelPoint: "ok:0", ChanStatusFlags: "ChanStatusDefault",
+			CommitmentType: lnrpc.CommitmentType_ANCHORS}, ""},
+		{"closing", &lnrpc.Channel{ChannelPoint: "closing:0", ChanStatusFlags: "ChanStatusDefault"},
+			"pending close"},
+		{"borked", &lnrpc.Channel{ChannelPoint: "ok:0", ChanStatusFlags: "ChanStatusBorked"},
+			"status ChanStatusBorked"},
+		{"several flags", &lnrpc.Channel{ChannelPoint: "ok:0",
+			ChanStatusFlags: "ChanStatusDefault | ChanStatusCoopBroadcasted"}, "status ChanStatusCoopBroadcasted"},
+		{"local disabled", &lnrpc.Channel{ChannelPoint: "ok:0",
+			ChanStatusFlags: "ChanStatusDefault|ChanStatusLocalChanDisabled"}, ""},
+		{"unknown commitment", &lnrpc.Channel{ChannelPoint: "ok:0", ChanStatusFlags: "ChanStatusDefault",
+			CommitmentType: 100}, "unknown commitment type 100"},
+	} {
+		if got := pendingUpdateReason(tc.channel, pending); got != tc.reason {
+			t.Errorf("%s: got %q, expected %q", tc.name, got, tc.reason)
+		}
+	}
+}
+
+func TestFilterPendingUpdates(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	ln := &fakeLightning{pending: &lnrpc.PendingChannelsResponse{
+		WaitingCloseChannels: []*lnrpc.PendingChannelsResponse_WaitingCloseChannel{
+			{Channel: &lnrpc.PendingChannelsResponse_PendingChannel{ChannelPoint: "waiting:0"}},
+			// the channels without details are ignored
+			{},
+		},
+		PendingForceClosingChannels: []*lnrpc.PendingChannelsResponse_ForceClosedChannel{
+			{Channel: &lnrpc.PendingChannelsResponse_PendingChannel{ChannelPoint: "force:0"}},
+		},
+	}}
+	r := &regolancer{lnClient: ln, channels: []*lnrpc.Channel{
+		{ChanId: 1, ChannelPoint: "ok:0", ChanStatusFlags: "ChanStatusDefault"},
+		{ChanId: 2, ChannelPoint: "waiting:0", ChanStatusFlags: "ChanStatusDefault"},
+		{ChanId: 3, ChannelPoint: "force:0", ChanStatusFlags: "ChanStatusDefault"},
+		{ChanId: 4, ChannelPoint: "restored:0", ChanStatusFlags: "ChanStatusRestored"},
+	}}
+	params.SkipPendingUpdates = nil
+	if err := r.filterPendingUpdates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{2, 3, 4} {
+		if _, ok := r.pendingUpdates[id]; !ok {
+			t.Errorf("channel %d should be skipped", id)
+		}
+	}
+	if _, ok := r.pendingUpdates[1]; ok || len(r.pendingUpdates) != 3 {
+		t.Errorf("only channels 2, 3 and 4 should be skipped, got %v", r.pendingUpdates)
+	}
+	disabled := false
+	params.SkipPendingUpdates = &disabled
+	if err := r.filterPendingUpdates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.pendingUpdates) != 0 {
+		t.Errorf("--skip-pending-updates=false should keep all channels, got %v", r.pendingUpdates)
+	}
+}
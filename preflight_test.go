@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestPreflightPercentages checks that the percentage errors match the
+// accepted ranges, 0 leaves the optional percentages unset.
+func TestPreflightPercentages(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func(p *configParams, v int64)
+		msg  string
+	}{
+		{"perc", func(p *configParams, v int64) { p.Perc = v }, "perc should be between 1 and 100 or 0"},
+		{"pfrom-strict", func(p *configParams, v int64) { p.FromPercStrict = v; p.From = []string{"1"} },
+			"pfrom-strict should be between 1 and 100 or 0"},
+		{"pto-strict", func(p *configParams, v int64) { p.ToPercStrict = v; p.To = []string{"1"} },
+			"pto-strict should be between 1 and 100 or 0"},
+		{"pfrom", func(p *configParams, v int64) { p.FromPerc = v }, "pfrom should be between 1 and 100"},
+		{"pto", func(p *configParams, v int64) { p.ToPerc = v }, "pto should be between 1 and 100"},
+	} {
+		for _, v := range []int64{-1, 0, 1, 100, 101} {
+			p := configParams{Amount: 1000}
+			tc.set(&p, v)
+			err := preflightChecks(&p)
+			failed := err != nil && strings.Contains(err.Error(), tc.msg)
+			// pfrom and pto default to 50 when they're 0
+			if expected := v < 0 || v > 100; failed != expected {
+				t.Errorf("%s=%d: expected failure %v, got %v", tc.name, v, expected, err)
+			}
+		}
+	}
+}
@@ -6,18 +6,29 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"time"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
-	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	COIN = 1e8
+	// nodes missing from the graph are cached for this time
+	nodeUnknownLifetime = time.Minute * 15
+	// max number of cached channels in low memory mode
+	lowMemoryChanCacheSize = 100
+	// pairs without enough routes for --min-route-choices are skipped for this time
+	routeChoicesFailureTTL = time.Minute
 )
 
+var ErrNodeUnknown = fmt.Errorf("node unknown")
+
 func (r *regolancer) getChanInfo(ctx context.Context, chanId uint64) (*lnrpc.ChannelEdge, error) {
-	if c, ok := r.chanCache[chanId]; ok {
+	if c, ok := r.chanCache[chanId]; ok && !r.chanPolicyStale(chanId, c) {
+		r.touchChanCache(chanId)
 		return c, nil
 	}
 	c, err := r.lnClient.GetChanInfo(ctx, &lnrpc.ChanInfoRequest{ChanId: chanId})
@@ -25,11 +36,83 @@ func (r *regolancer) getChanInfo(ctx context.Context, chanId uint64) (*lnrpc.Cha
 		return nil, err
 	}
 	r.chanCache[chanId] = c
+	r.chanCacheTimes[chanId] = time.Now()
+	delete(r.chanUpdates, chanId)
+	r.touchChanCache(chanId)
 	return c, nil
 }
 
+// chanPolicyStale reports if a newer channel update than the cached policies
+// was seen in a payment failure, the channel should be queried again then.
+func (r *regolancer) chanPolicyStale(chanId uint64, c *lnrpc.ChannelEdge) bool {
+	updated, ok := r.chanUpdates[chanId]
+	if !ok {
+		return false
+	}
+	for _, p := range []*lnrpc.RoutingPolicy{c.Node1Policy, c.Node2Policy} {
+		if p != nil && p.LastUpdate >= updated {
+			return false
+		}
+	}
+	return true
+}
+
+// addChanUpdate remembers the time of the channel update returned with the
+// payment failure so that the cached policies older than it are refreshed.
+func (r *regolancer) addChanUpdate(failure *lnrpc.Failure) {
+	if failure == nil || failure.ChannelUpdate == nil {
+		return
+	}
+	u := failure.ChannelUpdate
+	if r.chanUpdates == nil {
+		r.chanUpdates = map[uint64]uint32{}
+	}
+	if u.Timestamp > r.chanUpdates[u.ChanId] {
+		r.chanUpdates[u.ChanId] = u.Timestamp
+	}
+}
+
+// touchChanCache marks the channel as recently used and evicts the least
+// recently used channels in low memory mode.
+func (r *regolancer) touchChanCache(chanId uint64) {
+	if !params.LowMemory {
+		return
+	}
+	for i, c := range r.chanCacheOrder {
+		if c == chanId {
+			r.chanCacheOrder = append(r.chanCacheOrder[:i], r.chanCacheOrder[i+1:]...)
+			break
+		}
+	}
+	r.chanCacheOrder = append(r.chanCacheOrder, chanId)
+	for len(r.chanCacheOrder) > lowMemoryChanCacheSize {
+		delete(r.chanCache, r.chanCacheOrder[0])
+		delete(r.chanCacheTimes, r.chanCacheOrder[0])
+		r.chanCacheOrder = r.chanCacheOrder[1:]
+	}
+}
+
+// compactNodeInfo only keeps the fields needed to print routes and the node
+// features.
+func compactNodeInfo(nodeInfo *lnrpc.NodeInfo) *lnrpc.NodeInfo {
+	result := &lnrpc.NodeInfo{
+		NumChannels:   nodeInfo.NumChannels,
+		TotalCapacity: nodeInfo.TotalCapacity,
+	}
+	if nodeInfo.Node != nil {
+		result.Node = &lnrpc.LightningNode{
+			PubKey:     nodeInfo.Node.PubKey,
+			Alias:      nodeInfo.Node.Alias,
+			LastUpdate: nodeInfo.Node.LastUpdate,
+			Addresses:  nodeInfo.Node.Addresses,
+			Features:   nodeInfo.Node.Features,
+		}
+	}
+	return result
+}
+
 func (r *regolancer) calcFeeLimitMsat(ctx context.Context, to uint64,
-	amtMsat int64, ppm int64) (feeMsat int64, lastPKstr string, err error) {
+	amtMsat Msat, ppm int64) (feeMsat Msat, lastPKstr string, err error) {
 	cTo, err := r.getChanInfo(ctx, to)
 	if err != nil {
 		return 0, "", err
@@ -38,15 +121,19 @@ func (r *regolancer) calcFeeLimitMsat(ctx context.Context, to uint64,
 	if lastPKstr == r.myPK {
 		lastPKstr = cTo.Node2Pub
 	}
-	feeMsat = amtMsat * ppm / 1e6
+	feeMsat = ppmFee(amtMsat, ppm)
+	r.explainf("fee-limit-ppm %d: %d msat * %d / 1000000 = %d msat", ppm, amtMsat, ppm, feeMsat)
 	return
 }
 
-func (r *regolancer) calcEconFeeMsat(ctx context.Context, from, to uint64, amtMsat int64, ratio float64) (feeMsat int64,
-	lastPKstr string, err error) {
+// calcEconFeeMsat returns the max fee according to the econ ratio. If the fee
+// was limited by --econ-ratio-max-ppm, neededPPM is set to the ppm that the
+// econ ratio alone would allow, otherwise it's zero.
+func (r *regolancer) calcEconFeeMsat(ctx context.Context, from, to uint64, amtMsat Msat, ratio float64) (feeMsat Msat,
+	lastPKstr string, neededPPM int64, err error) {
 	cTo, err := r.getChanInfo(ctx, to)
 	if err != nil {
-		return 0, "", err
+		return 0, "", 0, err
 	}
 	lastPKstr = cTo.Node1Pub
 	policyTo := cTo.Node2Policy
@@ -54,146 +141,601 @@ func (r *regolancer) calcEconFeeMsat(ctx context.Context, from, to uint64, amtMs
 		lastPKstr = cTo.Node2Pub
 		policyTo = cTo.Node1Policy
 	}
-	lostProfitMsat := int64(0)
+	if policyTo == nil {
+		// new channels might have no policy gossiped yet
+		switch {
+		case params.EconRatioMaxPPM != 0:
+			r.logNoPolicy(to, fmt.Sprintf("using econ-ratio-max-ppm %d", params.EconRatioMaxPPM))
+			feeMsat = ppmFee(amtMsat, params.EconRatioMaxPPM)
+			r.explainf("target channel has no policy, econ-ratio-max-ppm %d: %d msat", params.EconRatioMaxPPM, feeMsat)
+			return feeMsat, lastPKstr, 0, nil
+		case params.DefaultTargetPPM != 0:
+			r.logNoPolicy(to, fmt.Sprintf("assuming %d ppm fee rate", params.DefaultTargetPPM))
+			policyTo = &lnrpc.RoutingPolicy{FeeRateMilliMsat: params.DefaultTargetPPM}
+			r.explainf("target channel has no policy, assuming default-target-ppm %d", params.DefaultTargetPPM)
+		default:
+			return 0, "", 0, fmt.Errorf("target channel %d has no policy yet, set --econ-ratio-max-ppm or --default-target-ppm to rebalance it", to)
+		}
+	}
+	lostProfitMsat := Msat(0)
 	if params.LostProfit {
 		cFrom, err := r.getChanInfo(ctx, from)
 		if err != nil {
-			return 0, "", err
+			return 0, "", 0, err
 		}
 		policyFrom := cFrom.Node1Policy
 		if cFrom.Node2Pub == r.myPK {
 			policyFrom = cFrom.Node2Policy
 		}
-		lostProfitMsat = int64(float64(policyFrom.FeeBaseMsat+
-			amtMsat*policyFrom.FeeRateMilliMsat) / 1e6)
+		if policyFrom != nil {
+			lostProfitMsat = policyFee(policyFrom, amtMsat)
+			r.explainf("lost profit: source channel base fee %d msat + %d ppm = %d msat", policyFrom.FeeBaseMsat,
+				policyFrom.FeeRateMilliMsat, lostProfitMsat)
+		} else {
+			r.explainf("lost profit: source channel has no policy, 0 msat")
+		}
 	}
-	feeMsat = int64(float64(policyTo.FeeBaseMsat+amtMsat*
-		policyTo.FeeRateMilliMsat)*ratio/1e6) - lostProfitMsat
+	feeMsat = Msat(float64(policyFee(policyTo, amtMsat))*ratio) - lostProfitMsat
+	r.explainf("econ ratio: (target channel base fee %d msat + %d ppm) * %g - lost profit %d msat = %d msat",
+		policyTo.FeeBaseMsat, policyTo.FeeRateMilliMsat, ratio, lostProfitMsat, feeMsat)
 
-	if params.EconRatioMaxPPM != 0 && int64(float64(feeMsat)/float64(amtMsat)*1e6) > params.EconRatioMaxPPM {
-		feeMsat = params.EconRatioMaxPPM * amtMsat / 1e6
+	if ppm := feePPM(amtMsat, feeMsat); params.EconRatioMaxPPM != 0 && ppm > params.EconRatioMaxPPM {
+		feeMsat = ppmFee(amtMsat, params.EconRatioMaxPPM)
+		neededPPM = ppm
+		r.explainf("econ-ratio-max-ppm %d caps %d ppm: %d msat", params.EconRatioMaxPPM, ppm, feeMsat)
 	}
 	if feeMsat < 0 {
-		return 0, "", fmt.Errorf("max fee less than zero")
+		return 0, "", 0, fmt.Errorf("max fee less than zero")
 	}
 	return
 }
 
+func (r *regolancer) logNoPolicy(chanId uint64, msg string) {
+	if _, ok := r.noPolicyLogged[chanId]; ok {
+		return
+	}
+	r.noPolicyLogged[chanId] = struct{}{}
+	log.Print(infoColorF("Target channel %d has no policy yet, %s", chanId, msg))
+}
+
 func (r *regolancer) calcFeeMsat(ctx context.Context, from, to uint64,
-	amtMsat int64) (feeMsat int64, lastPKstr string, err error) {
-	if params.FeeLimitPPM > 0 {
-		return r.calcFeeLimitMsat(ctx, to, amtMsat, params.FeeLimitPPM)
+	amtMsat Msat) (feeMsat Msat, lastPKstr string, neededPPM int64, err error) {
+	r.feeBound = ""
+	if params.FeeLimitPPM > 0 && !params.FeeLimitIsCap {
+		feeMsat, lastPKstr, err = r.calcFeeLimitMsat(ctx, to, amtMsat, params.FeeLimitPPM)
 	} else {
-		return r.calcEconFeeMsat(ctx, from, to, amtMsat, params.EconRatio)
+		feeMsat, lastPKstr, neededPPM, err = r.calcEconFeeMsat(ctx, from, to, amtMsat, params.EconRatio)
 	}
+	if err != nil {
+		return
+	}
+	feeMsat = r.scaleFeeMsat(to, amtMsat, feeMsat)
+	feeMsat = r.scheduleFeeMsat(feeMsat)
+	if params.FeeLimitIsCap {
+		feeMsat = r.capFeeMsat(amtMsat, feeMsat)
+	}
+	return
 }
 
-func (r *regolancer) getRoutes(ctx context.Context, from, to uint64, amtMsat int64) ([]*lnrpc.Route, int64, error) {
-	routeCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(params.TimeoutRoute))
-	defer cancel()
-	feeMsat, lastPKstr, err := r.calcFeeMsat(routeCtx, from, to, amtMsat)
-	if err != nil {
-		return nil, 0, err
+const (
+	feeBoundEcon = "econ-ratio"
+	feeBoundCap  = "fee-limit-ppm"
+)
+
+// feeBound tells which limit bound the max fee if --fee-limit-is-cap is set.
+type feeBound string
+
+func (b feeBound) String() string {
+	if b == "" {
+		return ""
 	}
-	lastPK, err := hex.DecodeString(lastPKstr)
-	if err != nil {
-		return nil, 0, err
+	return fmt.Sprintf("| bound by %s ", hiWhiteColor(string(b)))
+}
+
+// capFeeMsat applies --fee-limit-ppm as the hard cap on top of the econ ratio
+// derived fee.
+func (r *regolancer) capFeeMsat(amtMsat Msat, feeMsat Msat) Msat {
+	capMsat := ppmFee(amtMsat, params.FeeLimitPPM)
+	if feeMsat > capMsat {
+		r.feeBound = feeBoundCap
+		r.explainf("fee-limit-ppm %d caps the fee: %d msat", params.FeeLimitPPM, capMsat)
+		return capMsat
 	}
-	routes, err := r.lnClient.QueryRoutes(routeCtx, &lnrpc.QueryRoutesRequest{
+	r.feeBound = feeBoundEcon
+	return feeMsat
+}
+
+type feeScale struct {
+	localPerc float64
+	scale     float64
+}
+
+func (s feeScale) String() string {
+	if s.scale == 0 || s.scale == 1 {
+		return " "
+	}
+	return fmt.Sprintf(" | scaled %s at %s local ", hiWhiteColorF("%.2fx", s.scale), hiWhiteColorF("%.1f%%", s.localPerc))
+}
+
+// feeLimitScale interpolates the max fee multiplier from the target channel
+// local balance percentage between (--fee-limit-scale-perc, --fee-limit-scale)
+// and (--pto, 1).
+func feeLimitScale(localPerc float64) float64 {
+	if params.FeeLimitScale == 0 {
+		return 1
+	}
+	lo, hi := float64(params.FeeLimitScalePerc), float64(params.ToPerc)
+	switch {
+	case localPerc <= lo:
+		return params.FeeLimitScale
+	case localPerc >= hi:
+		return 1
+	}
+	return params.FeeLimitScale + (1-params.FeeLimitScale)*(localPerc-lo)/(hi-lo)
+}
+
+// scaleFeeMsat applies --fee-limit-scale to the max fee, the result never
+// exceeds --econ-ratio-max-ppm if it's set.
+func (r *regolancer) scaleFeeMsat(to uint64, amtMsat Msat, feeMsat Msat) Msat {
+	r.feeScale = feeScale{}
+	if params.FeeLimitScale == 0 {
+		return feeMsat
+	}
+	for _, c := range r.channels {
+		if c.ChanId == to && c.Capacity > 0 {
+			localPerc := float64(c.LocalBalance) * 100 / float64(c.Capacity)
+			r.feeScale = feeScale{localPerc: localPerc, scale: feeLimitScale(localPerc)}
+			break
+		}
+	}
+	if r.feeScale.scale == 0 {
+		return feeMsat
+	}
+	scaled := Msat(float64(feeMsat) * r.feeScale.scale)
+	r.explainf("fee-limit-scale %.2f at %.1f%% target channel local balance: %d msat", r.feeScale.scale,
+		r.feeScale.localPerc, scaled)
+	if maxFeeMsat := ppmFee(amtMsat, params.EconRatioMaxPPM); params.EconRatioMaxPPM != 0 && scaled > maxFeeMsat {
+		if feeMsat > maxFeeMsat {
+			maxFeeMsat = feeMsat
+		}
+		r.explainf("scaled fee capped by econ-ratio-max-ppm %d: %d msat", params.EconRatioMaxPPM, maxFeeMsat)
+		return maxFeeMsat
+	}
+	return scaled
+}
+
+func (r *regolancer) routeRequest(from uint64, lastPK []byte, amtMsat Msat, feeMsat Msat) *lnrpc.QueryRoutesRequest {
+	return &lnrpc.QueryRoutesRequest{
 		PubKey:            r.myPK,
 		OutgoingChanId:    from,
 		LastHopPubkey:     lastPK,
-		AmtMsat:           amtMsat,
+		AmtMsat:           int64(amtMsat),
 		UseMissionControl: true,
-		FeeLimit:          &lnrpc.FeeLimit{Limit: &lnrpc.FeeLimit_FixedMsat{FixedMsat: feeMsat}},
+		FeeLimit:          &lnrpc.FeeLimit{Limit: &lnrpc.FeeLimit_FixedMsat{FixedMsat: int64(feeMsat)}},
 		IgnoredNodes:      r.excludeNodes,
-		IgnoredPairs:      r.failedPairs,
-	})
+		IgnoredPairs:      r.ignoredPairs(),
+		CltvLimit:         uint32(params.MaxCltv),
+	}
+}
+
+// routeQuery is the route request for the pair with the target specific
+// route hints and CLTV limit.
+func (r *regolancer) routeQuery(ctx context.Context, from, to uint64, lastPKstr string, amtMsat Msat,
+	feeMsat Msat) (*lnrpc.QueryRoutesRequest, error) {
+	lastPK, err := hex.DecodeString(lastPKstr)
+	if err != nil {
+		return nil, err
+	}
+	req := r.routeRequest(from, lastPK, amtMsat, feeMsat)
+	req.RouteHints = r.privateTargetHints(ctx, to)
+	req.CltvLimit = uint32(r.targetMaxCltv(to))
+	return req, nil
+}
+
+func (r *regolancer) getRoutes(ctx context.Context, from, to uint64, amtMsat Msat) ([]*lnrpc.Route, Msat, error) {
+	routeCtx, cancel := context.WithTimeout(ctx, r.routeTimeout())
+	defer cancel()
+	feeMsat, lastPKstr, neededPPM, err := r.calcFeeMsat(routeCtx, from, to, amtMsat)
 	if err != nil {
 		return nil, 0, err
 	}
+	if params.EconRatioMaxPPM != 0 {
+		r.addCapStat(to, neededPPM)
+	}
+	req, err := r.routeQuery(routeCtx, from, to, lastPKstr, amtMsat, feeMsat)
+	if err != nil {
+		return nil, 0, err
+	}
+	queryStart := time.Now()
+	routes, err := r.queryRoutes(routeCtx, req)
+	if err != nil {
+		routeQueryEvent(from, to, amtMsat, feeMsat, nil, 0, err)
+		if params.ExploreFeeHeadroom && routeCtx.Err() == nil {
+			r.exploreFeeHeadroom(routeCtx, from, to, lastPKstr, amtMsat, feeMsat)
+		}
+		return nil, 0, err
+	}
+	r.addRouteLatency(time.Since(queryStart))
+	r.routePacer.add(time.Since(queryStart))
 	result := []*lnrpc.Route{}
+	var sourceErr, cltvErr, requeryErr, shapeErr error
+	var requeryPairs []*lnrpc.NodePair
 	for i := range routes.Routes { // lnd always returns 1 route for now but just in case it changes
+		if err := r.validateRouteShape(routes.Routes[i], lastPKstr); err != nil {
+			logErrorF("%s", err)
+			shapeErr = err
+			continue
+		}
+		if err := r.validateSource(routes.Routes[i], from); err != nil {
+			log.Print(errColor(err))
+			sourceErr = err
+			continue
+		}
+		if params.MaxHops > 0 && len(routes.Routes[i].Hops) > params.MaxHops {
+			log.Print(infoColorF("Route has %d hops, more than --max-hops=%d, looking for a shorter one",
+				len(routes.Routes[i].Hops), params.MaxHops))
+			requeryErr = ErrRouteTooLong{hops: len(routes.Routes[i].Hops)}
+			requeryPairs, err = routeNodePairs(routes.Routes[i])
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if maxBaseMsat, ok := maxHopBaseFee(); ok {
+			pairs, offenders, err := r.baseFeePairs(routeCtx, routes.Routes[i], maxBaseMsat)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(offenders) > 0 {
+				r.logBaseFeeHops(routeCtx, offenders, maxBaseMsat)
+				r.baseFeeStats.filtered++
+				requeryErr, requeryPairs = ErrBaseFeeRoute{maxMsat: maxBaseMsat}, pairs
+				continue
+			}
+		}
+		if params.MaxHopPPM > 0 {
+			pairs, offenders, err := r.hopPPMPairs(routeCtx, routes.Routes[i], params.MaxHopPPM)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(offenders) > 0 {
+				r.logHopPPM(routeCtx, offenders, params.MaxHopPPM)
+				requeryErr, requeryPairs = ErrHopPPMRoute{maxPPM: params.MaxHopPPM}, pairs
+				continue
+			}
+		}
+		if err := r.validateRouteCltv(routeCtx, routes.Routes[i]); err != nil {
+			// lnd applies the limit too so this only happens if its height differs
+			cltvErr = err
+			continue
+		}
+		if err := r.validateNodeRepeats(routeCtx, routes.Routes[i]); err != nil {
+			repeat, ok := err.(ErrNodeRepeat)
+			if !ok {
+				return nil, 0, err
+			}
+			log.Print(infoColorF("%s, looking for alternatives", repeat))
+			requeryErr, requeryPairs = repeat, []*lnrpc.NodePair{repeat.pair}
+			continue
+		}
 		if err := r.validateRoute(routes.Routes[i]); err == nil {
 			result = append(result, routes.Routes[i])
+			// in low memory mode the routes are tried one by one and the
+			// rest of the response isn't kept
+			if params.LowMemory {
+				break
+			}
 		} else {
 			log.Print(err)
 		}
 	}
+	routeQueryEvent(from, to, amtMsat, feeMsat, routes.Routes, len(result), nil)
 	if len(result) == 0 {
+		if sourceErr != nil {
+			return nil, 0, sourceErr
+		}
+		if shapeErr != nil {
+			return nil, 0, shapeErr
+		}
+		if cltvErr != nil {
+			return nil, 0, cltvErr
+		}
+		if requeryErr != nil {
+			return r.requeryIgnoring(ctx, from, to, amtMsat, requeryPairs, requeryErr)
+		}
 		return r.getRoutes(ctx, from, to, amtMsat)
 	}
 	r.routeFound = true
 	return result, feeMsat, nil
 }
 
+type ErrRouteTooLong struct {
+	hops int
+}
+
+func (e ErrRouteTooLong) Error() string {
+	return fmt.Sprintf("only found a route with %d hops, skipping under --max-hops=%d", e.hops, params.MaxHops)
+}
+
+// routeNodePairs returns the node pairs of the route between our peers.
+func routeNodePairs(route *lnrpc.Route) ([]*lnrpc.NodePair, error) {
+	result := []*lnrpc.NodePair{}
+	for i := 1; i < len(route.Hops)-1; i++ {
+		pairFrom, err := hex.DecodeString(route.Hops[i-1].PubKey)
+		if err != nil {
+			return nil, err
+		}
+		pairTo, err := hex.DecodeString(route.Hops[i].PubKey)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &lnrpc.NodePair{From: pairFrom, To: pairTo})
+	}
+	return result, nil
+}
+
+// requeryIgnoring queries the routes again ignoring the pairs of the rejected
+// route, up to --max-requeries times. The rejection error is returned if there
+// are no more attempts or nothing to ignore.
+func (r *regolancer) requeryIgnoring(ctx context.Context, from, to uint64, amtMsat Msat,
+	pairs []*lnrpc.NodePair, rejectErr error) ([]*lnrpc.Route, Msat, error) {
+	if r.requeries >= params.MaxRequeries || len(pairs) == 0 {
+		return nil, 0, rejectErr
+	}
+	if r.requeries == 0 {
+		defer func() {
+			r.requeryPairs, r.requeries = nil, 0
+		}()
+	}
+	r.requeries++
+	r.requeryPairs = append(r.requeryPairs, pairs...)
+	return r.getRoutes(ctx, from, to, amtMsat)
+}
+
+type ErrNotEnoughRoutes struct {
+	found int
+}
+
+func (e ErrNotEnoughRoutes) Error() string {
+	return fmt.Sprintf("only %d route(s) available, skipping under --min-route-choices=%d", e.found, params.MinRouteChoices)
+}
+
+// getRouteChoices looks for --min-route-choices distinct routes, every next
+// route query ignores the intermediate hops of the routes found so far. The
+// routes are sorted by fee, the cheapest first.
+func (r *regolancer) getRouteChoices(ctx context.Context, from, to uint64, amtMsat Msat) ([]*lnrpc.Route, Msat, error) {
+	routes, feeMsat, err := r.getRoutes(ctx, from, to, amtMsat)
+	if err != nil || params.MinRouteChoices <= 1 {
+		return routes, feeMsat, err
+	}
+	defer func() {
+		r.routeChoicePairs = nil
+	}()
+	for len(routes) < params.MinRouteChoices {
+		ignored := 0
+		last := routes[len(routes)-1]
+		for i := 1; i < len(last.Hops)-1; i++ {
+			pairFrom, err := hex.DecodeString(last.Hops[i-1].PubKey)
+			if err != nil {
+				return nil, 0, err
+			}
+			pairTo, err := hex.DecodeString(last.Hops[i].PubKey)
+			if err != nil {
+				return nil, 0, err
+			}
+			r.routeChoicePairs = append(r.routeChoicePairs, &lnrpc.NodePair{From: pairFrom, To: pairTo})
+			ignored++
+		}
+		if ignored == 0 {
+			break
+		}
+		more, _, err := r.getRoutes(ctx, from, to, amtMsat)
+		if err != nil {
+			break
+		}
+		routes = append(routes, more...)
+	}
+	log.Printf("Found %s distinct routes", hiWhiteColor(len(routes)))
+	if len(routes) < params.MinRouteChoices {
+		return nil, 0, ErrNotEnoughRoutes{found: len(routes)}
+	}
+	zeroBase, err := r.zeroBaseFeeRoutes(ctx, routes)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if zeroBase[routes[i]] != zeroBase[routes[j]] {
+			return zeroBase[routes[i]]
+		}
+		return routes[i].TotalFeesMsat < routes[j].TotalFeesMsat
+	})
+	return routes, feeMsat, nil
+}
+
+// validateSource checks that the route starts with the requested source
+// channel. lnd might choose another channel to the same peer, such route is
+// rejected unless --accept-any-source is set and the actual source channel is
+// a valid source candidate.
+func (r *regolancer) validateSource(route *lnrpc.Route, from uint64) error {
+	if len(route.Hops) == 0 || route.Hops[0].ChanId == from {
+		return nil
+	}
+	actual := route.Hops[0].ChanId
+	if !params.AcceptAnySource {
+		return fmt.Errorf("route starts with channel %d instead of %d, skipping it", actual, from)
+	}
+	for _, c := range r.fromChannels {
+		if c.ChanId == actual {
+			log.Printf("Route starts with channel %s instead of %s, using it as the source",
+				hiWhiteColor(actual), hiWhiteColor(from))
+			return nil
+		}
+	}
+	return fmt.Errorf("route starts with channel %d instead of %d which is not a source candidate, skipping it",
+		actual, from)
+}
+
+// validateRouteShape rejects the malformed routes returned by lnd (or a proxy
+// in front of it) before they're used: the route should have at least two
+// non-empty hops, the forwarded amounts should only decrease along the route
+// and add up with the total fees, it should end at our node and go through
+// lastPK if it's set.
+func (r *regolancer) validateRouteShape(route *lnrpc.Route, lastPK string) error {
+	if route == nil || len(route.Hops) == 0 {
+		return fmt.Errorf("malformed route without hops, skipping it")
+	}
+	for i, h := range route.Hops {
+		if h == nil {
+			return fmt.Errorf("malformed route with empty hop %d, skipping it", i+1)
+		}
+		if h.AmtToForwardMsat <= 0 {
+			return fmt.Errorf("malformed route forwarding %d msat at hop %d, skipping it", h.AmtToForwardMsat, i+1)
+		}
+		if i > 0 && h.AmtToForwardMsat > route.Hops[i-1].AmtToForwardMsat {
+			return fmt.Errorf("malformed route forwarding %d msat at hop %d after %d msat at hop %d, skipping it",
+				h.AmtToForwardMsat, i+1, route.Hops[i-1].AmtToForwardMsat, i)
+		}
+	}
+	if len(route.Hops) < 2 {
+		return fmt.Errorf("malformed route with a single hop, skipping it")
+	}
+	lastHop := route.Hops[len(route.Hops)-1]
+	if route.TotalFeesMsat < 0 || route.TotalAmtMsat-route.TotalFeesMsat != lastHop.AmtToForwardMsat {
+		return fmt.Errorf("malformed route with total amount %d msat and fees %d msat delivering %d msat, skipping it",
+			route.TotalAmtMsat, route.TotalFeesMsat, lastHop.AmtToForwardMsat)
+	}
+	if lastHop.PubKey != r.myPK {
+		return fmt.Errorf("malformed route ending at node %s instead of ours, skipping it", lastHop.PubKey)
+	}
+	if lastPK != "" && route.Hops[len(route.Hops)-2].PubKey != lastPK {
+		return fmt.Errorf("malformed route going through node %s instead of the target peer %s, skipping it",
+			route.Hops[len(route.Hops)-2].PubKey, lastPK)
+	}
+	return nil
+}
+
+func (r *regolancer) ignoredPairs() []*lnrpc.NodePair {
+	result := append([]*lnrpc.NodePair{}, r.excludePairs...)
+	result = append(result, r.failedPairs...)
+	result = append(result, r.routeChoicePairs...)
+	result = append(result, r.requeryPairs...)
+	return append(result, r.badPairs...)
+}
+
 func (r *regolancer) getNodeInfo(ctx context.Context, pk string) (*lnrpc.NodeInfo, error) {
 	if nodeInfo, ok := r.nodeCache[pk]; ok {
-		return nodeInfo.NodeInfo, nil
+		if nodeInfo.NodeInfo != nil {
+			r.nodeCacheStats.hits++
+			return nodeInfo.NodeInfo, nil
+		}
+		if time.Since(nodeInfo.Timestamp) < nodeUnknownLifetime {
+			r.nodeCacheStats.unknownHits++
+			return nil, ErrNodeUnknown
+		}
 	}
+	r.nodeCacheStats.misses++
 	nodeInfo, err := r.lnClient.GetNodeInfo(ctx, &lnrpc.NodeInfoRequest{PubKey: pk})
 	if err == nil {
+		if params.LowMemory {
+			nodeInfo = compactNodeInfo(nodeInfo)
+		}
 		r.nodeCache[pk] = cachedNodeInfo{
 			NodeInfo:  nodeInfo,
 			Timestamp: time.Now(),
 		}
+	} else if status.Code(err) == codes.NotFound {
+		// the node is not in the graph anymore, don't ask for it for a while
+		r.nodeCache[pk] = cachedNodeInfo{Timestamp: time.Now()}
+		return nil, ErrNodeUnknown
 	}
 	return nodeInfo, err
 }
 
-func (r *regolancer) printRoute(ctx context.Context, route *lnrpc.Route) {
+// printRoute prints the route hops with the node info, with --node-cache-info
+// it returns how many nodes were found in the node cache.
+func (r *regolancer) printRoute(ctx context.Context, route *lnrpc.Route) (tally routeCacheTally) {
 	if len(route.Hops) == 0 {
 		return
 	}
+	if params.NodeCacheInfo {
+		for _, hop := range route.Hops {
+			if r.nodeCached(hop.PubKey) {
+				tally.hits++
+			} else {
+				tally.misses++
+			}
+		}
+	}
+	if jsonLog() {
+		r.emitRoute(ctx, route, tally)
+		return
+	}
 	errs := ""
 	fmt.Printf("%s %s sat | %s ppm\n", faintWhiteColor("Total fee:"),
-		formatFee(route.TotalFeesMsat), formatFeePPM(route.TotalAmtMsat, route.TotalFeesMsat))
+		formatFee(Msat(route.TotalFeesMsat)), formatFeePPM(Msat(route.TotalAmtMsat), Msat(route.TotalFeesMsat)))
 	for i, hop := range route.Hops {
 		cached := ""
 		if params.NodeCacheInfo {
 			cached = errColor("x")
-			if _, ok := r.nodeCache[hop.PubKey]; ok {
+			if r.nodeCached(hop.PubKey) {
 				cached = cyanColor("x")
 			}
 			cached += "|"
 		}
+		fee := hiWhiteColorF("%-6s", "")
+		if i > 0 {
+			fee = hiWhiteColorF("%-6d", route.Hops[i-1].FeeMsat)
+		}
 		nodeInfo, err := r.getNodeInfo(ctx, hop.PubKey)
+		if err == ErrNodeUnknown {
+			fmt.Printf("%s %s [%s%s|%s]\n", faintWhiteColor(hop.ChanId), fee, cached, faintWhiteColor("unknown node"),
+				infoColor(hop.PubKey))
+			continue
+		}
 		if err != nil {
 			errs = errs + err.Error() + "\n"
 			continue
 		}
-		fee := hiWhiteColorF("%-6s", "")
-		if i > 0 {
-			fee = hiWhiteColorF("%-6d", route.Hops[i-1].FeeMsat)
-		}
 		fmt.Printf("%s %s [%s%s|%sch|%ssat|%s]\n", faintWhiteColor(hop.ChanId), fee, cached, cyanColor(nodeInfo.Node.Alias),
 			infoColor(nodeInfo.NumChannels), formatAmt(nodeInfo.TotalCapacity), infoColor(nodeInfo.Node.PubKey))
 	}
 	if errs != "" {
 		fmt.Println(errColor(errs))
 	}
+	return
 }
 
-func (r *regolancer) rebuildRoute(ctx context.Context, route *lnrpc.Route, amount int64) (*lnrpc.Route, error) {
+func (r *regolancer) rebuildRoute(ctx context.Context, route *lnrpc.Route, amount Msat) (*lnrpc.Route, error) {
+	if err := r.validateRouteShape(route, ""); err != nil {
+		return nil, err
+	}
 	pks := [][]byte{}
+	chans := []uint64{}
 	for _, h := range route.Hops {
 		pk, _ := hex.DecodeString(h.PubKey)
 		pks = append(pks, pk)
+		chans = append(chans, h.ChanId)
 	}
-	resultRoute, err := r.routerClient.BuildRoute(ctx, &routerrpc.BuildRouteRequest{
-		AmtMsat:        amount * 1000,
-		OutgoingChanId: route.Hops[0].ChanId,
-		HopPubkeys:     pks,
-		FinalCltvDelta: 144,
-	})
+	resultRoute, err := r.buildRoute(ctx, chans, pks, amount)
 	if err != nil {
 		return nil, err
 	}
-	return resultRoute.Route, err
+	if err := r.validateRouteShape(resultRoute, route.Hops[len(route.Hops)-2].PubKey); err != nil {
+		return nil, err
+	}
+	// the timelock might grow with the amount and the final CLTV delta
+	if err := r.validateRouteCltv(ctx, resultRoute); err != nil {
+		return nil, err
+	}
+	return resultRoute, err
 }
 
+// probeRoute looks for the max amount the route can carry. The probe is
+// abandoned if the fee rate at the probed amount exceeds maxPPM, the rate
+// allowed for the original amount, as the base fees make small amounts much
+// more expensive.
 func (r *regolancer) probeRoute(ctx context.Context, route *lnrpc.Route,
-	goodAmount, badAmount, amount int64, steps int) (maxAmount int64, err error) {
+	goodAmount, badAmount, amount int64, steps int, maxPPM int64) (maxAmount int64, err error) {
 
 	defer func() {
 		if ctx.Err() == context.DeadlineExceeded && goodAmount > 0 {
@@ -212,32 +754,39 @@ func (r *regolancer) probeRoute(ctx context.Context, route *lnrpc.Route,
 		log.Printf("Best amount is %s", bestAmount)
 		return
 	}
-	probedRoute, err := r.rebuildRoute(ctx, route, amount)
+	probedRoute, err := r.rebuildRoute(ctx, route, satToMsat(amount))
 	if err != nil {
 		return
 	}
-	maxFeeMsat, _, err := r.calcFeeMsat(ctx, probedRoute.Hops[0].ChanId,
-		probedRoute.Hops[len(probedRoute.Hops)-1].ChanId, amount*1000)
+	if ppm := feePPM(satToMsat(amount), Msat(probedRoute.TotalFeesMsat)); ppm > maxPPM {
+		log.Printf("Probe abandoned: %s ppm exceeds limit %s ppm at %s sats", hiWhiteColor(ppm),
+			hiWhiteColor(maxPPM), hiWhiteColor(amount))
+		if goodAmount > 0 {
+			maxAmount = goodAmount
+		}
+		return
+	}
+	maxFeeMsat, _, _, err := r.calcFeeMsat(ctx, probedRoute.Hops[0].ChanId,
+		probedRoute.Hops[len(probedRoute.Hops)-1].ChanId, satToMsat(amount))
 	if err != nil {
 		return
 	}
-	if probedRoute.TotalFeesMsat > maxFeeMsat {
+	if Msat(probedRoute.TotalFeesMsat) > maxFeeMsat {
 		nextAmount := amount + (badAmount-amount)/2
 		log.Printf("%s requires too high fee %s (max allowed is %s), increasing amount to %s",
-			hiWhiteColor(amount), formatFee(probedRoute.TotalFeesMsat),
+			hiWhiteColor(amount), formatFee(Msat(probedRoute.TotalFeesMsat)),
 			formatFee(maxFeeMsat), hiWhiteColor(nextAmount))
 		// returning negative amount as "good", it's a special case which means
 		// this is rather the lower bound and the actual good amount is still
 		// unknown
-		return r.probeRoute(ctx, route, -amount, badAmount, nextAmount, steps)
+		return r.probeRoute(ctx, route, -amount, badAmount, nextAmount, steps, maxPPM)
 	}
 	fakeHash := make([]byte, 32)
 	rand.Read(fakeHash)
-	result, err := r.routerClient.SendToRouteV2(ctx,
-		&routerrpc.SendToRouteRequest{
-			PaymentHash: fakeHash,
-			Route:       probedRoute,
-		})
+	if r.attemptInfo != nil {
+		r.attemptInfo.probeDepth++
+	}
+	result, err := r.sendToRoute(ctx, fakeHash, probedRoute)
 	if err != nil {
 		return
 	}
@@ -256,7 +805,7 @@ func (r *regolancer) probeRoute(ctx context.Context, route *lnrpc.Route,
 				hiWhiteColor(amount), hiWhiteColor(nextAmount),
 				hiWhiteColor(steps-1))
 			return r.probeRoute(ctx, route, amount, badAmount, nextAmount,
-				steps-1)
+				steps-1, maxPPM)
 		}
 		if result.Failure.Code == lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE {
 			if steps == 1 {
@@ -279,12 +828,12 @@ func (r *regolancer) probeRoute(ctx context.Context, route *lnrpc.Route,
 				hiWhiteColor(amount), hiWhiteColor(nextAmount),
 				hiWhiteColor(steps-1))
 			return r.probeRoute(ctx, route, goodAmount, amount, nextAmount,
-				steps-1)
+				steps-1, maxPPM)
 		}
 		if result.Failure.Code == lnrpc.Failure_FEE_INSUFFICIENT {
 			log.Printf("Fee insufficient, retrying...")
 			return r.probeRoute(ctx, route, goodAmount, badAmount, amount,
-				steps)
+				steps, maxPPM)
 		}
 	}
 	return 0, fmt.Errorf("unknown error: %+v", result)
@@ -292,10 +841,7 @@ func (r *regolancer) probeRoute(ctx context.Context, route *lnrpc.Route,
 
 func (r *regolancer) makeNodeList(nodes []string) error {
 	for _, nid := range nodes {
-		if len(nid) != 66 {
-			return fmt.Errorf("invalid node id (%s) length, expected 66 characters, got %d", nid, len(nid))
-		}
-		pk, err := hex.DecodeString(nid)
+		pk, err := parseNodeID(nid)
 		if err != nil {
 			return err
 		}
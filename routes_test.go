@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// TestEconNoPolicy is the regression test for the target channels that have
+// no policy gossiped yet.
+func TestEconNoPolicy(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	r, ln := newRouteTest(nil)
+	r.noPolicyLogged = map[uint64]struct{}{}
+	ln.edges[2].Node2Policy = nil
+	params.FeeLimitPPM, params.EconRatio = 0, 0.5
+	for _, tc := range []struct {
+		name             string
+		maxPPM           int64
+		defaultTargetPPM int64
+		expected         Msat
+	}{
+		{"econ-ratio-max-ppm", 300, 0, 300},
+		{"default-target-ppm", 0, 800, 400},
+		{"both", 300, 800, 300},
+	} {
+		params.EconRatioMaxPPM, params.DefaultTargetPPM = tc.maxPPM, tc.defaultTargetPPM
+		feeMsat, lastPK, _, err := r.calcFeeMsat(context.Background(), 1, 2, 1000000)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+			continue
+		}
+		if feeMsat != tc.expected || lastPK != testPeerPK {
+			t.Errorf("%s: expected %d msat from %s, got %d msat from %s", tc.name, tc.expected, testPeerPK,
+				feeMsat, lastPK)
+		}
+	}
+	if _, ok := r.noPolicyLogged[2]; !ok || len(r.noPolicyLogged) != 1 {
+		t.Errorf("the missing policy should be logged once per channel, got %v", r.noPolicyLogged)
+	}
+	params.EconRatioMaxPPM, params.DefaultTargetPPM = 0, 0
+	if _, _, _, err := r.calcFeeMsat(context.Background(), 1, 2, 1000000); err == nil ||
+		!strings.Contains(err.Error(), "no policy yet") {
+		t.Errorf("the pair should be skipped without a fallback, got %v", err)
+	}
+	// the fixed ppm limit doesn't need the policy
+	params.FeeLimitPPM = 1000
+	if feeMsat, _, _, err := r.calcFeeMsat(context.Background(), 1, 2, 1000000); err != nil || feeMsat != 1000 {
+		t.Errorf("expected 1000 msat, got %d msat, error %v", feeMsat, err)
+	}
+}
+
+func TestFeeLimitScale(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FeeLimitScale, params.FeeLimitScalePerc, params.ToPerc = 1.5, 10, 50
+	for _, tc := range []struct {
+		localPerc float64
+		expected  float64
+	}{
+		{0, 1.5},
+		{10, 1.5},
+		{20, 1.375},
+		{30, 1.25},
+		{50, 1},
+		{80, 1},
+	} {
+		if scale := feeLimitScale(tc.localPerc); scale != tc.expected {
+			t.Errorf("%g%%: expected %g, got %g", tc.localPerc, tc.expected, scale)
+		}
+	}
+	params.FeeLimitScale = 0
+	if scale := feeLimitScale(0); scale != 1 {
+		t.Errorf("the fee shouldn't be scaled by default, got %g", scale)
+	}
+}
+
+func TestScaleFeeMsat(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FeeLimitScale, params.FeeLimitScalePerc, params.ToPerc = 1.5, 10, 50
+	r := &regolancer{channels: []*lnrpc.Channel{
+		{ChanId: 2, Capacity: 1000000, LocalBalance: 20000},
+		{ChanId: 3, Capacity: 1000000, LocalBalance: 300000},
+	}}
+	for _, tc := range []struct {
+		name     string
+		to       uint64
+		maxPPM   int64
+		expected Msat
+		scale    float64
+	}{
+		{"depleted", 2, 0, 1500, 1.5},
+		{"half way", 3, 0, 1250, 1.25},
+		{"capped", 2, 1200, 1200, 1.5},
+		// the cap doesn't lower the fee below the unscaled one
+		{"already above the cap", 2, 800, 1000, 1.5},
+		{"unknown channel", 4, 0, 1000, 0},
+	} {
+		params.EconRatioMaxPPM = tc.maxPPM
+		if feeMsat := r.scaleFeeMsat(tc.to, 1000000, 1000); feeMsat != tc.expected || r.feeScale.scale != tc.scale {
+			t.Errorf("%s: expected %d msat at %gx, got %d msat at %gx", tc.name, tc.expected, tc.scale, feeMsat,
+				r.feeScale.scale)
+		}
+	}
+	params.FeeLimitScale = 0
+	if feeMsat := r.scaleFeeMsat(2, 1000000, 1000); feeMsat != 1000 || r.feeScale != (feeScale{}) {
+		t.Errorf("the fee shouldn't be scaled, got %d msat, %+v", feeMsat, r.feeScale)
+	}
+}
+
+// TestRouteSource checks the routes that lnd starts with another channel than
+// requested.
+func TestRouteSource(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	mismatched := testRoute(5, 2, 1000000, 100, testPK(1), testPeerPK)
+	good := testRoute(1, 2, 1000000, 200, testPK(1), testPeerPK)
+	for _, tc := range []struct {
+		name           string
+		routes         []*lnrpc.Route
+		acceptAny      bool
+		fromChannels   []*lnrpc.Channel
+		expected       *lnrpc.Route
+		expectedRoutes int
+	}{
+		{"rejected", []*lnrpc.Route{mismatched}, false, []*lnrpc.Channel{{ChanId: 1}, {ChanId: 5}}, nil, 0},
+		{"rejected with another route", []*lnrpc.Route{mismatched, good}, false, nil, good, 1},
+		{"accepted", []*lnrpc.Route{mismatched}, true, []*lnrpc.Channel{{ChanId: 1}, {ChanId: 5}}, mismatched, 1},
+		{"not a source", []*lnrpc.Route{mismatched}, true, []*lnrpc.Channel{{ChanId: 1}}, nil, 0},
+	} {
+		r, _ := newRouteTest(func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+			return &lnrpc.QueryRoutesResponse{Routes: tc.routes}, nil
+		})
+		params.AcceptAnySource = tc.acceptAny
+		r.fromChannels = tc.fromChannels
+		routes, _, err := r.getRoutes(context.Background(), 1, 2, 1000000)
+		if len(routes) != tc.expectedRoutes || tc.expected != nil && routes[0] != tc.expected {
+			t.Errorf("%s: unexpected routes %v, error %v", tc.name, routes, err)
+		}
+		if (err == nil) != (tc.expected != nil) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+// TestProbeFeeLimit checks that the probe stops when the base fees make the
+// fee rate of the smaller amounts exceed the rate allowed for the original
+// one.
+func TestProbeFeeLimit(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	defer log.SetOutput(os.Stderr)
+	for _, tc := range []struct {
+		name        string
+		baseFee     int64
+		feeLimitPPM int64
+		liquidity   int64
+		probes      int
+		abandoned   string
+	}{
+		// 1025 sats for 250000 sats is 4100 ppm
+		{"base fee at the first probe", 1000, 3000, 100000, 0, "4100 ppm exceeds limit 3000 ppm at 250000 sats"},
+		// 1012 sats for 125000 sats is 8100 ppm
+		{"base fee after a failed probe", 1000, 5000, 100000, 1, "8100 ppm exceeds limit 5000 ppm at 125000 sats"},
+		{"no base fee", 0, 5000, 100000, 3, ""},
+	} {
+		r, net := pipelineTest(t, tc.liquidity, 1000000)
+		params.FeeLimitPPM, params.ProbeSteps = tc.feeLimitPPM, 3
+		route := func(from uint64, amtMsat int64) *lnrpc.Route {
+			return testRoute(from, 2, amtMsat, tc.baseFee*1000+amtMsat/10000, testPK(1), testPeerPK)
+		}
+		net.ln.routes = func(req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse, error) {
+			return &lnrpc.QueryRoutesResponse{Routes: []*lnrpc.Route{route(req.OutgoingChanId, req.AmtMsat)}}, nil
+		}
+		r.routerClient = &fakeRouter{build: func(req *routerrpc.BuildRouteRequest) (*lnrpc.Route, error) {
+			return route(req.OutgoingChanId, req.AmtMsat), nil
+		}}
+		buf := &bytes.Buffer{}
+		log.SetOutput(buf)
+		_, repeat := tryRebalance(context.Background(), r)
+		log.SetOutput(os.Stderr)
+		if !repeat || r.successes != 0 || net.payments != 1 || net.probes != tc.probes {
+			t.Errorf("%s: expected no success, 1 payment and %d probes, got %d, %d and %d, repeat %t", tc.name,
+				tc.probes, r.successes, net.payments, net.probes, repeat)
+		}
+		if abandoned := strings.Contains(buf.String(), "Probe abandoned"); abandoned != (tc.abandoned != "") ||
+			!strings.Contains(buf.String(), tc.abandoned) {
+			t.Errorf("%s: expected the probe to be abandoned with %q\n%s", tc.name, tc.abandoned, buf.String())
+		}
+	}
+}
+
+func TestValidateRouteShape(t *testing.T) {
+	r := &regolancer{myPK: testMyPK}
+	good := func() *lnrpc.Route { return testRoute(1, 2, 1000000, 100, testPK(1), testPeerPK) }
+	if err := r.validateRouteShape(good(), testPeerPK); err != nil {
+		t.Fatalf("the route should be valid: %s", err)
+	}
+	for name, mangle := range map[string]func(route *lnrpc.Route) *lnrpc.Route{
+		"nil route":         func(route *lnrpc.Route) *lnrpc.Route { return nil },
+		"no hops":           func(route *lnrpc.Route) *lnrpc.Route { route.Hops = nil; return route },
+		"nil hop":           func(route *lnrpc.Route) *lnrpc.Route { route.Hops[1] = nil; return route },
+		"single hop":        func(route *lnrpc.Route) *lnrpc.Route { route.Hops = route.Hops[2:]; return route },
+		"zero amount":       func(route *lnrpc.Route) *lnrpc.Route { route.Hops[0].AmtToForwardMsat = 0; return route },
+		"negative fees":     func(route *lnrpc.Route) *lnrpc.Route { route.TotalFeesMsat = -1; return route },
+		"wrong total":       func(route *lnrpc.Route) *lnrpc.Route { route.TotalAmtMsat++; return route },
+		"growing amount":    func(route *lnrpc.Route) *lnrpc.Route { route.Hops[1].AmtToForwardMsat++; return route },
+		"foreign last node": func(route *lnrpc.Route) *lnrpc.Route { route.Hops[2].PubKey = testPK(5); return route },
+		"wrong target peer": func(route *lnrpc.Route) *lnrpc.Route { route.Hops[1].PubKey = testPK(5); return route },
+	} {
+		if err := r.validateRouteShape(mangle(good()), testPeerPK); err == nil {
+			t.Errorf("%s: the route should be rejected", name)
+		}
+	}
+}
+
+// fuzzRoute decodes a route from the fuzzer data: the number of hops, then 3
+// bytes per hop (nil marker and node, forwarded amount) and the total fees.
+func fuzzRoute(data []byte) *lnrpc.Route {
+	if len(data) == 0 {
+		return nil
+	}
+	route := &lnrpc.Route{}
+	hops := int(data[0] % 6)
+	data = data[1:]
+	nodes := []string{testMyPK, testPeerPK, testPK(1), "", "zz"}
+	for i := 0; i < hops && len(data) >= 3; i++ {
+		if data[0] == 0xff {
+			route.Hops = append(route.Hops, nil)
+		} else {
+			route.Hops = append(route.Hops, &lnrpc.Hop{ChanId: uint64(i + 1), PubKey: nodes[int(data[0])%len(nodes)],
+				AmtToForwardMsat: int64(int16(binary.BigEndian.Uint16(data[1:3])))})
+		}
+		data = data[3:]
+	}
+	if len(data) >= 2 {
+		route.TotalFeesMsat = int64(int16(binary.BigEndian.Uint16(data)))
+	}
+	if len(route.Hops) > 0 && route.Hops[len(route.Hops)-1] != nil {
+		route.TotalAmtMsat = route.Hops[len(route.Hops)-1].AmtToForwardMsat + route.TotalFeesMsat
+	}
+	return route
+}
+
+// FuzzValidateRouteShape checks that the malformed routes are rejected
+// without panicking and that the accepted ones are safe for the fee math and
+// the payment.
+func FuzzValidateRouteShape(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0})
+	f.Add([]byte{1, 0, 0, 10, 0, 0})
+	f.Add([]byte{2, 1, 0, 10, 0xff, 0, 10, 0, 1})
+	f.Add([]byte{3, 2, 0, 20, 1, 0, 20, 0, 0, 20, 0, 5})
+	f.Add([]byte{3, 2, 0, 20, 1, 0, 30, 0, 0, 20, 0, 5})
+	f.Add([]byte{2, 1, 0x80, 0, 0, 0x80, 0, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := &regolancer{myPK: testMyPK, mcCache: map[string]failedAmount{},
+			lnClient: struct{ lnrpc.LightningClient }{}}
+		route := fuzzRoute(data)
+		for _, lastPK := range []string{"", testPeerPK} {
+			if err := r.validateRouteShape(route, lastPK); err != nil {
+				continue
+			}
+			if len(route.Hops) < 2 || route.Hops[len(route.Hops)-1].PubKey != testMyPK {
+				t.Fatalf("accepted a malformed route %v", route)
+			}
+			for _, h := range route.Hops {
+				if h == nil || h.AmtToForwardMsat <= 0 {
+					t.Fatalf("accepted a route with an invalid hop %v", route)
+				}
+			}
+			_ = route.TotalFeesMsat - route.Hops[0].FeeMsat
+			r.validateRoute(route)
+		}
+		if r.validateRouteShape(route, "") != nil {
+			// the lnd client panics on any call so the payment must stop
+			// before using it
+			if err := r.pay(context.Background(), 1000, 0, route, 0); err == nil {
+				t.Fatalf("paid a malformed route %v", route)
+			}
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// feeScheduleRule multiplies the max fee during the time window, for example
+// "Sat,Sun 00:00-24:00" or "Mon-Fri 22:00-06:00 Europe/Berlin".
+type feeScheduleRule struct {
+	Window     string  `json:"window" toml:"window"`
+	Multiplier float64 `json:"multiplier" toml:"multiplier"`
+}
+
+type feeSchedule []feeScheduleRule
+
+// feeWindow is a parsed time window. The days are the days the window starts
+// on, a window that ends before it starts spans midnight and continues on the
+// next day.
+type feeWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+	loc   *time.Location
+}
+
+type scheduledFee struct {
+	window     feeWindow
+	multiplier float64
+}
+
+func parseDayList(s string) (days [7]bool, err error) {
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return days, fmt.Errorf("invalid day range %s", part)
+		}
+		first, ok := weekdayNames[bounds[0]]
+		if !ok {
+			return days, fmt.Errorf("unknown day %s", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdayNames[bounds[1]]; !ok {
+				return days, fmt.Errorf("unknown day %s", bounds[1])
+			}
+		}
+		// ranges wrap around the week, e.g. Fri-Mon
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("time should be HH:MM, got %s", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid hours in %s", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid minutes in %s", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m > 0 {
+		return 0, fmt.Errorf("time out of range: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseFeeWindow parses "[days] HH:MM-HH:MM [timezone]", the days are
+// comma separated names or ranges (every day if omitted) and the timezone is
+// an IANA name (local time if omitted).
+func parseFeeWindow(s string) (w feeWindow, err error) {
+	fields := strings.Fields(s)
+	w.loc = time.Local
+	w.days = [7]bool{true, true, true, true, true, true, true}
+	clock := -1
+	for i, f := range fields {
+		if strings.Contains(f, ":") {
+			clock = i
+			break
+		}
+	}
+	if clock < 0 || clock > 1 || len(fields) > clock+2 {
+		return w, fmt.Errorf("window should be [days] HH:MM-HH:MM [timezone], got %q", s)
+	}
+	if clock == 1 {
+		if w.days, err = parseDayList(fields[0]); err != nil {
+			return w, err
+		}
+	}
+	if len(fields) == clock+2 {
+		if w.loc, err = time.LoadLocation(fields[clock+1]); err != nil {
+			return w, err
+		}
+	}
+	bounds := strings.Split(fields[clock], "-")
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("time range should be HH:MM-HH:MM, got %s", fields[clock])
+	}
+	if w.start, err = parseClock(bounds[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(bounds[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("empty time range %s", fields[clock])
+	}
+	return w, nil
+}
+
+func (w feeWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// spans midnight
+	if w.days[day] && minute >= w.start {
+		return true
+	}
+	return w.days[(day+6)%7] && minute < w.end
+}
+
+func (s feeSchedule) parse() ([]scheduledFee, error) {
+	result := []scheduledFee{}
+	for _, rule := range s {
+		if rule.Multiplier <= 0 {
+			return nil, fmt.Errorf("multiplier for window %q should be positive, got %g", rule.Window, rule.Multiplier)
+		}
+		w, err := parseFeeWindow(rule.Window)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, scheduledFee{window: w, multiplier: rule.Multiplier})
+	}
+	return result, nil
+}
+
+// scheduleMultiplier returns the max multiplier of the windows active at the
+// time or 1 if none are.
+func (r *regolancer) scheduleMultiplier(t time.Time) float64 {
+	result := 0.0
+	for _, f := range r.feeSchedule {
+		if f.window.contains(t) && f.multiplier > result {
+			result = f.multiplier
+		}
+	}
+	if result == 0 {
+		return 1
+	}
+	return result
+}
+
+type feeMultiplier float64
+
+func (m feeMultiplier) String() string {
+	if m == 0 || m == 1 {
+		return ""
+	}
+	return fmt.Sprintf("| scheduled %s ", hiWhiteColorF("%.2fx", float64(m)))
+}
+
+// scheduleFeeMsat applies the fee schedule multiplier active at the attempt
+// time.
+func (r *regolancer) scheduleFeeMsat(feeMsat Msat) Msat {
+	r.feeMultiplier = feeMultiplier(r.scheduleMultiplier(r.now()))
+	if r.feeMultiplier == 1 {
+		return feeMsat
+	}
+	scheduled := Msat(float64(feeMsat) * float64(r.feeMultiplier))
+	r.explainf("fee schedule %.2fx: %d msat", float64(r.feeMultiplier), scheduled)
+	return scheduled
+}
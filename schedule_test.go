@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFeeWindow(t *testing.T) {
+	for _, s := range []string{
+		"00:00-24:00",
+		"Sat,Sun 00:00-24:00",
+		"Mon-Fri 22:00-06:00 Europe/Berlin",
+		"fri-mon 10:00-11:00 UTC",
+		"23:30-00:15 Asia/Tokyo",
+	} {
+		if _, err := parseFeeWindow(s); err != nil {
+			t.Errorf("%q should be valid: %s", s, err)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"Sat",
+		"Sat 10:00",
+		"Xyz 10:00-11:00",
+		"Mon-Tue-Wed 10:00-11:00",
+		"Sat Sun 10:00-11:00",
+		"10:00-11:00 UTC extra",
+		"10:00-11:00 Mars/Base",
+		"10:00-10:00",
+		"25:00-26:00",
+		"24:30-01:00",
+		"10:60-11:00",
+		"10-11:00",
+		"1O:00-11:00",
+	} {
+		if _, err := parseFeeWindow(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestFeeWindowContains(t *testing.T) {
+	// 2026-10-17 is Saturday, Berlin switches from CEST to CET on 2026-10-25
+	at := func(s string) time.Time {
+		result, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	for _, tc := range []struct {
+		window   string
+		time     string
+		contains bool
+	}{
+		{"Sat,Sun 00:00-24:00 UTC", "2026-10-17 12:00", true},
+		{"Sat,Sun 00:00-24:00 UTC", "2026-10-16 23:59", false},
+		{"Sat,Sun 00:00-24:00 UTC", "2026-10-18 23:59", true},
+		{"Sat,Sun 00:00-24:00 UTC", "2026-10-19 00:00", false},
+		// the window spanning midnight continues on the next day
+		{"Mon-Fri 22:00-06:00 UTC", "2026-10-16 23:00", true},
+		{"Mon-Fri 22:00-06:00 UTC", "2026-10-17 05:59", true},
+		{"Mon-Fri 22:00-06:00 UTC", "2026-10-17 06:00", false},
+		{"Mon-Fri 22:00-06:00 UTC", "2026-10-17 23:00", false},
+		{"Mon-Fri 22:00-06:00 UTC", "2026-10-19 03:00", false},
+		{"Mon-Fri 22:00-06:00 UTC", "2026-10-19 22:00", true},
+		{"Mon-Fri 22:00-06:00 UTC", "2026-10-20 03:00", true},
+		// the day range wraps around the week
+		{"Fri-Mon 10:00-11:00 UTC", "2026-10-18 10:30", true},
+		{"Fri-Mon 10:00-11:00 UTC", "2026-10-19 10:59", true},
+		{"Fri-Mon 10:00-11:00 UTC", "2026-10-21 10:30", false},
+		// Saturday night spans to Sunday across the week boundary
+		{"Sat 23:00-01:00 UTC", "2026-10-18 00:30", true},
+		{"Sun 23:00-01:00 UTC", "2026-10-19 00:30", true},
+		{"Sun 23:00-01:00 UTC", "2026-10-18 00:30", false},
+		// the window is in the timezone of the rule with DST
+		{"22:00-02:00 Europe/Berlin", "2026-10-15 20:30", true},
+		{"22:00-02:00 Europe/Berlin", "2026-10-15 19:30", false},
+		{"22:00-02:00 Europe/Berlin", "2026-10-27 21:30", true},
+		{"22:00-02:00 Europe/Berlin", "2026-10-27 20:30", false},
+		// the day is the day in the timezone of the rule
+		{"Mon 00:00-01:00 Asia/Tokyo", "2026-10-18 15:30", true},
+		{"Mon 00:00-01:00 Asia/Tokyo", "2026-10-19 00:30", false},
+		{"Sun 23:00-24:00 America/New_York", "2026-10-19 03:30", true},
+	} {
+		w, err := parseFeeWindow(tc.window)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.window, err)
+		}
+		if got := w.contains(at(tc.time)); got != tc.contains {
+			t.Errorf("%q at %s UTC: got %v, expected %v", tc.window, tc.time, got, tc.contains)
+		}
+	}
+}
+
+func TestScheduleMultiplier(t *testing.T) {
+	schedule, err := feeSchedule{
+		{Window: "Sat,Sun 00:00-24:00 UTC", Multiplier: 1.5},
+		{Window: "22:00-06:00 UTC", Multiplier: 2},
+		{Window: "12:00-13:00 UTC", Multiplier: 0.5},
+	}.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC)
+	r := &regolancer{feeSchedule: schedule, clock: func() time.Time { return now }}
+	for _, tc := range []struct {
+		time       time.Time
+		multiplier float64
+	}{
+		// the overlapping windows use the max multiplier
+		{time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC), 2},
+		{time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC), 1.5},
+		{time.Date(2026, 10, 15, 12, 30, 0, 0, time.UTC), 0.5},
+		{time.Date(2026, 10, 15, 15, 0, 0, 0, time.UTC), 1},
+	} {
+		if got := r.scheduleMultiplier(tc.time); got != tc.multiplier {
+			t.Errorf("%s: got %g, expected %g", tc.time, got, tc.multiplier)
+		}
+	}
+	if fee := r.scheduleFeeMsat(1000); fee != 1500 || r.feeMultiplier != 1.5 {
+		t.Errorf("expected 1500 msat with 1.5x, got %d with %gx", fee, float64(r.feeMultiplier))
+	}
+	if _, err := (feeSchedule{{Window: "10:00-11:00", Multiplier: 0}}).parse(); err == nil {
+		t.Error("zero multiplier should be rejected")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+var ErrSeesawFeeLimit = fmt.Errorf("seesaw fee limit reached")
+
+type seesawStat struct {
+	count      int
+	amountMsat Msat
+	feesMsat   Msat
+}
+
+// seesawState tracks the fees paid in both directions so that the limits are
+// checked before every payment.
+type seesawState struct {
+	dir int
+	// the total fees when the current direction started
+	feesStart Msat
+	stats     [2]seesawStat
+}
+
+func seesawDirMaxFee(dir int) int64 {
+	if dir == 0 {
+		return params.SeesawMaxFeeFwd
+	}
+	return params.SeesawMaxFeeBack
+}
+
+// checkSeesawBudget makes sure the route fee fits in --seesaw-max-fee and the
+// limit of the current direction.
+func (r *regolancer) checkSeesawBudget(fee Msat) error {
+	s := r.seesaw
+	if s == nil {
+		return nil
+	}
+	current := r.totalFeesMsat - s.feesStart
+	total := s.stats[0].feesMsat + s.stats[1].feesMsat + current
+	if params.SeesawMaxFee > 0 && total+fee > satToMsat(params.SeesawMaxFee) {
+		logErrorF("Route fee %s sat doesn't fit in the seesaw fee limit, spent %s of %d sat, stopping",
+			formatFee(fee), formatFee(total), params.SeesawMaxFee)
+		return ErrSeesawFeeLimit
+	}
+	spent := s.stats[s.dir].feesMsat + current
+	if limit := seesawDirMaxFee(s.dir); limit > 0 && spent+fee > satToMsat(limit) {
+		logErrorF("Route fee %s sat doesn't fit in the seesaw fee limit of this direction, spent %s of %d sat, "+
+			"stopping", formatFee(fee), formatFee(spent), limit)
+		return ErrSeesawFeeLimit
+	}
+	return nil
+}
+
+func parseSeesaw(s string) (chans []string, err error) {
+	chans = strings.Split(s, ",")
+	if len(chans) != 2 {
+		return nil, fmt.Errorf("seesaw should be two channel ids separated by comma, got %s", s)
+	}
+	for i := range chans {
+		chans[i] = strings.TrimSpace(chans[i])
+	}
+	if chans[0] == chans[1] {
+		return nil, fmt.Errorf("seesaw channels should be different")
+	}
+	return
+}
+
+// resetCandidates refreshes the channels and selects only the specified pair.
+func (r *regolancer) resetCandidates(ctx context.Context, from, to uint64) error {
+	err := r.getChannels(ctx)
+	if err != nil {
+		return err
+	}
+	r.fromChannelId = makeChanSet([]uint64{from})
+	r.toChannelId = makeChanSet([]uint64{to})
+	r.fromChannels = r.fromChannels[:0]
+	r.toChannels = r.toChannels[:0]
+	for k := range r.channelPairs {
+		delete(r.channelPairs, k)
+	}
+	for k := range r.failureCache {
+		delete(r.failureCache, k)
+	}
+	// the balances change after every flip so the amount isn't fitted
+	r.amount = params.Amount
+	return r.getChannelCandidates(params.FromPerc, params.ToPerc, params.Amount)
+}
+
+// runSeesaw rebalances between two channels flipping the direction after every
+// successful rebalance.
+func runSeesaw(ctx context.Context, r *regolancer) {
+	chans := convertChanStringToInt(strings.Split(params.Seesaw, ","))
+	r.seesaw = &seesawState{}
+	stats := &r.seesaw.stats
+	defer func() {
+		for dir, s := range stats {
+			from, to := chans[dir], chans[1-dir]
+			log.Printf("%d ⇒ %d: %s rebalances, %s sat moved, %s sat paid in fees", from, to, hiWhiteColor(s.count),
+				formatAmt(s.amountMsat.sats()), formatFee(s.feesMsat))
+		}
+	}()
+	for cycle := 0; cycle < params.SeesawCycles*2; cycle++ {
+		dir := cycle % 2
+		from, to := chans[dir], chans[1-dir]
+		log.Printf("Seesaw cycle %s, %d ⇒ %d", hiWhiteColor(cycle/2+1), from, to)
+		err := r.resetCandidates(ctx, from, to)
+		if err != nil {
+			logErrorF("Error refreshing channels: %s", err)
+			return
+		}
+		if len(r.channelPairs) == 0 {
+			logErrorF("Channel %d can't be used as source or %d as target anymore, stopping", from, to)
+			return
+		}
+		amountMsat := r.totalAmountMsat
+		r.seesaw.dir, r.seesaw.feesStart = dir, r.totalFeesMsat
+		for {
+			r.pace(ctx)
+			r.periodicSaveNodeCache()
+			err, retry := tryRebalance(ctx, r)
+			if ctx.Err() != nil {
+				return
+			}
+			if !retry {
+				if err != nil {
+					return
+				}
+				break
+			}
+		}
+		stats[dir].count++
+		stats[dir].amountMsat += r.totalAmountMsat - amountMsat
+		stats[dir].feesMsat += r.totalFeesMsat - r.seesaw.feesStart
+		r.seesaw.feesStart = r.totalFeesMsat
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestParseSeesaw(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		fail bool
+	}{
+		{"1, 2", false},
+		{"1", true},
+		{"1,2,3", true},
+		{"1,1", true},
+	} {
+		chans, err := parseSeesaw(tc.s)
+		if (err != nil) != tc.fail {
+			t.Errorf("%q: unexpected error %v", tc.s, err)
+		}
+		if err == nil && (chans[0] != "1" || chans[1] != "2") {
+			t.Errorf("%q: got %v", tc.s, chans)
+		}
+	}
+}
+
+// TestSeesawFeeLimits checks that the total and per-direction limits are
+// checked before the payment, counting the fees paid in the current
+// direction so far.
+func TestSeesawFeeLimits(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.MaxTotalFee = 0
+	params.SeesawMaxFee = 10
+	params.SeesawMaxFeeFwd = 6
+	params.SeesawMaxFeeBack = 3
+	for _, tc := range []struct {
+		dir     int
+		fwd     Msat
+		back    Msat
+		current Msat
+		fee     Msat
+		fail    bool
+	}{
+		{0, 0, 0, 0, 6000, false},
+		{0, 0, 0, 0, 6001, true},
+		{0, 4000, 0, 1000, 1000, false},
+		{0, 4000, 0, 1000, 1001, true},
+		{1, 6000, 0, 0, 3000, false},
+		{1, 6000, 2000, 0, 1001, true},
+		{1, 6000, 0, 1000, 2001, true},
+		// the total limit
+		{0, 5000, 3000, 0, 1000, false},
+		{1, 6000, 2000, 1000, 1001, true},
+		{0, 5000, 3000, 1000, 1001, true},
+	} {
+		r := &regolancer{totalFeesMsat: 100000 + tc.current}
+		r.seesaw = &seesawState{dir: tc.dir, feesStart: 100000}
+		r.seesaw.stats[0].feesMsat, r.seesaw.stats[1].feesMsat = tc.fwd, tc.back
+		err := r.checkFeeBudget(tc.fee)
+		if (err != nil) != tc.fail {
+			t.Errorf("%+v: unexpected error %v", tc, err)
+		}
+		if tc.fail && r.feeBudgetErr != ErrSeesawFeeLimit {
+			t.Errorf("%+v: the session should stop, got %v", tc, r.feeBudgetErr)
+		}
+	}
+	params.SeesawMaxFee, params.SeesawMaxFeeFwd, params.SeesawMaxFeeBack = 0, 0, 0
+	r := &regolancer{seesaw: &seesawState{}}
+	if err := r.checkFeeBudget(1000000); err != nil {
+		t.Errorf("no limits are set, got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// paymentSender sends a payment along the specified route and returns the
+// resulting HTLC attempt.
+type paymentSender interface {
+	sendToRoute(ctx context.Context, hash []byte, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error)
+}
+
+type routerSender struct {
+	client routerrpc.RouterClient
+}
+
+func (s *routerSender) sendToRoute(ctx context.Context, hash []byte, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+	return s.client.SendToRouteV2(ctx,
+		&routerrpc.SendToRouteRequest{
+			PaymentHash: hash,
+			Route:       route,
+		})
+}
+
+// legacySender uses the synchronous SendToRoute call of the main lnd service
+// for nodes without the router service.
+type legacySender struct {
+	client lnrpc.LightningClient
+}
+
+func (s *legacySender) sendToRoute(ctx context.Context, hash []byte, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+	resp, err := s.client.SendToRouteSync(ctx, &lnrpc.SendToRouteRequest{
+		PaymentHash: hash,
+		Route:       route,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.PaymentError == paymentInFlight {
+		// the same error as the router service returns
+		return nil, status.Error(codes.AlreadyExists, resp.PaymentError)
+	}
+	if resp.PaymentError == "" {
+		return &lnrpc.HTLCAttempt{
+			Status:   lnrpc.HTLCAttempt_SUCCEEDED,
+			Route:    resp.PaymentRoute,
+			Preimage: resp.PaymentPreimage,
+		}, nil
+	}
+	return &lnrpc.HTLCAttempt{
+		Status:  lnrpc.HTLCAttempt_FAILED,
+		Route:   route,
+		Failure: parsePaymentError(resp.PaymentError),
+	}, nil
+}
+
+// paymentErrorCodes maps the lnd names of the forwarding failures to the codes
+// returned by the router service.
+var paymentErrorCodes = map[string]lnrpc.Failure_FailureCode{
+	"IncorrectOrUnknownPaymentDetails": lnrpc.Failure_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS,
+	"IncorrectPaymentAmount":           lnrpc.Failure_INCORRECT_PAYMENT_AMOUNT,
+	"FinalIncorrectCltvExpiry":         lnrpc.Failure_FINAL_INCORRECT_CLTV_EXPIRY,
+	"FinalIncorrectHtlcAmount":         lnrpc.Failure_FINAL_INCORRECT_HTLC_AMOUNT,
+	"FinalExpiryTooSoon":               lnrpc.Failure_FINAL_EXPIRY_TOO_SOON,
+	"InvalidRealm":                     lnrpc.Failure_INVALID_REALM,
+	"ExpiryTooSoon":                    lnrpc.Failure_EXPIRY_TOO_SOON,
+	"InvalidOnionVersion":              lnrpc.Failure_INVALID_ONION_VERSION,
+	"InvalidOnionHmac":                 lnrpc.Failure_INVALID_ONION_HMAC,
+	"InvalidOnionKey":                  lnrpc.Failure_INVALID_ONION_KEY,
+	"AmountBelowMinimum":               lnrpc.Failure_AMOUNT_BELOW_MINIMUM,
+	"FeeInsufficient":                  lnrpc.Failure_FEE_INSUFFICIENT,
+	"IncorrectCltvExpiry":              lnrpc.Failure_INCORRECT_CLTV_EXPIRY,
+	"ChannelDisabled":                  lnrpc.Failure_CHANNEL_DISABLED,
+	"TemporaryChannelFailure":          lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE,
+	"RequiredNodeFeatureMissing":       lnrpc.Failure_REQUIRED_NODE_FEATURE_MISSING,
+	"RequiredChannelFeatureMissing":    lnrpc.Failure_REQUIRED_CHANNEL_FEATURE_MISSING,
+	"UnknownNextPeer":                  lnrpc.Failure_UNKNOWN_NEXT_PEER,
+	"TemporaryNodeFailure":             lnrpc.Failure_TEMPORARY_NODE_FAILURE,
+	"PermanentNodeFailure":             lnrpc.Failure_PERMANENT_NODE_FAILURE,
+	"PermanentChannelFailure":          lnrpc.Failure_PERMANENT_CHANNEL_FAILURE,
+	"ExpiryTooFar":                     lnrpc.Failure_EXPIRY_TOO_FAR,
+	"MPPTimeout":                       lnrpc.Failure_MPP_TIMEOUT,
+	"InvalidOnionPayload":              lnrpc.Failure_INVALID_ONION_PAYLOAD,
+}
+
+// paymentInFlight is the payment error of lnd if the payment hash is already
+// in flight.
+const paymentInFlight = "payment is in transition"
+
+// parsePaymentError converts lnd forwarding error strings such as
+// "TemporaryChannelFailure(update=...)@2" to the failure structure returned by
+// the router service.
+func parsePaymentError(paymentError string) *lnrpc.Failure {
+	result := &lnrpc.Failure{Code: lnrpc.Failure_UNKNOWN_FAILURE}
+	msg := paymentError
+	if idx := strings.LastIndex(paymentError, "@"); idx >= 0 {
+		if sourceIdx, err := strconv.ParseUint(paymentError[idx+1:], 10, 32); err == nil {
+			result.FailureSourceIndex = uint32(sourceIdx)
+			msg = paymentError[:idx]
+		}
+	}
+	if idx := strings.IndexAny(msg, "( "); idx >= 0 {
+		msg = msg[:idx]
+	}
+	if code, ok := paymentErrorCodes[msg]; ok {
+		result.Code = code
+	}
+	return result
+}
+
+// sendToRoute switches to the legacy sender if the router service isn't
+// available.
+func (r *regolancer) sendToRoute(ctx context.Context, hash []byte, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+	result, err := r.sender.sendToRoute(ctx, hash, route)
+	if !r.legacyRouter && r.routerUnavailable(err) {
+		result, err = r.sender.sendToRoute(ctx, hash, route)
+	}
+	if err == nil && result.Status == lnrpc.HTLCAttempt_FAILED {
+		r.failedHTLCs.add(time.Now())
+	}
+	return result, err
+}
+
+// routerUnavailable reports if the router service call failed because lnd
+// doesn't provide it, the legacy router is used from now on then.
+func (r *regolancer) routerUnavailable(err error) bool {
+	if status.Code(err) != codes.Unimplemented {
+		return false
+	}
+	if !r.legacyRouter {
+		r.useLegacyRouter()
+	}
+	return true
+}
+
+func (r *regolancer) useLegacyRouter() {
+	log.Print(infoColor("Router service is not available, falling back to legacy SendToRoute; " +
+		"the routes are built from the channel policies and the payments are tracked with ListPayments"))
+	r.legacyRouter = true
+	r.sender = &legacySender{client: r.lnClient}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// unimplementedRouter is lnd without the router service.
+type unimplementedRouter struct {
+	routerrpc.RouterClient
+}
+
+var errNoRouter = status.Error(codes.Unimplemented, "unknown service routerrpc.Router")
+
+func (f *unimplementedRouter) SendToRouteV2(ctx context.Context, in *routerrpc.SendToRouteRequest,
+	opts ...grpc.CallOption) (*lnrpc.HTLCAttempt, error) {
+	return nil, errNoRouter
+}
+
+func (f *unimplementedRouter) BuildRoute(ctx context.Context, in *routerrpc.BuildRouteRequest,
+	opts ...grpc.CallOption) (*routerrpc.BuildRouteResponse, error) {
+	return nil, errNoRouter
+}
+
+func (f *unimplementedRouter) TrackPaymentV2(ctx context.Context, in *routerrpc.TrackPaymentRequest,
+	opts ...grpc.CallOption) (routerrpc.Router_TrackPaymentV2Client, error) {
+	return nil, errNoRouter
+}
+
+func (f *unimplementedRouter) QueryMissionControl(ctx context.Context, in *routerrpc.QueryMissionControlRequest,
+	opts ...grpc.CallOption) (*routerrpc.QueryMissionControlResponse, error) {
+	return nil, errNoRouter
+}
+
+func (f *unimplementedRouter) ResetMissionControl(ctx context.Context, in *routerrpc.ResetMissionControlRequest,
+	opts ...grpc.CallOption) (*routerrpc.ResetMissionControlResponse, error) {
+	return nil, errNoRouter
+}
+
+// legacyLightning sends the payments to the pipelineNet with SendToRouteSync
+// and reports them with ListPayments, the failures are returned as the lnd
+// error strings.
+type legacyLightning struct {
+	*fakeLightning
+	net      *pipelineNet
+	payments [][]*lnrpc.Payment
+}
+
+func (l *legacyLightning) SendToRouteSync(ctx context.Context, in *lnrpc.SendToRouteRequest,
+	opts ...grpc.CallOption) (*lnrpc.SendResponse, error) {
+	result, err := l.net.send(ctx, in.PaymentHash, in.Route)
+	if err != nil {
+		return nil, err
+	}
+	if result.Status == lnrpc.HTLCAttempt_SUCCEEDED {
+		return &lnrpc.SendResponse{PaymentRoute: in.Route, PaymentPreimage: []byte("preimage")}, nil
+	}
+	for name, code := range paymentErrorCodes {
+		if code == result.Failure.Code {
+			return &lnrpc.SendResponse{PaymentError: fmt.Sprintf("%s(amt=%d)@%d", name,
+				in.Route.TotalAmtMsat, result.Failure.FailureSourceIndex)}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected failure %s", result.Failure.Code)
+}
+
+func (l *legacyLightning) ListPayments(ctx context.Context, in *lnrpc.ListPaymentsRequest,
+	opts ...grpc.CallOption) (*lnrpc.ListPaymentsResponse, error) {
+	if len(l.payments) == 0 {
+		return &lnrpc.ListPaymentsResponse{}, nil
+	}
+	payments := l.payments[0]
+	if len(l.payments) > 1 {
+		l.payments = l.payments[1:]
+	}
+	return &lnrpc.ListPaymentsResponse{Payments: payments}, nil
+}
+
+func TestParsePaymentError(t *testing.T) {
+	for _, tc := range []struct {
+		err   string
+		code  lnrpc.Failure_FailureCode
+		index uint32
+	}{
+		{err: "TemporaryChannelFailure(update=(*lnwire.ChannelUpdate)(0xc000123456))@2",
+			code: lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE, index: 2},
+		{err: "IncorrectOrUnknownPaymentDetails(amt=1000, height=800000)@3",
+			code: lnrpc.Failure_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS, index: 3},
+		{err: "FeeInsufficient(htlc_amt==1000, update=...)@1", code: lnrpc.Failure_FEE_INSUFFICIENT, index: 1},
+		{err: "UnknownNextPeer@4", code: lnrpc.Failure_UNKNOWN_NEXT_PEER, index: 4},
+		{err: "MPPTimeout@3", code: lnrpc.Failure_MPP_TIMEOUT, index: 3},
+		{err: "ChannelDisabled(flags=00000001, update=...)", code: lnrpc.Failure_CHANNEL_DISABLED},
+		{err: "SomethingNew(x=1)@2", code: lnrpc.Failure_UNKNOWN_FAILURE, index: 2},
+		{err: "unable to find a path to destination", code: lnrpc.Failure_UNKNOWN_FAILURE},
+		{err: "route to user@example@x", code: lnrpc.Failure_UNKNOWN_FAILURE},
+	} {
+		failure := parsePaymentError(tc.err)
+		if failure.Code != tc.code || failure.FailureSourceIndex != tc.index {
+			t.Errorf("%q: expected %s at %d, got %s at %d", tc.err, tc.code, tc.index, failure.Code,
+				failure.FailureSourceIndex)
+		}
+	}
+}
+
+// legacyPipelineTest is pipelineTest on lnd without the router service, the
+// edge 1001 charges fees so the routes are built from the policies.
+func legacyPipelineTest(t *testing.T, liquidity, budget int64) (*regolancer, *pipelineNet) {
+	r, net := pipelineTest(t, liquidity, budget)
+	net.ln.height = 800000
+	net.ln.edges[1001] = &lnrpc.ChannelEdge{ChannelId: 1001, Node1Pub: testPK(1), Node2Pub: testPeerPK,
+		Node1Policy: &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 10, TimeLockDelta: 40},
+		Node2Policy: &lnrpc.RoutingPolicy{}}
+	r.lnClient = &legacyLightning{fakeLightning: net.ln, net: net}
+	r.routerClient = &unimplementedRouter{}
+	r.sender = &routerSender{client: r.routerClient}
+	return r, net
+}
+
+// TestLegacyRouterPipeline checks that probing and rapid rebalance work
+// after falling back to the legacy router.
+func TestLegacyRouterPipeline(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	for _, tc := range []struct {
+		name      string
+		liquidity int64
+		budget    int64
+		setup     func()
+		repeat    bool
+		successes int
+		payments  int
+		probes    int
+		received  int64
+	}{
+		{name: "success", liquidity: 1000000, budget: 1000000, successes: 1, payments: 1, received: 500000},
+		{name: "probed", liquidity: 300000, budget: 1000000, setup: func() { params.ProbeSteps = 2 },
+			repeat: true, payments: 1, probes: 2},
+		{name: "rapid", liquidity: 1000000, budget: 2000000, setup: func() { params.AllowRapidRebalance = true },
+			successes: 2, payments: 2, received: 1000000},
+	} {
+		r, net := legacyPipelineTest(t, tc.liquidity, tc.budget)
+		if tc.setup != nil {
+			tc.setup()
+		}
+		err, repeat := tryRebalance(context.Background(), r)
+		if err != nil || repeat != tc.repeat {
+			t.Errorf("%s: unexpected result %v, repeat %t", tc.name, err, repeat)
+		}
+		if !r.legacyRouter {
+			t.Errorf("%s: the legacy router should be used", tc.name)
+		}
+		if r.successes != tc.successes || net.payments != tc.payments || net.probes != tc.probes {
+			t.Errorf("%s: expected %d successes, %d payments and %d probes, got %d, %d and %d", tc.name,
+				tc.successes, tc.payments, tc.probes, r.successes, net.payments, net.probes)
+		}
+		if received := r.findChannel(2).LocalBalance; received != tc.received {
+			t.Errorf("%s: expected the target to receive %d sats, got %d", tc.name, tc.received, received)
+		}
+	}
+}
+
+// TestLegacyFailedPayment checks that the parsed failure gets to
+// classifyResult and the probed amount is paid along the locally built route.
+func TestLegacyFailedPayment(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	r, net := legacyPipelineTest(t, 300000, 1000000)
+	r.attemptInfo = &attemptInfo{number: 1, start: time.Now()}
+	route := pipelineRoute(1, 500000000)
+	err := r.pay(context.Background(), satToMsat(500000), 0, route, 0)
+	failed, ok := err.(ErrPaymentFailed)
+	if !ok || failed.code != lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE || failed.index != 1 {
+		t.Fatalf("expected the temporary channel failure at hop 1, got %v", err)
+	}
+	a := &rebalanceAttempt{from: 1, to: 2, amount: satToMsat(500000)}
+	if !r.classifyResult(context.Background(), context.Background(), a, route, ErrRetry{amount: satToMsat(250000)}) {
+		t.Fatal("the probed amount should be paid")
+	}
+	if net.payments != 2 || r.successes != 1 || r.findChannel(2).LocalBalance != 250000 {
+		t.Errorf("expected the second payment to deliver 250000 sats, got %d payments, %d successes, %d sats",
+			net.payments, r.successes, r.findChannel(2).LocalBalance)
+	}
+}
+
+func TestBuildLocalRoute(t *testing.T) {
+	a, b := testPK(1), testPK(2)
+	ln := &fakeLightning{height: 1000, edges: map[uint64]*lnrpc.ChannelEdge{
+		1: {ChannelId: 1, Capacity: 5000000, Node1Pub: testMyPK, Node2Pub: a,
+			Node1Policy: &lnrpc.RoutingPolicy{FeeBaseMsat: 9999}, Node2Policy: &lnrpc.RoutingPolicy{}},
+		10: {ChannelId: 10, Capacity: 4000000, Node1Pub: b, Node2Pub: a,
+			Node1Policy: &lnrpc.RoutingPolicy{FeeBaseMsat: 9999},
+			Node2Policy: &lnrpc.RoutingPolicy{FeeBaseMsat: 1000, FeeRateMilliMsat: 1000, TimeLockDelta: 40}},
+		2: {ChannelId: 2, Capacity: 3000000, Node1Pub: b, Node2Pub: testMyPK,
+			Node1Policy: &lnrpc.RoutingPolicy{FeeBaseMsat: 500, FeeRateMilliMsat: 100, TimeLockDelta: 80},
+			Node2Policy: &lnrpc.RoutingPolicy{}},
+	}}
+	r := &regolancer{myPK: testMyPK, lnClient: ln, routerClient: &unimplementedRouter{},
+		chanCache: map[uint64]*lnrpc.ChannelEdge{}, chanCacheTimes: map[uint64]time.Time{}}
+	pks := [][]byte{}
+	for _, pk := range []string{a, b, testMyPK} {
+		data, _ := hex.DecodeString(pk)
+		pks = append(pks, data)
+	}
+	route, err := r.buildRoute(context.Background(), []uint64{1, 10, 2}, pks, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.legacyRouter {
+		t.Error("the legacy router should be used")
+	}
+	// b charges 500+100 for the channel 2, a charges 1000+1000 for the
+	// channel 10 on 1000600 msat
+	expected := []struct {
+		amt, fee int64
+		expiry   uint32
+	}{{1000600, 2000, 1224}, {1000000, 600, 1144}, {1000000, 0, 1144}}
+	for i, hop := range route.Hops {
+		if hop.AmtToForwardMsat != expected[i].amt || hop.FeeMsat != expected[i].fee || hop.Expiry != expected[i].expiry {
+			t.Errorf("hop %d: expected %+v, got %d, %d, %d", i, expected[i], hop.AmtToForwardMsat, hop.FeeMsat,
+				hop.Expiry)
+		}
+	}
+	if route.TotalAmtMsat != 1002600 || route.TotalFeesMsat != 2600 || route.TotalTimeLock != 1264 {
+		t.Errorf("expected 1002600 msat with 2600 fee until 1264, got %d, %d, %d", route.TotalAmtMsat,
+			route.TotalFeesMsat, route.TotalTimeLock)
+	}
+	if route.Hops[1].PubKey != b || route.Hops[1].ChanCapacity != 4000000 || !route.Hops[2].TlvPayload {
+		t.Errorf("unexpected hop %+v", route.Hops[1])
+	}
+	ln.edges[2].Node1Policy = nil
+	r.chanCache = map[uint64]*lnrpc.ChannelEdge{}
+	if _, err := r.buildRoute(context.Background(), []uint64{1, 10, 2}, pks, 1000000); err == nil {
+		t.Error("the route through a channel without policy shouldn't be built")
+	}
+}
+
+// TestLegacyPaymentTracking checks that the in-flight payment is tracked with
+// ListPayments after TrackPaymentV2 fails.
+func TestLegacyPaymentTracking(t *testing.T) {
+	defer func(interval time.Duration) { paymentPollInterval = interval }(paymentPollInterval)
+	paymentPollInterval = time.Millisecond
+	hash := []byte("hash")
+	other := &lnrpc.Payment{PaymentHash: hex.EncodeToString([]byte("other")), Status: lnrpc.Payment_FAILED}
+	ln := &legacyLightning{fakeLightning: &fakeLightning{}, payments: [][]*lnrpc.Payment{
+		{other, {PaymentHash: hex.EncodeToString(hash), Status: lnrpc.Payment_IN_FLIGHT}},
+		{other, {PaymentHash: hex.EncodeToString(hash), Status: lnrpc.Payment_SUCCEEDED, FeeMsat: 1000}},
+	}}
+	r := &regolancer{lnClient: ln, routerClient: &unimplementedRouter{}}
+	payment, err := r.paymentResult(context.Background(), hash)
+	if err != nil || payment.Status != lnrpc.Payment_SUCCEEDED || payment.FeeMsat != 1000 {
+		t.Fatalf("expected the succeeded payment, got %v, %v", payment, err)
+	}
+	if !r.legacyRouter {
+		t.Error("the legacy router should be used")
+	}
+	if _, err := r.paymentResult(context.Background(), []byte("unknown")); err == nil {
+		t.Error("the unknown payment shouldn't be tracked")
+	}
+}
+
+// TestMissionControlWithoutRouter checks that the mission control calls at
+// startup switch to the legacy router.
+func TestMissionControlWithoutRouter(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	dir := t.TempDir()
+	params.NodeCacheFilename = filepath.Join(dir, "nodes.dat")
+	r := &regolancer{myPK: testMyPK, lnClient: &fakeLightning{}, routerClient: &unimplementedRouter{}}
+	if err := r.resetMissionControl(context.Background()); err != ErrNoMissionControl {
+		t.Fatalf("expected ErrNoMissionControl, got %v", err)
+	}
+	if _, ok := r.sender.(*legacySender); !ok || !r.legacyRouter {
+		t.Error("the legacy router should be used")
+	}
+	if err := r.exportMissionControl(context.Background(), filepath.Join(dir, "mc.json")); err != ErrNoMissionControl {
+		t.Errorf("expected ErrNoMissionControl, got %v", err)
+	}
+	r = &regolancer{myPK: testMyPK, lnClient: &fakeLightning{}, routerClient: &unimplementedRouter{}}
+	if err := r.exportMissionControl(context.Background(), filepath.Join(dir, "mc.json")); err != ErrNoMissionControl ||
+		!r.legacyRouter {
+		t.Errorf("expected the export to fall back to the legacy router, got %v", err)
+	}
+}
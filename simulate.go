@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+type econSimulation struct {
+	allowed       int
+	allowedMsat   Msat
+	allowedFees   Msat
+	rejected      int
+	rejectedMsat  Msat
+	rejectedFees  Msat
+	skipped       int
+	rejectedPairs map[[2]uint64]int
+}
+
+// simulateEcon recomputes the max fee of every successful rebalance in the
+// stat file with the current channel policies and fee parameters, it uses the
+// same functions as the actual rebalance. The fee schedule is applied at the
+// time of the rebalance, the other inputs (policies, balances for
+// --fee-limit-scale) are current.
+func (r *regolancer) simulateEcon(ctx context.Context) error {
+	records, err := readStatFile(params.StatFilename)
+	if err != nil {
+		return err
+	}
+	sim, err := r.replayEcon(ctx, records)
+	if err != nil {
+		return err
+	}
+	r.printEconSimulation(len(records), sim)
+	return nil
+}
+
+// replayEcon checks the fees of the recorded rebalances against the max fee
+// calculated at their time.
+func (r *regolancer) replayEcon(ctx context.Context, records []statRecord) (econSimulation, error) {
+	clock := r.clock
+	defer func() {
+		r.clock = clock
+	}()
+	sim := econSimulation{rejectedPairs: map[[2]uint64]int{}}
+	for _, rec := range records {
+		ts := time.Unix(rec.Timestamp, 0)
+		r.clock = func() time.Time { return ts }
+		amtMsat := Msat(rec.AmountMsat)
+		infoCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(params.TimeoutInfo))
+		feeMsat, _, _, err := r.calcFeeMsat(infoCtx, rec.FromChannel, rec.ToChannel, amtMsat)
+		cancel()
+		if ctx.Err() != nil {
+			return sim, ctx.Err()
+		}
+		if err != nil {
+			// the channel was closed or has no policy
+			sim.skipped++
+			continue
+		}
+		if Msat(rec.FeesMsat) > feeMsat {
+			sim.rejected++
+			sim.rejectedMsat += amtMsat
+			sim.rejectedFees += Msat(rec.FeesMsat)
+			sim.rejectedPairs[[2]uint64{rec.FromChannel, rec.ToChannel}]++
+			continue
+		}
+		sim.allowed++
+		sim.allowedMsat += amtMsat
+		sim.allowedFees += Msat(rec.FeesMsat)
+	}
+	return sim, nil
+}
+
+func (r *regolancer) printEconSimulation(total int, sim econSimulation) {
+	log.Printf("Simulated %s successful rebalances from %s with the current parameters:", hiWhiteColor(total),
+		params.StatFilename)
+	log.Printf("  allowed: %s rebalances, %s sats paying %s sats in fees (%s ppm)", hiWhiteColor(sim.allowed),
+		hiWhiteColor(sim.allowedMsat.sats()), formatFee(sim.allowedFees), formatFeePPM(sim.allowedMsat, sim.allowedFees))
+	log.Printf("  rejected: %s rebalances, %s sats, %s sats in fees saved (%s ppm)", hiWhiteColor(sim.rejected),
+		hiWhiteColor(sim.rejectedMsat.sats()), formatFee(sim.rejectedFees),
+		formatFeePPM(sim.rejectedMsat, sim.rejectedFees))
+	if sim.skipped > 0 {
+		log.Printf("  skipped: %s rebalances of the closed channels or channels without policies",
+			hiWhiteColor(sim.skipped))
+	}
+	pairs := [][2]uint64{}
+	for pair := range sim.rejectedPairs {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return sim.rejectedPairs[pairs[i]] > sim.rejectedPairs[pairs[j]]
+	})
+	for _, pair := range pairs {
+		log.Printf("  %s rejected %s times", r.pairLabel(context.Background(), pair[0], pair[1]),
+			hiWhiteColor(sim.rejectedPairs[pair]))
+	}
+}
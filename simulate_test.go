@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestReadStatFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "stat.csv")
+	// the files written by the older versions have fewer columns
+	old := "timestamp,from_channel,to_channel,amount_msat,fees_msat\n1700000000,1,2,1000000,400\n\n" +
+		"1700000060,3,2,2000000,900\n"
+	if err := os.WriteFile(filename, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := readStatFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[1].FromChannel != 3 || recs[1].AmountMsat != 2000000 || recs[1].FeesMsat != 900 {
+		t.Errorf("unexpected records %+v", recs)
+	}
+	for _, content := range []string{
+		"",
+		"timestamp,from_channel,to_channel,amount_msat\n",
+		"timestamp,from_channel,to_channel,amount_msat,fees_msat\n1700000000,1,2,1000000\n",
+		"timestamp,from_channel,to_channel,amount_msat,fees_msat\n1700000000,x,2,1000000,400\n",
+		"timestamp,from_channel,to_channel,amount_msat,fees_msat\n1700000000,1,2,1e6,400\n",
+	} {
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readStatFile(filename); err == nil {
+			t.Errorf("%q should fail", content)
+		}
+	}
+}
+
+// TestSimulateEcon replays the stat file with the fixed ppm limit, the econ
+// ratio and the fee schedule at the time of the rebalance.
+func TestSimulateEcon(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	r, ln := newRouteTest(nil)
+	ln.edges[2].Node2Policy = &lnrpc.RoutingPolicy{FeeRateMilliMsat: 1000}
+	r.statFilename = filepath.Join(t.TempDir(), "stat.csv")
+	// 2023-11-14 22:13:20 UTC is Tuesday
+	tuesdayNight := int64(1700000000)
+	for _, rec := range []statRecord{
+		{Timestamp: tuesdayNight + 3600*12, FromChannel: 1, ToChannel: 2, AmountMsat: 1000000, FeesMsat: 400},
+		{Timestamp: tuesdayNight, FromChannel: 1, ToChannel: 2, AmountMsat: 1000000, FeesMsat: 900},
+		{Timestamp: tuesdayNight + 3600*12, FromChannel: 1, ToChannel: 2, AmountMsat: 1000000, FeesMsat: 1500},
+		// the closed channel is skipped
+		{Timestamp: tuesdayNight, FromChannel: 1, ToChannel: 9, AmountMsat: 1000000, FeesMsat: 100},
+		// the failed attempts aren't rebalances
+		{Timestamp: tuesdayNight, FromChannel: 1, ToChannel: 2, AmountMsat: 1000000, FeesMsat: 5000,
+			FailureStage: failureStagePayment},
+	} {
+		r.writeStat(rec)
+	}
+	records, err := readStatFile(r.statFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expected 4 rebalances, got %d", len(records))
+	}
+	schedule, err := feeSchedule{{Window: "Tue 22:00-23:00 UTC", Multiplier: 2}}.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name             string
+		feeLimitPPM      int64
+		econRatio        float64
+		schedule         []scheduledFee
+		allowed          int
+		rejected         int
+		allowedFees      Msat
+		rejectedFees     Msat
+		rejectedFromPair int
+	}{
+		{"fee limit ppm", 1000, 0, nil, 2, 1, 1300, 1500, 1},
+		{"econ ratio", 0, 0.5, nil, 1, 2, 400, 2400, 2},
+		{"econ ratio with schedule", 0, 0.5, schedule, 2, 1, 1300, 1500, 1},
+	} {
+		params.FeeLimitPPM, params.EconRatio = tc.feeLimitPPM, tc.econRatio
+		r.feeSchedule = tc.schedule
+		r.chanCache = map[uint64]*lnrpc.ChannelEdge{}
+		sim, err := r.replayEcon(context.Background(), records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sim.allowed != tc.allowed || sim.rejected != tc.rejected || sim.skipped != 1 ||
+			sim.allowedFees != tc.allowedFees || sim.rejectedFees != tc.rejectedFees ||
+			sim.rejectedMsat != Msat(tc.rejected)*1000000 || sim.rejectedPairs[[2]uint64{1, 2}] != tc.rejectedFromPair {
+			t.Errorf("%s: unexpected simulation %+v", tc.name, sim)
+		}
+	}
+	if time.Since(r.now()) > time.Minute {
+		t.Error("the clock should be restored after the simulation")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const snapshotVersion = 1
+
+var ErrOffline = errors.New("not available in offline mode")
+
+// channelSnapshot is our channels with their policies and peers saved with
+// --channels-snapshot, --offline reads it instead of querying lnd. It's plain
+// JSON using the lnd field names so it can be edited by hand or used as a
+// fixture.
+type channelSnapshot struct {
+	Version        int                  `json:"version"`
+	Created        time.Time            `json:"created"`
+	IdentityPubkey string               `json:"identity_pubkey"`
+	BlockHeight    uint32               `json:"block_height"`
+	Channels       []*lnrpc.Channel     `json:"channels"`
+	Edges          []*lnrpc.ChannelEdge `json:"edges"`
+	Peers          []*lnrpc.NodeInfo    `json:"peers"`
+}
+
+func readChannelSnapshot(rd io.Reader) (*channelSnapshot, error) {
+	result := &channelSnapshot{}
+	err := json.NewDecoder(rd).Decode(result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d, expected %d", result.Version, snapshotVersion)
+	}
+	if result.IdentityPubkey == "" {
+		return nil, errors.New("snapshot has no identity_pubkey")
+	}
+	return result, nil
+}
+
+func loadChannelSnapshot(filename string) (*channelSnapshot, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readChannelSnapshot(f)
+}
+
+// saveChannelSnapshot writes our channels, their edges and the peer info to
+// the file.
+func (r *regolancer) saveChannelSnapshot(ctx context.Context, filename string, blockHeight uint32) error {
+	snapshot := channelSnapshot{
+		Version:        snapshotVersion,
+		Created:        time.Now(),
+		IdentityPubkey: r.myPK,
+		BlockHeight:    blockHeight,
+		Channels:       r.channels,
+	}
+	peers := map[string]struct{}{}
+	for _, c := range r.channels {
+		edge, err := r.getChanInfo(ctx, c.ChanId)
+		if err != nil {
+			return fmt.Errorf("error getting channel %d info: %s", c.ChanId, err)
+		}
+		snapshot.Edges = append(snapshot.Edges, edge)
+		if _, ok := peers[c.RemotePubkey]; ok {
+			continue
+		}
+		peers[c.RemotePubkey] = struct{}{}
+		if nodeInfo, err := r.getNodeInfo(ctx, c.RemotePubkey); err == nil {
+			snapshot.Peers = append(snapshot.Peers, compactNodeInfo(nodeInfo))
+		}
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(snapshot)
+	if err != nil {
+		return err
+	}
+	log.Printf("Saved %s channels to snapshot %s", hiWhiteColor(len(snapshot.Channels)), filename)
+	return nil
+}
+
+// offlineClient serves the lnd calls needed to select the channel candidates
+// from the snapshot. Route queries, invoices and other calls that need the
+// node fail with ErrOffline.
+type offlineClient struct {
+	lnrpc.LightningClient
+	snapshot *channelSnapshot
+}
+
+func newOfflineClient(snapshot *channelSnapshot) *offlineClient {
+	return &offlineClient{snapshot: snapshot}
+}
+
+func (c *offlineClient) GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.GetInfoResponse, error) {
+	return &lnrpc.GetInfoResponse{IdentityPubkey: c.snapshot.IdentityPubkey, BlockHeight: c.snapshot.BlockHeight}, nil
+}
+
+func (c *offlineClient) ListChannels(ctx context.Context, in *lnrpc.ListChannelsRequest,
+	opts ...grpc.CallOption) (*lnrpc.ListChannelsResponse, error) {
+	result := &lnrpc.ListChannelsResponse{}
+	peer := hex.EncodeToString(in.Peer)
+	for _, ch := range c.snapshot.Channels {
+		if in.ActiveOnly && !ch.Active || in.PublicOnly && ch.Private {
+			continue
+		}
+		if len(in.Peer) > 0 && ch.RemotePubkey != peer {
+			continue
+		}
+		result.Channels = append(result.Channels, ch)
+	}
+	return result, nil
+}
+
+func (c *offlineClient) GetChanInfo(ctx context.Context, in *lnrpc.ChanInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.ChannelEdge, error) {
+	for _, e := range c.snapshot.Edges {
+		if e.ChannelId == in.ChanId {
+			return e, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "channel %d is not in the snapshot", in.ChanId)
+}
+
+func (c *offlineClient) GetNodeInfo(ctx context.Context, in *lnrpc.NodeInfoRequest,
+	opts ...grpc.CallOption) (*lnrpc.NodeInfo, error) {
+	for _, p := range c.snapshot.Peers {
+		if p.Node != nil && p.Node.PubKey == in.PubKey {
+			return p, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "node %s is not in the snapshot", in.PubKey)
+}
+
+// PendingChannels returns nothing as the snapshot only has open channels.
+func (c *offlineClient) PendingChannels(ctx context.Context, in *lnrpc.PendingChannelsRequest,
+	opts ...grpc.CallOption) (*lnrpc.PendingChannelsResponse, error) {
+	return &lnrpc.PendingChannelsResponse{}, nil
+}
+
+func (c *offlineClient) QueryRoutes(ctx context.Context, in *lnrpc.QueryRoutesRequest,
+	opts ...grpc.CallOption) (*lnrpc.QueryRoutesResponse, error) {
+	return nil, fmt.Errorf("route query is %s", ErrOffline)
+}
+
+func (c *offlineClient) AddInvoice(ctx context.Context, in *lnrpc.Invoice,
+	opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+	return nil, fmt.Errorf("invoice creation is %s", ErrOffline)
+}
+
+func (c *offlineClient) ForwardingHistory(ctx context.Context, in *lnrpc.ForwardingHistoryRequest,
+	opts ...grpc.CallOption) (*lnrpc.ForwardingHistoryResponse, error) {
+	return nil, fmt.Errorf("forwarding history is %s", ErrOffline)
+}
+
+func (c *offlineClient) FeeReport(ctx context.Context, in *lnrpc.FeeReportRequest,
+	opts ...grpc.CallOption) (*lnrpc.FeeReportResponse, error) {
+	return nil, fmt.Errorf("fee report is %s", ErrOffline)
+}
+
+func (c *offlineClient) DescribeGraph(ctx context.Context, in *lnrpc.ChannelGraphRequest,
+	opts ...grpc.CallOption) (*lnrpc.ChannelGraph, error) {
+	return nil, fmt.Errorf("graph is %s", ErrOffline)
+}
+
+type offlineSender struct{}
+
+func (offlineSender) sendToRoute(ctx context.Context, hash []byte, route *lnrpc.Route) (*lnrpc.HTLCAttempt, error) {
+	return nil, fmt.Errorf("payment is %s", ErrOffline)
+}
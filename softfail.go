@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	// the pairs are still picked with this weight no matter how often they failed
+	softFailureMinWeight = 0.01
+	// penalties that decayed below this value are forgotten
+	softFailureForget = 0.01
+	// the pairs that failed this many times within about a half-life are put
+	// in the failure cache as without --soft-failure-decay so that the session
+	// ends when nothing works
+	softFailureMaxPenalty = 3
+	// number of the lowest weights shown in the summary
+	softFailureShown = 10
+)
+
+// softFailure is the penalty of a channel pair that failed to route with
+// --soft-failure-decay, every failure adds 1 and the sum halves every
+// --soft-failure-half-life minutes.
+type softFailure struct {
+	penalty float64
+	updated time.Time
+	reason  failReason
+}
+
+// softFailureCode reports if the failure is subject to the decaying penalty.
+// The other failures depend on the local channel state that doesn't change
+// until the channels are refreshed, they're excluded as usual.
+func softFailureCode(code string) bool {
+	return code == failNoRoute || code == failNotEnoughRoutes
+}
+
+func (r *regolancer) softPenalty(k string, now time.Time) float64 {
+	f, ok := r.softFailures[k]
+	if !ok {
+		return 0
+	}
+	halfLife := time.Minute * time.Duration(params.SoftFailureHalfLife)
+	return f.penalty * math.Pow(0.5, float64(now.Sub(f.updated))/float64(halfLife))
+}
+
+// pairWeight is the relative chance of the channel pair to be picked.
+func (r *regolancer) pairWeight(k string, now time.Time) float64 {
+	return math.Max(softFailureMinWeight, 1-r.softPenalty(k, now))
+}
+
+// addSoftFailure penalizes the pair, the result is false if the penalty
+// reached softFailureMaxPenalty and the pair should be excluded instead.
+func (r *regolancer) addSoftFailure(from, to uint64, code string, chanId uint64) bool {
+	now := r.now()
+	k := formatChannelPair(from, to)
+	reason := failReason{code: code, chanId: chanId, time: now}
+	penalty := r.softPenalty(k, now) + 1
+	r.softFailures[k] = softFailure{penalty: penalty, updated: now, reason: reason}
+	if penalty >= softFailureMaxPenalty {
+		return false
+	}
+	if r.failureCacheStats.reasons == nil {
+		r.failureCacheStats.reasons = map[string]int{}
+	}
+	r.failureCacheStats.reasons[code]++
+	r.tallyRouteFailure(from, to, code)
+	log.Print(faintWhiteColor(fmt.Sprintf("Penalizing %s → %s: %s, weight %.2f", formatScid(from), formatScid(to),
+		reason, r.pairWeight(k, now))))
+	return true
+}
+
+// pickWeightedPair picks a random pair, the pairs that failed recently are
+// less likely to be picked.
+func (r *regolancer) pickWeightedPair(pairs [][2]*lnrpc.Channel) [2]*lnrpc.Channel {
+	if len(r.softFailures) == 0 {
+		return pairs[rand.Intn(len(pairs))]
+	}
+	now := r.now()
+	weights := make([]float64, len(pairs))
+	total := 0.0
+	for i, pair := range pairs {
+		weights[i] = r.pairWeight(formatChannelPair(pair[0].ChanId, pair[1].ChanId), now)
+		total += weights[i]
+	}
+	n := rand.Float64() * total
+	for i, w := range weights {
+		if n < w {
+			if w < 1 {
+				log.Print(faintWhiteColor(fmt.Sprintf("Picked penalized pair %s → %s, weight %.2f of %.2f total",
+					formatScid(pairs[i][0].ChanId), formatScid(pairs[i][1].ChanId), w, total)))
+			}
+			return pairs[i]
+		}
+		n -= w
+	}
+	return pairs[len(pairs)-1]
+}
+
+// expireSoftFailures forgets the penalties that have decayed.
+func (r *regolancer) expireSoftFailures() {
+	now := r.now()
+	for k := range r.softFailures {
+		if r.softPenalty(k, now) < softFailureForget {
+			delete(r.softFailures, k)
+		}
+	}
+}
+
+func (r *regolancer) printSoftFailures() {
+	if len(r.softFailures) == 0 {
+		return
+	}
+	now := r.now()
+	keys := []string{}
+	for k := range r.softFailures {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		wi, wj := r.pairWeight(keys[i], now), r.pairWeight(keys[j], now)
+		return wi < wj || wi == wj && keys[i] < keys[j]
+	})
+	weights := []string{}
+	for i, k := range keys {
+		if i == softFailureShown {
+			weights = append(weights, fmt.Sprintf("%d more", len(keys)-i))
+			break
+		}
+		weights = append(weights, fmt.Sprintf("%s %s", k, hiWhiteColorF("%.2f", r.pairWeight(k, now))))
+	}
+	log.Printf("Penalized pairs: %s, weights: %s", hiWhiteColor(len(keys)), strings.Join(weights, ", "))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	softTestFailed  = 20
+	softTestHealthy = 5
+	// picks per simulated minute
+	softTestPicks = 600
+)
+
+// softFailureTest creates the candidates, the first softTestFailed pairs fail
+// at the start of the simulation.
+func softFailureTest(now *time.Time) *regolancer {
+	r := &regolancer{
+		channelPairs: map[string][2]*lnrpc.Channel{},
+		failureCache: map[string]failedRoute{},
+		softFailures: map[string]softFailure{},
+		clock:        func() time.Time { return *now },
+	}
+	for i := uint64(1); i <= softTestFailed+softTestHealthy; i++ {
+		from := &lnrpc.Channel{ChanId: i, LocalBalance: 1000000, RemoteBalance: 1000000, Capacity: 2000000}
+		to := &lnrpc.Channel{ChanId: i + 100, LocalBalance: 1000000, RemoteBalance: 1000000, Capacity: 2000000}
+		r.channelPairs[formatChannelPair(from.ChanId, to.ChanId)] = [2]*lnrpc.Channel{from, to}
+	}
+	for i := uint64(1); i <= softTestFailed; i++ {
+		r.addFailedRoute(i, i+100, failNoRoute, 0)
+	}
+	return r
+}
+
+// retryShares simulates the picks for the given number of minutes and returns
+// the share of the picks that went to the failed pairs every minute.
+func retryShares(t *testing.T, soft bool, minutes int) []float64 {
+	defer func(p configParams) { params = p }(params)
+	params.FailedRouteTTL, params.SoftFailureHalfLife, params.FailureCacheSize = 5, 5, 1000
+	params.SoftFailureDecay = soft
+	rand.Seed(1)
+	now := time.Unix(1700000000, 0)
+	r := softFailureTest(&now)
+	shares := []float64{}
+	for m := 0; m < minutes; m++ {
+		retries := 0
+		for i := 0; i < softTestPicks; i++ {
+			now = now.Add(time.Minute / softTestPicks)
+			from, _, _, err := r.pickChannelPair(satToMsat(1000), 0, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from <= softTestFailed {
+				retries++
+			}
+		}
+		shares = append(shares, float64(retries)/softTestPicks)
+	}
+	return shares
+}
+
+func maxStep(shares []float64) float64 {
+	step := shares[0]
+	for i := 1; i < len(shares); i++ {
+		if d := shares[i] - shares[i-1]; d > step {
+			step = d
+		}
+	}
+	return step
+}
+
+// TestSoftFailureRetries compares how the failed pairs are retried: the hard
+// cache returns all of them at once after the expiration while the decaying
+// penalty spreads the retries over time.
+func TestSoftFailureRetries(t *testing.T) {
+	hard := retryShares(t, false, 12)
+	soft := retryShares(t, true, 12)
+	t.Logf("hard: %.2f", hard)
+	t.Logf("soft: %.2f", soft)
+	if hard[0] != 0 || maxStep(hard) < 0.6 {
+		t.Errorf("the hard cache should exclude the failed pairs and then return them all at once")
+	}
+	if soft[0] == 0 {
+		t.Errorf("the penalized pairs should still be picked sometimes")
+	}
+	if maxStep(soft) > 0.3 {
+		t.Errorf("the retries should ramp up gradually, max step %.2f", maxStep(soft))
+	}
+	if soft[len(soft)-1] < 0.6 {
+		t.Errorf("the penalties should decay, the failed pairs got %.2f of the picks", soft[len(soft)-1])
+	}
+}
+
+// TestSoftFailureStop makes sure the session ends when every pair keeps
+// failing instead of retrying the penalized pairs until the timeout.
+func TestSoftFailureStop(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FailedRouteTTL, params.SoftFailureHalfLife, params.FailureCacheSize = 5, 5, 1000
+	params.SoftFailureDecay = true
+	now := time.Unix(1700000000, 0)
+	r := softFailureTest(&now)
+	for i := 0; i < 1000; i++ {
+		now = now.Add(time.Second)
+		from, to, _, err := r.pickChannelPair(satToMsat(1000), 0, 0, 0)
+		if err != nil {
+			if len(r.failureCache) != softTestFailed+softTestHealthy {
+				t.Errorf("all pairs should be excluded, %d are", len(r.failureCache))
+			}
+			return
+		}
+		r.addFailedRoute(from, to, failNoRoute, 0)
+	}
+	t.Error("the session didn't end although every pair fails")
+}
+
+func TestSoftFailureDecay(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.SoftFailureHalfLife = 10
+	now := time.Unix(1700000000, 0)
+	r := &regolancer{softFailures: map[string]softFailure{}, clock: func() time.Time { return now }}
+	if !r.addSoftFailure(1, 2, failNoRoute, 0) {
+		t.Fatal("the first failure should only penalize the pair")
+	}
+	for _, tc := range []struct {
+		after  time.Duration
+		weight float64
+	}{{0, softFailureMinWeight}, {10 * time.Minute, 0.5}, {20 * time.Minute, 0.75}} {
+		if w := r.pairWeight("1-2", now.Add(tc.after)); w < tc.weight-0.001 || w > tc.weight+0.001 {
+			t.Errorf("after %s: weight %.3f, expected %.3f", tc.after, w, tc.weight)
+		}
+	}
+	r.addSoftFailure(1, 2, failNoRoute, 0)
+	if r.addSoftFailure(1, 2, failNoRoute, 0) {
+		t.Error("the third failure in a row should exclude the pair")
+	}
+	now = now.Add(2 * time.Hour)
+	r.expireSoftFailures()
+	if len(r.softFailures) != 0 {
+		t.Error("the decayed penalty should be forgotten")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// sourceRule makes the channel a source only when its local balance exceeds
+// the ceiling percentage, the amount is then capped to bring it down to the
+// floor percentage (the ceiling if not set).
+type sourceRule struct {
+	Ceiling int64 `json:"ceiling" toml:"ceiling"`
+	Floor   int64 `json:"floor" toml:"floor"`
+}
+
+// sourceRules maps channel or node ids to the rules.
+type sourceRules map[string]sourceRule
+
+func (s sourceRule) validate() error {
+	if s.Ceiling <= 0 || s.Ceiling > 100 {
+		return fmt.Errorf("ceiling should be between 1 and 100, got %d", s.Ceiling)
+	}
+	if s.Floor < 0 || s.Floor > s.Ceiling {
+		return fmt.Errorf("floor should be between 0 and the ceiling %d, got %d", s.Ceiling, s.Floor)
+	}
+	return nil
+}
+
+func (s sourceRule) floor() int64 {
+	if s.Floor == 0 {
+		return s.Ceiling
+	}
+	return s.Floor
+}
+
+// triggered reports if the channel local balance is above the ceiling.
+func (s sourceRule) triggered(localBalance, capacity int64) bool {
+	return localBalance > capacity*s.Ceiling/100
+}
+
+// maxAmount is the amount that brings the local balance down to the floor.
+func (s sourceRule) maxAmount(localBalance, capacity int64) int64 {
+	return localBalance - capacity*s.floor()/100
+}
+
+// resolveSourceRules maps the rules specified by channel or node id to our
+// channels, a channel rule takes precedence over the rule of its peer.
+func (r *regolancer) resolveSourceRules() error {
+	r.sourceRules = map[uint64]sourceRule{}
+	if len(params.SourceRules) == 0 {
+		return nil
+	}
+	ids := []string{}
+	for id := range params.SourceRules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	byChan := map[uint64]sourceRule{}
+	byNode := map[string]sourceRule{}
+	for _, id := range ids {
+		rule := params.SourceRules[id]
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("source rule for %s: %s", id, err)
+		}
+		chans, nodes, err := parseNodeChannelIDs([]string{id})
+		if err != nil {
+			return fmt.Errorf("source rule for %s: %s", id, err)
+		}
+		for chanId := range chans {
+			byChan[chanId] = rule
+		}
+		for _, pk := range nodes {
+			byNode[hex.EncodeToString(pk)] = rule
+		}
+	}
+	for _, c := range r.channels {
+		rule, ok := byChan[c.ChanId]
+		if !ok {
+			rule, ok = byNode[c.RemotePubkey]
+		}
+		if !ok {
+			continue
+		}
+		r.sourceRules[c.ChanId] = rule
+		state := "not triggered"
+		if rule.triggered(c.LocalBalance, c.Capacity) {
+			state = "triggered"
+		}
+		log.Printf("Source rule for channel %s: ceiling %s%%, floor %s%%, local balance %s%%, %s", hiWhiteColor(c.ChanId),
+			hiWhiteColor(rule.Ceiling), hiWhiteColor(rule.floor()), hiWhiteColor(c.LocalBalance*100/c.Capacity), state)
+	}
+	return nil
+}
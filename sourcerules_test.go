@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestSourceRule(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		rule      sourceRule
+		local     int64
+		valid     bool
+		triggered bool
+		max       int64
+	}{
+		{"above the ceiling", sourceRule{Ceiling: 80, Floor: 60}, 900000, true, true, 300000},
+		{"at the ceiling", sourceRule{Ceiling: 80, Floor: 60}, 800000, true, false, 200000},
+		{"below the ceiling", sourceRule{Ceiling: 80, Floor: 60}, 700000, true, false, 100000},
+		// without the floor the amount only brings the channel to the ceiling
+		{"no floor", sourceRule{Ceiling: 50}, 600000, true, true, 100000},
+		{"floor at the ceiling", sourceRule{Ceiling: 50, Floor: 50}, 600000, true, true, 100000},
+		{"no ceiling", sourceRule{}, 600000, false, false, 0},
+		{"ceiling over 100", sourceRule{Ceiling: 120}, 600000, false, false, 0},
+		{"floor over the ceiling", sourceRule{Ceiling: 50, Floor: 60}, 600000, false, false, 0},
+		{"negative floor", sourceRule{Ceiling: 50, Floor: -1}, 600000, false, false, 0},
+	} {
+		if err := tc.rule.validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: unexpected validation result %v", tc.name, err)
+		}
+		if !tc.valid {
+			continue
+		}
+		if triggered := tc.rule.triggered(tc.local, 1000000); triggered != tc.triggered {
+			t.Errorf("%s: expected triggered %t, got %t", tc.name, tc.triggered, triggered)
+		}
+		if max := tc.rule.maxAmount(tc.local, 1000000); max != tc.max {
+			t.Errorf("%s: expected the max amount %d, got %d", tc.name, tc.max, max)
+		}
+	}
+}
+
+func TestSourceRulesCandidates(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.SourceRules = sourceRules{
+		"1":        {Ceiling: 80, Floor: 60},
+		testPK(2):  {Ceiling: 80},
+		"3":        {Ceiling: 50},
+		testPK(10): {Ceiling: 50},
+	}
+	channel := func(id uint64, peer int, local int64) *lnrpc.Channel {
+		return &lnrpc.Channel{ChanId: id, RemotePubkey: testPK(peer), Capacity: 1000000, LocalBalance: local,
+			RemoteBalance: 1000000 - local}
+	}
+	r := &regolancer{
+		channels: []*lnrpc.Channel{
+			channel(1, 1, 900000),
+			// the global --pfrom would make it a source
+			channel(2, 2, 700000),
+			// the channel rule takes precedence over the peer rule
+			channel(3, 2, 600000),
+			channel(4, 4, 700000),
+			channel(5, 5, 0),
+		},
+		channelPairs: map[string][2]*lnrpc.Channel{},
+	}
+	if err := r.resolveSourceRules(); err != nil {
+		t.Fatal(err)
+	}
+	expectedRules := map[uint64]sourceRule{1: {Ceiling: 80, Floor: 60}, 2: {Ceiling: 80}, 3: {Ceiling: 50}}
+	if !reflect.DeepEqual(r.sourceRules, expectedRules) {
+		t.Errorf("expected the rules %v, got %v", expectedRules, r.sourceRules)
+	}
+	if err := r.getChannelCandidates(50, 50, 0); err != nil {
+		t.Fatal(err)
+	}
+	from := []uint64{}
+	for _, c := range r.fromChannels {
+		from = append(from, c.ChanId)
+	}
+	if !reflect.DeepEqual(from, []uint64{1, 3, 4}) {
+		t.Errorf("expected the sources 1, 3 and 4, got %v", from)
+	}
+
+	for _, tc := range []struct {
+		from   uint64
+		amount int64
+		max    int64
+	}{
+		{1, 0, 300000},
+		{1, 200000, 200000},
+		{3, 0, 100000},
+		// the channels without rules aren't capped
+		{4, 0, 700000},
+	} {
+		r.channelPairs = map[string][2]*lnrpc.Channel{
+			formatChannelPair(tc.from, 5): {r.findChannel(tc.from), r.findChannel(5)},
+		}
+		_, _, max, err := r.pickChannelPair(satToMsat(tc.amount), 0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if max.sats() != tc.max {
+			t.Errorf("source %d, amount %d: expected the max amount %d, got %d", tc.from, tc.amount, tc.max,
+				max.sats())
+		}
+	}
+
+	params.SourceRules = sourceRules{"1": {Ceiling: 80, Floor: 90}}
+	if err := r.resolveSourceRules(); err == nil {
+		t.Error("expected the invalid rule to fail")
+	}
+}
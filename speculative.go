@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// speculativeQuery is the route query for half the attempt amount sent
+// together with the full amount query when the target peer is likely to fail
+// the full amount anyway. Its response is used by the next route query of the
+// same pair and amount instead of asking lnd again.
+type speculativeQuery struct {
+	req    *lnrpc.QueryRoutesRequest
+	done   chan struct{}
+	resp   *lnrpc.QueryRoutesResponse
+	err    error
+	cancel context.CancelFunc
+}
+
+type speculativeStats struct {
+	sent int
+	used int
+}
+
+// likelyProbed reports if the target peer failed to forward less than the
+// amount to us before so the payment would probably end with probing.
+func (r *regolancer) likelyProbed(to uint64, amount Msat) bool {
+	c := r.findChannel(to)
+	if c == nil {
+		return false
+	}
+	failed, ok := r.mcCache[c.RemotePubkey+r.myPK]
+	return ok && failed.amount < int64(amount)
+}
+
+// startSpeculativeHalf queries the routes for half the attempt amount in
+// background if --speculative-half-query is set and the target is likely to
+// be probed.
+func (r *regolancer) startSpeculativeHalf(ctx context.Context, a *rebalanceAttempt) {
+	half := satToMsat(a.amount.sats() / 2)
+	if !params.SpeculativeHalf || a.exploring || half == 0 || half < satToMsat(params.MinAmount) ||
+		!r.likelyProbed(a.to, a.amount) {
+		return
+	}
+	feeMsat, lastPKstr, _, err := r.calcFeeMsat(ctx, a.from, a.to, half)
+	if err != nil {
+		return
+	}
+	req, err := r.routeQuery(ctx, a.from, a.to, lastPKstr, half, feeMsat)
+	if err != nil {
+		return
+	}
+	// the worker lock can't be released from another goroutine
+	client := r.lnClient
+	if c, ok := client.(*workerClient); ok {
+		client = c.LightningClient
+	}
+	queryCtx, cancel := context.WithCancel(ctx)
+	s := &speculativeQuery{req: req, done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(s.done)
+		s.resp, s.err = client.QueryRoutes(queryCtx, req)
+	}()
+	r.speculative = s
+	r.speculativeStats.sent++
+}
+
+// stopSpeculative cancels the half amount query if it wasn't used.
+func (r *regolancer) stopSpeculative() {
+	if r.speculative != nil {
+		r.speculative.cancel()
+		r.speculative = nil
+	}
+}
+
+// speculativeRoutes retries the pair with the half amount after the full
+// amount query failed, the routes come from the speculative query.
+func (r *regolancer) speculativeRoutes(ctx context.Context, a *rebalanceAttempt, fullErr error) (routes []*lnrpc.Route,
+	fee Msat, err error) {
+	half := satToMsat(a.amount.sats() / 2)
+	log.Printf("%s %s, trying %s sats found by the speculative query", r.pairLabel(ctx, a.from, a.to),
+		infoColorF("no route for the full amount (%s)", fullErr), hiWhiteColor(half.sats()))
+	routes, fee, err = r.getRouteChoices(ctx, a.from, a.to, half)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.speculativeStats.used++
+	a.amount, a.routeAmount = half, half
+	return routes, fee, nil
+}
+
+// queryRoutes asks lnd for the routes unless the speculative query was sent
+// for the same request, then its response is used.
+func (r *regolancer) queryRoutes(ctx context.Context, req *lnrpc.QueryRoutesRequest) (*lnrpc.QueryRoutesResponse,
+	error) {
+	s := r.speculative
+	if s == nil || s.req.OutgoingChanId != req.OutgoingChanId || s.req.AmtMsat != req.AmtMsat ||
+		!bytes.Equal(s.req.LastHopPubkey, req.LastHopPubkey) {
+		return r.lnClient.QueryRoutes(ctx, req)
+	}
+	r.speculative = nil
+	defer s.cancel()
+	var err error
+	r.unlocked(func() {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.resp, s.err
+}
+
+func (r *regolancer) printSpeculativeStats() {
+	s := r.speculativeStats
+	if s.sent == 0 {
+		return
+	}
+	log.Printf("Speculative half amount queries: %s sent, %s used", hiWhiteColor(s.sent), hiWhiteColor(s.used))
+}
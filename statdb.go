@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+
+	// pure Go driver so that cross-compilation doesn't need cgo
+	_ "modernc.org/sqlite"
+)
+
+const statDBSchema = `CREATE TABLE IF NOT EXISTS rebalances (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp INTEGER NOT NULL,
+	from_chan INTEGER NOT NULL,
+	to_chan INTEGER NOT NULL,
+	amount_sat INTEGER NOT NULL,
+	fee_msat INTEGER NOT NULL,
+	ppm INTEGER NOT NULL,
+	hops INTEGER NOT NULL,
+	attempt INTEGER NOT NULL,
+	attempts INTEGER NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	fee_limit_msat INTEGER NOT NULL,
+	success INTEGER NOT NULL,
+	failure_stage TEXT NOT NULL DEFAULT '',
+	failure_code TEXT NOT NULL DEFAULT '',
+	failure_hop INTEGER
+);
+CREATE INDEX IF NOT EXISTS rebalances_timestamp ON rebalances (timestamp);
+CREATE INDEX IF NOT EXISTS rebalances_to_chan ON rebalances (to_chan)`
+
+// statDB saves the rebalances to the SQLite database set with --stat-db. The
+// database can be shared by several instances, the writers wait for each
+// other up to the busy timeout.
+type statDB struct {
+	db *sql.DB
+}
+
+func openStatDB(filename string) (*statDB, error) {
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, q := range []string{"PRAGMA busy_timeout = 10000", statDBSchema} {
+		if _, err = db.Exec(q); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &statDB{db: db}, nil
+}
+
+func (s *statDB) add(rec statRecord) error {
+	success := 0
+	if rec.FailureStage == "" {
+		success = 1
+	}
+	_, err := s.db.Exec(`INSERT INTO rebalances (timestamp, from_chan, to_chan, amount_sat, fee_msat, ppm, hops,
+		attempt, attempts, duration_ms, fee_limit_msat, success, failure_stage, failure_code, failure_hop)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.Timestamp, int64(rec.FromChannel), int64(rec.ToChannel), Msat(rec.AmountMsat).sats(), rec.FeesMsat,
+		feePPM(Msat(rec.AmountMsat), Msat(rec.FeesMsat)), rec.RouteHops, rec.Attempt, rec.RoutesTried,
+		rec.DurationMs, rec.FeeLimit, success, rec.FailureStage, rec.FailureCode, rec.FailureHop)
+	return err
+}
+
+func (s *statDB) close() {
+	s.db.Close()
+}
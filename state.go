@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const stateVersion = 1
+
+// stateFile is the learned session state that can be moved between hosts.
+type stateFile struct {
+	Version      int                `json:"version"`
+	Exported     time.Time          `json:"exported"`
+	FailedRoutes []stateFailedRoute `json:"failed_routes"`
+	FailedHops   []stateFailedHop   `json:"failed_hops"`
+	HopHistory   []*hopStat         `json:"hop_history"`
+}
+
+// stateFailedRoute is a channel pair in the failure cache, it's not tried
+// again until it expires.
+type stateFailedRoute struct {
+	From       uint64    `json:"from"`
+	To         uint64    `json:"to"`
+	Expiration time.Time `json:"expiration"`
+	Reason     string    `json:"reason,omitempty"`
+	ReasonChan uint64    `json:"reason_chan,omitempty"`
+	Failed     time.Time `json:"failed,omitempty"`
+}
+
+// stateFailedHop is the amount that failed to go through the hop between two
+// nodes.
+type stateFailedHop struct {
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	AmountMsat int64     `json:"amount_msat"`
+	Updated    time.Time `json:"updated"`
+}
+
+func (r *regolancer) exportState(filename string) error {
+	state := stateFile{Version: stateVersion, Exported: time.Now()}
+	for _, v := range r.failureCache {
+		if v.channelPair[0] == nil || v.channelPair[1] == nil {
+			continue
+		}
+		state.FailedRoutes = append(state.FailedRoutes, stateFailedRoute{From: v.channelPair[0].ChanId,
+			To: v.channelPair[1].ChanId, Expiration: *v.expiration, Reason: v.reason.code,
+			ReasonChan: v.reason.chanId, Failed: v.reason.time})
+	}
+	for k, v := range r.mcCache {
+		if len(k) != 132 {
+			continue
+		}
+		state.FailedHops = append(state.FailedHops, stateFailedHop{From: k[:66], To: k[66:],
+			AmountMsat: v.amount, Updated: v.updated})
+	}
+	for _, s := range r.hopHistory {
+		state.HopHistory = append(state.HopHistory, s)
+	}
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating state file: %s", err)
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(state)
+}
+
+func readState(filename string) (*stateFile, error) {
+	l := lock()
+	l.RLock()
+	defer l.Unlock()
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening state file: %s", err)
+	}
+	defer f.Close()
+	state := &stateFile{}
+	err = json.NewDecoder(f).Decode(state)
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %s", err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state file version %d, expected %d", state.Version, stateVersion)
+	}
+	return state, nil
+}
+
+// importState merges the state exported by another session, newer entries win.
+// Entries that refer to the channels we don't have anymore are dropped. The
+// channel candidates should be selected before the import so that the failed
+// routes can be applied.
+func (r *regolancer) importState(filename string) error {
+	state, err := readState(filename)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	imported, dropped := 0, 0
+	for _, fr := range state.FailedRoutes {
+		if r.findChannel(fr.From) == nil || r.findChannel(fr.To) == nil {
+			dropped++
+			continue
+		}
+		if fr.Expiration.Before(now) {
+			continue
+		}
+		k := formatChannelPair(fr.From, fr.To)
+		expiration := fr.Expiration
+		reason := failReason{code: fr.Reason, chanId: fr.ReasonChan, time: fr.Failed}
+		if cached, ok := r.failureCache[k]; ok {
+			if cached.expiration.Before(expiration) {
+				cached.expiration = &expiration
+				cached.reason = reason
+				r.failureCache[k] = cached
+				imported++
+			}
+			continue
+		}
+		// only the current candidates can be put on hold
+		if pair, ok := r.channelPairs[k]; ok {
+			r.failureCache[k] = failedRoute{channelPair: pair, expiration: &expiration, reason: reason}
+			delete(r.channelPairs, k)
+			imported++
+		}
+	}
+	for _, fh := range state.FailedHops {
+		if now.Sub(fh.Updated) > time.Minute*time.Duration(params.FailedRouteTTL) {
+			continue
+		}
+		if len(fh.From) != 66 || len(fh.To) != 66 {
+			dropped++
+			continue
+		}
+		k := fh.From + fh.To
+		if cached, ok := r.mcCache[k]; ok && !cached.updated.Before(fh.Updated) {
+			continue
+		}
+		r.mcCache[k] = failedAmount{amount: fh.AmountMsat, updated: fh.Updated}
+		imported++
+	}
+	if r.hopHistory != nil {
+		for _, s := range state.HopHistory {
+			if s.From == r.myPK && r.findChannel(s.ChanId) == nil {
+				dropped++
+				continue
+			}
+			k := hopKey(s.From, s.To)
+			if cached, ok := r.hopHistory[k]; ok && !cached.LastUpdate.Before(s.LastUpdate) {
+				continue
+			}
+			r.hopHistory[k] = s
+			imported++
+		}
+	}
+	log.Printf("Imported %s state entries exported at %s, dropped %s referring to the channels we don't have",
+		hiWhiteColor(imported), state.Exported.Format(time.RFC3339), hiWhiteColor(dropped))
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// stateTest returns the session with the channels and the candidate pairs
+// between them.
+func stateTest(chans ...uint64) *regolancer {
+	r := &regolancer{
+		myPK:         testMyPK,
+		channelPairs: map[string][2]*lnrpc.Channel{},
+		failureCache: map[string]failedRoute{},
+		mcCache:      map[string]failedAmount{},
+		hopHistory:   map[string]*hopStat{},
+	}
+	for _, id := range chans {
+		r.channels = append(r.channels, &lnrpc.Channel{ChanId: id})
+	}
+	for _, from := range r.channels {
+		for _, to := range r.channels {
+			if from != to {
+				r.channelPairs[formatChannelPair(from.ChanId, to.ChanId)] = [2]*lnrpc.Channel{from, to}
+			}
+		}
+	}
+	return r
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.FailedRouteTTL, params.FailureCacheSize = 5, 1000
+	filename := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now()
+	src := stateTest(1, 2, 3)
+	src.addFailedRouteTTL(1, 2, time.Minute*10, failNoRoute, 1000)
+	src.addFailedRoute(1, 3, failNoAmount, 0)
+	src.mcCache[testPK(1)+testPK(2)] = failedAmount{amount: 1000000, updated: now.Add(-time.Minute)}
+	src.mcCache[testPK(2)+testPK(3)] = failedAmount{amount: 2000000, updated: now.Add(-time.Minute)}
+	src.mcCache[testPK(3)+testPK(4)] = failedAmount{amount: 3000000, updated: now.Add(-time.Hour)}
+	src.hopHistory[hopKey(testMyPK, testPK(1))] = &hopStat{From: testMyPK, To: testPK(1), ChanId: 1,
+		Attempts: 3, Failures: 1, LastUpdate: now}
+	src.hopHistory[hopKey(testMyPK, testPK(3))] = &hopStat{From: testMyPK, To: testPK(3), ChanId: 3,
+		Attempts: 1, LastUpdate: now}
+	src.hopHistory[hopKey(testPK(1), testPK(2))] = &hopStat{From: testPK(1), To: testPK(2), ChanId: 1001,
+		Attempts: 5, Failures: 5, LastUpdate: now.Add(-time.Minute)}
+	if err := src.exportState(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// the channel 3 is closed on the other host
+	dst := stateTest(1, 2)
+	dst.mcCache[testPK(2)+testPK(3)] = failedAmount{amount: 500000, updated: now}
+	dst.hopHistory[hopKey(testPK(1), testPK(2))] = &hopStat{From: testPK(1), To: testPK(2), ChanId: 1001,
+		Attempts: 1, LastUpdate: now.Add(-time.Hour)}
+	if err := dst.importState(filename); err != nil {
+		t.Fatal(err)
+	}
+	failed, ok := dst.failureCache[formatChannelPair(1, 2)]
+	if !ok || !failed.expiration.Round(time.Second).Equal(now.Add(time.Minute*10).Round(time.Second)) ||
+		failed.reason.code != failNoRoute || failed.reason.chanId != 1000 {
+		t.Errorf("the failed route should be imported, got %+v", failed)
+	}
+	if _, ok := dst.channelPairs[formatChannelPair(1, 2)]; ok || len(dst.failureCache) != 1 {
+		t.Errorf("only the pair 1 → 2 should be on hold, failure cache %v", dst.failureCache)
+	}
+	// the newer entries win, the stale ones are not imported
+	if a := dst.mcCache[testPK(1)+testPK(2)]; a.amount != 1000000 {
+		t.Errorf("the failed amount should be imported, got %+v", a)
+	}
+	if a := dst.mcCache[testPK(2)+testPK(3)]; a.amount != 500000 {
+		t.Errorf("the local newer failed amount should win, got %+v", a)
+	}
+	if _, ok := dst.mcCache[testPK(3)+testPK(4)]; ok {
+		t.Error("the expired failed amount shouldn't be imported")
+	}
+	if s := dst.hopHistory[hopKey(testPK(1), testPK(2))]; s.Attempts != 5 {
+		t.Errorf("the newer hop history should win, got %+v", s)
+	}
+	if _, ok := dst.hopHistory[hopKey(testMyPK, testPK(3))]; ok {
+		t.Error("the history of the closed channel should be dropped")
+	}
+	if s := dst.hopHistory[hopKey(testMyPK, testPK(1))]; s == nil || s.Attempts != 3 || s.Failures != 1 {
+		t.Errorf("the hop history should be imported, got %+v", s)
+	}
+
+	// importing again changes nothing
+	before := len(dst.failureCache) + len(dst.mcCache) + len(dst.hopHistory)
+	if err := dst.importState(filename); err != nil {
+		t.Fatal(err)
+	}
+	if after := len(dst.failureCache) + len(dst.mcCache) + len(dst.hopHistory); after != before {
+		t.Errorf("the second import should be idempotent, %d entries before, %d after", before, after)
+	}
+}
+
+func TestStateVersion(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	for content, expected := range map[string]string{
+		`{"version": 2}`: "unsupported state file version 2",
+		`{}`:             "unsupported state file version 0",
+		`not json`:       "error reading state file",
+	} {
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readState(filename); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error %q, got %v", content, expected, err)
+		}
+	}
+	if _, err := readState(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("the missing file should fail")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statPostTokenEnv     = "REGOLANCER_STAT_POST_TOKEN"
+	statPostRetries      = 3
+	statPostTimeout      = time.Second * 10
+	statPostFlushTimeout = time.Second * 10
+	statPostQueueSize    = 1000
+)
+
+func defaultStatSpool() string {
+	return filepath.Join(os.TempDir(), "regolancer-stat-spool.jsonl")
+}
+
+// statRecord is a single successful rebalance or a failed attempt (with
+// --stat-failures, the failure fields are only set then), the same fields are
+// saved to the stat file.
+type statRecord struct {
+	Timestamp    int64    `json:"timestamp"`
+	FromChannel  uint64   `json:"from_channel"`
+	ToChannel    uint64   `json:"to_channel"`
+	AmountMsat   int64    `json:"amount_msat"`
+	FeesMsat     int64    `json:"fees_msat"`
+	Attempt      int      `json:"attempt_number"`
+	RoutesTried  int      `json:"routes_tried_in_attempt"`
+	ProbeDepth   int      `json:"probe_depth"`
+	RouteHops    int      `json:"route_hops"`
+	DurationMs   int64    `json:"attempt_duration_ms"`
+	Route        []uint64 `json:"route"`
+	RouteNodes   []string `json:"route_nodes"`
+	CacheMisses  *int     `json:"node_cache_misses,omitempty"`
+	RoutePath    []string `json:"route_path"`
+	HopFeesMsat  []int64  `json:"hop_fees_msat"`
+	FeeLimit     int64    `json:"fee_limit_msat"`
+	FailureStage string   `json:"failure_stage,omitempty"`
+	FailureCode  string   `json:"failure_code,omitempty"`
+	FailureHop   *int     `json:"failure_hop,omitempty"`
+	// iteration of the rapid rebalance or the number of successful iterations
+	// if it stopped
+	RapidIteration int    `json:"rapid_iteration,omitempty"`
+	RapidStop      string `json:"rapid_stop,omitempty"`
+	// how much more in ppm the route found by --explore-fee-headroom costs
+	FeeHeadroomPPM *int64 `json:"fee_headroom_ppm,omitempty"`
+}
+
+// statPoster sends the stat records to an HTTP endpoint in the background so
+// that a slow or broken endpoint never delays rebalancing. The records that
+// couldn't be delivered are saved to the spool file and sent on the next run.
+type statPoster struct {
+	url    string
+	token  string
+	spool  string
+	client *http.Client
+	queue  chan statRecord
+	stop   chan struct{}
+	done   chan struct{}
+	lock   sync.Mutex
+	failed []statRecord
+}
+
+func newStatPoster(url, token, spool string) *statPoster {
+	p := &statPoster{
+		url:    url,
+		token:  token,
+		spool:  spool,
+		client: &http.Client{Timeout: statPostTimeout},
+		queue:  make(chan statRecord, statPostQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	spooled, err := p.readSpool()
+	if err != nil {
+		logErrorF("Error reading stat spool file %s: %s", p.spool, err)
+	}
+	go p.run(spooled)
+	return p
+}
+
+func (p *statPoster) run(spooled []spooledRecord) {
+	defer close(p.done)
+	if len(spooled) > 0 {
+		delivered := []string{}
+		for _, rec := range spooled {
+			if p.deliver(rec.statRecord) {
+				delivered = append(delivered, rec.line)
+			}
+		}
+		if err := p.dropSpooled(delivered); err != nil {
+			logErrorF("Error updating stat spool file %s: %s", p.spool, err)
+		}
+	}
+	for rec := range p.queue {
+		if !p.deliver(rec) {
+			p.addFailed(rec)
+		}
+	}
+}
+
+func (p *statPoster) addFailed(rec statRecord) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.failed = append(p.failed, rec)
+}
+
+// post queues the record, it never blocks.
+func (p *statPoster) post(rec statRecord) {
+	select {
+	case p.queue <- rec:
+	default:
+		p.addFailed(rec)
+	}
+}
+
+// deliver tries to send the record retrying on network and server errors with
+// exponential backoff, the result is false if the record wasn't delivered.
+func (p *statPoster) deliver(rec statRecord) bool {
+	backoff := time.Second
+	for i := 0; i < statPostRetries; i++ {
+		select {
+		case <-p.stop:
+			return false
+		default:
+		}
+		err, retry := p.send(rec)
+		if err == nil {
+			return true
+		}
+		if !retry || i == statPostRetries-1 {
+			logErrorF("Error posting stat record to %s: %s", p.url, err)
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-p.stop:
+		}
+		backoff *= 2
+	}
+	return false
+}
+
+func (p *statPoster) send(rec statRecord) (err error, retry bool) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err, true
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout:
+		return fmt.Errorf("server responded with %s", resp.Status), true
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("server responded with %s", resp.Status), false
+	}
+	return nil, false
+}
+
+// spooledRecord is a record left from the previous runs along with its spool
+// file line.
+type spooledRecord struct {
+	statRecord
+	line string
+}
+
+// readSpool loads the records left from the previous runs, the spool file is
+// only updated when they're delivered so nothing is lost if we crash before.
+func (p *statPoster) readSpool() ([]spooledRecord, error) {
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	f, err := os.Open(p.spool)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	result := []spooledRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rec := spooledRecord{line: scanner.Text()}
+		if err := json.Unmarshal(scanner.Bytes(), &rec.statRecord); err != nil {
+			logErrorF("Skipping invalid stat spool record: %s", err)
+			continue
+		}
+		result = append(result, rec)
+	}
+	if len(result) > 0 {
+		log.Printf("Sending %s stat records left from the previous runs", hiWhiteColor(len(result)))
+	}
+	return result, scanner.Err()
+}
+
+// dropSpooled rewrites the spool file without the delivered lines and the
+// invalid ones, the records spooled by other runs in the meantime are kept.
+func (p *statPoster) dropSpooled(delivered []string) error {
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	data, err := os.ReadFile(p.spool)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	drop := map[string]int{}
+	for _, line := range delivered {
+		drop[line]++
+	}
+	left := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || !json.Valid([]byte(line)) {
+			continue
+		}
+		if drop[line] > 0 {
+			drop[line]--
+			continue
+		}
+		left = append(left, line+"\n")
+	}
+	if len(left) == 0 {
+		return os.Remove(p.spool)
+	}
+	tmp := p.spool + ".tmp"
+	err = os.WriteFile(tmp, []byte(strings.Join(left, "")), 0600)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p.spool)
+}
+
+func (p *statPoster) writeSpool() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.failed) == 0 {
+		return nil
+	}
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	f, err := os.OpenFile(p.spool, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	for _, rec := range p.failed {
+		if err := encoder.Encode(rec); err != nil {
+			return err
+		}
+	}
+	log.Printf("Saved %s undelivered stat records to %s", hiWhiteColor(len(p.failed)), p.spool)
+	return nil
+}
+
+// close waits for the queued records to be sent for a limited time and spools
+// the rest.
+func (p *statPoster) close() {
+	close(p.queue)
+	select {
+	case <-p.done:
+	case <-time.After(statPostFlushTimeout):
+		close(p.stop)
+		<-p.done
+	}
+	if err := p.writeSpool(); err != nil {
+		logErrorF("Error writing stat spool file %s: %s", p.spool, err)
+	}
+}
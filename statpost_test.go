@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestSpool(t *testing.T, filename string, recs ...statRecord) {
+	lines := ""
+	for _, rec := range recs {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += string(data) + "\n"
+	}
+	if err := os.WriteFile(filename, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestSpool(t *testing.T, filename string) []statRecord {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := []statRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		rec := statRecord{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, rec)
+	}
+	return result
+}
+
+// TestStatSpoolKept checks that the spool file survives until the records are
+// delivered.
+func TestStatSpoolKept(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	writeTestSpool(t, spool, statRecord{Attempt: 1}, statRecord{Attempt: 2})
+	p := &statPoster{spool: spool}
+	recs, err := p.readSpool()
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %d, error %v", len(recs), err)
+	}
+	if len(readTestSpool(t, spool)) != 2 {
+		t.Error("the spool file shouldn't change before the records are delivered")
+	}
+}
+
+// TestStatSpoolDelivery checks that only the undelivered records stay in the
+// spool.
+func TestStatSpoolDelivery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := statRecord{}
+		json.NewDecoder(req.Body).Decode(&rec)
+		if rec.Attempt == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	writeTestSpool(t, spool, statRecord{Attempt: 1}, statRecord{Attempt: 2})
+	f, err := os.OpenFile(spool, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("invalid\n")
+	f.Close()
+	p := newStatPoster(server.URL, "", spool)
+	p.post(statRecord{Attempt: 3})
+	p.post(statRecord{Attempt: 2, FromChannel: 1})
+	p.close()
+	attempts := []int{}
+	for _, rec := range readTestSpool(t, spool) {
+		attempts = append(attempts, rec.Attempt)
+	}
+	if len(attempts) != 2 || attempts[0] != 2 || attempts[1] != 2 {
+		t.Errorf("expected the two rejected records in the spool, got attempts %v", attempts)
+	}
+}
+
+// TestStatSpoolDropped checks that the spool file is removed once everything
+// is delivered.
+func TestStatSpoolDropped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	writeTestSpool(t, spool, statRecord{Attempt: 1})
+	p := newStatPoster(server.URL, "", spool)
+	p.close()
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("the spool file should be removed, got %v", err)
+	}
+}
+
+// TestStatSpoolDropSpooled checks that the records spooled by another run
+// after the spool was read aren't lost.
+func TestStatSpoolDropSpooled(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	writeTestSpool(t, spool, statRecord{Attempt: 1}, statRecord{Attempt: 2})
+	p := &statPoster{spool: spool}
+	recs, err := p.readSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestSpool(t, spool, statRecord{Attempt: 1}, statRecord{Attempt: 2}, statRecord{Attempt: 3})
+	if err := p.dropSpooled([]string{recs[0].line}); err != nil {
+		t.Fatal(err)
+	}
+	left := readTestSpool(t, spool)
+	if len(left) != 2 || left[0].Attempt != 2 || left[1].Attempt != 3 {
+		t.Errorf("expected attempts 2 and 3 to stay in the spool, got %v", left)
+	}
+}
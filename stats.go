@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const statHeader = "timestamp,from_channel,to_channel,amount_msat,fees_msat,attempt_number,routes_tried_in_attempt,probe_depth,route_hops,attempt_duration_ms,route,route_nodes,node_cache_misses,route_path,hop_fees_msat,fee_limit_msat,failure_stage,failure_code,failure_hop,rapid_iteration,rapid_stop,fee_headroom_ppm"
+
+// length of the node id prefixes in the route_nodes column
+const routeNodePrefixLen = 8
+
+// the characters separating the columns and hops are replaced in the aliases
+var statAliasReplacer = strings.NewReplacer(",", " ", "|", " ", "/", " ")
+
+// statAlias returns the cached alias of the node for the route_path column so
+// that no RPCs are made when saving the stats, the node id prefix is used if
+// the node isn't cached.
+func (r *regolancer) statAlias(pk string) string {
+	if n, ok := r.nodeCache[pk]; ok && n.NodeInfo != nil && n.NodeInfo.Node != nil && n.NodeInfo.Node.Alias != "" {
+		return statAliasReplacer.Replace(sanitizeAlias(n.NodeInfo.Node.Alias))
+	}
+	if len(pk) > routeNodePrefixLen {
+		return pk[:routeNodePrefixLen]
+	}
+	return pk
+}
+
+// attemptInfo is filled while the attempt progresses and saved to the stat
+// file if it succeeds.
+type attemptInfo struct {
+	number      int
+	routesTried int
+	probeDepth  int
+	start       time.Time
+	// route nodes missing from the node cache, only counted with
+	// --node-cache-info
+	cacheTallied bool
+	cacheMisses  int
+	feeLimit     Msat
+	// iteration of the rapid rebalance starting from 1, 0 otherwise
+	rapidIteration int
+}
+
+// stages of the failed attempts saved with --stat-failures
+const (
+	failureStageNoRoute = "no_route"
+	failureStageFee     = "fee_too_high"
+	failureStagePayment = "payment"
+	// rapid rebalance stop, it's saved without --stat-failures too
+	failureStageRapidStop = "rapid_stop"
+)
+
+// nextAttempt assigns a new session-wide id to a payment attempt, it's used in
+// the logs and the stat file to correlate them.
+func (r *regolancer) nextAttempt() int {
+	r.attempt++
+	return r.attempt
+}
+
+// currentAttempt returns the number of the attempt in progress, it's kept in
+// attemptInfo as the workers run several attempts at once.
+func (r *regolancer) currentAttempt() int {
+	if r.attemptInfo != nil && r.attemptInfo.number > 0 {
+		return r.attemptInfo.number
+	}
+	return r.attempt
+}
+
+func (r *regolancer) saveStat(route *lnrpc.Route) {
+	if len(route.Hops) == 0 {
+		return
+	}
+	a := r.attemptInfo
+	if a == nil {
+		a = &attemptInfo{start: time.Now()}
+	}
+	r.addRouteStat(route)
+	r.successes++
+	amountMsat := Msat(route.TotalAmtMsat - route.TotalFeesMsat)
+	r.totalAmountMsat += amountMsat
+	r.totalFeesMsat += Msat(route.TotalFeesMsat)
+	r.sourceUsage[route.Hops[0].ChanId] += amountMsat
+	if r.successes == 1 {
+		notifyLocal("First successful rebalance: " + r.summaryLine())
+	}
+	r.successRoutesTried += a.routesTried
+	err := r.addDailyLedger(params.DailyLedger, route.Hops[len(route.Hops)-1].ChanId,
+		amountMsat.sats())
+	if err != nil {
+		logErrorF("Error saving daily ledger to %s: %s", params.DailyLedger, err)
+	}
+	err = addFeeLedger(params.FeeLedger, Msat(route.TotalFeesMsat))
+	if err != nil {
+		logErrorF("Error saving fee ledger to %s: %s", params.FeeLedger, err)
+	}
+	rec := statRecord{
+		Timestamp:      time.Now().Unix(),
+		FromChannel:    route.Hops[0].ChanId,
+		ToChannel:      route.Hops[len(route.Hops)-1].ChanId,
+		AmountMsat:     int64(amountMsat),
+		FeesMsat:       route.TotalFeesMsat,
+		Attempt:        a.number,
+		RoutesTried:    a.routesTried,
+		ProbeDepth:     a.probeDepth,
+		RouteHops:      len(route.Hops),
+		DurationMs:     time.Since(a.start).Milliseconds(),
+		FeeLimit:       int64(a.feeLimit),
+		RapidIteration: a.rapidIteration,
+	}
+	if a.cacheTallied {
+		misses := a.cacheMisses
+		rec.CacheMisses = &misses
+	}
+	for _, h := range route.Hops {
+		rec.Route = append(rec.Route, h.ChanId)
+		pk := h.PubKey
+		if len(pk) > routeNodePrefixLen {
+			pk = pk[:routeNodePrefixLen]
+		}
+		rec.RouteNodes = append(rec.RouteNodes, pk)
+		rec.RoutePath = append(rec.RoutePath, fmt.Sprintf("%d/%s", h.ChanId, r.statAlias(h.PubKey)))
+		rec.HopFeesMsat = append(rec.HopFeesMsat, h.FeeMsat)
+	}
+	if r.statPoster != nil {
+		r.statPoster.post(rec)
+	}
+	r.writeStat(rec)
+}
+
+// saveFailedAttempt saves the failed attempt to the stat file and database if
+// --stat-failures is set. The route is nil if the attempt failed before
+// paying, hop is the index of the failing hop or -1 if it's unknown.
+func (r *regolancer) saveFailedAttempt(from, to uint64, amount Msat, feeLimit Msat, route *lnrpc.Route,
+	stage string, code string, hop int) {
+	if !params.StatFailures {
+		return
+	}
+	rec := statRecord{
+		Timestamp:    time.Now().Unix(),
+		FromChannel:  from,
+		ToChannel:    to,
+		AmountMsat:   int64(amount),
+		FeeLimit:     int64(feeLimit),
+		FailureStage: stage,
+		FailureCode:  code,
+	}
+	// the attempt info belongs to the previous attempt if no route was found
+	if a := r.attemptInfo; a != nil && stage != failureStageNoRoute {
+		rec.Attempt, rec.RoutesTried, rec.ProbeDepth = a.number, a.routesTried, a.probeDepth
+		rec.DurationMs = time.Since(a.start).Milliseconds()
+		if feeLimit == 0 {
+			rec.FeeLimit = int64(a.feeLimit)
+		}
+	}
+	if o, ok := r.feeHeadroomStat.overshoot[formatChannelPair(from, to)]; ok && stage == failureStageNoRoute {
+		rec.FeeHeadroomPPM = &o
+	}
+	if hop >= 0 {
+		rec.FailureHop = &hop
+	}
+	if route != nil && len(route.Hops) > 0 {
+		rec.FeesMsat = route.TotalFeesMsat
+		rec.RouteHops = len(route.Hops)
+		for _, h := range route.Hops {
+			rec.Route = append(rec.Route, h.ChanId)
+			pk := h.PubKey
+			if len(pk) > routeNodePrefixLen {
+				pk = pk[:routeNodePrefixLen]
+			}
+			rec.RouteNodes = append(rec.RouteNodes, pk)
+			rec.RoutePath = append(rec.RoutePath, fmt.Sprintf("%d/%s", h.ChanId, r.statAlias(h.PubKey)))
+			rec.HopFeesMsat = append(rec.HopFeesMsat, h.FeeMsat)
+		}
+	}
+	r.writeStat(rec)
+}
+
+// saveRapidStop saves the reason the rapid rebalance stopped and the number of
+// its successful iterations.
+func (r *regolancer) saveRapidStop(from, to uint64, reason string, iterations int) {
+	rec := statRecord{
+		Timestamp:      time.Now().Unix(),
+		FromChannel:    from,
+		ToChannel:      to,
+		FailureStage:   failureStageRapidStop,
+		FailureCode:    reason,
+		RapidIteration: iterations,
+		RapidStop:      reason,
+	}
+	if a := r.attemptInfo; a != nil {
+		rec.Attempt = a.number
+	}
+	if r.statPoster != nil {
+		r.statPoster.post(rec)
+	}
+	r.writeStat(rec)
+}
+
+// routeEnds returns the source and target channels of the route, they're zero
+// if the route has no hops.
+func routeEnds(route *lnrpc.Route) (from, to uint64) {
+	if route == nil || len(route.Hops) == 0 {
+		return 0, 0
+	}
+	return route.Hops[0].ChanId, route.Hops[len(route.Hops)-1].ChanId
+}
+
+// saveNoRoute saves the attempt that failed to find a route with the fee limit
+// it was looking for.
+func (r *regolancer) saveNoRoute(ctx context.Context, a *rebalanceAttempt, code string) {
+	if !params.StatFailures {
+		return
+	}
+	feeMsat, _, _, err := r.calcFeeMsat(ctx, a.from, a.to, a.amount)
+	if err != nil {
+		feeMsat = 0
+	}
+	r.saveFailedAttempt(a.from, a.to, a.amount, feeMsat, nil, failureStageNoRoute, code, -1)
+}
+
+// writeStat appends the record to the stat file and database.
+func (r *regolancer) writeStat(rec statRecord) {
+	if r.statDB != nil {
+		if err := r.statDB.add(rec); err != nil {
+			logErrorF("Error saving rebalance stats to %s: %s", params.StatDB, err)
+		}
+	}
+	if r.statFilename == "" {
+		return
+	}
+	l := lock()
+	l.Lock()
+	defer l.Unlock()
+	f, err := openStatFile(r.statFilename)
+	if err != nil {
+		logErrorF("Error saving rebalance stats to %s: %s", r.statFilename, err)
+		return
+	}
+	defer f.Close()
+	chans := []string{}
+	for _, c := range rec.Route {
+		chans = append(chans, strconv.FormatUint(c, 10))
+	}
+	misses := ""
+	if rec.CacheMisses != nil {
+		misses = strconv.Itoa(*rec.CacheMisses)
+	}
+	fees := []string{}
+	for _, fee := range rec.HopFeesMsat {
+		fees = append(fees, strconv.FormatInt(fee, 10))
+	}
+	hop := ""
+	if rec.FailureHop != nil {
+		hop = strconv.Itoa(*rec.FailureHop)
+	}
+	headroom := ""
+	if rec.FeeHeadroomPPM != nil {
+		headroom = strconv.FormatInt(*rec.FeeHeadroomPPM, 10)
+	}
+	iteration := ""
+	if rec.RapidIteration > 0 || rec.RapidStop != "" {
+		iteration = strconv.Itoa(rec.RapidIteration)
+	}
+	f.Write([]byte(fmt.Sprintf("%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%s,%s,%s,%s,%s,%d,%s,%s,%s,%s,%s,%s\n", rec.Timestamp,
+		rec.FromChannel, rec.ToChannel, rec.AmountMsat, rec.FeesMsat, rec.Attempt, rec.RoutesTried, rec.ProbeDepth,
+		rec.RouteHops, rec.DurationMs, strings.Join(chans, "|"), strings.Join(rec.RouteNodes, "|"), misses,
+		strings.Join(rec.RoutePath, "|"), strings.Join(fees, "|"), rec.FeeLimit, rec.FailureStage, rec.FailureCode,
+		hop, iteration, rec.RapidStop, headroom)))
+}
+
+// openStatFile opens the stat file for appending and writes the header if
+// it's new. A file with a different header (created by another version) is
+// renamed to .old so that the rows of different layouts are never mixed.
+func openStatFile(filename string) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	header, err := bufio.NewReader(f).ReadString('\n')
+	if err == io.EOF && header == "" {
+		if _, err := f.WriteString(statHeader + "\n"); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	if strings.TrimSpace(header) == statHeader {
+		return f, nil
+	}
+	f.Close()
+	old := filename + ".old"
+	if err := os.Rename(filename, old); err != nil {
+		return nil, fmt.Errorf("stat file has a different header and can't be moved away: %s", err)
+	}
+	log.Print(infoColorF("Stat file %s has a different header, it was probably created by another version; "+
+		"moved it to %s", filename, old))
+	return openStatFile(filename)
+}
+
+// readStatFile reads the successful rebalances saved to the stat file. The
+// columns are looked up by the header so the files created by the older
+// versions with fewer columns can be read too, the route columns are not
+// parsed.
+func readStatFile(filename string) ([]statRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("stat file %s is empty", filename)
+	}
+	columns := map[string]int{}
+	for i, c := range strings.Split(strings.TrimSpace(scanner.Text()), ",") {
+		columns[c] = i
+	}
+	for _, c := range []string{"timestamp", "from_channel", "to_channel", "amount_msat", "fees_msat"} {
+		if _, ok := columns[c]; !ok {
+			return nil, fmt.Errorf("stat file %s has no %s column", filename, c)
+		}
+	}
+	result := []statRecord{}
+	line := 1
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < len(columns) {
+			return nil, fmt.Errorf("line %d of %s has %d columns, expected %d", line, filename, len(fields),
+				len(columns))
+		}
+		if i, ok := columns["failure_stage"]; ok && fields[i] != "" {
+			continue
+		}
+		ints := map[string]int64{}
+		for _, c := range []string{"timestamp", "amount_msat", "fees_msat", "attempt_number",
+			"routes_tried_in_attempt", "probe_depth", "route_hops", "attempt_duration_ms"} {
+			i, ok := columns[c]
+			if !ok {
+				continue
+			}
+			if ints[c], err = strconv.ParseInt(fields[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("error parsing %s at line %d of %s: %s", c, line, filename, err)
+			}
+		}
+		rec := statRecord{Timestamp: ints["timestamp"], AmountMsat: ints["amount_msat"], FeesMsat: ints["fees_msat"],
+			Attempt: int(ints["attempt_number"]), RoutesTried: int(ints["routes_tried_in_attempt"]),
+			ProbeDepth: int(ints["probe_depth"]), RouteHops: int(ints["route_hops"]),
+			DurationMs: ints["attempt_duration_ms"]}
+		if rec.FromChannel, err = strconv.ParseUint(fields[columns["from_channel"]], 10, 64); err != nil {
+			return nil, fmt.Errorf("error parsing from_channel at line %d of %s: %s", line, filename, err)
+		}
+		if rec.ToChannel, err = strconv.ParseUint(fields[columns["to_channel"]], 10, 64); err != nil {
+			return nil, fmt.Errorf("error parsing to_channel at line %d of %s: %s", line, filename, err)
+		}
+		result = append(result, rec)
+	}
+	return result, scanner.Err()
+}
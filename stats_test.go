@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readStatColumns(t *testing.T, filename string) []map[string]string {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	header := strings.Split(lines[0], ",")
+	result := []map[string]string{}
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, ",")
+		if len(fields) != len(header) {
+			t.Fatalf("line %q has %d columns, expected %d", line, len(fields), len(header))
+		}
+		row := map[string]string{}
+		for i, c := range header {
+			row[c] = fields[i]
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// TestRapidStopStat checks that the rapid iterations and the stop reason are
+// saved to the stat file and that the stop isn't read as a rebalance.
+func TestRapidStopStat(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.StatFailures = false
+	r := &regolancer{statFilename: filepath.Join(t.TempDir(), "stat.csv"), sourceUsage: map[uint64]Msat{}}
+	route := testRoute(1, 2, 100000, 10, testPK(1), testPeerPK)
+	r.attemptInfo = &attemptInfo{number: 1, start: time.Now()}
+	r.saveStat(route)
+	r.attemptInfo = &attemptInfo{number: 2, start: time.Now(), rapidIteration: 1}
+	r.saveStat(route)
+	r.saveRapidStop(1, 2, rapidStopTargetReached, 1)
+	rows := readStatColumns(t, r.statFilename)
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if rows[0]["rapid_iteration"] != "" || rows[1]["rapid_iteration"] != "1" {
+		t.Errorf("unexpected rapid iterations %q and %q", rows[0]["rapid_iteration"], rows[1]["rapid_iteration"])
+	}
+	stop := rows[2]
+	if stop["failure_stage"] != failureStageRapidStop || stop["rapid_stop"] != rapidStopTargetReached ||
+		stop["rapid_iteration"] != "1" || stop["attempt_number"] != "2" {
+		t.Errorf("unexpected stop row %v", stop)
+	}
+	recs, err := readStatFile(r.statFilename)
+	if err != nil || len(recs) != 2 {
+		t.Errorf("expected 2 rebalances, got %d, error %v", len(recs), err)
+	}
+}
+
+// TestStatFileRotation checks that the rows are never appended to a stat file
+// with a different layout.
+func TestStatFileRotation(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.StatFailures = false
+	filename := filepath.Join(t.TempDir(), "stat.csv")
+	oldLayout := "timestamp,from_channel,to_channel,amount_msat,fees_msat\n1,1,2,1000,1\n"
+	if err := os.WriteFile(filename, []byte(oldLayout), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &regolancer{statFilename: filename, sourceUsage: map[uint64]Msat{}}
+	route := testRoute(1, 2, 100000, 10, testPK(1), testPeerPK)
+	r.saveStat(route)
+	r.saveStat(route)
+	if data, err := os.ReadFile(filename + ".old"); err != nil || string(data) != oldLayout {
+		t.Errorf("the old file should be moved intact, got %q, %v", data, err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != statHeader {
+		t.Fatalf("expected the current header and 2 rows, got %q", lines)
+	}
+	recs, err := readStatFile(filename)
+	if err != nil || len(recs) != 2 || recs[0].AmountMsat != 100000 {
+		t.Errorf("expected 2 rebalances of 100000 msat, got %v, error %v", recs, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// Heuristics used by --suggest:
+//   - pfrom/pto are set to the 25th percentile of the channels remote/local
+//     balance percentages rounded up to 10 and limited to 10..50 so that
+//     roughly a quarter of channels become candidates on each side
+//   - amount is the median deficit of the target candidates (the amount they
+//     need to reach pto) rounded down to 10k sats, min-amount is a tenth of it
+//   - econ-ratio depends on the median fee rate of our channels: cheap channels
+//     (up to 200 ppm) need the full ratio to find any routes, expensive ones
+//     (over 1000 ppm) can afford a half and everything in between gets 0.75
+const (
+	suggestPercentile   = 0.25
+	suggestPercStep     = 10
+	suggestPercMin      = 10
+	suggestPercMax      = 50
+	suggestAmountStep   = 10000
+	suggestMinAmountDiv = 10
+	suggestCheapPPM     = 200
+	suggestExpensivePPM = 1000
+)
+
+type suggestion struct {
+	fromPerc   int64
+	toPerc     int64
+	amount     int64
+	minAmount  int64
+	econRatio  float64
+	candidates int
+}
+
+func percentile(values []int64, p float64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]int64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func suggestPerc(percents []int64) int64 {
+	p := percentile(percents, suggestPercentile)
+	p = (p + suggestPercStep) / suggestPercStep * suggestPercStep
+	if p < suggestPercMin {
+		p = suggestPercMin
+	}
+	if p > suggestPercMax {
+		p = suggestPercMax
+	}
+	return p
+}
+
+func suggestParams(channels []*lnrpc.Channel, feeRates []int64) (result suggestion) {
+	localPercents := []int64{}
+	remotePercents := []int64{}
+	for _, c := range channels {
+		if c.Capacity == 0 {
+			continue
+		}
+		localPercents = append(localPercents, c.LocalBalance*100/c.Capacity)
+		remotePercents = append(remotePercents, c.RemoteBalance*100/c.Capacity)
+	}
+	result.fromPerc = suggestPerc(remotePercents)
+	result.toPerc = suggestPerc(localPercents)
+	deficits := []int64{}
+	for _, c := range channels {
+		if c.LocalBalance < c.Capacity*result.toPerc/100 {
+			deficits = append(deficits, c.Capacity*result.toPerc/100-c.LocalBalance)
+		}
+	}
+	result.candidates = len(deficits)
+	result.amount = percentile(deficits, 0.5) / suggestAmountStep * suggestAmountStep
+	if result.amount == 0 && len(deficits) > 0 {
+		result.amount = suggestAmountStep
+	}
+	result.minAmount = result.amount / suggestMinAmountDiv
+	medianPPM := percentile(feeRates, 0.5)
+	switch {
+	case medianPPM <= suggestCheapPPM:
+		result.econRatio = 1
+	case medianPPM > suggestExpensivePPM:
+		result.econRatio = 0.5
+	default:
+		result.econRatio = 0.75
+	}
+	return
+}
+
+func (s suggestion) String() string {
+	args := []string{"regolancer",
+		fmt.Sprintf("--pfrom %d", s.fromPerc),
+		fmt.Sprintf("--pto %d", s.toPerc),
+		fmt.Sprintf("--amount %d", s.amount),
+		fmt.Sprintf("--min-amount %d", s.minAmount),
+		fmt.Sprintf("--econ-ratio %g", s.econRatio),
+	}
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func suggestChannels(capacity int64, locals ...int64) []*lnrpc.Channel {
+	result := []*lnrpc.Channel{}
+	for _, local := range locals {
+		result = append(result, &lnrpc.Channel{Capacity: capacity, LocalBalance: local,
+			RemoteBalance: capacity - local})
+	}
+	return result
+}
+
+func TestPercentile(t *testing.T) {
+	values := []int64{50, 10, 40, 20, 30}
+	for _, tc := range []struct {
+		p        float64
+		expected int64
+	}{{0, 10}, {0.25, 20}, {0.5, 30}, {1, 50}} {
+		if v := percentile(values, tc.p); v != tc.expected {
+			t.Errorf("percentile %g: expected %d, got %d", tc.p, tc.expected, v)
+		}
+	}
+	if values[0] != 50 {
+		t.Error("percentile shouldn't sort the values in place")
+	}
+	if v := percentile(nil, 0.5); v != 0 {
+		t.Errorf("expected 0 for no values, got %d", v)
+	}
+}
+
+func TestSuggestParams(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		channels []*lnrpc.Channel
+		feeRates []int64
+		expected suggestion
+	}{
+		{
+			name:     "mixed",
+			channels: suggestChannels(1000000, 100000, 200000, 500000, 800000, 900000),
+			feeRates: []int64{100, 300, 500},
+			expected: suggestion{fromPerc: 30, toPerc: 30, amount: 100000, minAmount: 10000,
+				econRatio: 0.75, candidates: 2},
+		},
+		{
+			// everything is on the local side, pto is limited from below
+			// and pfrom from above
+			name:     "limits",
+			channels: suggestChannels(1000000, 1000000, 1000000, 990000, 1000000),
+			feeRates: []int64{50, 100, 2000},
+			expected: suggestion{fromPerc: 10, toPerc: 50, amount: 0, minAmount: 0,
+				econRatio: 1, candidates: 0},
+		},
+		{
+			// the small deficit is rounded up to the amount step
+			name: "small deficit",
+			channels: append(suggestChannels(100000, 5000, 50000, 60000, 90000),
+				&lnrpc.Channel{LocalBalance: 100}),
+			feeRates: []int64{1500, 2000, 800},
+			expected: suggestion{fromPerc: 20, toPerc: 10, amount: suggestAmountStep,
+				minAmount: suggestAmountStep / suggestMinAmountDiv, econRatio: 0.5, candidates: 1},
+		},
+		{
+			name:     "no channels",
+			expected: suggestion{fromPerc: 10, toPerc: 10, econRatio: 1},
+		},
+	} {
+		if s := suggestParams(tc.channels, tc.feeRates); s != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, s)
+		}
+	}
+}
+
+func TestSuggestEconRatio(t *testing.T) {
+	for _, tc := range []struct {
+		ppm      int64
+		expected float64
+	}{
+		{suggestCheapPPM, 1},
+		{suggestCheapPPM + 1, 0.75},
+		{suggestExpensivePPM, 0.75},
+		{suggestExpensivePPM + 1, 0.5},
+	} {
+		if s := suggestParams(nil, []int64{tc.ppm}); s.econRatio != tc.expected {
+			t.Errorf("%d ppm: expected econ ratio %g, got %g", tc.ppm, tc.expected, s.econRatio)
+		}
+	}
+}
+
+func TestSuggestionString(t *testing.T) {
+	s := suggestion{fromPerc: 30, toPerc: 40, amount: 100000, minAmount: 10000, econRatio: 0.75}
+	expected := "regolancer --pfrom 30 --pto 40 --amount 100000 --min-amount 10000 --econ-ratio 0.75"
+	if s.String() != expected {
+		t.Errorf("expected %q, got %q", expected, s.String())
+	}
+}
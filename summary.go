@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const capWarnThreshold = 0.8
+
+type capStat struct {
+	attempts  int
+	capped    int
+	neededPPM int64
+}
+
+func (r *regolancer) addCapStat(to uint64, neededPPM int64) {
+	s, ok := r.capStats[to]
+	if !ok {
+		s = &capStat{}
+		r.capStats[to] = s
+	}
+	s.attempts++
+	if neededPPM > 0 {
+		s.capped++
+		if neededPPM > s.neededPPM {
+			s.neededPPM = neededPPM
+		}
+	}
+}
+
+func (r *regolancer) printCapWarning() {
+	attempts, capped := 0, 0
+	targets := []uint64{}
+	for chanId, s := range r.capStats {
+		attempts += s.attempts
+		capped += s.capped
+		if s.capped > 0 {
+			targets = append(targets, chanId)
+		}
+	}
+	if attempts == 0 || float64(capped)/float64(attempts) < capWarnThreshold {
+		return
+	}
+	log.Print(infoColorF("Warning: econ-ratio-max-ppm (%d) limited the max fee in %d of %d attempts, it might be too tight",
+		params.EconRatioMaxPPM, capped, attempts))
+	sort.Slice(targets, func(i, j int) bool {
+		return r.capStats[targets[i]].capped > r.capStats[targets[j]].capped
+	})
+	if len(targets) > 5 {
+		targets = targets[:5]
+	}
+	for _, chanId := range targets {
+		s := r.capStats[chanId]
+		log.Printf("  target %s capped %s of %s times, econ ratio would allow up to %s ppm",
+			hiWhiteColor(chanId), hiWhiteColor(s.capped), hiWhiteColor(s.attempts), hiWhiteColor(s.neededPPM))
+	}
+}
+
+func (r *regolancer) printNodeCacheStats() {
+	if !params.NodeCacheInfo {
+		return
+	}
+	s := r.nodeCacheStats
+	log.Printf("Node cache: %s hits, %s unknown node hits, %s misses",
+		hiWhiteColor(s.hits), hiWhiteColor(s.unknownHits), hiWhiteColor(s.misses))
+	if s.routeHits+s.routeMisses > 0 {
+		log.Printf("Route nodes: %s cached, %s not cached, %s routes printed with misses",
+			hiWhiteColor(s.routeHits), hiWhiteColor(s.routeMisses), hiWhiteColor(s.coldRoutes))
+	}
+}
+
+func (r *regolancer) printSuccessStats() {
+	if r.paymentTimeouts > 0 {
+		log.Print(infoColorF("%d payments timed out and might still settle, check your lnd payments", r.paymentTimeouts))
+	}
+	if r.successes == 0 {
+		return
+	}
+	log.Printf("%s successful rebalances, %s routes tried per success on average", hiWhiteColor(r.successes),
+		hiWhiteColorF("%.1f", float64(r.successRoutesTried)/float64(r.successes)))
+}
+
+func (r *regolancer) printFailureCacheStats() {
+	s := r.failureCacheStats
+	if len(r.failureCache) == 0 && s.expired == 0 && s.evicted == 0 {
+		return
+	}
+	log.Printf("Failure cache: %s pairs, %s expired, %s evicted", hiWhiteColor(len(r.failureCache)),
+		hiWhiteColor(s.expired), hiWhiteColor(s.evicted))
+	if len(s.reasons) == 0 {
+		return
+	}
+	codes := []string{}
+	for code := range s.reasons {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return s.reasons[codes[i]] > s.reasons[codes[j]] ||
+			s.reasons[codes[i]] == s.reasons[codes[j]] && codes[i] < codes[j]
+	})
+	breakdown := []string{}
+	for _, code := range codes {
+		breakdown = append(breakdown, fmt.Sprintf("%s %s", hiWhiteColor(s.reasons[code]), code))
+	}
+	log.Printf("Failed pairs by reason: %s", strings.Join(breakdown, ", "))
+}
+
+func (r *regolancer) printNodeRepeats() {
+	if r.nodeRepeats == 0 {
+		return
+	}
+	log.Printf("Routes with repeated nodes: %s", hiWhiteColor(r.nodeRepeats))
+}
+
+func (r *regolancer) printLongRouteSkips() {
+	if r.longRouteSkips == 0 {
+		return
+	}
+	log.Printf("Pairs skipped with routes longer than --max-hops: %s", hiWhiteColor(r.longRouteSkips))
+}
+
+func (r *regolancer) printFailedHTLCs() {
+	if r.failedHTLCs.limit == 0 {
+		return
+	}
+	r.failedHTLCs.prune(time.Now())
+	log.Printf("Failed HTLCs in the last hour: %s/%s", hiWhiteColor(len(r.failedHTLCs.failures)),
+		hiWhiteColor(r.failedHTLCs.limit))
+}
+
+const (
+	rapidStopTargetReached   = "target channel reached pto"
+	rapidStopSourceExhausted = "source channel exhausted"
+	rapidStopLiquidity       = "not enough liquidity for min-amount"
+	rapidStopFee             = "route fee rose above the limit"
+	rapidStopRouteBroken     = "route can't be rebuilt"
+	rapidStopFeeBudget       = "session fee budget exhausted"
+	rapidStopDailyFeeBudget  = "daily fee budget reached"
+	rapidStopHopFailed       = "hop failed"
+	rapidStopTimeout         = "timed out"
+	rapidStopError           = "error"
+)
+
+type rapidStat struct {
+	stops      map[string]int
+	iterations int
+}
+
+func (r *regolancer) addRapidStop(reason string, iterations int) {
+	if r.rapidStat.stops == nil {
+		r.rapidStat.stops = map[string]int{}
+	}
+	r.rapidStat.stops[reason]++
+	r.rapidStat.iterations += iterations
+}
+
+func (r *regolancer) printRapidStat() {
+	s := r.rapidStat
+	if len(s.stops) == 0 {
+		return
+	}
+	total := 0
+	reasons := []string{}
+	for reason, count := range s.stops {
+		total += count
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		return s.stops[reasons[i]] > s.stops[reasons[j]]
+	})
+	log.Printf("Rapid rebalancing: %s runs, %s successful iterations per run on average", hiWhiteColor(total),
+		hiWhiteColorF("%.1f", float64(s.iterations)/float64(total)))
+	for _, reason := range reasons {
+		log.Printf("  stopped %s times: %s", hiWhiteColor(s.stops[reason]), reason)
+	}
+}
+
+func (r *regolancer) printSourceUsage() {
+	if len(r.sourceUsage) < 2 {
+		return
+	}
+	chans := []uint64{}
+	for chanId := range r.sourceUsage {
+		chans = append(chans, chanId)
+	}
+	sort.Slice(chans, func(i, j int) bool {
+		return r.sourceUsage[chans[i]] > r.sourceUsage[chans[j]]
+	})
+	log.Print("Amount by source channel:")
+	for _, chanId := range chans {
+		log.Printf("  %s: %s sat (%s%%)", hiWhiteColor(chanId), formatAmt(r.sourceUsage[chanId].sats()),
+			hiWhiteColorF("%.1f", float64(r.sourceUsage[chanId])*100/float64(r.totalAmountMsat)))
+	}
+}
+
+func (r *regolancer) printFeeBudget() {
+	if params.MaxTotalFee == 0 {
+		return
+	}
+	status := ""
+	if r.feeBudgetErr == ErrFeeBudgetExhausted {
+		status = ", " + infoColor("exhausted")
+	}
+	log.Printf("Fee budget: spent %s of %s sat%s", formatFee(r.totalFeesMsat-r.sessionFeesStart),
+		hiWhiteColor(params.MaxTotalFee), status)
+}
+
+func (r *regolancer) printSummary() {
+	r.printSuccessStats()
+	r.printSourceUsage()
+	r.printFeeBudget()
+	r.printRapidStat()
+	r.printRouteStat()
+	r.printGoals()
+	r.printNodeCacheStats()
+	r.printRouteMemoStats()
+	r.printSpeculativeStats()
+	r.printRouteTimeoutStats()
+	r.printFailureCacheStats()
+	r.printSoftFailures()
+	r.printHubCoolingStats()
+	r.printFeeHeadroomStats()
+	r.printFailedHTLCs()
+	r.printNodeRepeats()
+	r.printLongRouteSkips()
+	r.printBaseFeeStats()
+	r.printDiscoveries()
+	r.printCltvBounds()
+	r.printExclusionSuggestions()
+	r.printCapWarning()
+}
+
+type routeStat struct {
+	nodes    map[string]Msat
+	channels map[uint64]struct{}
+	total    Msat
+}
+
+// addRouteStat records the intermediate nodes and channels of a successful
+// route.
+func (r *regolancer) addRouteStat(route *lnrpc.Route) {
+	if r.routeStat.nodes == nil {
+		r.routeStat.nodes = map[string]Msat{}
+		r.routeStat.channels = map[uint64]struct{}{}
+	}
+	for i, h := range route.Hops {
+		r.routeStat.channels[h.ChanId] = struct{}{}
+		if i == len(route.Hops)-1 {
+			break
+		}
+		r.routeStat.nodes[h.PubKey] += Msat(h.AmtToForwardMsat)
+		r.routeStat.total += Msat(h.AmtToForwardMsat)
+	}
+}
+
+func (r *regolancer) printRouteStat() {
+	s := r.routeStat
+	if len(s.nodes) == 0 {
+		return
+	}
+	log.Printf("Route diversity: %s unique intermediate nodes, %s unique channels",
+		hiWhiteColor(len(s.nodes)), hiWhiteColor(len(s.channels)))
+	pks := []string{}
+	for pk := range s.nodes {
+		pks = append(pks, pk)
+	}
+	sort.Slice(pks, func(i, j int) bool {
+		return s.nodes[pks[i]] > s.nodes[pks[j]]
+	})
+	log.Printf("Top node transited %s%% of the volume", hiWhiteColorF("%.1f", float64(s.nodes[pks[0]])*100/float64(s.total)))
+	if len(pks) > 5 {
+		pks = pks[:5]
+	}
+	for _, pk := range pks {
+		alias := pk
+		if n, ok := r.nodeCache[pk]; ok && n.NodeInfo != nil && n.Node != nil {
+			alias = n.Node.Alias
+		}
+		log.Printf("  %s: %s sat", cyanColor(alias), formatAmt(s.nodes[pk].sats()))
+	}
+}
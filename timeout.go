@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	routeLatencySamples    = 50
+	routeLatencyMinSamples = 5
+	routeTimeoutMin        = time.Second * 5
+)
+
+// routeTimeout is either a fixed number of seconds or "auto"
+type routeTimeout struct {
+	seconds int
+	auto    bool
+}
+
+func (t *routeTimeout) UnmarshalFlag(value string) error {
+	if strings.ToLower(value) == "auto" {
+		t.auto = true
+		return nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("expected number of seconds or \"auto\", got %s", value)
+	}
+	t.seconds = seconds
+	return nil
+}
+
+func (t *routeTimeout) UnmarshalText(text []byte) error {
+	return t.UnmarshalFlag(string(text))
+}
+
+func (t *routeTimeout) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return t.UnmarshalFlag(fmt.Sprint(value))
+}
+
+// routeTimeout returns the current route query timeout, in auto mode it's
+// adjusted to the observed QueryRoutes latency.
+func (r *regolancer) routeTimeout() time.Duration {
+	if r.routeTimeoutCurrent == 0 {
+		return time.Second * time.Duration(params.TimeoutRoute.seconds)
+	}
+	return r.routeTimeoutCurrent
+}
+
+func (r *regolancer) addRouteLatency(latency time.Duration) {
+	if !params.TimeoutRoute.auto {
+		return
+	}
+	r.routeLatencies = append(r.routeLatencies, latency)
+	if len(r.routeLatencies) > routeLatencySamples {
+		r.routeLatencies = r.routeLatencies[1:]
+	}
+	if len(r.routeLatencies) < routeLatencyMinSamples {
+		return
+	}
+	sorted := append([]time.Duration{}, r.routeLatencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	timeout := sorted[(len(sorted)-1)*95/100] * 3 / 2
+	if timeout < routeTimeoutMin {
+		timeout = routeTimeoutMin
+	}
+	if max := time.Second * time.Duration(params.TimeoutRouteMax); timeout > max {
+		timeout = max
+	}
+	timeout = timeout.Round(time.Second)
+	if timeout != r.routeTimeout() {
+		log.Printf("Route query timeout adjusted to %s", hiWhiteColor(timeout))
+		r.routeTimeoutCurrent = timeout
+	}
+}
+
+func (r *regolancer) printRouteTimeoutStats() {
+	if !params.TimeoutRoute.auto || len(r.routeLatencies) == 0 {
+		return
+	}
+	total := time.Duration(0)
+	for _, l := range r.routeLatencies {
+		total += l
+	}
+	log.Printf("Route queries: average latency %s over last %s queries, timeout %s",
+		hiWhiteColor((total / time.Duration(len(r.routeLatencies))).Round(time.Millisecond)),
+		hiWhiteColor(len(r.routeLatencies)), hiWhiteColor(r.routeTimeout()))
+}
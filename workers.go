@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc"
+)
+
+// how long a worker waits when all channel pairs are taken by other workers
+const workerBusyWait = time.Second
+
+var ErrPairsBusy = errors.New("all channel pairs are used by other workers")
+
+// workerPool runs the attempts of --workers concurrently. The workers share
+// the session state under a single lock that is only released for the lnd
+// calls, so the caches and the counters don't need their own locks. The
+// channels used by an attempt are reserved so that two workers never use the
+// same source or target at once.
+type workerPool struct {
+	lock sync.Mutex
+	busy map[uint64]int
+}
+
+// workerState is the per-attempt part of the session state, it's saved when
+// a worker releases the lock and restored when it takes it back.
+type workerState struct {
+	id               int
+	attemptInfo      *attemptInfo
+	feeScale         feeScale
+	feeBound         feeBound
+	feeMultiplier    feeMultiplier
+	routeChoicePairs []*lnrpc.NodePair
+	requeryPairs     []*lnrpc.NodePair
+	requeries        int
+	speculative      *speculativeQuery
+}
+
+func (r *regolancer) saveWorkerState() workerState {
+	return workerState{id: r.workerId, attemptInfo: r.attemptInfo, feeScale: r.feeScale, feeBound: r.feeBound,
+		feeMultiplier: r.feeMultiplier, routeChoicePairs: r.routeChoicePairs, requeryPairs: r.requeryPairs,
+		requeries: r.requeries, speculative: r.speculative}
+}
+
+func (r *regolancer) restoreWorkerState(s workerState) {
+	r.workerId, r.attemptInfo, r.feeScale, r.feeBound = s.id, s.attemptInfo, s.feeScale, s.feeBound
+	r.feeMultiplier, r.routeChoicePairs = s.feeMultiplier, s.routeChoicePairs
+	r.requeryPairs, r.requeries, r.speculative = s.requeryPairs, s.requeries, s.speculative
+	log.SetPrefix(fmt.Sprintf("[w%d] ", s.id))
+}
+
+// unlocked runs f with the worker lock released, it's used for the blocking
+// calls. Without workers f is just called.
+func (r *regolancer) unlocked(f func()) {
+	if r.workers == nil {
+		f()
+		return
+	}
+	state := r.saveWorkerState()
+	r.workers.lock.Unlock()
+	defer func() {
+		r.workers.lock.Lock()
+		r.restoreWorkerState(state)
+	}()
+	f()
+}
+
+func (r *regolancer) channelBusy(chanId uint64) bool {
+	if r.workers == nil {
+		return false
+	}
+	_, ok := r.workers.busy[chanId]
+	return ok
+}
+
+// reserveChannels marks the channels as used by the current worker, the
+// returned function releases them.
+func (r *regolancer) reserveChannels(chans ...uint64) func() {
+	if r.workers == nil {
+		return func() {}
+	}
+	for _, c := range chans {
+		r.workers.busy[c] = r.workerId
+	}
+	return func() { r.releaseChannels(chans...) }
+}
+
+func (r *regolancer) releaseChannels(chans ...uint64) {
+	if r.workers == nil {
+		return
+	}
+	for _, c := range chans {
+		delete(r.workers.busy, c)
+	}
+}
+
+// runWorkers runs the session with --workers concurrent attempts. When one
+// worker ends the session (the goals are reached or there's nothing left to
+// try) the attempts of the others are cancelled.
+func (r *regolancer) runWorkers(ctx context.Context, stop <-chan struct{}) {
+	r.workers = &workerPool{busy: map[uint64]int{}}
+	r.lnClient = &workerClient{LightningClient: r.lnClient, r: r}
+	r.routerClient = &workerRouterClient{RouterClient: r.routerClient, r: r}
+	r.sender = &workerSender{sender: r.sender, r: r}
+	flags := log.Flags()
+	log.SetFlags(flags | log.Lmsgprefix)
+	defer func() {
+		r.workers = nil
+		// the clients could've been replaced while running by the legacy
+		// sender or a reconnect, so the current ones are unwrapped
+		if s, ok := r.sender.(*workerSender); ok {
+			r.sender = s.sender
+		}
+		if c, ok := r.lnClient.(*workerClient); ok {
+			r.lnClient = c.LightningClient
+		}
+		if c, ok := r.routerClient.(*workerRouterClient); ok {
+			r.routerClient = c.RouterClient
+		}
+		log.SetPrefix("")
+		log.SetFlags(flags)
+		r.workerId = 0
+		if r.heartbeat != nil {
+			r.heartbeat.resetPhases(heartbeatPhase{Phase: phaseFinishing, Since: time.Now().Unix()})
+		}
+	}()
+	if r.heartbeat != nil {
+		r.heartbeat.resetPhases()
+	}
+	workersCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wg := sync.WaitGroup{}
+	for i := 1; i <= params.Workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			r.workers.lock.Lock()
+			defer r.workers.lock.Unlock()
+			r.restoreWorkerState(workerState{id: id})
+			if r.runWorker(workersCtx, stop) {
+				log.Print("Session is over, cancelling the other workers")
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// runWorker repeats the attempts like rebalanceSession, the result is true if
+// the session should end for all workers.
+func (r *regolancer) runWorker(ctx context.Context, stop <-chan struct{}) bool {
+	for {
+		r.pace(ctx)
+		r.periodicSaveNodeCache()
+		err, retry := tryRebalance(ctx, r)
+		if ctx.Err() != nil {
+			return false
+		}
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+		if err == ErrPairsBusy {
+			r.setPhase(phaseWaiting, nil)
+			r.unlocked(func() {
+				select {
+				case <-time.After(workerBusyWait):
+				case <-ctx.Done():
+				}
+			})
+			continue
+		}
+		if !retry && (err != nil || !r.goalsLeft()) {
+			return true
+		}
+	}
+}
+
+// workerClient releases the worker lock for the lnd calls used during the
+// attempts.
+type workerClient struct {
+	lnrpc.LightningClient
+	r *regolancer
+}
+
+func (c *workerClient) QueryRoutes(ctx context.Context, in *lnrpc.QueryRoutesRequest,
+	opts ...grpc.CallOption) (resp *lnrpc.QueryRoutesResponse, err error) {
+	c.r.unlocked(func() { resp, err = c.LightningClient.QueryRoutes(ctx, in, opts...) })
+	return
+}
+
+func (c *workerClient) GetChanInfo(ctx context.Context, in *lnrpc.ChanInfoRequest,
+	opts ...grpc.CallOption) (resp *lnrpc.ChannelEdge, err error) {
+	c.r.unlocked(func() { resp, err = c.LightningClient.GetChanInfo(ctx, in, opts...) })
+	return
+}
+
+func (c *workerClient) GetNodeInfo(ctx context.Context, in *lnrpc.NodeInfoRequest,
+	opts ...grpc.CallOption) (resp *lnrpc.NodeInfo, err error) {
+	c.r.unlocked(func() { resp, err = c.LightningClient.GetNodeInfo(ctx, in, opts...) })
+	return
+}
+
+func (c *workerClient) GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest,
+	opts ...grpc.CallOption) (resp *lnrpc.GetInfoResponse, err error) {
+	c.r.unlocked(func() { resp, err = c.LightningClient.GetInfo(ctx, in, opts...) })
+	return
+}
+
+func (c *workerClient) AddInvoice(ctx context.Context, in *lnrpc.Invoice,
+	opts ...grpc.CallOption) (resp *lnrpc.AddInvoiceResponse, err error) {
+	c.r.unlocked(func() { resp, err = c.LightningClient.AddInvoice(ctx, in, opts...) })
+	return
+}
+
+func (c *workerClient) LookupInvoice(ctx context.Context, in *lnrpc.PaymentHash,
+	opts ...grpc.CallOption) (resp *lnrpc.Invoice, err error) {
+	c.r.unlocked(func() { resp, err = c.LightningClient.LookupInvoice(ctx, in, opts...) })
+	return
+}
+
+func (c *workerClient) SendToRouteSync(ctx context.Context, in *lnrpc.SendToRouteRequest,
+	opts ...grpc.CallOption) (resp *lnrpc.SendResponse, err error) {
+	c.r.unlocked(func() { resp, err = c.LightningClient.SendToRouteSync(ctx, in, opts...) })
+	return
+}
+
+func (c *workerClient) ListPayments(ctx context.Context, in *lnrpc.ListPaymentsRequest,
+	opts ...grpc.CallOption) (resp *lnrpc.ListPaymentsResponse, err error) {
+	c.r.unlocked(func() { resp, err = c.LightningClient.ListPayments(ctx, in, opts...) })
+	return
+}
+
+type workerRouterClient struct {
+	routerrpc.RouterClient
+	r *regolancer
+}
+
+func (c *workerRouterClient) BuildRoute(ctx context.Context, in *routerrpc.BuildRouteRequest,
+	opts ...grpc.CallOption) (resp *routerrpc.BuildRouteResponse, err error) {
+	c.r.unlocked(func() { resp, err = c.RouterClient.BuildRoute(ctx, in, opts...) })
+	return
+}
+
+func (c *workerRouterClient) TrackPaymentV2(ctx context.Context, in *routerrpc.TrackPaymentRequest,
+	opts ...grpc.CallOption) (routerrpc.Router_TrackPaymentV2Client, error) {
+	stream, err := c.RouterClient.TrackPaymentV2(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &workerTrackStream{Router_TrackPaymentV2Client: stream, r: c.r}, nil
+}
+
+type workerTrackStream struct {
+	routerrpc.Router_TrackPaymentV2Client
+	r *regolancer
+}
+
+func (s *workerTrackStream) Recv() (payment *lnrpc.Payment, err error) {
+	s.r.unlocked(func() { payment, err = s.Router_TrackPaymentV2Client.Recv() })
+	return
+}
+
+type workerSender struct {
+	sender paymentSender
+	r      *regolancer
+}
+
+func (s *workerSender) sendToRoute(ctx context.Context, hash []byte, route *lnrpc.Route) (result *lnrpc.HTLCAttempt,
+	err error) {
+	s.r.unlocked(func() { result, err = s.sender.sendToRoute(ctx, hash, route) })
+	return
+}
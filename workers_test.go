@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// TestWorkersInvoices runs several workers creating invoices for the same
+// amount at once, every worker should reuse its own invoice and never get the
+// payment hash of another one. Run with -race to check the shared caches.
+func TestWorkersInvoices(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	params.TimeoutRebalance = 360
+	r := &regolancer{invoiceCache: map[invoiceKey]cachedInvoice{}, invoiceSkewChecked: true}
+	r.lnClient = &workerClient{LightningClient: &fakeLightning{}, r: r}
+	r.workers = &workerPool{busy: map[uint64]int{}}
+	const workers = 4
+	hashes := make([]map[string]struct{}, workers+1)
+	wg := sync.WaitGroup{}
+	for i := 1; i <= workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			r.workers.lock.Lock()
+			defer r.workers.lock.Unlock()
+			r.restoreWorkerState(workerState{id: id})
+			release := r.reserveChannels(uint64(id), uint64(id+100))
+			defer release()
+			hashes[id] = map[string]struct{}{}
+			for j := 0; j < 20; j++ {
+				invoice, err := r.createInvoice(context.Background(), satToMsat(1000), "memo")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				hashes[id][hex.EncodeToString(invoice.RHash)] = struct{}{}
+				if !r.channelBusy(uint64(id)) || r.workers.busy[uint64(id+100)] != id {
+					t.Errorf("worker %d lost its channels", id)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	seen := map[string]int{}
+	for id := 1; id <= workers; id++ {
+		if len(hashes[id]) != 1 {
+			t.Errorf("worker %d got %d invoices, expected one reused invoice", id, len(hashes[id]))
+		}
+		for h := range hashes[id] {
+			if other, ok := seen[h]; ok {
+				t.Errorf("workers %d and %d share the payment hash %s", other, id, h)
+			}
+			seen[h] = id
+		}
+	}
+	if len(r.workers.busy) != 0 {
+		t.Errorf("channels still reserved: %v", r.workers.busy)
+	}
+}
+
+// TestWorkersSwappedSource checks that the route starting with another source
+// moves the reservation so two workers never pay through the same source.
+func TestWorkersSwappedSource(t *testing.T) {
+	defer func(p configParams) { params = p }(params)
+	r, _ := newRouteTest(nil)
+	r.workers = &workerPool{busy: map[uint64]int{}}
+	attempts := map[int]*rebalanceAttempt{1: {from: 1, to: 101}, 2: {from: 2, to: 102}}
+	for id := 1; id <= 2; id++ {
+		r.restoreWorkerState(workerState{id: id})
+		r.reserveChannels(attempts[id].from, attempts[id].to)
+	}
+	swapped := func() *lnrpc.Route { return testRoute(3, 101, 1000000, 100, testPK(1), testPeerPK) }
+	r.restoreWorkerState(workerState{id: 1})
+	if _, ok, _ := r.filterRoute(context.Background(), attempts[1], swapped()); !ok || attempts[1].from != 3 {
+		t.Fatalf("worker 1 should use the source 3, got %d", attempts[1].from)
+	}
+	if r.workers.busy[3] != 1 || r.channelBusy(1) {
+		t.Errorf("the reservation should move to the source 3, got %v", r.workers.busy)
+	}
+	r.restoreWorkerState(workerState{id: 2})
+	if _, ok, stop := r.filterRoute(context.Background(), attempts[2], swapped()); ok || stop ||
+		attempts[2].from != 2 {
+		t.Errorf("worker 2 should skip the route through the source of worker 1, got %d", attempts[2].from)
+	}
+	if r.workers.busy[3] != 1 || r.workers.busy[2] != 2 {
+		t.Errorf("the reservations shouldn't change, got %v", r.workers.busy)
+	}
+	for id := 1; id <= 2; id++ {
+		r.releaseChannels(attempts[id].from, attempts[id].to)
+	}
+	if len(r.workers.busy) != 0 {
+		t.Errorf("channels still reserved: %v", r.workers.busy)
+	}
+}